@@ -0,0 +1,575 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+//Alexa.ConnectedHome messages of payload version 2, skills which were not migrated to v3 still send them
+const (
+	ALEXA_CONNECTED_HOME_PAYLOAD_VERSION = "2"
+
+	NAMESPACE_CONTROL                  = "Alexa.ConnectedHome.Control"
+	NAMESPACE_CONNECTED_HOME_DISCOVERY = "Alexa.ConnectedHome.Discovery"
+	NAMESPACE_QUERY                    = "Alexa.ConnectedHome.Query"
+
+	DISCOVER_APPLIANCES_REQUEST  = "DiscoverAppliancesRequest"
+	DISCOVER_APPLIANCES_RESPONSE = "DiscoverAppliancesResponse"
+
+	TURN_ON_REQUEST       = "TurnOnRequest"
+	TURN_OFF_REQUEST      = "TurnOffRequest"
+	TURN_ON_CONFIRMATION  = "TurnOnConfirmation"
+	TURN_OFF_CONFIRMATION = "TurnOffConfirmation"
+
+	SET_PERCENTAGE_REQUEST            = "SetPercentageRequest"
+	SET_PERCENTAGE_CONFIRMATION       = "SetPercentageConfirmation"
+	INCREMENT_PERCENTAGE_REQUEST      = "IncrementPercentageRequest"
+	INCREMENT_PERCENTAGE_CONFIRMATION = "IncrementPercentageConfirmation"
+	DECREMENT_PERCENTAGE_REQUEST      = "DecrementPercentageRequest"
+	DECREMENT_PERCENTAGE_CONFIRMATION = "DecrementPercentageConfirmation"
+
+	SET_COLOR_REQUEST                        = "SetColorRequest"
+	SET_COLOR_CONFIRMATION                   = "SetColorConfirmation"
+	SET_COLOR_TEMPERATURE_REQUEST            = "SetColorTemperatureRequest"
+	SET_COLOR_TEMPERATURE_CONFIRMATION       = "SetColorTemperatureConfirmation"
+	INCREMENT_COLOR_TEMPERATURE_REQUEST      = "IncrementColorTemperatureRequest"
+	INCREMENT_COLOR_TEMPERATURE_CONFIRMATION = "IncrementColorTemperatureConfirmation"
+	DECREMENT_COLOR_TEMPERATURE_REQUEST      = "DecrementColorTemperatureRequest"
+	DECREMENT_COLOR_TEMPERATURE_CONFIRMATION = "DecrementColorTemperatureConfirmation"
+
+	SET_TARGET_TEMPERATURE_REQUEST            = "SetTargetTemperatureRequest"
+	SET_TARGET_TEMPERATURE_CONFIRMATION       = "SetTargetTemperatureConfirmation"
+	INCREMENT_TARGET_TEMPERATURE_REQUEST      = "IncrementTargetTemperatureRequest"
+	INCREMENT_TARGET_TEMPERATURE_CONFIRMATION = "IncrementTargetTemperatureConfirmation"
+	DECREMENT_TARGET_TEMPERATURE_REQUEST      = "DecrementTargetTemperatureRequest"
+	DECREMENT_TARGET_TEMPERATURE_CONFIRMATION = "DecrementTargetTemperatureConfirmation"
+	GET_TEMPERATURE_READING_REQUEST           = "GetTemperatureReadingRequest"
+	GET_TEMPERATURE_READING_RESPONSE          = "GetTemperatureReadingResponse"
+	GET_TARGET_TEMPERATURE_REQUEST            = "GetTargetTemperatureRequest"
+	GET_TARGET_TEMPERATURE_RESPONSE           = "GetTargetTemperatureResponse"
+	VALUE_OUT_OF_RANGE_ERROR                  = "ValueOutOfRangeError"
+	UNSUPPORTED_TARGET_SETTING_ERROR          = "UnsupportedTargetSettingError"
+	TARGET_OFFLINE_ERROR                      = "TargetOfflineError"
+	NO_SUCH_TARGET_ERROR                      = "NoSuchTargetError"
+	UNSUPPORTED_OPERATION_ERROR               = "UnsupportedOperationError"
+	DRIVER_INTERNAL_ERROR                     = "DriverInternalError"
+	INVALID_ACCESS_TOKEN_ERROR                = "InvalidAccessTokenError"
+	TEMPERATURE_MODE_AUTO                     = "AUTO"
+
+	APPLIANCE_TYPE_SCENE_TRIGGER    = "SCENE_TRIGGER"
+	APPLIANCE_TYPE_ACTIVITY_TRIGGER = "ACTIVITY_TRIGGER"
+)
+
+type AlexaDevice struct {
+	ApplicanceID        string `json:"applianceId"`
+	ManufacturerName    string `json:"manufacturerName"`
+	ModelName           string `json:"modelName"`
+	FriendlyName        string `json:"friendlyName"`
+	FriendlyDescription string `json:"friendlyDescription"`
+	IsReachable         bool   `json:"isReachable"`
+	Version             string `json:"version"`
+
+	ApplianceTypes             []string `json:"applianceTypes,omitempty"`
+	Actions                    []string `json:"actions"`
+	AdditionalApplianceDetails struct {
+	} `json:"additionalApplianceDetails"`
+}
+
+type AlexaDiscoveryResponse struct {
+	Header  AlexaHeader `json:"header"`
+	Payload struct {
+		DiscoveredAppliances []AlexaDevice `json:"discoveredAppliances"`
+	} `json:"payload"`
+}
+
+type AlexaValue struct {
+	Value float64 `json:"value"`
+}
+
+type AlexaMode struct {
+	Value string `json:"value"`
+}
+
+type AlexaAchievedState struct {
+	Color            *HSBColor   `json:"color,omitempty"`
+	ColorTemperature *AlexaValue `json:"colorTemperature,omitempty"`
+}
+
+type AlexaTemperatureState struct {
+	TargetTemperature *AlexaValue `json:"targetTemperature,omitempty"`
+	Mode              *AlexaMode  `json:"mode,omitempty"`
+}
+
+type AlexaControlPayload struct {
+	AchievedState              *AlexaAchievedState    `json:"achievedState,omitempty"`
+	TargetTemperature          *AlexaValue            `json:"targetTemperature,omitempty"`
+	TemperatureMode            *AlexaMode             `json:"temperatureMode,omitempty"`
+	TemperatureReading         *AlexaValue            `json:"temperatureReading,omitempty"`
+	PreviousState              *AlexaTemperatureState `json:"previousState,omitempty"`
+	ApplianceResponseTimestamp string                 `json:"applianceResponseTimestamp,omitempty"`
+	MinimumValue               *float64               `json:"minimumValue,omitempty"`
+	MaximumValue               *float64               `json:"maximumValue,omitempty"`
+}
+
+type AlexaControlResponse struct {
+	Header  AlexaHeader         `json:"header"`
+	Payload AlexaControlPayload `json:"payload"`
+}
+
+var alexaResourceActions = map[string][]string{
+	CAPABILITY_PERCENTAGE: {"setPercentage", "incrementPercentage", "decrementPercentage"},
+	CAPABILITY_COLOR:      {"setColor"},
+	CAPABILITY_COLOR_TEMP: {"setColorTemperature", "incrementColorTemperature", "decrementColorTemperature"},
+}
+
+//handleConnectedHomeMessage handles v2 message, it is authorized by access token of payload
+func (endpoint *AlexaEndpoint) handleConnectedHomeMessage(message string) interface{} {
+	log.Println("handleConnectedHomeMessage: " + message)
+	namespace := gjson.Get(message, "header.namespace").String()
+
+	userInfo, err := endpoint.Authorize(gjson.Get(message, "payload.accessToken").String())
+	if err != nil {
+		log.Println(err)
+		return newConnectedHomeError(namespace, err)
+	}
+	if namespace == NAMESPACE_CONNECTED_HOME_DISCOVERY {
+		return endpoint.handleConnectedHomeDiscovery(userInfo.Username)
+	}
+	if namespace != NAMESPACE_CONTROL && namespace != NAMESPACE_QUERY {
+		return newConnectedHomeError(namespace, errUnsupportedOperation)
+	}
+	if userInfo.Username == "" {
+		return newConnectedHomeError(namespace, errInvalidAccessToken)
+	}
+	response := newConnectedHomeResponse(namespace)
+	err = endpoint.handleConnectedHomeControl(message, userInfo.Username, response)
+	if err != nil {
+		setAlexaError(response, err)
+	}
+	return response
+}
+
+func newConnectedHomeResponse(namespace string) *AlexaControlResponse {
+	response := &AlexaControlResponse{}
+	response.Header.Namespace = namespace
+	response.Header.PayloadVersion = ALEXA_CONNECTED_HOME_PAYLOAD_VERSION
+	response.Header.MessageID = generateMessageUUID()
+	return response
+}
+
+func newConnectedHomeError(namespace string, err error) *AlexaControlResponse {
+	response := newConnectedHomeResponse(namespace)
+	setAlexaError(response, err)
+	return response
+}
+
+//getAlexaActions returns actions of capability, read-only resources get only query actions
+func getAlexaActions(capability *ResourceCapability) []string {
+	if capability.Capability.Name == CAPABILITY_TEMPERATURE {
+		if capability.isSetpoint() {
+			return []string{"getTargetTemperature", "setTargetTemperature", "incrementTargetTemperature", "decrementTargetTemperature"}
+		}
+		return []string{"getTemperatureReading"}
+	}
+	if !capability.Variable.isWritable() {
+		return nil
+	}
+	return alexaResourceActions[capability.Capability.Name]
+}
+
+//getAlexaDevices returns appliances of device, one for power of device and one for every controllable resource,
+//devices and resources hidden by user overlay are not exposed
+func getAlexaDevices(hubUUID string, device *IotDevice) []AlexaDevice {
+	if device.Hidden {
+		return nil
+	}
+	device = device.filterVariables(false)
+	var devices []AlexaDevice
+	if power := device.getCapability(CAPABILITY_POWER); power != nil && power.Variable.isWritable() {
+		dev := AlexaDevice{
+			ApplicanceID:        getAlexaApplianceID(hubUUID, device.UUID, ""),
+			ManufacturerName:    MANUFACTURER_NAME,
+			ModelName:           "The Best Model",
+			FriendlyName:        device.Name,
+			FriendlyDescription: getAlexaDescription("OCF Device by Wiklosoft", device),
+			IsReachable:         true,
+			Version:             "0.1",
+		}
+
+		dev.Actions = append(dev.Actions, "turnOn")
+		dev.Actions = append(dev.Actions, "turnOff")
+		devices = append(devices, dev)
+	}
+
+	for _, variable := range device.Variables {
+		var actions []string
+		for _, capability := range device.getResourceCapabilities(variable.Href) {
+			actions = append(actions, getAlexaActions(capability)...)
+		}
+		if len(actions) == 0 {
+			continue
+		}
+		dev := AlexaDevice{
+			ApplicanceID:        getAlexaApplianceID(hubUUID, device.UUID, variable.Href),
+			ManufacturerName:    MANUFACTURER_NAME,
+			ModelName:           "The Best Model",
+			FriendlyName:        variable.Name,
+			FriendlyDescription: getAlexaDescription("OCF Resource by Wiklosoft", device),
+			IsReachable:         true,
+			Version:             "0.1",
+		}
+
+		dev.Actions = append(dev.Actions, actions...)
+		devices = append(devices, dev)
+	}
+	return devices
+}
+
+func (endpoint *AlexaEndpoint) discoverScenes(username string) []AlexaDevice {
+	var devices []AlexaDevice
+	for _, scene := range endpoint.Scenes.getScenes(username) {
+		dev := AlexaDevice{
+			ApplicanceID:        SCENE_APPLIANCE_PREFIX + ":" + scene.ID,
+			ManufacturerName:    MANUFACTURER_NAME,
+			ModelName:           "Scene",
+			FriendlyName:        scene.Name,
+			FriendlyDescription: "Scene by Wiklosoft",
+			IsReachable:         true,
+			Version:             "0.1",
+			ApplianceTypes:      []string{APPLIANCE_TYPE_SCENE_TRIGGER},
+		}
+		dev.Actions = append(dev.Actions, "turnOn")
+		if len(scene.OffActions) > 0 {
+			dev.ApplianceTypes = []string{APPLIANCE_TYPE_ACTIVITY_TRIGGER}
+			dev.Actions = append(dev.Actions, "turnOff")
+		}
+		devices = append(devices, dev)
+	}
+	return devices
+}
+
+func (endpoint *AlexaEndpoint) handleConnectedHomeDiscovery(username string) *AlexaDiscoveryResponse {
+	response := &AlexaDiscoveryResponse{}
+	response.Header.Name = DISCOVER_APPLIANCES_RESPONSE
+	response.Header.Namespace = NAMESPACE_CONNECTED_HOME_DISCOVERY
+	response.Header.PayloadVersion = ALEXA_CONNECTED_HOME_PAYLOAD_VERSION
+	response.Header.MessageID = generateMessageUUID()
+	if username == "" {
+		return response
+	}
+
+	for _, con := range getHubConnections(endpoint.HubConnections) {
+		if con.Username != username {
+			continue
+		}
+		for _, device := range con.getDevices() {
+			response.Payload.DiscoveredAppliances = append(response.Payload.DiscoveredAppliances, getAlexaDevices(con.Uuid, endpoint.Overlays.apply(username, con.Uuid, device))...)
+		}
+	}
+	for _, device := range createGroupDevices(endpoint.HubConnections, username, endpoint.Groups) {
+		response.Payload.DiscoveredAppliances = append(response.Payload.DiscoveredAppliances, getAlexaDevices(GROUP_HUB_UUID, device)...)
+	}
+	response.Payload.DiscoveredAppliances = append(response.Payload.DiscoveredAppliances, endpoint.discoverScenes(username)...)
+	return response
+}
+
+func (endpoint *AlexaEndpoint) handleConnectedHomeControl(message string, username string, response *AlexaControlResponse) error {
+	name := gjson.Get(message, "header.name").String()
+	applianceID := strings.Split(gjson.Get(message, "payload.appliance.applianceId").String(), ":")
+	if len(applianceID) < 2 {
+		return errNoSuchDevice
+	}
+	if applianceID[0] == SCENE_APPLIANCE_PREFIX {
+		return endpoint.onSceneRequest(username, applianceID[1], name, response)
+	}
+
+	connectionID := applianceID[0]
+	deviceID := applianceID[1]
+	resource := ""
+	if len(applianceID) == 3 {
+		resource = strings.Replace(applianceID[2], "_", "/", -1)
+	}
+	if connectionID == GROUP_HUB_UUID {
+		return endpoint.onGroupRequest(username, deviceID, resource, name, message, response)
+	}
+	clientConnection := findHubConnection(endpoint.HubConnections, username, connectionID)
+	if clientConnection == nil {
+		log.Println("Unable to find hub " + connectionID + " of " + username)
+		return errHubOffline
+	}
+	device := clientConnection.getDevice(deviceID)
+	if device == nil {
+		log.Println("Unable to find device " + deviceID)
+		return errNoSuchDevice
+	}
+
+	switch name {
+	case TURN_ON_REQUEST:
+		response.Header.Name = TURN_ON_CONFIRMATION
+		return onTurnOnOffRequest(clientConnection, device, true)
+	case TURN_OFF_REQUEST:
+		response.Header.Name = TURN_OFF_CONFIRMATION
+		return onTurnOnOffRequest(clientConnection, device, false)
+	case SET_PERCENTAGE_REQUEST:
+		response.Header.Name = SET_PERCENTAGE_CONFIRMATION
+		percent := gjson.Get(message, "payload.percentageState.value").Int()
+		return onSetPercentRequest(clientConnection, device, resource, percent)
+	case INCREMENT_PERCENTAGE_REQUEST:
+		response.Header.Name = INCREMENT_PERCENTAGE_CONFIRMATION
+		percent := gjson.Get(message, "payload.deltaPercentage.value").Int()
+		return onChangePercentRequest(clientConnection, device, resource, percent)
+	case DECREMENT_PERCENTAGE_REQUEST:
+		response.Header.Name = DECREMENT_PERCENTAGE_CONFIRMATION
+		percent := gjson.Get(message, "payload.deltaPercentage.value").Int()
+		return onChangePercentRequest(clientConnection, device, resource, -percent)
+	case SET_COLOR_REQUEST:
+		response.Header.Name = SET_COLOR_CONFIRMATION
+		color := HSBColor{
+			Hue:        gjson.Get(message, "payload.color.hue").Float(),
+			Saturation: gjson.Get(message, "payload.color.saturation").Float(),
+			Brightness: gjson.Get(message, "payload.color.brightness").Float(),
+		}
+		return onSetColorRequest(clientConnection, device, resource, color, response)
+	case SET_COLOR_TEMPERATURE_REQUEST:
+		response.Header.Name = SET_COLOR_TEMPERATURE_CONFIRMATION
+		kelvin := gjson.Get(message, "payload.colorTemperature.value").Int()
+		return onSetColorTemperatureRequest(clientConnection, device, resource, kelvin, response)
+	case INCREMENT_COLOR_TEMPERATURE_REQUEST:
+		response.Header.Name = INCREMENT_COLOR_TEMPERATURE_CONFIRMATION
+		return onChangeColorTemperatureRequest(clientConnection, device, resource, true, response)
+	case DECREMENT_COLOR_TEMPERATURE_REQUEST:
+		response.Header.Name = DECREMENT_COLOR_TEMPERATURE_CONFIRMATION
+		return onChangeColorTemperatureRequest(clientConnection, device, resource, false, response)
+	case SET_TARGET_TEMPERATURE_REQUEST:
+		response.Header.Name = SET_TARGET_TEMPERATURE_CONFIRMATION
+		value := gjson.Get(message, "payload.targetTemperature.value").Float()
+		return onSetTargetTemperatureRequest(clientConnection, device, resource, value, false, response)
+	case INCREMENT_TARGET_TEMPERATURE_REQUEST:
+		response.Header.Name = INCREMENT_TARGET_TEMPERATURE_CONFIRMATION
+		delta := gjson.Get(message, "payload.deltaTemperature.value").Float()
+		return onSetTargetTemperatureRequest(clientConnection, device, resource, delta, true, response)
+	case DECREMENT_TARGET_TEMPERATURE_REQUEST:
+		response.Header.Name = DECREMENT_TARGET_TEMPERATURE_CONFIRMATION
+		delta := gjson.Get(message, "payload.deltaTemperature.value").Float()
+		return onSetTargetTemperatureRequest(clientConnection, device, resource, -delta, true, response)
+	case GET_TEMPERATURE_READING_REQUEST:
+		response.Header.Name = GET_TEMPERATURE_READING_RESPONSE
+		return onGetTemperatureRequest(device, resource, response)
+	case GET_TARGET_TEMPERATURE_REQUEST:
+		response.Header.Name = GET_TARGET_TEMPERATURE_RESPONSE
+		return onGetTemperatureRequest(device, resource, response)
+	}
+	return errUnsupportedOperation
+}
+
+func onTurnOnOffRequest(hubConnection *HubConnection, device *IotDevice, value bool) error {
+	capability := device.getCapability(CAPABILITY_POWER)
+	if capability == nil {
+		log.Println("Device " + device.UUID + " does not support power capability")
+		return errUnsupportedOperation
+	}
+	return capability.SetBool(hubConnection, value)
+}
+func onSetPercentRequest(clientConnection *HubConnection, device *IotDevice, resource string, value int64) error {
+	log.Println("onSetPercentRequest " + device.UUID + resource)
+	capability := device.getResourceCapability(resource, CAPABILITY_PERCENTAGE)
+	if capability == nil {
+		log.Println("Resource " + resource + " does not support percentage capability")
+		return errUnsupportedOperation
+	}
+	if value < 0 || value > 100 {
+		return &ValueOutOfRangeError{Range: ValueRange{Min: 0, Max: 100}}
+	}
+	return capability.SetPercent(clientConnection, value)
+}
+func onChangePercentRequest(conn *HubConnection, device *IotDevice, resource string, value int64) error {
+	capability := device.getResourceCapability(resource, CAPABILITY_PERCENTAGE)
+	if capability == nil {
+		log.Println("Resource " + resource + " does not support percentage capability")
+		return errUnsupportedOperation
+	}
+	return capability.ChangePercent(conn, value)
+}
+func onSetColorRequest(conn *HubConnection, device *IotDevice, resource string, color HSBColor, response *AlexaControlResponse) error {
+	capability := device.getResourceCapability(resource, CAPABILITY_COLOR)
+	if capability == nil {
+		log.Println("Resource " + resource + " does not support color capability")
+		return errUnsupportedOperation
+	}
+	err := capability.SetColor(conn, color)
+	if err != nil {
+		return err
+	}
+	response.Payload.AchievedState = &AlexaAchievedState{Color: &color}
+	return nil
+}
+func onSetColorTemperatureRequest(conn *HubConnection, device *IotDevice, resource string, kelvin int64, response *AlexaControlResponse) error {
+	capability := device.getResourceCapability(resource, CAPABILITY_COLOR_TEMP)
+	if capability == nil {
+		log.Println("Resource " + resource + " does not support color temperature capability")
+		return errUnsupportedOperation
+	}
+	achieved, err := capability.SetColorTemperature(conn, kelvin)
+	if err != nil {
+		return err
+	}
+	response.Payload.AchievedState = &AlexaAchievedState{ColorTemperature: &AlexaValue{Value: float64(achieved)}}
+	return nil
+}
+func onChangeColorTemperatureRequest(conn *HubConnection, device *IotDevice, resource string, cooler bool, response *AlexaControlResponse) error {
+	capability := device.getResourceCapability(resource, CAPABILITY_COLOR_TEMP)
+	if capability == nil {
+		log.Println("Resource " + resource + " does not support color temperature capability")
+		return errUnsupportedOperation
+	}
+	kelvin := nextColorTemperature(capability.GetColorTemperature(), cooler)
+	return onSetColorTemperatureRequest(conn, device, resource, kelvin, response)
+}
+func onGetTemperatureRequest(device *IotDevice, resource string, response *AlexaControlResponse) error {
+	capability := device.getResourceCapability(resource, CAPABILITY_TEMPERATURE)
+	if capability == nil {
+		log.Println("Resource " + resource + " does not support temperature capability")
+		return errUnsupportedOperation
+	}
+	value := &AlexaValue{Value: capability.GetTemperature()}
+	if response.Header.Name == GET_TARGET_TEMPERATURE_RESPONSE {
+		response.Payload.TargetTemperature = value
+		response.Payload.TemperatureMode = &AlexaMode{Value: TEMPERATURE_MODE_AUTO}
+	} else {
+		response.Payload.TemperatureReading = value
+	}
+	response.Payload.ApplianceResponseTimestamp = time.Now().UTC().Format(time.RFC3339)
+	return nil
+}
+func onSetTargetTemperatureRequest(conn *HubConnection, device *IotDevice, resource string, value float64, relative bool, response *AlexaControlResponse) error {
+	capability := device.getResourceCapability(resource, CAPABILITY_TEMPERATURE)
+	if capability == nil || !capability.isSetpoint() {
+		log.Println("Resource " + resource + " is not a temperature setpoint")
+		return errUnsupportedTargetSetting
+	}
+	previous := capability.GetTemperature()
+	if relative {
+		value = previous + value
+	}
+	err := capability.SetTemperature(conn, value)
+	if err != nil {
+		return err
+	}
+	response.Payload.TargetTemperature = &AlexaValue{Value: roundTemperature(value)}
+	response.Payload.TemperatureMode = &AlexaMode{Value: TEMPERATURE_MODE_AUTO}
+	response.Payload.PreviousState = &AlexaTemperatureState{
+		TargetTemperature: &AlexaValue{Value: previous},
+		Mode:              &AlexaMode{Value: TEMPERATURE_MODE_AUTO},
+	}
+	return nil
+}
+
+//setAlexaError replaces confirmation with error matching reason of failure
+func setAlexaError(response *AlexaControlResponse, err error) {
+	log.Println("Alexa request failed", err)
+	response.Payload = AlexaControlPayload{}
+
+	if _, ok := err.(*ValueValidationError); ok {
+		response.Header.Name = UNSUPPORTED_OPERATION_ERROR
+		return
+	}
+	if rangeErr, ok := err.(*ValueOutOfRangeError); ok {
+		response.Header.Name = VALUE_OUT_OF_RANGE_ERROR
+		response.Payload.MinimumValue = &rangeErr.Range.Min
+		response.Payload.MaximumValue = &rangeErr.Range.Max
+		return
+	}
+	switch err {
+	case errHubOffline, errHubTimeout:
+		response.Header.Name = TARGET_OFFLINE_ERROR
+	case errNoSuchDevice:
+		response.Header.Name = NO_SUCH_TARGET_ERROR
+	case errUnsupportedOperation:
+		response.Header.Name = UNSUPPORTED_OPERATION_ERROR
+	case errUnsupportedTargetSetting:
+		response.Header.Name = UNSUPPORTED_TARGET_SETTING_ERROR
+	case errInvalidAccessToken:
+		response.Header.Name = INVALID_ACCESS_TOKEN_ERROR
+	default:
+		response.Header.Name = DRIVER_INTERNAL_ERROR
+	}
+}
+
+//getConnectedHomeActionsError fails request only when no resource was set, v2 has no error for
+//partial failures
+func getConnectedHomeActionsError(name string, results []*SceneActionResult) error {
+	failed := countFailedActions(results)
+	if failed > 0 {
+		log.Println(name+" failed for", failed, "of", len(results), "resources")
+	}
+	if len(results) > 0 && failed == len(results) {
+		return errHubOffline
+	}
+	return nil
+}
+
+func (endpoint *AlexaEndpoint) onSceneRequest(username string, sceneID string, name string, response *AlexaControlResponse) error {
+	scene := endpoint.Scenes.getScene(username, sceneID)
+	if scene == nil {
+		return errNoSuchDevice
+	}
+	actions := scene.Actions
+	if name == TURN_ON_REQUEST {
+		response.Header.Name = TURN_ON_CONFIRMATION
+	} else if name == TURN_OFF_REQUEST && len(scene.OffActions) > 0 {
+		response.Header.Name = TURN_OFF_CONFIRMATION
+		actions = scene.OffActions
+	} else {
+		return errUnsupportedOperation
+	}
+	return getConnectedHomeActionsError("Scene "+scene.Name, activateScene(endpoint.HubConnections, username, actions))
+}
+
+//onGroupRequest fans power and percentage requests out to group members
+func (endpoint *AlexaEndpoint) onGroupRequest(username string, groupID string, resource string, name string, message string, response *AlexaControlResponse) error {
+	group := endpoint.Groups.getGroup(username, groupID)
+	if group == nil {
+		return errNoSuchDevice
+	}
+	href := GROUP_DIMMING_HREF
+	var value string
+	if name == TURN_ON_REQUEST || name == TURN_OFF_REQUEST {
+		href = GROUP_POWER_HREF
+		response.Header.Name = TURN_ON_CONFIRMATION
+		if name == TURN_OFF_REQUEST {
+			response.Header.Name = TURN_OFF_CONFIRMATION
+		}
+		value = `{"value":` + strconv.FormatBool(name == TURN_ON_REQUEST) + `}`
+	} else if name == SET_PERCENTAGE_REQUEST {
+		response.Header.Name = SET_PERCENTAGE_CONFIRMATION
+		value = `{"dimmingSetting":` + strconv.FormatInt(gjson.Get(message, "payload.percentageState.value").Int(), 10) + `}`
+	} else if name == INCREMENT_PERCENTAGE_REQUEST || name == DECREMENT_PERCENTAGE_REQUEST {
+		response.Header.Name = INCREMENT_PERCENTAGE_CONFIRMATION
+		delta := gjson.Get(message, "payload.deltaPercentage.value").Int()
+		if name == DECREMENT_PERCENTAGE_REQUEST {
+			response.Header.Name = DECREMENT_PERCENTAGE_CONFIRMATION
+			delta = -delta
+		}
+		variable := createGroupDevice(endpoint.HubConnections, username, group).getVariable(GROUP_DIMMING_HREF)
+		if variable == nil {
+			return errUnsupportedOperation
+		}
+		percent := (ValueRange{Min: 0, Max: 100}).clamp(variable.VariableValue.Value.Get("dimmingSetting").Float() + float64(delta))
+		value = `{"dimmingSetting":` + formatNumber(percent) + `}`
+	} else {
+		return errUnsupportedOperation
+	}
+	if resource != "" && resource != href {
+		return errUnsupportedOperation
+	}
+
+	results, err := setGroupValue(endpoint.HubConnections, username, group, href, gjson.Parse(value))
+	if err != nil {
+		return err
+	}
+	return getConnectedHomeActionsError("Group "+group.Name, results)
+}
@@ -2,279 +2,805 @@ package main
 
 import (
 	"container/list"
+	"errors"
 	"io/ioutil"
 	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/tidwall/gjson"
 	iris "gopkg.in/kataras/iris.v6"
 )
 
 const (
-	NAMESPACE_CONTROL   = "Alexa.ConnectedHome.Control"
-	NAMESPACE_DISCOVERY = "Alexa.ConnectedHome.Discovery"
-
-	DISCOVER_APPLIANCES_REQUEST  = "DiscoverAppliancesRequest"
-	DISCOVER_APPLIANCES_RESPONSE = "DiscoverAppliancesResponse"
-
-	TURN_ON_REQUEST       = "TurnOnRequest"
-	TURN_OFF_REQUEST      = "TurnOffRequest"
-	TURN_ON_CONFIRMATION  = "TurnOnConfirmation"
-	TURN_OFF_CONFIRMATION = "TurnOffConfirmation"
-
-	SET_PERCENTAGE_REQUEST            = "SetPercentageRequest"
-	SET_PERCENTAGE_CONFIRMATION       = "SetPercentageConfirmation"
-	INCREMENT_PERCENTAGE_REQUEST      = "IncrementPercentageRequest"
-	INCREMENT_PERCENTAGE_CONFIRMATION = "IncrementPercentageConfirmation"
-	DECREMENT_PERCENTAGE_REQUEST      = "DecrementPercentageRequest"
-	DECREMENT_PERCENTAGE_CONFIRMATION = "DecrementPercentageConfirmation"
+	ALEXA_PAYLOAD_VERSION = "3"
+
+	NAMESPACE_ALEXA              = "Alexa"
+	NAMESPACE_DISCOVERY          = "Alexa.Discovery"
+	NAMESPACE_AUTH               = "Alexa.Authorization"
+	NAMESPACE_POWER              = "Alexa.PowerController"
+	NAMESPACE_PERCENTAGE         = "Alexa.PercentageController"
+	NAMESPACE_COLOR              = "Alexa.ColorController"
+	NAMESPACE_COLOR_TEMPERATURE  = "Alexa.ColorTemperatureController"
+	NAMESPACE_THERMOSTAT         = "Alexa.ThermostatController"
+	NAMESPACE_TEMPERATURE_SENSOR = "Alexa.TemperatureSensor"
+	NAMESPACE_SCENE              = "Alexa.SceneController"
+
+	DISCOVER          = "Discover"
+	DISCOVER_RESPONSE = "Discover.Response"
+
+	TURN_ON                    = "TurnOn"
+	TURN_OFF                   = "TurnOff"
+	SET_PERCENTAGE             = "SetPercentage"
+	ADJUST_PERCENTAGE          = "AdjustPercentage"
+	SET_COLOR                  = "SetColor"
+	SET_COLOR_TEMPERATURE      = "SetColorTemperature"
+	INCREASE_COLOR_TEMPERATURE = "IncreaseColorTemperature"
+	DECREASE_COLOR_TEMPERATURE = "DecreaseColorTemperature"
+	SET_TARGET_TEMPERATURE     = "SetTargetTemperature"
+	ADJUST_TARGET_TEMPERATURE  = "AdjustTargetTemperature"
+	REPORT_STATE               = "ReportState"
+	STATE_REPORT               = "StateReport"
+	ACTIVATE                   = "Activate"
+	DEACTIVATE                 = "Deactivate"
+	ACTIVATION_STARTED         = "ActivationStarted"
+	DEACTIVATION_STARTED       = "DeactivationStarted"
+	RESPONSE                   = "Response"
+	ERROR_RESPONSE             = "ErrorResponse"
+
+	ERROR_ENDPOINT_UNREACHABLE        = "ENDPOINT_UNREACHABLE"
+	ERROR_NO_SUCH_ENDPOINT            = "NO_SUCH_ENDPOINT"
+	ERROR_VALUE_OUT_OF_RANGE          = "VALUE_OUT_OF_RANGE"
+	ERROR_INVALID_VALUE               = "INVALID_VALUE"
+	ERROR_INVALID_DIRECTIVE           = "INVALID_DIRECTIVE"
+	ERROR_INVALID_CREDENTIAL          = "INVALID_AUTHORIZATION_CREDENTIAL"
+	ERROR_INTERNAL                    = "INTERNAL_ERROR"
+	ERROR_ACCEPT_GRANT_FAILED         = "ACCEPT_GRANT_FAILED"
+	TEMPERATURE_SCALE_CELSIUS         = "CELSIUS"
+	ALEXA_CAUSE_VOICE_INTERACTION     = "VOICE_INTERACTION"
+	ALEXA_CAUSE_PHYSICAL_INTERACTION  = "PHYSICAL_INTERACTION"
+	ALEXA_SCOPE_BEARER_TOKEN          = "BearerToken"
+	ALEXA_CAPABILITY_TYPE             = "AlexaInterface"
+	ALEXA_UNCERTAINTY_IN_MILLISECONDS = 500
+
+	ACCEPT_GRANT_REQUEST  = "AcceptGrant"
+	ACCEPT_GRANT_RESPONSE = "AcceptGrant.Response"
 
 	MANUFACTURER_NAME = "Wiklosoft"
+
+	DISPLAY_CATEGORY_LIGHT              = "LIGHT"
+	DISPLAY_CATEGORY_SWITCH             = "SWITCH"
+	DISPLAY_CATEGORY_THERMOSTAT         = "THERMOSTAT"
+	DISPLAY_CATEGORY_TEMPERATURE_SENSOR = "TEMPERATURE_SENSOR"
+	DISPLAY_CATEGORY_SCENE_TRIGGER      = "SCENE_TRIGGER"
+	DISPLAY_CATEGORY_ACTIVITY_TRIGGER   = "ACTIVITY_TRIGGER"
+	SCENE_APPLIANCE_PREFIX              = "scene"
 )
 
 type AlexaHeader struct {
-	Namespace      string `json:"namespace"`
-	Name           string `json:"name"`
-	PayloadVersion string `json:"payloadVersion"`
-	MessageID      string `json:"messageId"`
+	Namespace        string `json:"namespace"`
+	Name             string `json:"name"`
+	PayloadVersion   string `json:"payloadVersion"`
+	MessageID        string `json:"messageId"`
+	CorrelationToken string `json:"correlationToken,omitempty"`
+}
+
+type AlexaScope struct {
+	Type  string `json:"type"`
+	Token string `json:"token"`
+}
+
+type AlexaEndpointRef struct {
+	Scope      *AlexaScope `json:"scope,omitempty"`
+	EndpointID string      `json:"endpointId"`
+}
+
+type AlexaProperty struct {
+	Namespace                 string      `json:"namespace"`
+	Name                      string      `json:"name"`
+	Value                     interface{} `json:"value"`
+	TimeOfSample              string      `json:"timeOfSample"`
+	UncertaintyInMilliseconds int         `json:"uncertaintyInMilliseconds"`
+}
+
+type AlexaContext struct {
+	Properties []AlexaProperty `json:"properties"`
+}
+
+//AlexaResponse is v3 event sent as reply to directive
+type AlexaResponse struct {
+	Event struct {
+		Header   AlexaHeader       `json:"header"`
+		Endpoint *AlexaEndpointRef `json:"endpoint,omitempty"`
+		Payload  interface{}       `json:"payload"`
+	} `json:"event"`
+	Context *AlexaContext `json:"context,omitempty"`
 }
-type AlexaPayload struct {
-	AccessToken string `json:"accessToken"`
+
+type AlexaValidRange struct {
+	MinimumValue interface{} `json:"minimumValue"`
+	MaximumValue interface{} `json:"maximumValue"`
+}
+
+type AlexaErrorPayload struct {
+	Type       string           `json:"type"`
+	Message    string           `json:"message"`
+	ValidRange *AlexaValidRange `json:"validRange,omitempty"`
 }
 
-type AlexaMessage struct {
-	Header  AlexaHeader  `json:"header"`
-	Payload AlexaPayload `json:"payload"`
+type AlexaTemperature struct {
+	Value float64 `json:"value"`
+	Scale string  `json:"scale"`
 }
-type AlexaDevice struct {
-	ApplicanceID        string `json:"applianceId"`
-	ManufacturerName    string `json:"manufacturerName"`
-	ModelName           string `json:"modelName"`
-	FriendlyName        string `json:"friendlyName"`
-	FriendlyDescription string `json:"friendlyDescription"`
-	IsReachable         bool   `json:"isReachable"`
-	Version             string `json:"version"`
 
-	Actions                    []string `json:"actions"`
-	AdditionalApplianceDetails struct {
-	} `json:"additionalApplianceDetails"`
+type AlexaPropertyName struct {
+	Name string `json:"name"`
 }
 
-type AlexaDiscoveryResponse struct {
-	Header  AlexaHeader `json:"header"`
-	Payload struct {
-		DiscoveredAppliances []AlexaDevice `json:"discoveredAppliances"`
-	} `json:"payload"`
+type AlexaCapabilityProperties struct {
+	Supported           []AlexaPropertyName `json:"supported"`
+	ProactivelyReported bool                `json:"proactivelyReported"`
+	Retrievable         bool                `json:"retrievable"`
 }
-type AlexaControlResponse struct {
-	Header  AlexaHeader `json:"header"`
-	Payload struct {
-	} `json:"payload"`
+
+type AlexaEndpointCapability struct {
+	Type                 string                     `json:"type"`
+	Interface            string                     `json:"interface"`
+	Version              string                     `json:"version"`
+	Properties           *AlexaCapabilityProperties `json:"properties,omitempty"`
+	SupportsDeactivation *bool                      `json:"supportsDeactivation,omitempty"`
+}
+
+type AlexaDiscoveryEndpoint struct {
+	EndpointID        string                    `json:"endpointId"`
+	ManufacturerName  string                    `json:"manufacturerName"`
+	FriendlyName      string                    `json:"friendlyName"`
+	Description       string                    `json:"description"`
+	DisplayCategories []string                  `json:"displayCategories"`
+	Capabilities      []AlexaEndpointCapability `json:"capabilities"`
+}
+
+//AlexaInterface describes v3 interface exposing capability of resource
+type AlexaInterface struct {
+	Namespace string
+	Property  string
+	Category  string
 }
 
+var (
+	errUnsupportedOperation     = errors.New("operation not supported by target")
+	errUnsupportedTargetSetting = errors.New("target setting not supported")
+	errInvalidAccessToken       = errors.New("invalid access token")
+)
+
 type AlexaEndpoint struct {
 	HubConnections *list.List
+	Events         *AlexaEventGateway
+	Scenes         *SceneStore
+	Overlays       *OverlayStore
+	Groups         *GroupStore
+
+	//Authorize resolves bearer token of directive to user
+	Authorize func(token string) (*AuthUserData, error)
 }
 
-func NewAlexaEndpoint(app *iris.Framework, hubConnections *list.List) *AlexaEndpoint {
-	endpoint := &AlexaEndpoint{}
+func getAlexaApplianceID(hubUUID string, deviceUUID string, href string) string {
+	if href == "" {
+		return hubUUID + ":" + deviceUUID
+	}
+	return hubUUID + ":" + deviceUUID + ":" + strings.Replace(href, "/", "_", -1)
+}
+
+func NewAlexaEndpoint(app *iris.Framework, hubConnections *list.List, events *AlexaEventGateway, scenes *SceneStore, overlays *OverlayStore, groups *GroupStore) *AlexaEndpoint {
+	endpoint := &AlexaEndpoint{
+		HubConnections: hubConnections,
+		Events:         events,
+		Scenes:         scenes,
+		Overlays:       overlays,
+		Groups:         groups,
+		Authorize: func(token string) (*AuthUserData, error) {
+			return GetUserInfo(token, getAuthData(AUTH_ALEXA))
+		},
+	}
 
 	app.Post("/", func(c *iris.Context) {
 		bodyBytes, err := ioutil.ReadAll(c.Request.Body)
 		if err != nil {
-			c.JSON(iris.StatusInternalServerError, nil)
+			log.Println(err)
+			c.JSON(iris.StatusOK, newAlexaErrorResponse(gjson.Result{}, err))
 			return
 		}
 		body := string(bodyBytes)
-
-		token := gjson.Get(body, "payload.accessToken").String()
-
-		userInfo, err := GetUserInfo(token, getAuthData(AUTH_ALEXA))
-		if err != nil {
-			log.Println(err)
+		if !gjson.Get(body, "directive").Exists() {
+			c.JSON(iris.StatusOK, endpoint.handleConnectedHomeMessage(body))
 			return
 		}
-
-		handleAlexaMessage(body, hubConnections, userInfo, c)
+		c.JSON(iris.StatusOK, endpoint.handleDirective(body))
 	})
 	return endpoint
 }
 
-func onTurnOnOffRequest(hubConnection *HubConnection, device *IotDevice, value bool) {
-	setDeviceValue(hubConnection, device.UUID, "/master", `{"value":`+strconv.FormatBool(value)+`}`)
+func newAlexaResponse(directive gjson.Result, namespace string, name string) *AlexaResponse {
+	response := &AlexaResponse{}
+	response.Event.Header.Namespace = namespace
+	response.Event.Header.Name = name
+	response.Event.Header.PayloadVersion = ALEXA_PAYLOAD_VERSION
+	response.Event.Header.MessageID = generateMessageUUID()
+	response.Event.Header.CorrelationToken = directive.Get("header.correlationToken").String()
+	if endpointID := directive.Get("endpoint.endpointId").String(); endpointID != "" {
+		response.Event.Endpoint = &AlexaEndpointRef{EndpointID: endpointID}
+	}
+	response.Event.Payload = struct{}{}
+	return response
 }
-func onSetPercentRequest(clientConnection *HubConnection, device *IotDevice, resource string, value int64) {
-	log.Println("onSetPercentRequest " + device.UUID + resource)
-	resourceType := device.getVariable(resource).ResourceType
-	variable := device.getVariable(resource).VariableValue.Value
-	log.Println("onSetPercentRequest " + resource + " variable:" + device.getVariable(resource).VariableValue.Value.String())
-	if resourceType == "oic.r.light.dimming" {
-		var max int64
-		if !variable.Get("range").Exists() {
-			max = 100
-		} else {
-			var err error
-			max, err = strconv.ParseInt(strings.Split(variable.Get("range").String(), ",")[1], 10, 0)
-			if err != nil {
-				log.Println(err)
-				max = 100
-			}
+
+func newAlexaProperty(namespace string, name string, value interface{}) AlexaProperty {
+	return AlexaProperty{
+		Namespace:                 namespace,
+		Name:                      name,
+		Value:                     value,
+		TimeOfSample:              time.Now().UTC().Format(time.RFC3339),
+		UncertaintyInMilliseconds: ALEXA_UNCERTAINTY_IN_MILLISECONDS,
+	}
+}
+
+//handleDirective authorizes directive and dispatches it by namespace, reply is always a v3 event
+func (endpoint *AlexaEndpoint) handleDirective(body string) *AlexaResponse {
+	log.Println("handleDirective: " + body)
+	directive := gjson.Get(body, "directive")
+	namespace := directive.Get("header.namespace").String()
+	name := directive.Get("header.name").String()
+
+	token := directive.Get("endpoint.scope.token").String()
+	if token == "" {
+		token = directive.Get("payload.scope.token").String()
+	}
+	if token == "" {
+		token = directive.Get("payload.grantee.token").String()
+	}
+
+	userInfo, err := endpoint.Authorize(token)
+	if err != nil {
+		log.Println(err)
+		return newAlexaErrorResponse(directive, err)
+	}
+	if namespace == NAMESPACE_AUTH && name == ACCEPT_GRANT_REQUEST {
+		return endpoint.handleAcceptGrant(directive, userInfo)
+	}
+	if userInfo.Username == "" {
+		return newAlexaErrorResponse(directive, errInvalidAccessToken)
+	}
+	if namespace == NAMESPACE_DISCOVERY && name == DISCOVER {
+		return endpoint.handleDiscovery(directive, userInfo.Username)
+	}
+
+	response, err := endpoint.handleControl(directive, userInfo.Username)
+	if err != nil {
+		return newAlexaErrorResponse(directive, err)
+	}
+	return response
+}
+
+func (endpoint *AlexaEndpoint) handleAcceptGrant(directive gjson.Result, userInfo *AuthUserData) *AlexaResponse {
+	code := directive.Get("payload.grant.code").String()
+	err := errors.New("Unable to identify user")
+	if userInfo.Username != "" {
+		err = endpoint.Events.AcceptGrant(userInfo.Username, code)
+	}
+	if err != nil {
+		log.Println(err)
+		response := newAlexaResponse(directive, NAMESPACE_AUTH, ERROR_RESPONSE)
+		response.Event.Payload = &AlexaErrorPayload{Type: ERROR_ACCEPT_GRANT_FAILED, Message: err.Error()}
+		return response
+	}
+	return newAlexaResponse(directive, NAMESPACE_AUTH, ACCEPT_GRANT_RESPONSE)
+}
+
+//getAlexaInterface returns v3 interface exposing capability, read-only resources are exposed only as sensors
+func getAlexaInterface(capability *ResourceCapability) *AlexaInterface {
+	if capability.Capability.Name == CAPABILITY_TEMPERATURE {
+		if capability.isSetpoint() {
+			return &AlexaInterface{Namespace: NAMESPACE_THERMOSTAT, Property: "targetSetpoint", Category: DISPLAY_CATEGORY_THERMOSTAT}
 		}
+		return &AlexaInterface{Namespace: NAMESPACE_TEMPERATURE_SENSOR, Property: "temperature", Category: DISPLAY_CATEGORY_TEMPERATURE_SENSOR}
+	}
+	if !capability.Variable.isWritable() {
+		return nil
+	}
+	switch capability.Capability.Name {
+	case CAPABILITY_POWER:
+		return &AlexaInterface{Namespace: NAMESPACE_POWER, Property: "powerState", Category: DISPLAY_CATEGORY_SWITCH}
+	case CAPABILITY_PERCENTAGE:
+		return &AlexaInterface{Namespace: NAMESPACE_PERCENTAGE, Property: "percentage", Category: DISPLAY_CATEGORY_LIGHT}
+	case CAPABILITY_COLOR:
+		return &AlexaInterface{Namespace: NAMESPACE_COLOR, Property: "color", Category: DISPLAY_CATEGORY_LIGHT}
+	case CAPABILITY_COLOR_TEMP:
+		return &AlexaInterface{Namespace: NAMESPACE_COLOR_TEMPERATURE, Property: "colorTemperatureInKelvin", Category: DISPLAY_CATEGORY_LIGHT}
+	}
+	return nil
+}
 
-		newValue := value * max / 100
+//getAlexaValue returns current value of capability in format of its Alexa property
+func getAlexaValue(capability *ResourceCapability) interface{} {
+	switch capability.Capability.Name {
+	case CAPABILITY_POWER:
+		if capability.GetBool() {
+			return "ON"
+		}
+		return "OFF"
+	case CAPABILITY_PERCENTAGE:
+		return capability.GetPercent()
+	case CAPABILITY_COLOR:
+		return capability.GetColor()
+	case CAPABILITY_COLOR_TEMP:
+		return capability.GetColorTemperature()
+	case CAPABILITY_TEMPERATURE:
+		return AlexaTemperature{Value: capability.GetTemperature(), Scale: TEMPERATURE_SCALE_CELSIUS}
+	}
+	return nil
+}
 
-		setDeviceValue(clientConnection, device.UUID, resource, `{"dimmingSetting":`+strconv.FormatInt(newValue, 10)+`}`)
+//getAlexaProperties returns properties of capability exposed to Alexa
+func getAlexaProperties(capability *ResourceCapability) []AlexaProperty {
+	alexaInterface := getAlexaInterface(capability)
+	if alexaInterface == nil {
+		return nil
 	}
+	return []AlexaProperty{newAlexaProperty(alexaInterface.Namespace, alexaInterface.Property, getAlexaValue(capability))}
 }
-func onChangePercentRequest(conn *HubConnection, device *IotDevice, resource string, value int64) {
-	resourceType := device.getVariable(resource).ResourceType
-	variable := device.getVariable(resource).VariableValue.Value
 
-	if resourceType == "oic.r.light.dimming" {
-		var max int64
-		if !variable.Get("range").Exists() {
-			max = 100
-		} else {
-			var err error
-			max, err = strconv.ParseInt(strings.Split(variable.Get("range").String(), ",")[1], 10, 0)
-			if err != nil {
-				log.Println(err)
-				max = 100
+func newAlexaCapability(namespace string, property string, reported bool) AlexaEndpointCapability {
+	capability := AlexaEndpointCapability{Type: ALEXA_CAPABILITY_TYPE, Interface: namespace, Version: ALEXA_PAYLOAD_VERSION}
+	if property != "" {
+		capability.Properties = &AlexaCapabilityProperties{
+			Supported:           []AlexaPropertyName{{Name: property}},
+			ProactivelyReported: reported,
+			Retrievable:         true,
+		}
+	}
+	return capability
+}
+
+func getAlexaDescription(description string, device *IotDevice) string {
+	if device.Room != "" {
+		return description + " in " + device.Room
+	}
+	return description
+}
+
+//getAlexaEndpoints returns endpoints of device, one for power of device and one for every controllable resource,
+//devices and resources hidden by user overlay are not exposed, reported tells if changes are sent to event gateway
+func getAlexaEndpoints(hubUUID string, device *IotDevice, reported bool) []AlexaDiscoveryEndpoint {
+	if device.Hidden {
+		return nil
+	}
+	device = device.filterVariables(false)
+	var endpoints []AlexaDiscoveryEndpoint
+	if power := device.getCapability(CAPABILITY_POWER); power != nil && power.Variable.isWritable() {
+		category := DISPLAY_CATEGORY_SWITCH
+		if device.getCapability(CAPABILITY_PERCENTAGE) != nil || device.getCapability(CAPABILITY_COLOR) != nil {
+			category = DISPLAY_CATEGORY_LIGHT
+		}
+		endpoints = append(endpoints, AlexaDiscoveryEndpoint{
+			EndpointID:        getAlexaApplianceID(hubUUID, device.UUID, ""),
+			ManufacturerName:  MANUFACTURER_NAME,
+			FriendlyName:      device.Name,
+			Description:       getAlexaDescription("OCF Device by Wiklosoft", device),
+			DisplayCategories: []string{category},
+			Capabilities: []AlexaEndpointCapability{
+				newAlexaCapability(NAMESPACE_ALEXA, "", false),
+				newAlexaCapability(NAMESPACE_POWER, "powerState", reported),
+			},
+		})
+	}
+
+	for _, variable := range device.Variables {
+		endpoint := AlexaDiscoveryEndpoint{
+			EndpointID:       getAlexaApplianceID(hubUUID, device.UUID, variable.Href),
+			ManufacturerName: MANUFACTURER_NAME,
+			FriendlyName:     variable.Name,
+			Description:      getAlexaDescription("OCF Resource by Wiklosoft", device),
+			Capabilities:     []AlexaEndpointCapability{newAlexaCapability(NAMESPACE_ALEXA, "", false)},
+		}
+		for _, capability := range device.getResourceCapabilities(variable.Href) {
+			alexaInterface := getAlexaInterface(capability)
+			if alexaInterface == nil || capability.Capability.Name == CAPABILITY_POWER {
+				continue
+			}
+			endpoint.Capabilities = append(endpoint.Capabilities, newAlexaCapability(alexaInterface.Namespace, alexaInterface.Property, reported))
+			if len(endpoint.DisplayCategories) == 0 {
+				endpoint.DisplayCategories = []string{alexaInterface.Category}
 			}
 		}
+		if len(endpoint.DisplayCategories) == 0 {
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+func getSceneEndpoint(scene *Scene) AlexaDiscoveryEndpoint {
+	deactivation := len(scene.OffActions) > 0
+	category := DISPLAY_CATEGORY_SCENE_TRIGGER
+	if deactivation {
+		category = DISPLAY_CATEGORY_ACTIVITY_TRIGGER
+	}
+	capability := newAlexaCapability(NAMESPACE_SCENE, "", false)
+	capability.SupportsDeactivation = &deactivation
+	return AlexaDiscoveryEndpoint{
+		EndpointID:        SCENE_APPLIANCE_PREFIX + ":" + scene.ID,
+		ManufacturerName:  MANUFACTURER_NAME,
+		FriendlyName:      scene.Name,
+		Description:       "Scene by Wiklosoft",
+		DisplayCategories: []string{category},
+		Capabilities:      []AlexaEndpointCapability{newAlexaCapability(NAMESPACE_ALEXA, "", false), capability},
+	}
+}
+
+func (endpoint *AlexaEndpoint) handleDiscovery(directive gjson.Result, username string) *AlexaResponse {
+	reported := endpoint.Events.isEnabled(username)
+	endpoints := []AlexaDiscoveryEndpoint{}
+	for _, con := range getHubConnections(endpoint.HubConnections) {
+		if con.Username != username {
+			continue
+		}
+		for _, device := range con.getDevices() {
+			endpoints = append(endpoints, getAlexaEndpoints(con.Uuid, endpoint.Overlays.apply(username, con.Uuid, device), reported)...)
+		}
+	}
+	for _, device := range createGroupDevices(endpoint.HubConnections, username, endpoint.Groups) {
+		endpoints = append(endpoints, getAlexaEndpoints(GROUP_HUB_UUID, device, reported)...)
+	}
+	for _, scene := range endpoint.Scenes.getScenes(username) {
+		endpoints = append(endpoints, getSceneEndpoint(scene))
+	}
+
+	response := newAlexaResponse(directive, NAMESPACE_DISCOVERY, DISCOVER_RESPONSE)
+	response.Event.Payload = struct {
+		Endpoints []AlexaDiscoveryEndpoint `json:"endpoints"`
+	}{endpoints}
+	return response
+}
+
+//getAlexaError maps failure to v3 error type
+func getAlexaError(err error) *AlexaErrorPayload {
+	payload := &AlexaErrorPayload{Type: ERROR_INTERNAL, Message: err.Error()}
+	if _, ok := err.(*ValueValidationError); ok {
+		payload.Type = ERROR_INVALID_VALUE
+		return payload
+	}
+	if rangeErr, ok := err.(*ValueOutOfRangeError); ok {
+		payload.Type = ERROR_VALUE_OUT_OF_RANGE
+		payload.ValidRange = &AlexaValidRange{MinimumValue: rangeErr.Range.Min, MaximumValue: rangeErr.Range.Max}
+		return payload
+	}
+	if rangeErr, ok := err.(*TemperatureOutOfRangeError); ok {
+		payload.Type = ERROR_VALUE_OUT_OF_RANGE
+		payload.ValidRange = &AlexaValidRange{
+			MinimumValue: AlexaTemperature{Value: rangeErr.Range.Min, Scale: TEMPERATURE_SCALE_CELSIUS},
+			MaximumValue: AlexaTemperature{Value: rangeErr.Range.Max, Scale: TEMPERATURE_SCALE_CELSIUS},
+		}
+		return payload
+	}
+	if _, ok := err.(*PartialFailureError); ok {
+		payload.Type = ERROR_ENDPOINT_UNREACHABLE
+		return payload
+	}
+	switch err {
+	case errHubOffline, errHubTimeout:
+		payload.Type = ERROR_ENDPOINT_UNREACHABLE
+	case errNoSuchDevice:
+		payload.Type = ERROR_NO_SUCH_ENDPOINT
+	case errUnsupportedOperation, errUnsupportedTargetSetting:
+		payload.Type = ERROR_INVALID_DIRECTIVE
+	case errInvalidAccessToken:
+		payload.Type = ERROR_INVALID_CREDENTIAL
+	}
+	return payload
+}
+
+func newAlexaErrorResponse(directive gjson.Result, err error) *AlexaResponse {
+	log.Println("Alexa directive failed", err)
+	response := newAlexaResponse(directive, NAMESPACE_ALEXA, ERROR_RESPONSE)
+	response.Event.Payload = getAlexaError(err)
+	return response
+}
 
-		diffValue := value * max / 100
-		prevValue := variable.Get("dimmingSetting").Int()
+//handleControl executes directive addressed to endpoint and replies with state of changed properties
+func (endpoint *AlexaEndpoint) handleControl(directive gjson.Result, username string) (*AlexaResponse, error) {
+	endpointID := strings.Split(directive.Get("endpoint.endpointId").String(), ":")
+	if len(endpointID) < 2 {
+		return nil, errNoSuchDevice
+	}
+	if endpointID[0] == SCENE_APPLIANCE_PREFIX {
+		return endpoint.onSceneDirective(directive, username, endpointID[1])
+	}
+
+	hubUUID := endpointID[0]
+	deviceID := endpointID[1]
+	resource := ""
+	if len(endpointID) == 3 {
+		resource = strings.Replace(endpointID[2], "_", "/", -1)
+	}
+	if hubUUID == GROUP_HUB_UUID {
+		return endpoint.onGroupDirective(directive, username, deviceID, resource)
+	}
 
-		newValue := prevValue + diffValue
-		log.Println("onChangePercentRequest oldValue:", prevValue, "newValue: ", newValue, " diff:", diffValue)
+	conn := findHubConnection(endpoint.HubConnections, username, hubUUID)
+	if conn == nil {
+		log.Println("Unable to find hub " + hubUUID + " of " + username)
+		return nil, errHubOffline
+	}
+	device := conn.getDevice(deviceID)
+	if device == nil {
+		log.Println("Unable to find device " + deviceID)
+		return nil, errNoSuchDevice
+	}
+	properties, err := onDeviceDirective(conn, device, resource, directive)
+	if err != nil {
+		return nil, err
+	}
+	response := newAlexaResponse(directive, NAMESPACE_ALEXA, RESPONSE)
+	if directive.Get("header.name").String() == REPORT_STATE {
+		response.Event.Header.Name = STATE_REPORT
+	}
+	response.Context = &AlexaContext{Properties: properties}
+	return response, nil
+}
 
-		if newValue > max {
-			newValue = max
+//getEndpointProperties returns current state of all properties exposed by endpoint of device or resource
+func getEndpointProperties(device *IotDevice, resource string) []AlexaProperty {
+	properties := []AlexaProperty{}
+	if resource == "" {
+		if power := device.getCapability(CAPABILITY_POWER); power != nil {
+			properties = append(properties, getAlexaProperties(power)...)
 		}
+		return properties
+	}
+	for _, capability := range device.getResourceCapabilities(resource) {
+		if capability.Capability.Name != CAPABILITY_POWER {
+			properties = append(properties, getAlexaProperties(capability)...)
+		}
+	}
+	return properties
+}
+
+func getDirectiveCapability(device *IotDevice, resource string, name string) (*ResourceCapability, error) {
+	var capability *ResourceCapability
+	if resource == "" && name == CAPABILITY_POWER {
+		capability = device.getCapability(name)
+	} else {
+		capability = device.getResourceCapability(resource, name)
+	}
+	if capability == nil {
+		log.Println("Resource " + device.UUID + resource + " does not support " + name + " capability")
+		return nil, errUnsupportedOperation
+	}
+	return capability, nil
+}
+
+//onDeviceDirective applies directive to device and returns properties of endpoint after change
+func onDeviceDirective(conn *HubConnection, device *IotDevice, resource string, directive gjson.Result) ([]AlexaProperty, error) {
+	name := directive.Get("header.name").String()
+	payload := directive.Get("payload")
 
-		if newValue < 0 {
-			newValue = 0
+	switch directive.Get("header.namespace").String() + "." + name {
+	case NAMESPACE_ALEXA + "." + REPORT_STATE:
+		return getEndpointProperties(device, resource), nil
+
+	case NAMESPACE_POWER + "." + TURN_ON, NAMESPACE_POWER + "." + TURN_OFF:
+		capability, err := getDirectiveCapability(device, resource, CAPABILITY_POWER)
+		if err != nil {
+			return nil, err
 		}
-		setDeviceValue(conn, device.UUID, resource, `{"dimmingSetting":`+strconv.FormatInt(newValue, 10)+`}`)
-	}
-}
-
-func handleAlexaMessage(message string, hubConnections *list.List, userInfo *AuthUserData, c *iris.Context) {
-	namespace := gjson.Get(message, "header.namespace").String()
-
-	log.Println("handleAlexaMessage: " + message)
-	if namespace == NAMESPACE_DISCOVERY {
-		response := &AlexaDiscoveryResponse{}
-		response.Header.Name = DISCOVER_APPLIANCES_RESPONSE
-		response.Header.Namespace = NAMESPACE_DISCOVERY
-		response.Header.PayloadVersion = "2"
-		response.Header.MessageID = generateMessageUUID()
-
-		for e := hubConnections.Front(); e != nil; e = e.Next() {
-			con := e.Value.(*HubConnection)
-			log.Println(con.Username + " " + userInfo.Username)
-			if userInfo.Username != "" && con.Username == userInfo.Username {
-				for d := con.DeviceList.Front(); d != nil; d = d.Next() {
-					device := d.Value.(*IotDevice)
-					log.Println("Adding device " + device.UUID)
-
-					if device.getVariable("/master") != nil {
-						dev := AlexaDevice{
-							ApplicanceID:        con.Uuid + ":" + device.UUID,
-							ManufacturerName:    MANUFACTURER_NAME,
-							ModelName:           "The Best Model",
-							FriendlyName:        device.Name,
-							FriendlyDescription: "OCF Device by Wiklosoft",
-							IsReachable:         true,
-							Version:             "0.1",
-						}
-
-						dev.Actions = append(dev.Actions, "turnOn")
-						dev.Actions = append(dev.Actions, "turnOff")
-						response.Payload.DiscoveredAppliances = append(response.Payload.DiscoveredAppliances, dev)
-					}
-
-					for _, variable := range device.Variables {
-						if variable.ResourceType == "oic.r.light.dimming" {
-							dev := AlexaDevice{
-								ApplicanceID:        con.Uuid + ":" + device.UUID + ":" + strings.Replace(variable.Href, "/", "_", -1),
-								ManufacturerName:    MANUFACTURER_NAME,
-								ModelName:           "The Best Model",
-								FriendlyName:        variable.Name,
-								FriendlyDescription: "OCF Resource by Wiklosoft",
-								IsReachable:         true,
-								Version:             "0.1",
-							}
-
-							dev.Actions = append(dev.Actions, "setPercentage")
-							dev.Actions = append(dev.Actions, "incrementPercentage")
-							dev.Actions = append(dev.Actions, "decrementPercentage")
-							response.Payload.DiscoveredAppliances = append(response.Payload.DiscoveredAppliances, dev)
-						}
-					}
-				}
-			}
+		if err = capability.SetBool(conn, name == TURN_ON); err != nil {
+			return nil, err
 		}
-		log.Println(response)
-		c.JSON(iris.StatusOK, response)
-	} else if namespace == NAMESPACE_CONTROL {
-		name := gjson.Get(message, "header.name").String()
-		response := &AlexaControlResponse{}
-
-		response.Header.Namespace = NAMESPACE_CONTROL
-		response.Header.PayloadVersion = "2"
-		response.Header.MessageID = generateMessageUUID()
-
-		applianceID := strings.Split(gjson.Get(message, "payload.appliance.applianceId").String(), ":")
-
-		connectionID := applianceID[0]
-		deviceID := applianceID[1]
-		resource := ""
-		if len(applianceID) == 3 {
-			resource = strings.Replace(applianceID[2], "_", "/", -1)
+		state := "OFF"
+		if name == TURN_ON {
+			state = "ON"
 		}
-		var clientConnection *HubConnection
-		for e := hubConnections.Front(); e != nil; e = e.Next() {
-			if e.Value.(*HubConnection).Uuid == connectionID {
-				clientConnection = e.Value.(*HubConnection)
+		return []AlexaProperty{newAlexaProperty(NAMESPACE_POWER, "powerState", state)}, nil
+
+	case NAMESPACE_PERCENTAGE + "." + SET_PERCENTAGE, NAMESPACE_PERCENTAGE + "." + ADJUST_PERCENTAGE:
+		capability, err := getDirectiveCapability(device, resource, CAPABILITY_PERCENTAGE)
+		if err != nil {
+			return nil, err
+		}
+		percent := payload.Get("percentage").Int()
+		if name == ADJUST_PERCENTAGE {
+			percent = capability.GetPercent() + payload.Get("percentageDelta").Int()
+			if percent < 0 {
+				percent = 0
+			} else if percent > 100 {
+				percent = 100
 			}
+		} else if percent < 0 || percent > 100 {
+			return nil, &ValueOutOfRangeError{Range: ValueRange{Min: 0, Max: 100}}
 		}
-		if clientConnection == nil {
-			log.Println("Unable to found hub connection: " + connectionID)
-			c.JSON(iris.StatusInternalServerError, nil)
-			return
+		if err = capability.SetPercent(conn, percent); err != nil {
+			return nil, err
 		}
+		return []AlexaProperty{newAlexaProperty(NAMESPACE_PERCENTAGE, "percentage", percent)}, nil
 
-		device := clientConnection.getDevice(deviceID)
-		if device == nil {
-			log.Println("Unable to device connection: " + deviceID)
-			c.JSON(iris.StatusInternalServerError, nil)
-			return
+	case NAMESPACE_COLOR + "." + SET_COLOR:
+		capability, err := getDirectiveCapability(device, resource, CAPABILITY_COLOR)
+		if err != nil {
+			return nil, err
+		}
+		color := HSBColor{
+			Hue:        payload.Get("color.hue").Float(),
+			Saturation: payload.Get("color.saturation").Float(),
+			Brightness: payload.Get("color.brightness").Float(),
+		}
+		if err = capability.SetColor(conn, color); err != nil {
+			return nil, err
 		}
+		return []AlexaProperty{newAlexaProperty(NAMESPACE_COLOR, "color", color)}, nil
 
-		if name == TURN_ON_REQUEST {
-			response.Header.Name = TURN_ON_CONFIRMATION
-			onTurnOnOffRequest(clientConnection, device, true)
-		} else if name == TURN_OFF_REQUEST {
-			response.Header.Name = TURN_OFF_CONFIRMATION
-			onTurnOnOffRequest(clientConnection, device, false)
-		} else if name == SET_PERCENTAGE_REQUEST {
-			response.Header.Name = SET_PERCENTAGE_CONFIRMATION
-			percent := gjson.Get(message, "payload.percentageState.value").Int()
-			onSetPercentRequest(clientConnection, device, resource, percent)
-		} else if name == INCREMENT_PERCENTAGE_REQUEST {
-			response.Header.Name = INCREMENT_PERCENTAGE_CONFIRMATION
-			percent := gjson.Get(message, "payload.deltaPercentage.value").Int()
-			onChangePercentRequest(clientConnection, device, resource, percent)
-		} else if name == DECREMENT_PERCENTAGE_REQUEST {
-			response.Header.Name = DECREMENT_PERCENTAGE_CONFIRMATION
-			percent := gjson.Get(message, "payload.deltaPercentage.value").Int()
-			onChangePercentRequest(clientConnection, device, resource, -percent)
+	case NAMESPACE_COLOR_TEMPERATURE + "." + SET_COLOR_TEMPERATURE,
+		NAMESPACE_COLOR_TEMPERATURE + "." + INCREASE_COLOR_TEMPERATURE,
+		NAMESPACE_COLOR_TEMPERATURE + "." + DECREASE_COLOR_TEMPERATURE:
+		capability, err := getDirectiveCapability(device, resource, CAPABILITY_COLOR_TEMP)
+		if err != nil {
+			return nil, err
+		}
+		kelvin := payload.Get("colorTemperatureInKelvin").Int()
+		if name != SET_COLOR_TEMPERATURE {
+			//Alexa increases white temperature to make light cooler
+			kelvin = nextColorTemperature(capability.GetColorTemperature(), name == INCREASE_COLOR_TEMPERATURE)
+		}
+		achieved, err := capability.SetColorTemperature(conn, kelvin)
+		if err != nil {
+			return nil, err
+		}
+		return []AlexaProperty{newAlexaProperty(NAMESPACE_COLOR_TEMPERATURE, "colorTemperatureInKelvin", achieved)}, nil
+
+	case NAMESPACE_THERMOSTAT + "." + SET_TARGET_TEMPERATURE, NAMESPACE_THERMOSTAT + "." + ADJUST_TARGET_TEMPERATURE:
+		capability, err := getDirectiveCapability(device, resource, CAPABILITY_TEMPERATURE)
+		if err != nil || !capability.isSetpoint() {
+			log.Println("Resource " + resource + " is not a temperature setpoint")
+			return nil, errUnsupportedTargetSetting
+		}
+		var value float64
+		if name == SET_TARGET_TEMPERATURE {
+			value = getAlexaTemperature(payload.Get("targetSetpoint"))
+		} else {
+			delta := payload.Get("targetSetpointDelta")
+			value = capability.GetTemperature() + getAlexaTemperatureDelta(delta)
 		}
+		if err = capability.SetTemperature(conn, value); err != nil {
+			if rangeErr, ok := err.(*ValueOutOfRangeError); ok {
+				return nil, &TemperatureOutOfRangeError{Range: rangeErr.Range}
+			}
+			return nil, err
+		}
+		return []AlexaProperty{newAlexaProperty(NAMESPACE_THERMOSTAT, "targetSetpoint",
+			AlexaTemperature{Value: roundTemperature(value), Scale: TEMPERATURE_SCALE_CELSIUS})}, nil
+	}
+	return nil, errUnsupportedOperation
+}
+
+//TemperatureOutOfRangeError is range error of temperature given in Celsius
+type TemperatureOutOfRangeError struct {
+	Range ValueRange
+}
+
+func (e *TemperatureOutOfRangeError) Error() string {
+	return "temperature out of range " + formatNumber(e.Range.Min) + "-" + formatNumber(e.Range.Max) + " C"
+}
+
+//getAlexaTemperature converts temperature sent by Alexa into Celsius
+func getAlexaTemperature(temperature gjson.Result) float64 {
+	value := temperature.Get("value").Float()
+	switch temperature.Get("scale").String() {
+	case "FAHRENHEIT":
+		return toCelsius(value, TEMPERATURE_UNIT_FAHRENHEIT)
+	case "KELVIN":
+		return toCelsius(value, TEMPERATURE_UNIT_KELVIN)
+	}
+	return value
+}
 
-		log.Println(response)
-		c.JSON(iris.StatusOK, response)
+//getAlexaTemperatureDelta converts temperature difference sent by Alexa into Celsius degrees
+func getAlexaTemperatureDelta(delta gjson.Result) float64 {
+	value := delta.Get("value").Float()
+	if delta.Get("scale").String() == "FAHRENHEIT" {
+		return value * 5 / 9
+	}
+	return value
+}
+
+func (endpoint *AlexaEndpoint) onSceneDirective(directive gjson.Result, username string, sceneID string) (*AlexaResponse, error) {
+	scene := endpoint.Scenes.getScene(username, sceneID)
+	if scene == nil {
+		return nil, errNoSuchDevice
+	}
+	name := directive.Get("header.name").String()
+	if directive.Get("header.namespace").String() != NAMESPACE_SCENE {
+		return nil, errUnsupportedOperation
+	}
+	actions := scene.Actions
+	responseName := ACTIVATION_STARTED
+	if name == DEACTIVATE && len(scene.OffActions) > 0 {
+		actions = scene.OffActions
+		responseName = DEACTIVATION_STARTED
+	} else if name != ACTIVATE {
+		return nil, errUnsupportedOperation
+	}
+
+	err := getActionsError(activateScene(endpoint.HubConnections, username, actions))
+	if err != nil {
+		log.Println("Scene "+scene.Name+" failed", err)
+		return nil, err
+	}
+	response := newAlexaResponse(directive, NAMESPACE_SCENE, responseName)
+	response.Event.Payload = map[string]interface{}{
+		"cause":     map[string]string{"type": ALEXA_CAUSE_VOICE_INTERACTION},
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+	response.Context = &AlexaContext{Properties: []AlexaProperty{}}
+	return response, nil
+}
+
+//onGroupDirective fans power and percentage directives out to group members, directive fails when
+//any member was not set so the user is told that part of the group did not react
+func (endpoint *AlexaEndpoint) onGroupDirective(directive gjson.Result, username string, groupID string, resource string) (*AlexaResponse, error) {
+	group := endpoint.Groups.getGroup(username, groupID)
+	if group == nil {
+		return nil, errNoSuchDevice
+	}
+	name := directive.Get("header.name").String()
+	device := createGroupDevice(endpoint.HubConnections, username, group)
+
+	response := newAlexaResponse(directive, NAMESPACE_ALEXA, RESPONSE)
+	if name == REPORT_STATE {
+		response.Event.Header.Name = STATE_REPORT
+		response.Context = &AlexaContext{Properties: getEndpointProperties(device, resource)}
+		return response, nil
+	}
+
+	href := GROUP_DIMMING_HREF
+	var value string
+	var property AlexaProperty
+	if name == TURN_ON || name == TURN_OFF {
+		href = GROUP_POWER_HREF
+		value = `{"value":` + strconv.FormatBool(name == TURN_ON) + `}`
+		state := "OFF"
+		if name == TURN_ON {
+			state = "ON"
+		}
+		property = newAlexaProperty(NAMESPACE_POWER, "powerState", state)
+		resource = ""
+	} else if name == SET_PERCENTAGE || name == ADJUST_PERCENTAGE {
+		percent := float64(directive.Get("payload.percentage").Int())
+		if name == ADJUST_PERCENTAGE {
+			variable := device.getVariable(GROUP_DIMMING_HREF)
+			if variable == nil {
+				return nil, errUnsupportedOperation
+			}
+			percent = variable.VariableValue.Value.Get("dimmingSetting").Float() + float64(directive.Get("payload.percentageDelta").Int())
+		}
+		percent = (ValueRange{Min: 0, Max: 100}).clamp(percent)
+		value = `{"dimmingSetting":` + formatNumber(percent) + `}`
+		property = newAlexaProperty(NAMESPACE_PERCENTAGE, "percentage", int64(percent))
+	} else {
+		return nil, errUnsupportedOperation
+	}
+	if resource != "" && resource != href {
+		return nil, errUnsupportedOperation
+	}
+
+	results, err := setGroupValue(endpoint.HubConnections, username, group, href, gjson.Parse(value))
+	if err != nil {
+		return nil, err
+	}
+	if err = getActionsError(results); err != nil {
+		log.Println("Group "+group.Name+" failed", err)
+		return nil, err
 	}
+	response.Context = &AlexaContext{Properties: []AlexaProperty{property}}
+	return response, nil
 }
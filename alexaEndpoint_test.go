@@ -0,0 +1,214 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func newTestVariable(href string, resourceType string, iface string, value string) *IotVariable {
+	return &IotVariable{
+		Interface:     iface,
+		ResourceType:  resourceType,
+		Href:          href,
+		Name:          href,
+		VariableValue: VariableValue{Value: gjson.Parse(value)},
+	}
+}
+
+func newTestLamp() *IotDevice {
+	return &IotDevice{
+		UUID:    "lamp",
+		HubUUID: "hub",
+		Name:    "Lamp",
+		Variables: []*IotVariable{
+			newTestVariable("/switch", "oic.r.switch.binary", INTERFACE_ACTUATOR, `{"value":true}`),
+			newTestVariable("/dimming", "oic.r.light.dimming", INTERFACE_ACTUATOR, `{"dimmingSetting":50}`),
+			newTestVariable("/temperature", "oic.r.temperature", INTERFACE_SENSOR, `{"temperature":70,"units":"F"}`),
+		},
+	}
+}
+
+func newTestAlexaEndpoint(t *testing.T) *AlexaEndpoint {
+	t.Setenv("DATA_DIR", t.TempDir())
+	hubs := list.New()
+	overlays := NewOverlayStore()
+	hub := &HubConnection{Username: "user", Uuid: "hub", Callbacks: make(map[int64]RequestCallback)}
+	hub.Forward = func(mid int64, name string, payload string) {}
+	hub.DeviceList.PushBack(newTestLamp())
+	hubs.PushBack(hub)
+	return &AlexaEndpoint{
+		HubConnections: hubs,
+		Events:         NewAlexaEventGateway(),
+		Scenes:         NewSceneStore(),
+		Overlays:       overlays,
+		Groups:         NewGroupStore(overlays),
+		Authorize: func(token string) (*AuthUserData, error) {
+			if token == "valid" {
+				return &AuthUserData{Active: true, Username: "user"}, nil
+			}
+			return &AuthUserData{}, nil
+		},
+	}
+}
+
+func handleTestDirective(endpoint *AlexaEndpoint, directive string) gjson.Result {
+	data, _ := json.Marshal(endpoint.handleDirective(directive))
+	return gjson.ParseBytes(data)
+}
+
+func TestAlexaDiscovery(t *testing.T) {
+	endpoint := newTestAlexaEndpoint(t)
+	response := handleTestDirective(endpoint, `{"directive":{"header":{"namespace":"Alexa.Discovery","name":"Discover",
+		"payloadVersion":"3","messageId":"1"},"payload":{"scope":{"type":"BearerToken","token":"valid"}}}}`)
+
+	if response.Get("event.header.name").String() != DISCOVER_RESPONSE || response.Get("event.header.payloadVersion").String() != "3" {
+		t.Fatalf("unexpected header %s", response.Get("event.header").Raw)
+	}
+	tests := []struct {
+		endpointID string
+		namespace  string
+		property   string
+		category   string
+	}{
+		{"hub:lamp", NAMESPACE_POWER, "powerState", DISPLAY_CATEGORY_LIGHT},
+		{"hub:lamp:_dimming", NAMESPACE_PERCENTAGE, "percentage", DISPLAY_CATEGORY_LIGHT},
+		{"hub:lamp:_temperature", NAMESPACE_TEMPERATURE_SENSOR, "temperature", DISPLAY_CATEGORY_TEMPERATURE_SENSOR},
+	}
+	endpoints := response.Get("event.payload.endpoints").Array()
+	if len(endpoints) != len(tests) {
+		t.Fatalf("expected %d endpoints, got %s", len(tests), response.Get("event.payload.endpoints").Raw)
+	}
+	for i, test := range tests {
+		discovered := endpoints[i]
+		if discovered.Get("endpointId").String() != test.endpointID {
+			t.Errorf("endpoint %d: expected %s, got %s", i, test.endpointID, discovered.Get("endpointId").String())
+		}
+		if discovered.Get("displayCategories.0").String() != test.category {
+			t.Errorf("%s: expected category %s, got %s", test.endpointID, test.category, discovered.Get("displayCategories").Raw)
+		}
+		capability := discovered.Get(`capabilities.#(interface=="` + test.namespace + `")`)
+		if capability.Get("properties.supported.0.name").String() != test.property {
+			t.Errorf("%s: missing %s.%s in %s", test.endpointID, test.namespace, test.property, discovered.Get("capabilities").Raw)
+		}
+		if capability.Get("properties.proactivelyReported").Bool() {
+			t.Errorf("%s: properties must not be proactively reported without linked events", test.endpointID)
+		}
+	}
+}
+
+func TestAlexaDirectives(t *testing.T) {
+	endpoint := newTestAlexaEndpoint(t)
+	tests := []struct {
+		name       string
+		namespace  string
+		directive  string
+		endpointID string
+		token      string
+		response   string
+		property   string
+		value      string
+		errorType  string
+	}{
+		{"power state", NAMESPACE_ALEXA, REPORT_STATE, "hub:lamp", "valid", STATE_REPORT, "powerState", `"ON"`, ""},
+		{"percentage state", NAMESPACE_ALEXA, REPORT_STATE, "hub:lamp:_dimming", "valid", STATE_REPORT, "percentage", `50`, ""},
+		{"temperature in celsius", NAMESPACE_ALEXA, REPORT_STATE, "hub:lamp:_temperature", "valid", STATE_REPORT, "temperature", `{"value":21.1,"scale":"CELSIUS"}`, ""},
+		{"invalid token", NAMESPACE_POWER, TURN_ON, "hub:lamp", "invalid", ERROR_RESPONSE, "", "", ERROR_INVALID_CREDENTIAL},
+		{"unknown hub", NAMESPACE_POWER, TURN_ON, "other:lamp", "valid", ERROR_RESPONSE, "", "", ERROR_ENDPOINT_UNREACHABLE},
+		{"unknown device", NAMESPACE_POWER, TURN_ON, "hub:other", "valid", ERROR_RESPONSE, "", "", ERROR_NO_SUCH_ENDPOINT},
+		{"sensor setpoint", NAMESPACE_THERMOSTAT, SET_TARGET_TEMPERATURE, "hub:lamp:_temperature", "valid", ERROR_RESPONSE, "", "", ERROR_INVALID_DIRECTIVE},
+		{"unknown scene", NAMESPACE_SCENE, ACTIVATE, "scene:other", "valid", ERROR_RESPONSE, "", "", ERROR_NO_SUCH_ENDPOINT},
+	}
+	for _, test := range tests {
+		response := handleTestDirective(endpoint, `{"directive":{"header":{"namespace":"`+test.namespace+`","name":"`+test.directive+
+			`","payloadVersion":"3","messageId":"1","correlationToken":"correlation"},"endpoint":{"scope":{"type":"BearerToken","token":"`+
+			test.token+`"},"endpointId":"`+test.endpointID+`"},"payload":{}}}`)
+
+		if name := response.Get("event.header.name").String(); name != test.response {
+			t.Errorf("%s: expected %s, got %s", test.name, test.response, response.Raw)
+			continue
+		}
+		if response.Get("event.header.correlationToken").String() != "correlation" {
+			t.Errorf("%s: correlation token not returned", test.name)
+		}
+		if test.errorType != "" && response.Get("event.payload.type").String() != test.errorType {
+			t.Errorf("%s: expected error %s, got %s", test.name, test.errorType, response.Get("event.payload").Raw)
+		}
+		if test.property != "" {
+			property := response.Get(`context.properties.#(name=="` + test.property + `")`)
+			if property.Get("value").Raw != test.value {
+				t.Errorf("%s: expected %s, got %s", test.name, test.value, response.Get("context").Raw)
+			}
+		}
+	}
+}
+
+func TestAlexaConnectedHomeMessages(t *testing.T) {
+	endpoint := newTestAlexaEndpoint(t)
+	tests := []struct {
+		name        string
+		namespace   string
+		request     string
+		applianceID string
+		token       string
+		payload     string
+		response    string
+	}{
+		{"turn on", NAMESPACE_CONTROL, TURN_ON_REQUEST, "hub:lamp", "valid", "", TURN_ON_CONFIRMATION},
+		{"set percentage", NAMESPACE_CONTROL, SET_PERCENTAGE_REQUEST, "hub:lamp:_dimming", "valid", `"percentageState":{"value":20}`, SET_PERCENTAGE_CONFIRMATION},
+		{"percentage out of range", NAMESPACE_CONTROL, SET_PERCENTAGE_REQUEST, "hub:lamp:_dimming", "valid", `"percentageState":{"value":150}`, VALUE_OUT_OF_RANGE_ERROR},
+		{"temperature reading", NAMESPACE_QUERY, GET_TEMPERATURE_READING_REQUEST, "hub:lamp:_temperature", "valid", "", GET_TEMPERATURE_READING_RESPONSE},
+		{"sensor setpoint", NAMESPACE_CONTROL, SET_TARGET_TEMPERATURE_REQUEST, "hub:lamp:_temperature", "valid", "", UNSUPPORTED_TARGET_SETTING_ERROR},
+		{"invalid token", NAMESPACE_CONTROL, TURN_ON_REQUEST, "hub:lamp", "invalid", "", INVALID_ACCESS_TOKEN_ERROR},
+		{"unknown hub", NAMESPACE_CONTROL, TURN_ON_REQUEST, "other:lamp", "valid", "", TARGET_OFFLINE_ERROR},
+		{"unknown device", NAMESPACE_CONTROL, TURN_ON_REQUEST, "hub:other", "valid", "", NO_SUCH_TARGET_ERROR},
+	}
+	for _, test := range tests {
+		if test.payload != "" {
+			test.payload = "," + test.payload
+		}
+		data, _ := json.Marshal(endpoint.handleConnectedHomeMessage(`{"header":{"namespace":"` + test.namespace + `","name":"` + test.request +
+			`","payloadVersion":"2","messageId":"1"},"payload":{"accessToken":"` + test.token + `","appliance":{"applianceId":"` +
+			test.applianceID + `"}` + test.payload + `}}`))
+		response := gjson.ParseBytes(data)
+		if response.Get("header.name").String() != test.response || response.Get("header.payloadVersion").String() != "2" {
+			t.Errorf("%s: expected %s, got %s", test.name, test.response, response.Raw)
+		}
+	}
+
+	data, _ := json.Marshal(endpoint.handleConnectedHomeMessage(`{"header":{"namespace":"` + NAMESPACE_CONNECTED_HOME_DISCOVERY +
+		`","name":"` + DISCOVER_APPLIANCES_REQUEST + `","payloadVersion":"2","messageId":"1"},"payload":{"accessToken":"valid"}}`))
+	appliances := gjson.GetBytes(data, "payload.discoveredAppliances.#.applianceId").Array()
+	if len(appliances) != 3 {
+		t.Errorf("expected power, dimming and temperature appliances, got %s", string(data))
+	}
+}
+
+func TestAlexaScenePartialFailure(t *testing.T) {
+	endpoint := newTestAlexaEndpoint(t)
+	endpoint.Scenes.addScene("user", &Scene{ID: "evening", Name: "Evening", Actions: []*SceneAction{
+		{HubUUID: "hub", DeviceUUID: "lamp", Resource: "/switch", Value: json.RawMessage(`{"value":true}`)},
+		{HubUUID: "offline", DeviceUUID: "lamp", Resource: "/switch", Value: json.RawMessage(`{"value":true}`)},
+	}})
+	endpoint.Scenes.addScene("user", &Scene{ID: "night", Name: "Night", Actions: []*SceneAction{
+		{HubUUID: "hub", DeviceUUID: "lamp", Resource: "/switch", Value: json.RawMessage(`{"value":false}`)},
+	}})
+
+	tests := []struct {
+		scene     string
+		response  string
+		errorType string
+	}{
+		{"night", ACTIVATION_STARTED, ""},
+		{"evening", ERROR_RESPONSE, ERROR_ENDPOINT_UNREACHABLE},
+	}
+	for _, test := range tests {
+		response := handleTestDirective(endpoint, `{"directive":{"header":{"namespace":"Alexa.SceneController","name":"Activate",
+			"payloadVersion":"3","messageId":"1"},"endpoint":{"scope":{"type":"BearerToken","token":"valid"},"endpointId":"scene:`+test.scene+`"}}}`)
+		if response.Get("event.header.name").String() != test.response || response.Get("event.payload.type").String() != test.errorType {
+			t.Errorf("%s: unexpected response %s", test.scene, response.Raw)
+		}
+	}
+}
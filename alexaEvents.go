@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	ALEXA_EVENT_GATEWAY_URL = "https://api.amazonalexa.com/v3/events"
+	ALEXA_LWA_TOKEN_URL     = "https://api.amazon.com/auth/o2/token"
+
+	ALEXA_TOKENS_STORAGE = "alexaTokens"
+
+	ADD_OR_UPDATE_REPORT = "AddOrUpdateReport"
+	DELETE_REPORT        = "DeleteReport"
+
+	ALEXA_EVENT_TIMEOUT    = 10 * time.Second
+	ALEXA_EVENT_QUEUE_SIZE = 100
+)
+
+type AlexaUserToken struct {
+	AccessToken  string    `json:"accessToken"`
+	RefreshToken string    `json:"refreshToken"`
+	Expires      time.Time `json:"expires"`
+}
+
+type AlexaEventGateway struct {
+	EventURL string
+	TokenURL string
+	Auth     *OAuthData
+
+	client  *http.Client
+	mutex   sync.Mutex
+	tokens  map[string]*AlexaUserToken
+	workers map[string]chan AlexaEvent
+}
+
+type AlexaChangeReport struct {
+	Event struct {
+		Header   AlexaHeader `json:"header"`
+		Endpoint struct {
+			Scope      AlexaScope `json:"scope"`
+			EndpointID string     `json:"endpointId"`
+		} `json:"endpoint"`
+		Payload struct {
+			Change struct {
+				Cause struct {
+					Type string `json:"type"`
+				} `json:"cause"`
+				Properties []AlexaProperty `json:"properties"`
+			} `json:"change"`
+		} `json:"payload"`
+	} `json:"event"`
+	Context struct {
+		Properties []AlexaProperty `json:"properties"`
+	} `json:"context"`
+}
+
+//AlexaEvent is event sent to Alexa event gateway with user token in its scope
+type AlexaEvent interface {
+	setScopeToken(token string)
+}
+
+func (report *AlexaChangeReport) setScopeToken(token string) {
+	report.Event.Endpoint.Scope.Token = token
+}
+
+type AlexaEndpointID struct {
+	EndpointID string `json:"endpointId"`
+}
+
+//AlexaDiscoveryReport is AddOrUpdateReport or DeleteReport informing Alexa about changed endpoints
+type AlexaDiscoveryReport struct {
+	Event struct {
+		Header  AlexaHeader `json:"header"`
+		Payload struct {
+			Endpoints interface{} `json:"endpoints"`
+			Scope     AlexaScope  `json:"scope"`
+		} `json:"payload"`
+	} `json:"event"`
+}
+
+func (report *AlexaDiscoveryReport) setScopeToken(token string) {
+	report.Event.Payload.Scope.Token = token
+}
+
+func NewAlexaEventGateway() *AlexaEventGateway {
+	gateway := &AlexaEventGateway{
+		EventURL: os.Getenv("ALEXA_EVENT_GATEWAY_URL"),
+		TokenURL: os.Getenv("ALEXA_LWA_TOKEN_URL"),
+		Auth: &OAuthData{
+			Client: os.Getenv("ALEXA_EVENT_CLIENT"),
+			Secret: os.Getenv("ALEXA_EVENT_CLIENT_SECRET"),
+		},
+		client:  &http.Client{Timeout: ALEXA_EVENT_TIMEOUT},
+		tokens:  make(map[string]*AlexaUserToken),
+		workers: make(map[string]chan AlexaEvent),
+	}
+	if gateway.EventURL == "" {
+		gateway.EventURL = ALEXA_EVENT_GATEWAY_URL
+	}
+	if gateway.TokenURL == "" {
+		gateway.TokenURL = ALEXA_LWA_TOKEN_URL
+	}
+	err := loadData(ALEXA_TOKENS_STORAGE, &gateway.tokens)
+	if err != nil {
+		log.Println(err)
+	}
+	return gateway
+}
+
+func (gateway *AlexaEventGateway) requestToken(form url.Values) (*AlexaUserToken, error) {
+	form.Set("client_id", gateway.Auth.Client)
+	form.Set("client_secret", gateway.Auth.Secret)
+
+	resp, err := gateway.client.PostForm(gateway.TokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("LWA token request failed " + strconv.Itoa(resp.StatusCode) + " " + string(bodyBytes))
+	}
+	r := gjson.ParseBytes(bodyBytes)
+	return &AlexaUserToken{
+		AccessToken:  r.Get("access_token").String(),
+		RefreshToken: r.Get("refresh_token").String(),
+		Expires:      time.Now().Add(time.Duration(r.Get("expires_in").Int()) * time.Second),
+	}, nil
+}
+
+func (gateway *AlexaEventGateway) storeToken(username string, token *AlexaUserToken) {
+	gateway.mutex.Lock()
+	gateway.tokens[username] = token
+	err := saveData(ALEXA_TOKENS_STORAGE, gateway.tokens)
+	gateway.mutex.Unlock()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//AcceptGrant exchanges authorization code received from Alexa for user tokens
+func (gateway *AlexaEventGateway) AcceptGrant(username string, code string) error {
+	token, err := gateway.requestToken(url.Values{
+		"grant_type": {"authorization_code"},
+		"code":       {code},
+	})
+	if err != nil {
+		return err
+	}
+	gateway.storeToken(username, token)
+	log.Println("Alexa events enabled for " + username)
+	return nil
+}
+
+func (gateway *AlexaEventGateway) getAccessToken(username string, forceRefresh bool) (string, error) {
+	gateway.mutex.Lock()
+	token := gateway.tokens[username]
+	gateway.mutex.Unlock()
+
+	if token == nil {
+		return "", nil
+	}
+	if !forceRefresh && time.Now().Add(time.Minute).Before(token.Expires) {
+		return token.AccessToken, nil
+	}
+	refreshed, err := gateway.requestToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {token.RefreshToken},
+	})
+	if err != nil {
+		return "", err
+	}
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = token.RefreshToken
+	}
+	gateway.storeToken(username, refreshed)
+	return refreshed.AccessToken, nil
+}
+
+func (gateway *AlexaEventGateway) postEvent(token string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", gateway.EventURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("Content-type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	resp, err := gateway.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, nil
+}
+
+func (gateway *AlexaEventGateway) sendEvent(username string, report AlexaEvent) error {
+	token, err := gateway.getAccessToken(username, false)
+	if err != nil || token == "" {
+		return err
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		report.setScopeToken(token)
+		body, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		status, err := gateway.postEvent(token, body)
+		if err != nil {
+			return err
+		}
+		if status == http.StatusAccepted || status == http.StatusOK {
+			return nil
+		}
+		if status != http.StatusUnauthorized {
+			return errors.New("Alexa event gateway responded with " + strconv.Itoa(status))
+		}
+		token, err = gateway.getAccessToken(username, true)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.New("Alexa event gateway rejected token for " + username)
+}
+
+//enqueue passes event to worker of user so events of one user reach Alexa in order, events
+//overflowing the queue are dropped
+func (gateway *AlexaEventGateway) enqueue(username string, event AlexaEvent) {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	queue := gateway.workers[username]
+	if queue == nil {
+		queue = make(chan AlexaEvent, ALEXA_EVENT_QUEUE_SIZE)
+		gateway.workers[username] = queue
+		go gateway.runWorker(username, queue)
+	}
+	select {
+	case queue <- event:
+	default:
+		log.Println("Alexa event queue of " + username + " is full, event dropped")
+	}
+}
+
+//runWorker sends queued events of user and stops once the queue is drained
+func (gateway *AlexaEventGateway) runWorker(username string, queue chan AlexaEvent) {
+	for {
+		select {
+		case event := <-queue:
+			err := gateway.sendEvent(username, event)
+			if err != nil {
+				log.Println("Unable to send Alexa event of "+username, err)
+			}
+		default:
+			gateway.mutex.Lock()
+			if len(queue) == 0 {
+				delete(gateway.workers, username)
+				gateway.mutex.Unlock()
+				return
+			}
+			gateway.mutex.Unlock()
+		}
+	}
+}
+
+//isEnabled tells if user linked Alexa account for events, only then properties are proactively reported
+func (gateway *AlexaEventGateway) isEnabled(username string) bool {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	return gateway.tokens[username] != nil
+}
+
+//ReportChange sends ChangeReport for resource if owner of the hub linked Alexa account, properties are
+//reported for endpoints announced by getAlexaEndpoints so device power goes to endpoint of the device
+func (gateway *AlexaEventGateway) ReportChange(username string, hubUUID string, device *IotDevice, href string) {
+	if device.Hidden || !gateway.isEnabled(username) {
+		return
+	}
+	device = device.filterVariables(false)
+	for _, capability := range device.getResourceCapabilities(href) {
+		properties := getAlexaProperties(capability)
+		if len(properties) == 0 {
+			continue
+		}
+		endpointID := getAlexaApplianceID(hubUUID, device.UUID, href)
+		if capability.Capability.Name == CAPABILITY_POWER {
+			if power := device.getCapability(CAPABILITY_POWER); power.Variable.Href != href {
+				continue
+			}
+			endpointID = getAlexaApplianceID(hubUUID, device.UUID, "")
+		}
+
+		report := &AlexaChangeReport{}
+		report.Event.Header.Namespace = NAMESPACE_ALEXA
+		report.Event.Header.Name = "ChangeReport"
+		report.Event.Header.PayloadVersion = ALEXA_PAYLOAD_VERSION
+		report.Event.Header.MessageID = generateMessageUUID()
+		report.Event.Endpoint.Scope.Type = ALEXA_SCOPE_BEARER_TOKEN
+		report.Event.Endpoint.EndpointID = endpointID
+		report.Event.Payload.Change.Cause.Type = ALEXA_CAUSE_PHYSICAL_INTERACTION
+		report.Event.Payload.Change.Properties = properties
+		report.Context.Properties = []AlexaProperty{}
+
+		gateway.enqueue(username, report)
+	}
+}
+
+func newAlexaDiscoveryReport(name string, endpoints interface{}) *AlexaDiscoveryReport {
+	report := &AlexaDiscoveryReport{}
+	report.Event.Header.Namespace = NAMESPACE_DISCOVERY
+	report.Event.Header.Name = name
+	report.Event.Header.PayloadVersion = ALEXA_PAYLOAD_VERSION
+	report.Event.Header.MessageID = generateMessageUUID()
+	report.Event.Payload.Endpoints = endpoints
+	report.Event.Payload.Scope.Type = ALEXA_SCOPE_BEARER_TOKEN
+	return report
+}
+
+//ReportDiscoveryChange asks Alexa to rediscover changed devices and forget removed ones, endpoints are
+//described the same way as in Discover.Response
+func (gateway *AlexaEventGateway) ReportDiscoveryChange(username string, hubUUID string, updated []*IotDevice, removed []*IotDevice) {
+	if !gateway.isEnabled(username) {
+		return
+	}
+	var endpoints []AlexaDiscoveryEndpoint
+	for _, device := range updated {
+		endpoints = append(endpoints, getAlexaEndpoints(hubUUID, device, true)...)
+	}
+	var removedEndpoints []AlexaEndpointID
+	for _, device := range removed {
+		for _, endpoint := range getAlexaEndpoints(hubUUID, device, true) {
+			removedEndpoints = append(removedEndpoints, AlexaEndpointID{EndpointID: endpoint.EndpointID})
+		}
+	}
+	var reports []*AlexaDiscoveryReport
+	if len(endpoints) > 0 {
+		reports = append(reports, newAlexaDiscoveryReport(ADD_OR_UPDATE_REPORT, endpoints))
+	}
+	if len(removedEndpoints) > 0 {
+		reports = append(reports, newAlexaDiscoveryReport(DELETE_REPORT, removedEndpoints))
+	}
+	for _, report := range reports {
+		gateway.enqueue(username, report)
+	}
+}
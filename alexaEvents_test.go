@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+type testEventGateway struct {
+	server *httptest.Server
+	events chan gjson.Result
+	tokens chan string
+}
+
+//newTestEventGateway starts event gateway rejecting expired token and LWA server issuing refreshed one
+func newTestEventGateway(t *testing.T) *testEventGateway {
+	gateway := &testEventGateway{
+		events: make(chan gjson.Result, 10),
+		tokens: make(chan string, 10),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		token := r.Header.Get("Authorization")
+		gateway.tokens <- token
+		if token != "Bearer fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		gateway.events <- gjson.ParseBytes(body)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") == "refresh_token" && r.Form.Get("refresh_token") != "refresh" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token":"fresh","refresh_token":"refresh","expires_in":3600}`))
+	})
+	gateway.server = httptest.NewServer(mux)
+	t.Cleanup(gateway.server.Close)
+
+	t.Setenv("DATA_DIR", t.TempDir())
+	t.Setenv("ALEXA_EVENT_GATEWAY_URL", gateway.server.URL+"/events")
+	t.Setenv("ALEXA_LWA_TOKEN_URL", gateway.server.URL+"/token")
+	return gateway
+}
+
+func (gateway *testEventGateway) nextEvent(t *testing.T) gjson.Result {
+	select {
+	case event := <-gateway.events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+	return gjson.Result{}
+}
+
+func TestAlexaEventsRequireLinkedAccount(t *testing.T) {
+	server := newTestEventGateway(t)
+	gateway := NewAlexaEventGateway()
+
+	gateway.ReportChange("user", "hub", newTestLamp(), "/dimming")
+	gateway.ReportDiscoveryChange("user", "hub", []*IotDevice{newTestLamp()}, nil)
+	select {
+	case token := <-server.tokens:
+		t.Fatal("event sent without linked account with token " + token)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAlexaChangeReport(t *testing.T) {
+	server := newTestEventGateway(t)
+	gateway := NewAlexaEventGateway()
+	if err := gateway.AcceptGrant("user", "code"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		href       string
+		endpointID string
+		namespace  string
+		property   string
+		value      string
+	}{
+		{"/switch", "hub:lamp", NAMESPACE_POWER, "powerState", `"ON"`},
+		{"/dimming", "hub:lamp:_dimming", NAMESPACE_PERCENTAGE, "percentage", `50`},
+		{"/temperature", "hub:lamp:_temperature", NAMESPACE_TEMPERATURE_SENSOR, "temperature", `{"value":21.1,"scale":"CELSIUS"}`},
+	}
+	for _, test := range tests {
+		gateway.ReportChange("user", "hub", newTestLamp(), test.href)
+		event := server.nextEvent(t)
+		if event.Get("event.header.name").String() != "ChangeReport" || event.Get("event.header.payloadVersion").String() != "3" {
+			t.Errorf("%s: unexpected header %s", test.href, event.Get("event.header").Raw)
+		}
+		if event.Get("event.endpoint.endpointId").String() != test.endpointID {
+			t.Errorf("%s: expected endpoint %s, got %s", test.href, test.endpointID, event.Get("event.endpoint.endpointId").String())
+		}
+		if event.Get("event.endpoint.scope.token").String() != "fresh" {
+			t.Errorf("%s: scope token not set", test.href)
+		}
+		property := event.Get("event.payload.change.properties.0")
+		if property.Get("namespace").String() != test.namespace || property.Get("name").String() != test.property || property.Get("value").Raw != test.value {
+			t.Errorf("%s: unexpected property %s", test.href, property.Raw)
+		}
+	}
+}
+
+func TestAlexaEventTokenRefresh(t *testing.T) {
+	server := newTestEventGateway(t)
+	gateway := NewAlexaEventGateway()
+	gateway.storeToken("user", &AlexaUserToken{AccessToken: "revoked", RefreshToken: "refresh", Expires: time.Now().Add(time.Hour)})
+
+	gateway.ReportChange("user", "hub", newTestLamp(), "/switch")
+	server.nextEvent(t)
+	if first, second := <-server.tokens, <-server.tokens; first != "Bearer revoked" || second != "Bearer fresh" {
+		t.Errorf("expected retry with refreshed token, got %s and %s", first, second)
+	}
+}
+
+func TestAlexaDiscoveryReport(t *testing.T) {
+	server := newTestEventGateway(t)
+	gateway := NewAlexaEventGateway()
+	if err := gateway.AcceptGrant("user", "code"); err != nil {
+		t.Fatal(err)
+	}
+
+	hidden := newTestLamp()
+	hidden.Variables[1].Hidden = true
+	gateway.ReportDiscoveryChange("user", "hub", []*IotDevice{hidden}, nil)
+	event := server.nextEvent(t)
+	if event.Get("event.header.namespace").String() != NAMESPACE_DISCOVERY || event.Get("event.header.name").String() != ADD_OR_UPDATE_REPORT {
+		t.Fatalf("unexpected header %s", event.Get("event.header").Raw)
+	}
+	if event.Get("event.payload.scope.token").String() != "fresh" {
+		t.Error("scope token not set")
+	}
+	endpoints := event.Get("event.payload.endpoints.#.endpointId").Array()
+	if len(endpoints) != 2 || endpoints[0].String() != "hub:lamp" || endpoints[1].String() != "hub:lamp:_temperature" {
+		t.Errorf("hidden resource reported %s", event.Get("event.payload.endpoints").Raw)
+	}
+	power := event.Get(`event.payload.endpoints.0.capabilities.#(interface=="` + NAMESPACE_POWER + `")`)
+	if !power.Get("properties.proactivelyReported").Bool() || !power.Get("properties.retrievable").Bool() {
+		t.Errorf("reported endpoint must declare proactively reported properties %s", power.Raw)
+	}
+
+	gateway.ReportDiscoveryChange("user", "hub", nil, []*IotDevice{newTestLamp()})
+	event = server.nextEvent(t)
+	if event.Get("event.header.name").String() != DELETE_REPORT || len(event.Get("event.payload.endpoints").Array()) != 3 {
+		t.Errorf("unexpected delete report %s", event.Raw)
+	}
+}
+
+func TestAlexaEventsKeepOrder(t *testing.T) {
+	server := newTestEventGateway(t)
+	gateway := NewAlexaEventGateway()
+	if err := gateway.AcceptGrant("user", "code"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		href       string
+		endpointID string
+	}{
+		{"/switch", "hub:lamp"},
+		{"/dimming", "hub:lamp:_dimming"},
+		{"/temperature", "hub:lamp:_temperature"},
+		{"/dimming", "hub:lamp:_dimming"},
+		{"/switch", "hub:lamp"},
+	}
+	for _, test := range tests {
+		gateway.ReportChange("user", "hub", newTestLamp(), test.href)
+	}
+	for i, test := range tests {
+		endpointID := server.nextEvent(t).Get("event.endpoint.endpointId").String()
+		<-server.tokens
+		if endpointID != test.endpointID {
+			t.Errorf("event %d: expected %s, got %s", i, test.endpointID, endpointID)
+		}
+	}
+}
+
+func TestAlexaEventGatewayTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+	defer close(unblock)
+	t.Setenv("DATA_DIR", t.TempDir())
+	t.Setenv("ALEXA_EVENT_GATEWAY_URL", server.URL)
+	gateway := NewAlexaEventGateway()
+	gateway.client.Timeout = 100 * time.Millisecond
+
+	if _, err := gateway.postEvent("token", []byte(`{}`)); err == nil {
+		t.Error("stalled event gateway must time out")
+	}
+}
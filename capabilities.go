@@ -0,0 +1,268 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	CAPABILITY_POWER       = "power"
+	CAPABILITY_PERCENTAGE  = "percentage"
+	CAPABILITY_COLOR       = "color"
+	CAPABILITY_COLOR_TEMP  = "colorTemperature"
+	CAPABILITY_TEMPERATURE = "temperature"
+
+	VALUE_TYPE_BOOL   = "bool"
+	VALUE_TYPE_NUMBER = "number"
+	VALUE_TYPE_ARRAY  = "array"
+	VALUE_TYPE_HSV    = "hsv"
+)
+
+type ValueRange struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+func (r ValueRange) clamp(value float64) float64 {
+	return math.Max(r.Min, math.Min(r.Max, value))
+}
+
+func (r ValueRange) contains(value float64) bool {
+	return value >= r.Min && value <= r.Max
+}
+
+type ValueOutOfRangeError struct {
+	Range    ValueRange
+	Property string
+}
+
+func (e *ValueOutOfRangeError) Error() string {
+	if e.Property != "" {
+		return "value of " + e.Property + " out of range " + formatNumber(e.Range.Min) + "-" + formatNumber(e.Range.Max)
+	}
+	return "value out of range " + formatNumber(e.Range.Min) + "-" + formatNumber(e.Range.Max)
+}
+
+//Capability describes how an abstract capability is stored in an OCF resource type
+type Capability struct {
+	Name         string
+	ResourceType string
+	Property     string
+	ValueType    string
+	DefaultRange ValueRange
+}
+
+//ResourceCapability binds a capability to a concrete resource of a device
+type ResourceCapability struct {
+	Capability *Capability
+	Device     *IotDevice
+	Variable   *IotVariable
+}
+
+var capabilities = make(map[string][]*Capability)
+
+func registerCapability(capability *Capability) {
+	capabilities[capability.ResourceType] = append(capabilities[capability.ResourceType], capability)
+}
+
+func init() {
+	registerCapability(&Capability{
+		Name:         CAPABILITY_POWER,
+		ResourceType: "oic.r.switch.binary",
+		Property:     "value",
+		ValueType:    VALUE_TYPE_BOOL,
+	})
+	registerCapability(&Capability{
+		Name:         CAPABILITY_PERCENTAGE,
+		ResourceType: "oic.r.light.dimming",
+		Property:     "dimmingSetting",
+		ValueType:    VALUE_TYPE_NUMBER,
+		DefaultRange: ValueRange{Min: 0, Max: 100},
+	})
+	registerCapability(&Capability{
+		Name:         CAPABILITY_COLOR,
+		ResourceType: "oic.r.colour.rgb",
+		Property:     "rgbValue",
+		ValueType:    VALUE_TYPE_ARRAY,
+		DefaultRange: ValueRange{Min: 0, Max: 255},
+	})
+	registerCapability(&Capability{
+		Name:         CAPABILITY_COLOR,
+		ResourceType: "oic.r.colour.chroma",
+		Property:     "hue",
+		ValueType:    VALUE_TYPE_HSV,
+		DefaultRange: ValueRange{Min: 0, Max: 360},
+	})
+	registerCapability(&Capability{
+		Name:         CAPABILITY_COLOR_TEMP,
+		ResourceType: "oic.r.colour.chroma",
+		Property:     "ct",
+		ValueType:    VALUE_TYPE_NUMBER,
+		DefaultRange: ValueRange{Min: MIN_MIRED, Max: MAX_MIRED},
+	})
+	registerCapability(&Capability{
+		Name:         CAPABILITY_TEMPERATURE,
+		ResourceType: "oic.r.temperature",
+		Property:     "temperature",
+		ValueType:    VALUE_TYPE_NUMBER,
+		DefaultRange: ValueRange{Min: -40, Max: 125},
+	})
+}
+
+func getCapabilities(resourceType string) []*Capability {
+	return capabilities[resourceType]
+}
+
+func (device *IotDevice) getCapabilities() []*ResourceCapability {
+	var result []*ResourceCapability
+	for _, variable := range device.Variables {
+		result = append(result, device.getResourceCapabilities(variable.Href)...)
+	}
+	return result
+}
+
+//getCapability returns first resource of device providing given capability
+func (device *IotDevice) getCapability(name string) *ResourceCapability {
+	for _, capability := range device.getCapabilities() {
+		if capability.Capability.Name == name {
+			return capability
+		}
+	}
+	return nil
+}
+
+func (device *IotDevice) getResourceCapabilities(href string) []*ResourceCapability {
+	variable := device.getVariable(href)
+	if variable == nil {
+		return nil
+	}
+	var result []*ResourceCapability
+	for _, capability := range getCapabilities(variable.ResourceType) {
+		result = append(result, &ResourceCapability{
+			Capability: capability,
+			Device:     device,
+			Variable:   variable,
+		})
+	}
+	return result
+}
+
+func (device *IotDevice) getResourceCapability(href string, name string) *ResourceCapability {
+	for _, capability := range device.getResourceCapabilities(href) {
+		if capability.Capability.Name == name {
+			return capability
+		}
+	}
+	return nil
+}
+
+func parseRange(value gjson.Result) (ValueRange, bool) {
+	var bounds []string
+	if value.IsArray() {
+		for _, bound := range value.Array() {
+			bounds = append(bounds, bound.String())
+		}
+	} else {
+		bounds = strings.Split(value.String(), ",")
+	}
+	if len(bounds) != 2 {
+		return ValueRange{}, false
+	}
+	min, err := strconv.ParseFloat(strings.TrimSpace(bounds[0]), 64)
+	if err != nil {
+		return ValueRange{}, false
+	}
+	max, err := strconv.ParseFloat(strings.TrimSpace(bounds[1]), 64)
+	if err != nil || max < min {
+		return ValueRange{}, false
+	}
+	return ValueRange{Min: min, Max: max}, true
+}
+
+//Range returns value range advertised by resource or capability default, resource range applies
+//only to properties which schema allows it for so chroma hue and ct keep their own ranges
+func (c *ResourceCapability) Range() ValueRange {
+	value := c.Value()
+	if schema, _ := getPropertySchema(c.Variable, c.Capability.Property); schema != nil && !schema.allowsResourceRange() {
+		return c.Capability.DefaultRange
+	}
+	if value.Get("range").Exists() {
+		r, ok := parseRange(value.Get("range"))
+		if ok {
+			return r
+		}
+		log.Println("Invalid range " + value.Get("range").String() + " for " + c.Device.UUID + c.Variable.Href)
+	}
+	return c.Capability.DefaultRange
+}
+
+func (c *ResourceCapability) Value() gjson.Result {
+	return c.Variable.VariableValue.Value
+}
+
+func (c *ResourceCapability) GetBool() bool {
+	return c.Value().Get(c.Capability.Property).Bool()
+}
+
+func (c *ResourceCapability) GetNumber() float64 {
+	return c.Value().Get(c.Capability.Property).Float()
+}
+
+func (c *ResourceCapability) GetPercent() int64 {
+	r := c.Range()
+	if r.Max == r.Min {
+		return 0
+	}
+	return int64(math.Round((c.GetNumber() - r.Min) * 100 / (r.Max - r.Min)))
+}
+
+func (c *ResourceCapability) set(conn *HubConnection, value string) error {
+	err := setDeviceValueSync(conn, c.Device.UUID, c.Variable.Href, `{"`+c.Capability.Property+`":`+value+`}`)
+	if hubErr, ok := err.(*HubRequestError); ok && hubErr.Code == HUB_ERROR_OUT_OF_RANGE {
+		return &ValueOutOfRangeError{Range: c.Range()}
+	}
+	return err
+}
+
+func (c *ResourceCapability) SetBool(conn *HubConnection, value bool) error {
+	return c.set(conn, strconv.FormatBool(value))
+}
+
+func formatNumber(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+//SetNumber writes value clamped to resource range
+func (c *ResourceCapability) SetNumber(conn *HubConnection, value float64) error {
+	return c.set(conn, formatNumber(c.Range().clamp(value)))
+}
+
+func (c *ResourceCapability) SetArray(conn *HubConnection, values []float64) error {
+	r := c.Range()
+	var items []string
+	for _, value := range values {
+		items = append(items, formatNumber(r.clamp(value)))
+	}
+	return c.set(conn, "["+strings.Join(items, ",")+"]")
+}
+
+func (c *ResourceCapability) percentToValue(percent int64) float64 {
+	r := c.Range()
+	return math.Round(r.Min + float64(percent)*(r.Max-r.Min)/100)
+}
+
+func (c *ResourceCapability) SetPercent(conn *HubConnection, percent int64) error {
+	return c.SetNumber(conn, c.percentToValue(percent))
+}
+
+func (c *ResourceCapability) ChangePercent(conn *HubConnection, delta int64) error {
+	r := c.Range()
+	diff := math.Round(float64(delta) * (r.Max - r.Min) / 100)
+	prevValue := c.GetNumber()
+	log.Println("ChangePercent oldValue:", prevValue, "newValue: ", prevValue+diff, " diff:", diff)
+	return c.SetNumber(conn, prevValue+diff)
+}
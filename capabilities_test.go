@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		valid bool
+		min   float64
+		max   float64
+	}{
+		{"array", `[0,10]`, true, 0, 10},
+		{"string", `"5, 20"`, true, 5, 20},
+		{"fractions", `[0.5,1.5]`, true, 0.5, 1.5},
+		{"reversed", `[10,0]`, false, 0, 0},
+		{"single bound", `[1]`, false, 0, 0},
+		{"not numbers", `"a,b"`, false, 0, 0},
+	}
+	for _, test := range tests {
+		r, ok := parseRange(gjson.Parse(test.value))
+		if ok != test.valid || r.Min != test.min || r.Max != test.max {
+			t.Errorf("%s: unexpected range %v %v", test.name, r, ok)
+		}
+	}
+}
+
+func TestCapabilityRange(t *testing.T) {
+	tests := []struct {
+		name         string
+		resourceType string
+		value        string
+		capability   string
+		expected     ValueRange
+	}{
+		{"dimming default", "oic.r.light.dimming", `{"dimmingSetting":5}`, CAPABILITY_PERCENTAGE, ValueRange{Min: 0, Max: 100}},
+		{"dimming advertised", "oic.r.light.dimming", `{"dimmingSetting":5,"range":[0,255]}`, CAPABILITY_PERCENTAGE, ValueRange{Min: 0, Max: 255}},
+		{"dimming malformed", "oic.r.light.dimming", `{"dimmingSetting":5,"range":[255,0]}`, CAPABILITY_PERCENTAGE, ValueRange{Min: 0, Max: 100}},
+		{"rgb advertised", "oic.r.colour.rgb", `{"rgbValue":[0,0,0],"range":[0,100]}`, CAPABILITY_COLOR, ValueRange{Min: 0, Max: 100}},
+		{"chroma hue", "oic.r.colour.chroma", `{"hue":5,"ct":300,"range":[0,10]}`, CAPABILITY_COLOR, ValueRange{Min: 0, Max: 360}},
+		{"chroma ct", "oic.r.colour.chroma", `{"hue":5,"ct":300,"range":[0,10]}`, CAPABILITY_COLOR_TEMP, ValueRange{Min: MIN_MIRED, Max: MAX_MIRED}},
+	}
+	for _, test := range tests {
+		device := &IotDevice{UUID: "lamp", Variables: []*IotVariable{newTestVariable("/light", test.resourceType, INTERFACE_ACTUATOR, test.value)}}
+		capability := device.getResourceCapability("/light", test.capability)
+		if capability == nil {
+			t.Errorf("%s: capability not found", test.name)
+			continue
+		}
+		if r := capability.Range(); r != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, r)
+		}
+	}
+}
+
+func TestPercentMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		percent int64
+		setting float64
+	}{
+		{"default range", `{"dimmingSetting":40}`, 40, 40},
+		{"byte range", `{"dimmingSetting":128,"range":[0,255]}`, 50, 128},
+		{"offset range", `{"dimmingSetting":60,"range":[20,100]}`, 50, 60},
+		{"empty range", `{"dimmingSetting":10,"range":[10,10]}`, 0, 10},
+	}
+	for _, test := range tests {
+		device := &IotDevice{UUID: "lamp", Variables: []*IotVariable{newTestVariable("/dimming", "oic.r.light.dimming", INTERFACE_ACTUATOR, test.value)}}
+		capability := device.getResourceCapability("/dimming", CAPABILITY_PERCENTAGE)
+		if percent := capability.GetPercent(); percent != test.percent {
+			t.Errorf("%s: expected %d%%, got %d%%", test.name, test.percent, percent)
+		}
+		if setting := capability.percentToValue(test.percent); setting != test.setting {
+			t.Errorf("%s: expected setting %v, got %v", test.name, test.setting, setting)
+		}
+	}
+}
+
+func TestCapabilityGetSet(t *testing.T) {
+	tests := []struct {
+		name         string
+		resourceType string
+		value        string
+		capability   string
+		get          func(c *ResourceCapability) interface{}
+		current      interface{}
+		set          func(conn *HubConnection, c *ResourceCapability) error
+		written      string
+	}{
+		{"switch", "oic.r.switch.binary", `{"value":true}`, CAPABILITY_POWER,
+			func(c *ResourceCapability) interface{} { return c.GetBool() }, true,
+			func(conn *HubConnection, c *ResourceCapability) error { return c.SetBool(conn, false) }, `{"value":false}`},
+		{"dimming", "oic.r.light.dimming", `{"dimmingSetting":51,"range":[0,255]}`, CAPABILITY_PERCENTAGE,
+			func(c *ResourceCapability) interface{} { return c.GetPercent() }, int64(20),
+			func(conn *HubConnection, c *ResourceCapability) error { return c.SetPercent(conn, 50) }, `{"dimmingSetting":128}`},
+		{"dimming clamped", "oic.r.light.dimming", `{"dimmingSetting":90}`, CAPABILITY_PERCENTAGE,
+			func(c *ResourceCapability) interface{} { return c.GetPercent() }, int64(90),
+			func(conn *HubConnection, c *ResourceCapability) error { return c.ChangePercent(conn, 30) }, `{"dimmingSetting":100}`},
+		{"rgb", "oic.r.colour.rgb", `{"rgbValue":[0,255,0]}`, CAPABILITY_COLOR,
+			func(c *ResourceCapability) interface{} { return c.GetColor().Hue }, float64(120),
+			func(conn *HubConnection, c *ResourceCapability) error {
+				return c.SetColor(conn, HSBColor{Hue: 0, Saturation: 1, Brightness: 1})
+			}, `{"rgbValue":[255,0,0]}`},
+		{"chroma hue", "oic.r.colour.chroma", `{"hue":200,"saturation":50,"range":[0,10]}`, CAPABILITY_COLOR,
+			func(c *ResourceCapability) interface{} { return c.GetColor().Hue }, float64(200),
+			func(conn *HubConnection, c *ResourceCapability) error {
+				return c.SetColor(conn, HSBColor{Hue: 300, Saturation: 0.5, Brightness: 1})
+			}, `{"hue":300,"saturation":50}`},
+		{"chroma ct", "oic.r.colour.chroma", `{"ct":250,"range":[0,10]}`, CAPABILITY_COLOR_TEMP,
+			func(c *ResourceCapability) interface{} { return c.GetColorTemperature() }, int64(4000),
+			func(conn *HubConnection, c *ResourceCapability) error {
+				_, err := c.SetColorTemperature(conn, 2700)
+				return err
+			}, `{"ct":370}`},
+		{"temperature", "oic.r.temperature", `{"temperature":70,"units":"F"}`, CAPABILITY_TEMPERATURE,
+			func(c *ResourceCapability) interface{} { return c.GetNumber() }, float64(70),
+			func(conn *HubConnection, c *ResourceCapability) error { return c.SetNumber(conn, 72) }, `{"temperature":72}`},
+	}
+	for _, test := range tests {
+		conn, connection := newTestHubConnection()
+		device := &IotDevice{UUID: "light", Variables: []*IotVariable{newTestVariable("/light", test.resourceType, INTERFACE_ACTUATOR, test.value)}}
+		capability := device.getResourceCapability("/light", test.capability)
+		if current := test.get(capability); current != test.current {
+			t.Errorf("%s: expected %v, got %v", test.name, test.current, current)
+		}
+		if err := test.set(conn, capability); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if frame := connection.nextFrame(t); frame.Get("payload.value").Raw != test.written {
+			t.Errorf("%s: expected %s, got %s", test.name, test.written, frame.Get("payload.value").Raw)
+		}
+		conn.Queue.Close()
+	}
+}
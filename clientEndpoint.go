@@ -2,7 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 
 	"container/list"
 
@@ -14,28 +18,54 @@ type ClientConnectionServer struct {
 	WebSocketServer      websocket.Server
 	HubConnections       *list.List
 	WebClientConnections *list.List
+	Scenes               *SceneStore
+	Rules                *RuleEngine
+	Scheduler            *Scheduler
+	History              *HistoryStore
+	Webhooks             *WebhookDispatcher
+	DeviceVersions       *DeviceVersions
+	Overlays             *OverlayStore
+	Groups               *GroupStore
+	VirtualHub           *VirtualHub
+	AlexaEvents          *AlexaEventGateway
+
+	//clientsMutex guards WebClientConnections, it is taken before mutex of any web client
+	clientsMutex sync.Mutex
 }
 
+var errNotAuthorized = errors.New("connection not authorized")
+
+const (
+	//CLIENT_CAPABILITY_RESOURCE_UPDATES replaces full EventDeviceUpdate with EventResourceUpdate deltas
+	CLIENT_CAPABILITY_RESOURCE_UPDATES = "resourceUpdates"
+	//CLIENT_CAPABILITY_DEVICE_LIST_DELTAS replaces full EventDeviceListUpdate with versioned device list deltas
+	CLIENT_CAPABILITY_DEVICE_LIST_DELTAS = "deviceListDeltas"
+)
+
+var supportedClientCapabilities = []string{CLIENT_CAPABILITY_RESOURCE_UPDATES, CLIENT_CAPABILITY_DEVICE_LIST_DELTAS}
+
 type ResponseIotHubDevices struct {
 	Uuid    string       `json:"uuid"`
 	Name    string       `json:"name"`
 	Devices []*IotDevice `json:"devices"`
 }
 
-type WebClientSubscription struct {
-	Uuid    string `json:"uuid"`
-	HubUuid string `json:"uuid"`
-}
-
 type WebClientConnection struct {
 	Username      string
 	Connection    websocket.Connection
 	Subscriptions *list.List
+	Capabilities  map[string]bool
+	SessionToken  string
+	Sequence      int64
+	Detached      time.Time
+	Queue         *OutboundQueue
+
+	buffer []*BufferedEvent
+	mutex  sync.Mutex
 }
 
 func (server *ClientConnectionServer) getHubConnection(hubUUID string) *HubConnection {
-	for e := server.HubConnections.Front(); e != nil; e = e.Next() {
-		con := e.Value.(*HubConnection)
+	for _, con := range getHubConnections(server.HubConnections) {
 		if con.Uuid == hubUUID {
 			return con
 		}
@@ -43,34 +73,175 @@ func (server *ClientConnectionServer) getHubConnection(hubUUID string) *HubConne
 	return nil
 }
 
-func (server *ClientConnectionServer) notifyDeviceListChange() {
-	for e := server.WebClientConnections.Front(); e != nil; e = e.Next() {
-		con := e.Value.(*WebClientConnection)
-		devicesList := createDeviceList(con, server.HubConnections)
-		devs, _ := json.Marshal(devicesList)
-		sendResponse(con.Connection, -1, "EventDeviceListUpdate", `{"hubs":`+string(devs)+`}`)
+//sendDeviceListEvent sends device list delta to web clients of the user, clients which did not
+//negotiate deltas get the whole device list in EventDeviceListUpdate
+func (server *ClientConnectionServer) sendDeviceListEvent(username string, name string, payload string) {
+	var deviceList string
+	for _, con := range server.getWebClients() {
+		if con.Username == "" || con.Username != username {
+			continue
+		}
+		if con.hasCapability(CLIENT_CAPABILITY_DEVICE_LIST_DELTAS) {
+			con.sendEvent(name, payload)
+			continue
+		}
+		if deviceList == "" {
+			devs, _ := json.Marshal(createDeviceList(username, server.HubConnections, server.Overlays, server.Groups))
+			deviceList = `{"hubs":` + string(devs) + `}`
+		}
+		//newer list makes the previous one obsolete
+		con.sendSequencedEvent("EventDeviceListUpdate", "deviceList", func(sequence int64) string {
+			return deviceList
+		})
 	}
 }
-func (server *ClientConnectionServer) notifyDeviceResourceChange(hubUUID string, uuid string) {
+
+func (server *ClientConnectionServer) notifyDevicesAdded(hub *HubConnection, devices []*IotDevice) {
+	if hub.Username == "" || len(devices) == 0 {
+		return
+	}
+	version := server.DeviceVersions.record(hub.Username, DEVICE_CHANGE_ADDED, hub.Uuid, hub.getName(), devices)
+	hubName, _ := json.Marshal(hub.getName())
+	devs, _ := json.Marshal(server.Overlays.applyAll(hub.Username, hub.Uuid, devices))
+	server.sendDeviceListEvent(hub.Username, "EventDevicesAdded", `{"version":`+strconv.FormatInt(version, 10)+
+		`,"hubUuid":"`+hub.Uuid+`","hubName":`+string(hubName)+`,"devices":`+string(devs)+`}`)
+}
+
+func (server *ClientConnectionServer) notifyDevicesRemoved(hub *HubConnection, devices []*IotDevice) {
+	if hub.Username == "" || len(devices) == 0 {
+		return
+	}
+	version := server.DeviceVersions.record(hub.Username, DEVICE_CHANGE_REMOVED, hub.Uuid, hub.getName(), devices)
+	var uuids []string
+	for _, device := range devices {
+		uuids = append(uuids, device.UUID)
+	}
+	uuidsData, _ := json.Marshal(uuids)
+	server.sendDeviceListEvent(hub.Username, "EventDevicesRemoved", `{"version":`+strconv.FormatInt(version, 10)+
+		`,"hubUuid":"`+hub.Uuid+`","uuids":`+string(uuidsData)+`}`)
+}
+
+func (server *ClientConnectionServer) notifyDeviceChanged(hub *HubConnection, device *IotDevice) {
+	if hub.Username == "" {
+		return
+	}
+	version := server.DeviceVersions.record(hub.Username, DEVICE_CHANGE_CHANGED, hub.Uuid, hub.getName(), []*IotDevice{device})
+	deviceData, _ := json.Marshal(server.Overlays.apply(hub.Username, hub.Uuid, device))
+	server.sendDeviceListEvent(hub.Username, "EventDeviceChanged", `{"version":`+strconv.FormatInt(version, 10)+
+		`,"hubUuid":"`+hub.Uuid+`","device":`+string(deviceData)+`}`)
+}
+
+func (server *ClientConnectionServer) notifyDeviceResourceChange(hubUUID string, uuid string, href string, value gjson.Result) {
 	log.Println("notifyDeviceResourceChange" + uuid)
-	for e := server.WebClientConnections.Front(); e != nil; e = e.Next() {
-		con := e.Value.(*WebClientConnection)
-		log.Println("web client connection sub count=", con.Subscriptions.Len())
-		for e := con.Subscriptions.Front(); e != nil; e = e.Next() {
-			s := e.Value.(*WebClientSubscription)
-			if s.Uuid == uuid && s.HubUuid == hubUUID {
-				server.sendDeviceUpdateEvent(con, uuid, hubUUID)
+	hub := server.getHubConnection(hubUUID)
+	if hub == nil || hub.Username == "" {
+		return
+	}
+	device := hub.getDevice(uuid)
+	if device == nil {
+		return
+	}
+	variable := device.getVariable(href)
+	if variable == nil {
+		return
+	}
+	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+	for _, con := range server.getWebClients() {
+		//single event per connection even if several subscriptions match
+		if con.Username != hub.Username || !con.isSubscribed(hubUUID, device, variable) {
+			continue
+		}
+		if con.hasCapability(CLIENT_CAPABILITY_RESOURCE_UPDATES) {
+			server.sendResourceUpdateEvent(con, hubUUID, uuid, href, value, timestamp)
+		} else {
+			server.sendDeviceUpdateEvent(con, uuid, hubUUID)
+		}
+	}
+	server.notifyGroupsChanged(hub.Username, hubUUID, uuid, href)
+	server.VirtualHub.OnValueUpdate(hub.Username, hubUUID, uuid, href)
+}
+
+//notifyGroupsChanged sends aggregated state of groups containing changed resource to subscribed clients and Alexa
+func (server *ClientConnectionServer) notifyGroupsChanged(username string, hubUUID string, uuid string, href string) {
+	for _, group := range server.Groups.getGroupsWithMember(username, hubUUID, uuid, href) {
+		device := createGroupDevice(server.HubConnections, username, group)
+		for _, variable := range device.Variables {
+			server.AlexaEvents.ReportChange(username, GROUP_HUB_UUID, device, variable.Href)
+		}
+		for _, con := range server.getWebClients() {
+			if con.Username != username {
+				continue
+			}
+			for _, variable := range device.Variables {
+				if con.isSubscribed(GROUP_HUB_UUID, device, variable) {
+					server.sendGroupUpdateEvent(con, device)
+					break
+				}
+			}
+		}
+	}
+}
+
+func (server *ClientConnectionServer) sendGroupUpdateEvent(conn *WebClientConnection, device *IotDevice) {
+	deviceData, _ := json.Marshal(device)
+	conn.sendSequencedEvent("EventDeviceUpdate", GROUP_HUB_UUID+"/"+device.UUID, func(sequence int64) string {
+		return string(deviceData)
+	})
+}
+
+//negotiateCapabilities enables capabilities requested by client which gateway supports, map is
+//built before it is published as hub goroutines read it once connection has user
+func negotiateCapabilities(conn *WebClientConnection, requested []gjson.Result) []string {
+	capabilities := make(map[string]bool)
+	accepted := []string{}
+	for _, capability := range requested {
+		for _, supported := range supportedClientCapabilities {
+			if capability.String() == supported && !capabilities[supported] {
+				capabilities[supported] = true
+				accepted = append(accepted, supported)
 			}
 		}
+	}
+	conn.mutex.Lock()
+	conn.Capabilities = capabilities
+	conn.mutex.Unlock()
+	return accepted
+}
+
+func (conn *WebClientConnection) hasCapability(capability string) bool {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.Capabilities[capability]
+}
 
+func (conn *WebClientConnection) getCapabilityList() []string {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	capabilities := []string{}
+	for _, capability := range supportedClientCapabilities {
+		if conn.Capabilities[capability] {
+			capabilities = append(capabilities, capability)
+		}
 	}
+	return capabilities
 }
 
 //New client connection server
-func NewClientEndpoint(hubConnections *list.List, webClientConnections *list.List) *ClientConnectionServer {
+func NewClientEndpoint(hubConnections *list.List, webClientConnections *list.List, scenes *SceneStore, rules *RuleEngine, scheduler *Scheduler, history *HistoryStore, webhooks *WebhookDispatcher, overlays *OverlayStore, groups *GroupStore, virtualHub *VirtualHub, alexaEvents *AlexaEventGateway) *ClientConnectionServer {
 	server := ClientConnectionServer{}
 	server.HubConnections = hubConnections
 	server.WebClientConnections = webClientConnections
+	server.Scenes = scenes
+	server.Rules = rules
+	server.Scheduler = scheduler
+	server.History = history
+	server.Webhooks = webhooks
+	server.Overlays = overlays
+	server.Groups = groups
+	server.VirtualHub = virtualHub
+	server.AlexaEvents = alexaEvents
+	server.DeviceVersions = NewDeviceVersions()
+	go server.expireSessions()
 
 	server.WebSocketServer = websocket.New(websocket.Config{
 		Endpoint:       "/connectClient",
@@ -87,9 +258,10 @@ func (server *ClientConnectionServer) onClientConnect(c websocket.Connection, hu
 	newConnection := &WebClientConnection{
 		Connection:    c,
 		Subscriptions: list.New(),
+		Queue:         NewOutboundQueue(c),
 	}
 
-	server.WebClientConnections.PushBack(newConnection)
+	server.addWebClient(newConnection)
 
 	c.OnMessage(func(messageBytes []byte) {
 		message := string(messageBytes)
@@ -110,37 +282,109 @@ func (server *ClientConnectionServer) onClientConnect(c websocket.Connection, hu
 			}
 			if userInfo.Username == "" {
 				log.Println("Connection not authorized")
+				//written directly as the queue is discarded on disconnect
 				sendResponse(newConnection.Connection, mid, "ResponseAuthorize", `{"status":"error"}`)
 				c.Disconnect()
 				return
 			}
 			log.Println("New connection authorized for " + userInfo.Username)
 
+			//capabilities are in place before user is set so events are never sent with half built ones
+			sessionToken := messageJson.Get("payload.sessionToken").String()
+			lastSequence := messageJson.Get("payload.lastSeq").Int()
+			if sessionToken != "" {
+				resumed, complete := server.resumeSession(newConnection, userInfo.Username, sessionToken, lastSequence)
+				if resumed {
+					log.Println("Web client session resumed for " + userInfo.Username)
+					newConnection.Username = userInfo.Username
+					capabilities, _ := json.Marshal(newConnection.getCapabilityList())
+					newConnection.completeResume(mid, `{"status":"ok","sessionToken":"`+newConnection.SessionToken+`","resumed":true,"replayComplete":`+
+						strconv.FormatBool(complete)+`,"capabilities":`+string(capabilities)+`}`, lastSequence)
+					return
+				}
+			}
+			capabilities, _ := json.Marshal(negotiateCapabilities(newConnection, messageJson.Get("payload.capabilities").Array()))
 			newConnection.Username = userInfo.Username
+			newConnection.startSession()
 
-			sendResponse(newConnection.Connection, mid, "ResponseAuthorize", `{"status":"ok"}`)
+			newConnection.sendResponse(mid, "ResponseAuthorize", `{"status":"ok","sessionToken":"`+newConnection.SessionToken+`","resumed":false,"capabilities":`+string(capabilities)+`}`)
 
 		} else if eventName == "RequestGetDevices" {
-			server.handleGetDeviceList(newConnection, mid)
+			server.handleGetDeviceList(newConnection, mid, messageJson.Get("payload.sinceVersion"))
 		} else if eventName == "RequestSetValue" {
-			server.handleSetValue(newConnection, messageJson)
+			server.handleSetValue(newConnection, mid, messageJson)
+		} else if eventName == "RequestSetValues" {
+			server.handleSetValues(newConnection, mid, messageJson)
 		} else if eventName == "RequestSubscribeDevice" {
 			server.handleRequestSubscribeDevice(newConnection, messageJson.Get("payload.uuid").String(), messageJson.Get("payload.hubUuid").String())
 		} else if eventName == "RequestUnsubscribeDevice" {
 			server.handleRequestUnsubscribeDevice(newConnection, messageJson.Get("payload.uuid").String(), messageJson.Get("payload.hubUuid").String())
+		} else if eventName == "RequestSubscribe" {
+			server.handleSubscribe(newConnection, mid, messageJson)
+		} else if eventName == "RequestUnsubscribe" {
+			server.handleUnsubscribe(newConnection, mid, messageJson)
+		} else if eventName == "RequestCreateScene" {
+			server.handleCreateScene(newConnection, mid, messageJson)
+		} else if eventName == "RequestListScenes" {
+			server.handleListScenes(newConnection, mid)
+		} else if eventName == "RequestActivateScene" {
+			server.handleActivateScene(newConnection, mid, messageJson.Get("payload.id").String())
+		} else if eventName == "RequestDeleteScene" {
+			server.handleDeleteScene(newConnection, mid, messageJson.Get("payload.id").String())
+		} else if eventName == "RequestCreateRule" {
+			server.handleCreateRule(newConnection, mid, messageJson)
+		} else if eventName == "RequestListRules" {
+			server.handleListRules(newConnection, mid)
+		} else if eventName == "RequestDeleteRule" {
+			server.handleDeleteRule(newConnection, mid, messageJson.Get("payload.id").String())
+		} else if eventName == "RequestSetRuleEnabled" {
+			server.handleSetRuleEnabled(newConnection, mid, messageJson.Get("payload.id").String(), messageJson.Get("payload.enabled").Bool())
+		} else if eventName == "RequestCreateSchedule" {
+			server.handleCreateSchedule(newConnection, mid, messageJson)
+		} else if eventName == "RequestListSchedules" {
+			server.handleListSchedules(newConnection, mid)
+		} else if eventName == "RequestDeleteSchedule" {
+			server.handleDeleteSchedule(newConnection, mid, messageJson.Get("payload.id").String())
+		} else if eventName == "RequestSetScheduleEnabled" {
+			server.handleSetScheduleEnabled(newConnection, mid, messageJson.Get("payload.id").String(), messageJson.Get("payload.enabled").Bool())
+		} else if eventName == "RequestGetScheduleHistory" {
+			server.handleGetScheduleHistory(newConnection, mid, messageJson.Get("payload.id").String())
+		} else if eventName == "RequestGetHistory" {
+			server.handleGetHistory(newConnection, mid, messageJson)
+		} else if eventName == "RequestCreateWebhook" {
+			server.handleCreateWebhook(newConnection, mid, messageJson)
+		} else if eventName == "RequestListWebhooks" {
+			server.handleListWebhooks(newConnection, mid)
+		} else if eventName == "RequestDeleteWebhook" {
+			server.handleDeleteWebhook(newConnection, mid, messageJson.Get("payload.id").String())
+		} else if eventName == "RequestGetWebhookDeliveries" {
+			server.handleGetWebhookDeliveries(newConnection, mid, messageJson.Get("payload.id").String())
+		} else if eventName == "RequestSetDeviceOverlay" {
+			server.handleSetDeviceOverlay(newConnection, mid, messageJson)
+		} else if eventName == "RequestDeleteDeviceOverlay" {
+			server.handleDeleteDeviceOverlay(newConnection, mid, messageJson)
+		} else if eventName == "RequestListDeviceOverlays" {
+			server.handleListDeviceOverlays(newConnection, mid)
+		} else if eventName == "RequestCreateGroup" {
+			server.handleCreateGroup(newConnection, mid, messageJson)
+		} else if eventName == "RequestListGroups" {
+			server.handleListGroups(newConnection, mid)
+		} else if eventName == "RequestDeleteGroup" {
+			server.handleDeleteGroup(newConnection, mid, messageJson.Get("payload.id").String())
+		} else if eventName == "RequestSetGroupValue" {
+			server.handleSetGroupValue(newConnection, mid, messageJson)
+		} else if eventName == "RequestCreateVirtualDevice" {
+			server.handleCreateVirtualDevice(newConnection, mid, messageJson)
+		} else if eventName == "RequestDeleteVirtualDevice" {
+			server.handleDeleteVirtualDevice(newConnection, mid, messageJson.Get("payload.uuid").String())
 		}
 
 	})
 
 	c.OnDisconnect(func() {
 		log.Println("Connection with ID: " + c.ID() + " has been disconnected!")
-		for e := server.WebClientConnections.Front(); e != nil; e = e.Next() {
-			con := e.Value.(*WebClientConnection)
-			if con.Connection.ID() == c.ID() {
-				server.WebClientConnections.Remove(e)
-				break
-			}
-		}
+		newConnection.Queue.Close()
+		server.detach(newConnection)
 	})
 }
 
@@ -148,66 +392,661 @@ func (server *ClientConnectionServer) sendDeviceUpdateEvent(conn *WebClientConne
 	hubConnection := server.getHubConnection(hubUuid)
 	if hubConnection != nil {
 		device := hubConnection.getDevice(uuid)
+		if device != nil {
+			device = server.Overlays.apply(conn.Username, hubUuid, device)
+		}
 		deviceData, _ := json.Marshal(device)
-		sendResponse(conn.Connection, -1, "EventDeviceUpdate", string(deviceData))
+		conn.sendSequencedEvent("EventDeviceUpdate", hubUuid+"/"+uuid, func(sequence int64) string {
+			return string(deviceData)
+		})
 	}
 }
 
-func (server *ClientConnectionServer) handleRequestSubscribeDevice(conn *WebClientConnection, uuid string, hubUuid string) {
-	log.Println("Add subscribe " + uuid + " " + hubUuid)
-	//todo check if client can subscribe to device on hub
+//sendResourceUpdateEvent sends single resource value with session sequence number
+func (server *ClientConnectionServer) sendResourceUpdateEvent(conn *WebClientConnection, hubUUID string, uuid string, href string, value gjson.Result, timestamp int64) {
+	valueData := value.Raw
+	if valueData == "" {
+		valueData = "null"
+	}
+	hrefData, _ := json.Marshal(href)
+	conn.sendSequencedEvent("EventResourceUpdate", hubUUID+"/"+uuid+href, func(sequence int64) string {
+		return `{"hubUuid":"` + hubUUID + `","uuid":"` + uuid + `","href":` + string(hrefData) +
+			`,"value":` + valueData + `,"timestamp":` + strconv.FormatInt(timestamp, 10) + `,"seq":` + strconv.FormatInt(sequence, 10) + `}`
+	})
+}
 
+//handleRequestSubscribeDevice keeps legacy behaviour, subscription is accepted even before the hub
+//connects or client authorizes and ownership is checked when events are delivered
+func (server *ClientConnectionServer) handleRequestSubscribeDevice(conn *WebClientConnection, uuid string, hubUuid string) {
+	if uuid == "" || hubUuid == "" {
+		log.Println("Ignoring device subscription without uuid or hubUuid")
+		return
+	}
 	sub := &WebClientSubscription{
 		Uuid:    uuid,
 		HubUuid: hubUuid,
 	}
-	conn.Subscriptions.PushBack(sub)
-
-	server.sendDeviceUpdateEvent(conn, uuid, hubUuid)
+	if conn.storeSubscription(sub) {
+		server.sendSubscriptionState(conn, sub)
+	}
 }
 
 func (server *ClientConnectionServer) handleRequestUnsubscribeDevice(conn *WebClientConnection, uuid string, hubUuid string) {
-	for e := conn.Subscriptions.Front(); e != nil; e = e.Next() {
-		s := e.Value.(*WebClientSubscription)
-		if s.Uuid == uuid && s.HubUuid == hubUuid {
-			conn.Subscriptions.Remove(e)
-			return
-		}
-	}
+	server.removeSubscription(conn, &WebClientSubscription{
+		Uuid:    uuid,
+		HubUuid: hubUuid,
+	})
 }
 
-func createDeviceList(conn *WebClientConnection, hubConnections *list.List) []ResponseIotHubDevices {
+//createDeviceList returns devices of all user hubs with user overlays applied, groups are
+//listed as devices of synthetic groups hub
+func createDeviceList(username string, hubConnections *list.List, overlays *OverlayStore, groups *GroupStore) []ResponseIotHubDevices {
 	var devicesList []ResponseIotHubDevices
 
-	for e := hubConnections.Front(); e != nil; e = e.Next() {
-		con := e.Value.(*HubConnection)
+	for _, con := range getHubConnections(hubConnections) {
 		log.Println(con)
-		if con.Username != "" && con.Username == conn.Username {
+		if con.Username != "" && con.Username == username {
 			devices := ResponseIotHubDevices{}
-			devices.Uuid = con.Uuid //hub data
-			devices.Name = con.Name //hub data
+			devices.Uuid = con.Uuid      //hub data
+			devices.Name = con.getName() //hub data
 
-			for d := con.DeviceList.Front(); d != nil; d = d.Next() {
-				device := d.Value.(*IotDevice)
+			for _, device := range con.getDevices() {
 				device.HubUUID = con.Uuid
-				devices.Devices = append(devices.Devices, device)
+				devices.Devices = append(devices.Devices, overlays.apply(username, con.Uuid, device))
 			}
 			devicesList = append(devicesList, devices)
 		}
 	}
+	if groupDevices := createGroupDevices(hubConnections, username, groups); len(groupDevices) > 0 {
+		devicesList = append(devicesList, ResponseIotHubDevices{
+			Uuid:    GROUP_HUB_UUID,
+			Name:    GROUP_HUB_NAME,
+			Devices: groupDevices,
+		})
+	}
 	return devicesList
 }
 
-func (server *ClientConnectionServer) handleGetDeviceList(conn *WebClientConnection, mid int64) {
-	devicesList := createDeviceList(conn, server.HubConnections)
+//handleGetDeviceList returns changes since version known by client or full list
+//when the version is missing or too old
+func (server *ClientConnectionServer) handleGetDeviceList(conn *WebClientConnection, mid int64, sinceVersion gjson.Result) {
+	if sinceVersion.Exists() && conn.Username != "" {
+		changes, version, ok := server.DeviceVersions.getChangesSince(conn.Username, sinceVersion.Int())
+		if ok {
+			for i, change := range changes {
+				if change.Device != nil {
+					item := *change
+					item.Device = server.Overlays.apply(conn.Username, change.HubUUID, change.Device)
+					changes[i] = &item
+				}
+			}
+			changesData, _ := json.Marshal(changes)
+			conn.sendResponse(mid, "ResponseGetDevices", `{"version":`+strconv.FormatInt(version, 10)+`,"full":false,"changes":`+string(changesData)+`}`)
+			return
+		}
+	}
+	version := server.DeviceVersions.getVersion(conn.Username)
+	devicesList := createDeviceList(conn.Username, server.HubConnections, server.Overlays, server.Groups)
 	devs, _ := json.Marshal(devicesList)
-	sendResponse(conn.Connection, mid, "ResponseGetDevices", `{"hubs":`+string(devs)+`}`)
+	conn.sendResponse(mid, "ResponseGetDevices", `{"version":`+strconv.FormatInt(version, 10)+`,"full":true,"hubs":`+string(devs)+`}`)
 }
-func (server *ClientConnectionServer) handleSetValue(conn *WebClientConnection, message gjson.Result) {
+
+//handleSetValue sends value without waiting for hub, response is sent only when value is rejected
+func (server *ClientConnectionServer) handleSetValue(conn *WebClientConnection, mid int64, message gjson.Result) {
 	hubUUID := message.Get("payload.hubUuid").String()
 	deviceUUID := message.Get("payload.uuid").String()
 	resource := message.Get("payload.resource").String()
 	value := message.Get("payload.value").String()
 
-	setDeviceValue(server.getHubConnection(hubUUID), deviceUUID, resource, value)
+	if conn.Username == "" {
+		conn.sendErrorResponse(mid, "ResponseSetValue", errNotAuthorized)
+		return
+	}
+	if hubUUID == GROUP_HUB_UUID {
+		group := server.Groups.getGroup(conn.Username, deviceUUID)
+		if group == nil {
+			conn.sendErrorResponse(mid, "ResponseSetValue", errors.New("group not found"))
+			return
+		}
+		//group members are reported one by one as they may fail independently
+		go func() {
+			results, err := setGroupValue(server.HubConnections, conn.Username, group, resource, message.Get("payload.value"))
+			if err != nil {
+				conn.sendErrorResponse(mid, "ResponseSetValue", err)
+				return
+			}
+			if status := getActionsStatus(results); status != "ok" {
+				resultsData, _ := json.Marshal(results)
+				conn.sendResponse(mid, "ResponseSetValue", `{"status":"`+status+`","results":`+string(resultsData)+`}`)
+			}
+		}()
+		return
+	}
+	err := setDeviceValue(findHubConnection(server.HubConnections, conn.Username, hubUUID), deviceUUID, resource, value)
+	if err != nil && err != errHubOffline {
+		conn.sendErrorResponse(mid, "ResponseSetValue", err)
+	}
+}
+
+//handleSetValues sets several values at once, values of one hub are sent as single batch
+func (server *ClientConnectionServer) handleSetValues(conn *WebClientConnection, mid int64, message gjson.Result) {
+	if conn.Username == "" {
+		conn.sendErrorResponse(mid, "ResponseSetValues", errNotAuthorized)
+		return
+	}
+	var actions []*SceneAction
+	err := json.Unmarshal([]byte(message.Get("payload.values").Raw), &actions)
+	if err == nil && len(actions) == 0 {
+		err = errors.New("no values to set")
+	}
+	for _, action := range actions {
+		if err == nil && (action.HubUUID == "" || action.DeviceUUID == "" || action.Resource == "" || len(action.Value) == 0) {
+			err = errors.New("invalid value entry")
+		}
+	}
+	if err != nil {
+		conn.sendErrorResponse(mid, "ResponseSetValues", err)
+		return
+	}
+	go func() {
+		results := activateScene(server.HubConnections, conn.Username, actions)
+		resultsData, _ := json.Marshal(results)
+		conn.sendResponse(mid, "ResponseSetValues", `{"status":"`+getActionsStatus(results)+`","results":`+string(resultsData)+`}`)
+	}()
+}
+
+//sendResponse queues response behind events already queued for the client
+func (conn *WebClientConnection) sendResponse(mid int64, name string, payload string) {
+	log.Println("sendResponse" + payload)
+	conn.Queue.Enqueue("", messageFrame(mid, name, payload))
+}
+
+func (conn *WebClientConnection) sendErrorResponse(mid int64, name string, err error) {
+	errorMessage, _ := json.Marshal(err.Error())
+	conn.sendResponse(mid, name, `{"status":"error","error":`+string(errorMessage)+`}`)
+}
+
+func (server *ClientConnectionServer) handleCreateScene(conn *WebClientConnection, mid int64, message gjson.Result) {
+	if conn.Username == "" {
+		conn.sendErrorResponse(mid, "ResponseCreateScene", errNotAuthorized)
+		return
+	}
+	scene := &Scene{
+		ID:   generateMessageUUID(),
+		Name: message.Get("payload.name").String(),
+	}
+	if scene.Name == "" {
+		conn.sendErrorResponse(mid, "ResponseCreateScene", errors.New("scene name is missing"))
+		return
+	}
+	for _, actionData := range message.Get("payload.actions").Array() {
+		scene.Actions = append(scene.Actions, &SceneAction{
+			HubUUID:    actionData.Get("hubUuid").String(),
+			DeviceUUID: actionData.Get("uuid").String(),
+			Resource:   actionData.Get("resource").String(),
+			Value:      json.RawMessage(actionData.Get("value").Raw),
+		})
+	}
+	for _, actionData := range message.Get("payload.offActions").Array() {
+		scene.OffActions = append(scene.OffActions, &SceneAction{
+			HubUUID:    actionData.Get("hubUuid").String(),
+			DeviceUUID: actionData.Get("uuid").String(),
+			Resource:   actionData.Get("resource").String(),
+			Value:      json.RawMessage(actionData.Get("value").Raw),
+		})
+	}
+	for _, captureData := range message.Get("payload.capture").Array() {
+		hubUUID := captureData.Get("hubUuid").String()
+		hubConnection := findHubConnection(server.HubConnections, conn.Username, hubUUID)
+		action, err := captureSceneAction(hubConnection, captureData.Get("uuid").String(), captureData.Get("resource").String())
+		if err != nil {
+			conn.sendErrorResponse(mid, "ResponseCreateScene", err)
+			return
+		}
+		scene.Actions = append(scene.Actions, action)
+	}
+	for _, action := range append(scene.Actions, scene.OffActions...) {
+		if action.HubUUID == "" || action.DeviceUUID == "" || action.Resource == "" || !gjson.Valid(string(action.Value)) {
+			conn.sendErrorResponse(mid, "ResponseCreateScene", errors.New("invalid scene action"))
+			return
+		}
+	}
+	if len(scene.Actions) == 0 {
+		conn.sendErrorResponse(mid, "ResponseCreateScene", errors.New("scene has no actions"))
+		return
+	}
+
+	server.Scenes.addScene(conn.Username, scene)
+	sceneData, _ := json.Marshal(scene)
+	conn.sendResponse(mid, "ResponseCreateScene", `{"status":"ok","scene":`+string(sceneData)+`}`)
+}
+
+func (server *ClientConnectionServer) handleListScenes(conn *WebClientConnection, mid int64) {
+	scenes := server.Scenes.getScenes(conn.Username)
+	if conn.Username == "" {
+		scenes = nil
+	}
+	scenesData, _ := json.Marshal(scenes)
+	conn.sendResponse(mid, "ResponseListScenes", `{"scenes":`+string(scenesData)+`}`)
+}
+
+func (server *ClientConnectionServer) handleActivateScene(conn *WebClientConnection, mid int64, id string) {
+	scene := server.Scenes.getScene(conn.Username, id)
+	if conn.Username == "" || scene == nil {
+		conn.sendErrorResponse(mid, "ResponseActivateScene", errors.New("scene not found"))
+		return
+	}
+	go func() {
+		results := activateScene(server.HubConnections, conn.Username, scene.Actions)
+		resultsData, _ := json.Marshal(results)
+		conn.sendResponse(mid, "ResponseActivateScene", `{"status":"`+getActionsStatus(results)+`","results":`+string(resultsData)+`}`)
+	}()
+}
+
+func (server *ClientConnectionServer) handleDeleteScene(conn *WebClientConnection, mid int64, id string) {
+	if conn.Username == "" || !server.Scenes.deleteScene(conn.Username, id) {
+		conn.sendErrorResponse(mid, "ResponseDeleteScene", errors.New("scene not found"))
+		return
+	}
+	conn.sendResponse(mid, "ResponseDeleteScene", `{"status":"ok"}`)
+}
+
+func (server *ClientConnectionServer) handleCreateRule(conn *WebClientConnection, mid int64, message gjson.Result) {
+	if conn.Username == "" {
+		conn.sendErrorResponse(mid, "ResponseCreateRule", errNotAuthorized)
+		return
+	}
+	rule := &Rule{}
+	err := json.Unmarshal([]byte(message.Get("payload").Raw), rule)
+	if err != nil {
+		conn.sendErrorResponse(mid, "ResponseCreateRule", err)
+		return
+	}
+	rule.ID = generateMessageUUID()
+	if !message.Get("payload.enabled").Exists() {
+		rule.Enabled = true
+	}
+	err = server.Rules.addRule(conn.Username, rule)
+	if err != nil {
+		conn.sendErrorResponse(mid, "ResponseCreateRule", err)
+		return
+	}
+	ruleData, _ := json.Marshal(rule)
+	conn.sendResponse(mid, "ResponseCreateRule", `{"status":"ok","rule":`+string(ruleData)+`}`)
+}
+
+func (server *ClientConnectionServer) handleListRules(conn *WebClientConnection, mid int64) {
+	rules := server.Rules.getRules(conn.Username)
+	if conn.Username == "" {
+		rules = nil
+	}
+	rulesData, _ := json.Marshal(rules)
+	conn.sendResponse(mid, "ResponseListRules", `{"rules":`+string(rulesData)+`}`)
+}
+
+func (server *ClientConnectionServer) handleDeleteRule(conn *WebClientConnection, mid int64, id string) {
+	if conn.Username == "" || !server.Rules.deleteRule(conn.Username, id) {
+		conn.sendErrorResponse(mid, "ResponseDeleteRule", errors.New("rule not found"))
+		return
+	}
+	conn.sendResponse(mid, "ResponseDeleteRule", `{"status":"ok"}`)
+}
+
+func (server *ClientConnectionServer) handleSetRuleEnabled(conn *WebClientConnection, mid int64, id string, enabled bool) {
+	if conn.Username == "" || !server.Rules.setRuleEnabled(conn.Username, id, enabled) {
+		conn.sendErrorResponse(mid, "ResponseSetRuleEnabled", errors.New("rule not found"))
+		return
+	}
+	conn.sendResponse(mid, "ResponseSetRuleEnabled", `{"status":"ok"}`)
+}
+
+func (server *ClientConnectionServer) handleCreateSchedule(conn *WebClientConnection, mid int64, message gjson.Result) {
+	if conn.Username == "" {
+		conn.sendErrorResponse(mid, "ResponseCreateSchedule", errNotAuthorized)
+		return
+	}
+	schedule := &Schedule{}
+	err := json.Unmarshal([]byte(message.Get("payload").Raw), schedule)
+	if err != nil {
+		conn.sendErrorResponse(mid, "ResponseCreateSchedule", err)
+		return
+	}
+	schedule.ID = generateMessageUUID()
+	schedule.Enabled = true
+	err = server.Scheduler.addSchedule(conn.Username, schedule)
+	if err != nil {
+		conn.sendErrorResponse(mid, "ResponseCreateSchedule", err)
+		return
+	}
+	scheduleData, _ := json.Marshal(schedule)
+	conn.sendResponse(mid, "ResponseCreateSchedule", `{"status":"ok","schedule":`+string(scheduleData)+`}`)
+}
+
+func (server *ClientConnectionServer) handleListSchedules(conn *WebClientConnection, mid int64) {
+	schedules := server.Scheduler.getSchedules(conn.Username)
+	if conn.Username == "" {
+		schedules = nil
+	}
+	schedulesData, _ := json.Marshal(schedules)
+	conn.sendResponse(mid, "ResponseListSchedules", `{"schedules":`+string(schedulesData)+`}`)
+}
+
+func (server *ClientConnectionServer) handleDeleteSchedule(conn *WebClientConnection, mid int64, id string) {
+	if conn.Username == "" || !server.Scheduler.deleteSchedule(conn.Username, id) {
+		conn.sendErrorResponse(mid, "ResponseDeleteSchedule", errors.New("schedule not found"))
+		return
+	}
+	conn.sendResponse(mid, "ResponseDeleteSchedule", `{"status":"ok"}`)
+}
+
+func (server *ClientConnectionServer) handleSetScheduleEnabled(conn *WebClientConnection, mid int64, id string, enabled bool) {
+	if conn.Username == "" || !server.Scheduler.setScheduleEnabled(conn.Username, id, enabled) {
+		conn.sendErrorResponse(mid, "ResponseSetScheduleEnabled", errors.New("schedule not found"))
+		return
+	}
+	conn.sendResponse(mid, "ResponseSetScheduleEnabled", `{"status":"ok"}`)
+}
+
+func (server *ClientConnectionServer) handleGetScheduleHistory(conn *WebClientConnection, mid int64, id string) {
+	history := server.Scheduler.getHistory(conn.Username, id)
+	if conn.Username == "" {
+		history = nil
+	}
+	historyData, _ := json.Marshal(history)
+	conn.sendResponse(mid, "ResponseGetScheduleHistory", `{"history":`+string(historyData)+`}`)
+}
+
+func (server *ClientConnectionServer) handleGetHistory(conn *WebClientConnection, mid int64, message gjson.Result) {
+	if conn.Username == "" {
+		conn.sendErrorResponse(mid, "ResponseGetHistory", errNotAuthorized)
+		return
+	}
+	query, err := parseHistoryQuery(conn.Username,
+		message.Get("payload.hubUuid").String(),
+		message.Get("payload.uuid").String(),
+		message.Get("payload.resource").String(),
+		message.Get("payload.from").String(),
+		message.Get("payload.to").String(),
+		message.Get("payload.interval").Int())
+	if err != nil {
+		conn.sendErrorResponse(mid, "ResponseGetHistory", err)
+		return
+	}
+	go func() {
+		samples, err := server.History.Query(query)
+		if err != nil {
+			conn.sendErrorResponse(mid, "ResponseGetHistory", err)
+			return
+		}
+		if samples == nil {
+			samples = []*HistorySample{}
+		}
+		samplesData, _ := json.Marshal(samples)
+		conn.sendResponse(mid, "ResponseGetHistory", `{"status":"ok","samples":`+string(samplesData)+`}`)
+	}()
+}
+
+func (server *ClientConnectionServer) handleCreateWebhook(conn *WebClientConnection, mid int64, message gjson.Result) {
+	if conn.Username == "" {
+		conn.sendErrorResponse(mid, "ResponseCreateWebhook", errNotAuthorized)
+		return
+	}
+	webhook := &Webhook{}
+	err := json.Unmarshal([]byte(message.Get("payload").Raw), webhook)
+	if err != nil {
+		conn.sendErrorResponse(mid, "ResponseCreateWebhook", err)
+		return
+	}
+	webhook.ID = generateMessageUUID()
+	err = server.Webhooks.addWebhook(conn.Username, webhook)
+	if err != nil {
+		conn.sendErrorResponse(mid, "ResponseCreateWebhook", err)
+		return
+	}
+	//secret is returned only once, on creation
+	webhookData, _ := json.Marshal(webhook)
+	conn.sendResponse(mid, "ResponseCreateWebhook", `{"status":"ok","webhook":`+string(webhookData)+`}`)
+}
+
+func (server *ClientConnectionServer) handleListWebhooks(conn *WebClientConnection, mid int64) {
+	webhooks := server.Webhooks.getWebhooks(conn.Username)
+	if conn.Username == "" {
+		webhooks = nil
+	}
+	webhooksData, _ := json.Marshal(webhooks)
+	conn.sendResponse(mid, "ResponseListWebhooks", `{"webhooks":`+string(webhooksData)+`}`)
+}
+
+func (server *ClientConnectionServer) handleDeleteWebhook(conn *WebClientConnection, mid int64, id string) {
+	if conn.Username == "" || !server.Webhooks.deleteWebhook(conn.Username, id) {
+		conn.sendErrorResponse(mid, "ResponseDeleteWebhook", errors.New("webhook not found"))
+		return
+	}
+	conn.sendResponse(mid, "ResponseDeleteWebhook", `{"status":"ok"}`)
+}
+
+func (server *ClientConnectionServer) handleGetWebhookDeliveries(conn *WebClientConnection, mid int64, id string) {
+	recent, deadLetters, ok := server.Webhooks.getDeliveries(conn.Username, id)
+	if conn.Username == "" || !ok {
+		conn.sendErrorResponse(mid, "ResponseGetWebhookDeliveries", errors.New("webhook not found"))
+		return
+	}
+	recentData, _ := json.Marshal(recent)
+	deadLettersData, _ := json.Marshal(deadLetters)
+	conn.sendResponse(mid, "ResponseGetWebhookDeliveries", `{"status":"ok","deliveries":`+string(recentData)+`,"deadLetters":`+string(deadLettersData)+`}`)
+}
+
+func (server *ClientConnectionServer) handleSetDeviceOverlay(conn *WebClientConnection, mid int64, message gjson.Result) {
+	if conn.Username == "" {
+		conn.sendErrorResponse(mid, "ResponseSetDeviceOverlay", errNotAuthorized)
+		return
+	}
+	overlay := &DeviceOverlay{}
+	rooms := server.Groups.getRooms(conn.Username)
+	err := json.Unmarshal([]byte(message.Get("payload").Raw), overlay)
+	if err == nil {
+		err = server.Overlays.setOverlay(conn.Username, overlay)
+	}
+	if err != nil {
+		conn.sendErrorResponse(mid, "ResponseSetDeviceOverlay", err)
+		return
+	}
+	conn.sendResponse(mid, "ResponseSetDeviceOverlay", `{"status":"ok"}`)
+	server.notifyOverlayChanged(conn.Username, overlay.HubUUID, overlay.DeviceUUID)
+	server.notifyRoomsChanged(conn.Username, rooms)
+}
+
+func (server *ClientConnectionServer) handleDeleteDeviceOverlay(conn *WebClientConnection, mid int64, message gjson.Result) {
+	hubUUID := message.Get("payload.hubUuid").String()
+	deviceUUID := message.Get("payload.uuid").String()
+	rooms := server.Groups.getRooms(conn.Username)
+	if conn.Username == "" || !server.Overlays.deleteOverlay(conn.Username, hubUUID, deviceUUID) {
+		conn.sendErrorResponse(mid, "ResponseDeleteDeviceOverlay", errors.New("overlay not found"))
+		return
+	}
+	conn.sendResponse(mid, "ResponseDeleteDeviceOverlay", `{"status":"ok"}`)
+	server.notifyOverlayChanged(conn.Username, hubUUID, deviceUUID)
+	server.notifyRoomsChanged(conn.Username, rooms)
+}
+
+func (server *ClientConnectionServer) handleListDeviceOverlays(conn *WebClientConnection, mid int64) {
+	overlays := server.Overlays.getOverlays(conn.Username)
+	if conn.Username == "" {
+		overlays = nil
+	}
+	overlaysData, _ := json.Marshal(overlays)
+	conn.sendResponse(mid, "ResponseListDeviceOverlays", `{"overlays":`+string(overlaysData)+`}`)
+}
+
+//notifyOverlayChanged sends device with new overlay to user clients and updates Alexa discovery,
+//devices and resources which became hidden are reported to Alexa as removed
+func (server *ClientConnectionServer) notifyOverlayChanged(username string, hubUUID string, deviceUUID string) {
+	hub := findHubConnection(server.HubConnections, username, hubUUID)
+	if hub == nil {
+		return
+	}
+	device := hub.getDevice(deviceUUID)
+	if device == nil {
+		return
+	}
+	server.notifyDeviceChanged(hub, device)
+
+	overlaid := server.Overlays.apply(username, hubUUID, device)
+	var updated, removed []*IotDevice
+	if overlaid.Hidden {
+		removed = append(removed, device)
+	} else {
+		updated = append(updated, overlaid)
+		hidden := *device
+		hidden.Variables = nil
+		for _, variable := range overlaid.filterVariables(true).Variables {
+			hidden.Variables = append(hidden.Variables, device.getVariable(variable.Href))
+		}
+		if len(hidden.Variables) > 0 {
+			removed = append(removed, &hidden)
+		}
+	}
+	server.AlexaEvents.ReportDiscoveryChange(username, hubUUID, updated, removed)
+}
+
+func (server *ClientConnectionServer) handleCreateGroup(conn *WebClientConnection, mid int64, message gjson.Result) {
+	if conn.Username == "" {
+		conn.sendErrorResponse(mid, "ResponseCreateGroup", errNotAuthorized)
+		return
+	}
+	group := &DeviceGroup{}
+	err := json.Unmarshal([]byte(message.Get("payload").Raw), group)
+	if err == nil {
+		group.ID = generateMessageUUID()
+		err = server.Groups.addGroup(conn.Username, group)
+	}
+	if err != nil {
+		conn.sendErrorResponse(mid, "ResponseCreateGroup", err)
+		return
+	}
+	groupData, _ := json.Marshal(group)
+	conn.sendResponse(mid, "ResponseCreateGroup", `{"status":"ok","group":`+string(groupData)+`}`)
+
+	server.notifyGroupsAdded(conn.Username, []*IotDevice{createGroupDevice(server.HubConnections, conn.Username, group)})
+}
+
+func (server *ClientConnectionServer) notifyGroupsAdded(username string, devices []*IotDevice) {
+	version := server.DeviceVersions.record(username, DEVICE_CHANGE_ADDED, GROUP_HUB_UUID, GROUP_HUB_NAME, devices)
+	devs, _ := json.Marshal(devices)
+	server.sendDeviceListEvent(username, "EventDevicesAdded", `{"version":`+strconv.FormatInt(version, 10)+
+		`,"hubUuid":"`+GROUP_HUB_UUID+`","hubName":"`+GROUP_HUB_NAME+`","devices":`+string(devs)+`}`)
+	server.AlexaEvents.ReportDiscoveryChange(username, GROUP_HUB_UUID, devices, nil)
+}
+
+func (server *ClientConnectionServer) notifyGroupsRemoved(username string, devices []*IotDevice) {
+	version := server.DeviceVersions.record(username, DEVICE_CHANGE_REMOVED, GROUP_HUB_UUID, GROUP_HUB_NAME, devices)
+	var uuids []string
+	for _, device := range devices {
+		uuids = append(uuids, device.UUID)
+	}
+	uuidsData, _ := json.Marshal(uuids)
+	server.sendDeviceListEvent(username, "EventDevicesRemoved", `{"version":`+strconv.FormatInt(version, 10)+
+		`,"hubUuid":"`+GROUP_HUB_UUID+`","uuids":`+string(uuidsData)+`}`)
+	server.AlexaEvents.ReportDiscoveryChange(username, GROUP_HUB_UUID, nil, devices)
+}
+
+//notifyRoomsChanged reports rooms which appeared, disappeared or got other members since previous
+//rooms of user were taken, rooms are derived from device overlays
+func (server *ClientConnectionServer) notifyRoomsChanged(username string, previous []*DeviceGroup) {
+	current := server.Groups.getRooms(username)
+	var added, removed []*IotDevice
+	for _, room := range current {
+		old := findGroup(previous, room.ID)
+		if old == nil {
+			added = append(added, createGroupDevice(server.HubConnections, username, room))
+		} else if !hasSameMembers(old.Members, room.Members) {
+			device := createGroupDevice(server.HubConnections, username, room)
+			version := server.DeviceVersions.record(username, DEVICE_CHANGE_CHANGED, GROUP_HUB_UUID, GROUP_HUB_NAME, []*IotDevice{device})
+			deviceData, _ := json.Marshal(device)
+			server.sendDeviceListEvent(username, "EventDeviceChanged", `{"version":`+strconv.FormatInt(version, 10)+
+				`,"hubUuid":"`+GROUP_HUB_UUID+`","device":`+string(deviceData)+`}`)
+			server.AlexaEvents.ReportDiscoveryChange(username, GROUP_HUB_UUID, []*IotDevice{device}, nil)
+		}
+	}
+	for _, room := range previous {
+		if findGroup(current, room.ID) == nil {
+			removed = append(removed, createGroupDevice(server.HubConnections, username, room))
+		}
+	}
+	if len(added) > 0 {
+		server.notifyGroupsAdded(username, added)
+	}
+	if len(removed) > 0 {
+		server.notifyGroupsRemoved(username, removed)
+	}
+}
+
+func (server *ClientConnectionServer) handleListGroups(conn *WebClientConnection, mid int64) {
+	groups := server.Groups.getGroups(conn.Username)
+	if conn.Username == "" {
+		groups = nil
+	}
+	groupsData, _ := json.Marshal(groups)
+	conn.sendResponse(mid, "ResponseListGroups", `{"groups":`+string(groupsData)+`}`)
+}
+
+func (server *ClientConnectionServer) handleDeleteGroup(conn *WebClientConnection, mid int64, id string) {
+	group := server.Groups.getGroup(conn.Username, id)
+	if conn.Username == "" || group == nil {
+		conn.sendErrorResponse(mid, "ResponseDeleteGroup", errors.New("group not found"))
+		return
+	}
+	//state is captured before removal so Alexa is told about all endpoints of the group
+	device := createGroupDevice(server.HubConnections, conn.Username, group)
+	if !server.Groups.deleteGroup(conn.Username, id) {
+		conn.sendErrorResponse(mid, "ResponseDeleteGroup", errors.New("group not found"))
+		return
+	}
+	conn.sendResponse(mid, "ResponseDeleteGroup", `{"status":"ok"}`)
+
+	server.notifyGroupsRemoved(conn.Username, []*IotDevice{device})
+}
+
+//handleSetGroupValue writes value to all members of group and reports result of every member
+func (server *ClientConnectionServer) handleSetGroupValue(conn *WebClientConnection, mid int64, message gjson.Result) {
+	group := server.Groups.getGroup(conn.Username, message.Get("payload.id").String())
+	if conn.Username == "" || group == nil {
+		conn.sendErrorResponse(mid, "ResponseSetGroupValue", errors.New("group not found"))
+		return
+	}
+	go func() {
+		results, err := setGroupValue(server.HubConnections, conn.Username, group, message.Get("payload.resource").String(), message.Get("payload.value"))
+		if err != nil {
+			conn.sendErrorResponse(mid, "ResponseSetGroupValue", err)
+			return
+		}
+		resultsData, _ := json.Marshal(results)
+		conn.sendResponse(mid, "ResponseSetGroupValue", `{"status":"`+getActionsStatus(results)+`","results":`+string(resultsData)+`}`)
+	}()
+}
+
+func (server *ClientConnectionServer) handleCreateVirtualDevice(conn *WebClientConnection, mid int64, message gjson.Result) {
+	if conn.Username == "" {
+		conn.sendErrorResponse(mid, "ResponseCreateVirtualDevice", errNotAuthorized)
+		return
+	}
+	device := &IotDevice{}
+	err := json.Unmarshal([]byte(message.Get("payload").Raw), device)
+	if err == nil {
+		err = server.VirtualHub.addDevice(conn.Username, device)
+	}
+	if err != nil {
+		conn.sendErrorResponse(mid, "ResponseCreateVirtualDevice", err)
+		return
+	}
+	deviceData, _ := json.Marshal(device)
+	conn.sendResponse(mid, "ResponseCreateVirtualDevice", `{"status":"ok","device":`+string(deviceData)+`}`)
+}
+
+func (server *ClientConnectionServer) handleDeleteVirtualDevice(conn *WebClientConnection, mid int64, uuid string) {
+	if conn.Username == "" || !server.VirtualHub.deleteDevice(conn.Username, uuid) {
+		conn.sendErrorResponse(mid, "ResponseDeleteVirtualDevice", errors.New("virtual device not found"))
+		return
+	}
+	conn.sendResponse(mid, "ResponseDeleteVirtualDevice", `{"status":"ok"}`)
 }
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"container/list"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func newTestWebClient(id string, username string, capabilities ...string) (*WebClientConnection, *testConnection) {
+	connection := newTestConnection(id)
+	conn := &WebClientConnection{
+		Username:      username,
+		Connection:    connection,
+		Subscriptions: list.New(),
+		Capabilities:  make(map[string]bool),
+		Queue:         NewOutboundQueue(connection),
+	}
+	for _, capability := range capabilities {
+		conn.Capabilities[capability] = true
+	}
+	return conn, connection
+}
+
+func TestDeviceListEvents(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	hub, _ := newTestHubConnection()
+	defer hub.Queue.Close()
+	overlays := NewOverlayStore()
+	server := &ClientConnectionServer{
+		HubConnections:       list.New(),
+		WebClientConnections: list.New(),
+		DeviceVersions:       NewDeviceVersions(),
+		Overlays:             overlays,
+		Groups:               NewGroupStore(overlays),
+	}
+	server.HubConnections.PushBack(hub)
+
+	tests := []struct {
+		name         string
+		capabilities []string
+		event        string
+		path         string
+		expected     string
+	}{
+		{"legacy client gets whole list", nil, "EventDeviceListUpdate", "payload.hubs.0.devices.0.uuid", "lamp"},
+		{"delta client gets added devices", []string{CLIENT_CAPABILITY_DEVICE_LIST_DELTAS}, "EventDevicesAdded", "payload.devices.0.uuid", "lamp"},
+	}
+	var connections []*testConnection
+	for _, test := range tests {
+		conn, connection := newTestWebClient(test.name, "user", test.capabilities...)
+		defer conn.Queue.Close()
+		server.WebClientConnections.PushBack(conn)
+		connections = append(connections, connection)
+	}
+	other, otherConnection := newTestWebClient("other", "other")
+	defer other.Queue.Close()
+	server.WebClientConnections.PushBack(other)
+
+	server.notifyDevicesAdded(hub, []*IotDevice{hub.getDevice("lamp")})
+	for i, test := range tests {
+		frame := connections[i].nextFrame(t)
+		if frame.Get("name").String() != test.event || frame.Get(test.path).String() != test.expected {
+			t.Errorf("%s: unexpected event %s", test.name, frame.Raw)
+		}
+	}
+	select {
+	case frame := <-otherConnection.frames:
+		t.Errorf("device list of other user was sent %s", frame.Raw)
+	default:
+	}
+}
+
+func TestSetValueRequiresHubOwner(t *testing.T) {
+	hub, hubConnection := newTestHubConnection()
+	defer hub.Queue.Close()
+	server := &ClientConnectionServer{HubConnections: list.New()}
+	server.HubConnections.PushBack(hub)
+
+	tests := []struct {
+		name     string
+		username string
+		sent     bool
+	}{
+		{"owner", "user", true},
+		{"other user", "other", false},
+		{"unauthorized client", "", false},
+	}
+	for _, test := range tests {
+		conn, _ := newTestWebClient(test.name, test.username)
+		server.handleSetValue(conn, 1, gjson.Parse(`{"payload":{"hubUuid":"hub","uuid":"lamp","resource":"/switch","value":{"value":false}}}`))
+		conn.Queue.Close()
+		if test.sent {
+			if frame := hubConnection.nextFrame(t); frame.Get("name").String() != "RequestSetValue" {
+				t.Errorf("%s: unexpected request %s", test.name, frame.Raw)
+			}
+			continue
+		}
+		select {
+		case frame := <-hubConnection.frames:
+			t.Errorf("%s: value was sent to hub %s", test.name, frame.Raw)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestSetValuesResponse(t *testing.T) {
+	hub, _ := newTestHubConnection()
+	defer hub.Queue.Close()
+	server := &ClientConnectionServer{HubConnections: list.New()}
+	server.HubConnections.PushBack(hub)
+
+	tests := []struct {
+		name     string
+		username string
+		values   string
+		status   string
+	}{
+		{"unauthorized client", "", `[{"hubUuid":"hub","uuid":"lamp","resource":"/switch","value":{"value":false}}]`, "error"},
+		{"no values", "user", `[]`, "error"},
+		{"entry without resource", "user", `[{"hubUuid":"hub","uuid":"lamp","value":{"value":false}}]`, "error"},
+		{"all values set", "user", `[{"hubUuid":"hub","uuid":"lamp","resource":"/switch","value":{"value":false}}]`, "ok"},
+		{"some values rejected", "user", `[{"hubUuid":"hub","uuid":"lamp","resource":"/switch","value":{"value":false}},{"hubUuid":"hub","uuid":"lamp","resource":"/dimming","value":{"dimmingSetting":101}}]`, "partial"},
+		{"hub of other user", "other", `[{"hubUuid":"hub","uuid":"lamp","resource":"/switch","value":{"value":false}}]`, "error"},
+	}
+	for _, test := range tests {
+		conn, connection := newTestWebClient(test.name, test.username)
+		server.handleSetValues(conn, 1, gjson.Parse(`{"payload":{"values":`+test.values+`}}`))
+		if frame := connection.nextFrame(t); frame.Get("payload.status").String() != test.status {
+			t.Errorf("%s: unexpected response %s", test.name, frame.Raw)
+		}
+		conn.Queue.Close()
+	}
+}
+
+func TestRoomMembersSwapped(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	overlays := NewOverlayStore()
+	server := &ClientConnectionServer{
+		HubConnections:       list.New(),
+		WebClientConnections: list.New(),
+		DeviceVersions:       NewDeviceVersions(),
+		Overlays:             overlays,
+		Groups:               NewGroupStore(overlays),
+		AlexaEvents:          NewAlexaEventGateway(),
+	}
+	conn, connection := newTestWebClient("client", "user", CLIENT_CAPABILITY_DEVICE_LIST_DELTAS)
+	defer conn.Queue.Close()
+	server.WebClientConnections.PushBack(conn)
+	overlays.setOverlay("user", &DeviceOverlay{HubUUID: "hub", DeviceUUID: "lamp", Room: "Kitchen"})
+	overlays.setOverlay("user", &DeviceOverlay{HubUUID: "hub", DeviceUUID: "fan", Room: "Hall"})
+
+	rooms := server.Groups.getRooms("user")
+	overlays.setOverlay("user", &DeviceOverlay{HubUUID: "hub", DeviceUUID: "lamp", Room: "Hall"})
+	overlays.setOverlay("user", &DeviceOverlay{HubUUID: "hub", DeviceUUID: "fan", Room: "Kitchen"})
+	server.notifyRoomsChanged("user", rooms)
+
+	changed := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		frame := connection.nextFrame(t)
+		if frame.Get("name").String() != "EventDeviceChanged" {
+			t.Fatalf("unexpected event %s", frame.Raw)
+		}
+		changed[frame.Get("payload.device.name").String()] = true
+	}
+	if !changed["Kitchen"] || !changed["Hall"] {
+		t.Errorf("rooms with swapped members were not reported %v", changed)
+	}
+}
+
+func TestLegacyDeviceSubscription(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	overlays := NewOverlayStore()
+	server := &ClientConnectionServer{
+		HubConnections:       list.New(),
+		WebClientConnections: list.New(),
+		Overlays:             overlays,
+		Groups:               NewGroupStore(overlays),
+	}
+	tests := []struct {
+		name      string
+		username  string
+		delivered bool
+	}{
+		{"owner subscribed before hub connected", "user", true},
+		{"client of other user", "other", false},
+		{"unauthorized client", "", false},
+	}
+	var connections []*testConnection
+	for _, test := range tests {
+		conn, connection := newTestWebClient(test.name, test.username)
+		defer conn.Queue.Close()
+		server.handleRequestSubscribeDevice(conn, "lamp", "hub")
+		if conn.Subscriptions.Len() != 1 {
+			t.Errorf("%s: legacy subscription was not stored", test.name)
+		}
+		server.WebClientConnections.PushBack(conn)
+		connections = append(connections, connection)
+	}
+
+	hub, _ := newTestHubConnection()
+	defer hub.Queue.Close()
+	server.HubConnections.PushBack(hub)
+	hub.getDevice("lamp").getVariable("/dimming").VariableValue.Value = gjson.Parse(`{"dimmingSetting":20}`)
+	server.notifyDeviceResourceChange("hub", "lamp", "/dimming", gjson.Parse(`{"dimmingSetting":20}`))
+
+	for i, test := range tests {
+		select {
+		case frame := <-connections[i].frames:
+			if !test.delivered || frame.Get("name").String() != "EventDeviceUpdate" {
+				t.Errorf("%s: unexpected event %s", test.name, frame.Raw)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if test.delivered {
+				t.Errorf("%s: update was not delivered", test.name)
+			}
+		}
+	}
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested string
+		accepted  []string
+	}{
+		{"none", `[]`, []string{}},
+		{"resource updates", `["resourceUpdates"]`, []string{CLIENT_CAPABILITY_RESOURCE_UPDATES}},
+		{"unknown and duplicated", `["compression","deviceListDeltas","deviceListDeltas"]`, []string{CLIENT_CAPABILITY_DEVICE_LIST_DELTAS}},
+	}
+	for _, test := range tests {
+		conn, _ := newTestWebClient(test.name, "user")
+		//hub goroutines read capabilities of connections while client negotiates them
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				conn.hasCapability(CLIENT_CAPABILITY_RESOURCE_UPDATES)
+			}
+		}()
+		accepted := negotiateCapabilities(conn, gjson.Parse(test.requested).Array())
+		<-done
+		if len(accepted) != len(test.accepted) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.accepted, accepted)
+		}
+		for i, capability := range test.accepted {
+			if (i < len(accepted) && accepted[i] != capability) || !conn.hasCapability(capability) {
+				t.Errorf("%s: capability %s not accepted", test.name, capability)
+			}
+		}
+		if capabilities := conn.getCapabilityList(); len(capabilities) != len(test.accepted) {
+			t.Errorf("%s: unexpected capability list %v", test.name, capabilities)
+		}
+		conn.Queue.Close()
+	}
+}
+
+func TestSubscriptionsConcurrentWithEvents(t *testing.T) {
+	conn, _ := newTestWebClient("client", "user")
+	defer conn.Queue.Close()
+	server := &ClientConnectionServer{}
+	device := newTestLamp()
+	tests := []struct {
+		name       string
+		sub        *WebClientSubscription
+		subscribed bool
+	}{
+		{"device", &WebClientSubscription{HubUuid: "hub", Uuid: "lamp"}, true},
+		{"resource type", &WebClientSubscription{ResourceType: "oic.r.switch.binary"}, true},
+		{"other resource", &WebClientSubscription{Href: "/dimming"}, false},
+		{"other hub", &WebClientSubscription{HubUuid: "other"}, false},
+	}
+	for _, test := range tests {
+		//hub goroutines check subscriptions while client changes them
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				conn.isSubscribed("hub", device, device.getVariable("/switch"))
+			}
+		}()
+		if !conn.storeSubscription(test.sub) || conn.storeSubscription(test.sub) {
+			t.Errorf("%s: subscription has to be stored once", test.name)
+		}
+		<-done
+		if subscribed := conn.isSubscribed("hub", device, device.getVariable("/switch")); subscribed != test.subscribed {
+			t.Errorf("%s: expected subscribed %v, got %v", test.name, test.subscribed, subscribed)
+		}
+		if !server.removeSubscription(conn, test.sub) || conn.isSubscribed("hub", device, device.getVariable("/switch")) {
+			t.Errorf("%s: subscription was not removed", test.name)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	CLUSTER_MESSAGE_HELLO        = "hello"
+	CLUSTER_MESSAGE_HEARTBEAT    = "heartbeat"
+	CLUSTER_MESSAGE_HUB_STATE    = "hubState"
+	CLUSTER_MESSAGE_HUB_OFFLINE  = "hubOffline"
+	CLUSTER_MESSAGE_VALUE_UPDATE = "valueUpdate"
+	CLUSTER_MESSAGE_HUB_REQUEST  = "hubRequest"
+	CLUSTER_MESSAGE_HUB_RESPONSE = "hubResponse"
+
+	CLUSTER_HEARTBEAT_INTERVAL = 10 * time.Second
+	CLUSTER_INSTANCE_TIMEOUT   = 35 * time.Second
+)
+
+type ClusterMessage struct {
+	Type         string          `json:"type"`
+	Origin       string          `json:"origin"`
+	Target       string          `json:"target,omitempty"`
+	Username     string          `json:"username,omitempty"`
+	HubUUID      string          `json:"hubUuid,omitempty"`
+	HubName      string          `json:"hubName,omitempty"`
+	Capabilities []string        `json:"capabilities,omitempty"`
+	DeviceUUID   string          `json:"uuid,omitempty"`
+	Resource     string          `json:"resource,omitempty"`
+	Mid          int64           `json:"mid,omitempty"`
+	Name         string          `json:"name,omitempty"`
+	Payload      json.RawMessage `json:"payload,omitempty"`
+}
+
+//remoteHub is a hub connected to other instance, it is kept in hub connections list
+//as HubConnection which forwards requests through the cluster
+type remoteHub struct {
+	Connection *HubConnection
+	Instance   string
+}
+
+//Cluster shares hub location and presence between gateway instances, hubs of other
+//instances are visible locally so web clients, Alexa, scenes and rules can use them
+type Cluster struct {
+	ID                     string
+	Transport              ClusterTransport
+	HubConnections         *list.List
+	ClientConnectionServer *ClientConnectionServer
+
+	mutex     sync.Mutex
+	remotes   map[string]*remoteHub
+	instances map[string]time.Time
+}
+
+func NewCluster(transport ClusterTransport, hubConnections *list.List, clientConnectionServer *ClientConnectionServer) *Cluster {
+	id := os.Getenv("CLUSTER_INSTANCE_ID")
+	if id == "" {
+		log.Println("CLUSTER_INSTANCE_ID is not set, virtual devices of this instance are not kept across restarts")
+		id = generateMessageUUID()
+	}
+	cluster := &Cluster{
+		ID:                     id,
+		Transport:              transport,
+		HubConnections:         hubConnections,
+		ClientConnectionServer: clientConnectionServer,
+		remotes:                make(map[string]*remoteHub),
+		instances:              make(map[string]time.Time),
+	}
+	transport.Subscribe(cluster.handleMessage)
+	cluster.publish(&ClusterMessage{Type: CLUSTER_MESSAGE_HELLO})
+	go cluster.run()
+	log.Println("Cluster instance " + id + " started")
+	return cluster
+}
+
+func (cluster *Cluster) publish(message *ClusterMessage) {
+	message.Origin = cluster.ID
+	err := cluster.Transport.Publish(message)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (cluster *Cluster) run() {
+	ticker := time.NewTicker(CLUSTER_HEARTBEAT_INTERVAL)
+	for range ticker.C {
+		cluster.publish(&ClusterMessage{Type: CLUSTER_MESSAGE_HEARTBEAT})
+		cluster.expireInstances()
+	}
+}
+
+//PublishHubState announces local hub with its devices to other instances
+func (cluster *Cluster) PublishHubState(conn *HubConnection) {
+	if cluster == nil || conn.Username == "" || conn.Remote {
+		return
+	}
+	//hub moved to this instance
+	if remote := cluster.getRemoteHub(conn.Uuid); remote != nil {
+		cluster.removeRemoteHub(conn.Uuid, remote.Instance)
+	}
+	devicesData, _ := json.Marshal(conn.getDevices())
+	cluster.publish(&ClusterMessage{
+		Type:         CLUSTER_MESSAGE_HUB_STATE,
+		Username:     conn.Username,
+		HubUUID:      conn.Uuid,
+		HubName:      conn.getName(),
+		Capabilities: conn.getCapabilityList(),
+		Payload:      devicesData,
+	})
+}
+
+func (cluster *Cluster) PublishHubOffline(conn *HubConnection) {
+	if cluster == nil || conn.Username == "" || conn.Remote {
+		return
+	}
+	cluster.publish(&ClusterMessage{Type: CLUSTER_MESSAGE_HUB_OFFLINE, HubUUID: conn.Uuid})
+}
+
+func (cluster *Cluster) PublishValueUpdate(conn *HubConnection, deviceUUID string, resource string, value []byte) {
+	if cluster == nil || conn.Username == "" || conn.Remote || len(value) == 0 {
+		return
+	}
+	cluster.publish(&ClusterMessage{
+		Type:       CLUSTER_MESSAGE_VALUE_UPDATE,
+		HubUUID:    conn.Uuid,
+		DeviceUUID: deviceUUID,
+		Resource:   resource,
+		Payload:    value,
+	})
+}
+
+func (cluster *Cluster) handleMessage(message *ClusterMessage) {
+	if message.Origin == cluster.ID || (message.Target != "" && message.Target != cluster.ID) {
+		return
+	}
+	cluster.mutex.Lock()
+	cluster.instances[message.Origin] = time.Now()
+	cluster.mutex.Unlock()
+
+	switch message.Type {
+	case CLUSTER_MESSAGE_HELLO:
+		for _, conn := range getHubConnections(cluster.HubConnections) {
+			cluster.PublishHubState(conn)
+		}
+	case CLUSTER_MESSAGE_HUB_STATE:
+		cluster.handleHubState(message)
+	case CLUSTER_MESSAGE_HUB_OFFLINE:
+		cluster.removeRemoteHub(message.HubUUID, message.Origin)
+	case CLUSTER_MESSAGE_VALUE_UPDATE:
+		cluster.handleValueUpdate(message)
+	case CLUSTER_MESSAGE_HUB_REQUEST:
+		cluster.handleHubRequest(message)
+	case CLUSTER_MESSAGE_HUB_RESPONSE:
+		cluster.handleHubResponse(message)
+	}
+}
+
+func (cluster *Cluster) isLocalHub(hubUUID string) bool {
+	for _, con := range getHubConnections(cluster.HubConnections) {
+		if con.Uuid == hubUUID && !con.Remote {
+			return true
+		}
+	}
+	return false
+}
+
+func (cluster *Cluster) getRemoteHub(hubUUID string) *remoteHub {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	return cluster.remotes[hubUUID]
+}
+
+func (cluster *Cluster) handleHubState(message *ClusterMessage) {
+	if cluster.isLocalHub(message.HubUUID) {
+		return
+	}
+	var devices []*IotDevice
+	err := json.Unmarshal(message.Payload, &devices)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	remote := cluster.getRemoteHub(message.HubUUID)
+	if remote != nil && (remote.Instance != message.Origin || remote.Connection.Username != message.Username) {
+		cluster.removeRemoteHub(message.HubUUID, remote.Instance)
+		remote = nil
+	}
+	if remote == nil {
+		log.Println("Hub " + message.HubUUID + " is connected to instance " + message.Origin)
+		conn := &HubConnection{
+			Username:  message.Username,
+			Uuid:      message.HubUUID,
+			Name:      message.HubName,
+			Mid:       1,
+			Callbacks: make(map[int64]RequestCallback),
+			Closed:    make(chan struct{}),
+			Remote:    true,
+		}
+		instance := message.Origin
+		conn.Forward = func(mid int64, name string, payload string) {
+			cluster.publish(&ClusterMessage{
+				Type:     CLUSTER_MESSAGE_HUB_REQUEST,
+				Target:   instance,
+				Username: conn.Username,
+				HubUUID:  conn.Uuid,
+				Mid:      mid,
+				Name:     name,
+				Payload:  json.RawMessage(payload),
+			})
+		}
+		remote = &remoteHub{Connection: conn, Instance: instance}
+		cluster.mutex.Lock()
+		cluster.remotes[message.HubUUID] = remote
+		cluster.mutex.Unlock()
+		addHubConnection(cluster.HubConnections, conn)
+	}
+
+	conn := remote.Connection
+	//remote hub answers forwarded requests the way it negotiated with its instance
+	capabilities := make(map[string]bool)
+	for _, capability := range message.Capabilities {
+		capabilities[capability] = true
+	}
+	conn.mutex.Lock()
+	conn.Capabilities = capabilities
+	conn.mutex.Unlock()
+	var added, removed, changed []*IotDevice
+	hubsMutex.Lock()
+	conn.Name = message.HubName
+	for _, device := range devices {
+		device.HubUUID = conn.Uuid
+		existing := conn.findDevice(device.UUID)
+		if existing == nil {
+			conn.DeviceList.PushBack(device)
+			added = append(added, device.copy())
+		} else if existing.Name != device.Name || len(existing.Variables) != len(device.Variables) {
+			existing.Name = device.Name
+			existing.Variables = device.Variables
+			changed = append(changed, existing.copy())
+		} else {
+			existing.Variables = device.Variables
+		}
+	}
+	var next *list.Element
+	for d := conn.DeviceList.Front(); d != nil; d = next {
+		next = d.Next()
+		device := d.Value.(*IotDevice)
+		found := false
+		for _, current := range devices {
+			if current.UUID == device.UUID {
+				found = true
+			}
+		}
+		if !found {
+			conn.DeviceList.Remove(d)
+			removed = append(removed, device)
+		}
+	}
+	hubsMutex.Unlock()
+	cluster.ClientConnectionServer.notifyDevicesAdded(conn, added)
+	cluster.ClientConnectionServer.notifyDevicesRemoved(conn, removed)
+	for _, device := range changed {
+		cluster.ClientConnectionServer.notifyDeviceChanged(conn, device)
+	}
+}
+
+//removeRemoteHub drops hub of instance, hub which moved to other instance is kept
+func (cluster *Cluster) removeRemoteHub(hubUUID string, instance string) {
+	cluster.mutex.Lock()
+	remote := cluster.remotes[hubUUID]
+	if remote == nil || remote.Instance != instance {
+		cluster.mutex.Unlock()
+		return
+	}
+	delete(cluster.remotes, hubUUID)
+	cluster.mutex.Unlock()
+
+	log.Println("Hub " + hubUUID + " of instance " + instance + " is offline")
+	removeHubConnection(cluster.HubConnections, remote.Connection)
+	close(remote.Connection.Closed)
+	cluster.ClientConnectionServer.notifyDevicesRemoved(remote.Connection, remote.Connection.getDevices())
+}
+
+func (cluster *Cluster) expireInstances() {
+	cluster.mutex.Lock()
+	var expired []*remoteHub
+	for instance, seen := range cluster.instances {
+		if time.Since(seen) < CLUSTER_INSTANCE_TIMEOUT {
+			continue
+		}
+		log.Println("Cluster instance " + instance + " timed out")
+		delete(cluster.instances, instance)
+		for _, remote := range cluster.remotes {
+			if remote.Instance == instance {
+				expired = append(expired, remote)
+			}
+		}
+	}
+	cluster.mutex.Unlock()
+	for _, remote := range expired {
+		cluster.removeRemoteHub(remote.Connection.Uuid, remote.Instance)
+	}
+}
+
+//handleValueUpdate updates value of remote hub resource and notifies local web clients
+func (cluster *Cluster) handleValueUpdate(message *ClusterMessage) {
+	remote := cluster.getRemoteHub(message.HubUUID)
+	if remote == nil {
+		return
+	}
+	value := gjson.ParseBytes(message.Payload)
+	if _, _, err := remote.Connection.updateValue(message.DeviceUUID, message.Resource, value, false); err != nil {
+		log.Println(err)
+		return
+	}
+	cluster.ClientConnectionServer.notifyDeviceResourceChange(message.HubUUID, message.DeviceUUID, message.Resource, value)
+}
+
+//handleHubRequest sends request of other instance to local hub owned by user of the request
+//and publishes hub response
+func (cluster *Cluster) handleHubRequest(message *ClusterMessage) {
+	var hub *HubConnection
+	for _, con := range getHubConnections(cluster.HubConnections) {
+		if con.Uuid == message.HubUUID && !con.Remote {
+			hub = con
+		}
+	}
+	reply := func(response string) {
+		cluster.publish(&ClusterMessage{
+			Type:    CLUSTER_MESSAGE_HUB_RESPONSE,
+			Target:  message.Origin,
+			HubUUID: message.HubUUID,
+			Mid:     message.Mid,
+			Payload: json.RawMessage(response),
+		})
+	}
+	if hub == nil {
+		reply(`{ "mid":` + strconv.FormatInt(message.Mid, 10) + `,"name":"` + message.Name + `", "payload":{"status":"error","error":"` + errHubOffline.Error() + `"}}`)
+		return
+	}
+	if hub.Username == "" || hub.Username != message.Username {
+		log.Println("Rejecting cluster request of " + message.Username + " to hub " + hub.Uuid + " of other user")
+		reply(`{ "mid":` + strconv.FormatInt(message.Mid, 10) + `,"name":"` + message.Name + `", "payload":{"status":"error","error":"` + errNotAuthorized.Error() + `"}}`)
+		return
+	}
+	sendRequest(hub, message.Name, string(message.Payload), reply)
+}
+
+func (cluster *Cluster) handleHubResponse(message *ClusterMessage) {
+	remote := cluster.getRemoteHub(message.HubUUID)
+	if remote == nil {
+		return
+	}
+	callback := remote.Connection.popCallback(message.Mid)
+	if callback != nil {
+		callback(string(message.Payload))
+	}
+}
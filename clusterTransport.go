@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	iris "gopkg.in/kataras/iris.v6"
+)
+
+const (
+	CLUSTER_PATH          = "/cluster/messages"
+	CLUSTER_SECRET_HEADER = "X-Cluster-Secret"
+	CLUSTER_PEER_QUEUE    = 1000
+	CLUSTER_PEER_TIMEOUT  = 5 * time.Second
+)
+
+//ClusterTransport delivers messages between gateway instances, every published message
+//is delivered to handlers of all other instances
+type ClusterTransport interface {
+	Publish(message *ClusterMessage) error
+	Subscribe(handler func(message *ClusterMessage))
+}
+
+//MemoryClusterBus connects instances running in one process, used for local setups and tests
+type MemoryClusterBus struct {
+	mutex      sync.Mutex
+	transports []*MemoryClusterTransport
+}
+
+type MemoryClusterTransport struct {
+	bus      *MemoryClusterBus
+	messages chan *ClusterMessage
+	mutex    sync.Mutex
+	handlers []func(message *ClusterMessage)
+}
+
+func NewMemoryClusterBus() *MemoryClusterBus {
+	return &MemoryClusterBus{}
+}
+
+//Connect returns transport of a new instance attached to the bus
+func (bus *MemoryClusterBus) Connect() *MemoryClusterTransport {
+	transport := &MemoryClusterTransport{
+		bus:      bus,
+		messages: make(chan *ClusterMessage, CLUSTER_PEER_QUEUE),
+	}
+	bus.mutex.Lock()
+	bus.transports = append(bus.transports, transport)
+	bus.mutex.Unlock()
+	go transport.run()
+	return transport
+}
+
+func (transport *MemoryClusterTransport) run() {
+	for message := range transport.messages {
+		transport.mutex.Lock()
+		handlers := transport.handlers
+		transport.mutex.Unlock()
+		for _, handler := range handlers {
+			handler(message)
+		}
+	}
+}
+
+func (transport *MemoryClusterTransport) Publish(message *ClusterMessage) error {
+	transport.bus.mutex.Lock()
+	defer transport.bus.mutex.Unlock()
+	for _, peer := range transport.bus.transports {
+		if peer == transport {
+			continue
+		}
+		select {
+		case peer.messages <- message:
+		default:
+			return errors.New("cluster peer queue is full")
+		}
+	}
+	return nil
+}
+
+func (transport *MemoryClusterTransport) Subscribe(handler func(message *ClusterMessage)) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	transport.handlers = append(transport.handlers, handler)
+}
+
+//HTTPClusterTransport posts messages to configured peers, each peer has own ordered queue
+type HTTPClusterTransport struct {
+	Secret string
+
+	peers    map[string]chan []byte
+	mutex    sync.Mutex
+	handlers []func(message *ClusterMessage)
+}
+
+//NewHTTPClusterTransport registers endpoint receiving messages of peers
+func NewHTTPClusterTransport(app *iris.Framework, peers []string, secret string) *HTTPClusterTransport {
+	transport := &HTTPClusterTransport{
+		Secret: secret,
+		peers:  make(map[string]chan []byte),
+	}
+	for _, peer := range peers {
+		queue := make(chan []byte, CLUSTER_PEER_QUEUE)
+		transport.peers[peer] = queue
+		go transport.runPeer(peer, queue)
+	}
+
+	app.Post(CLUSTER_PATH, func(c *iris.Context) {
+		if !transport.isAuthorized(c.Request.Header.Get(CLUSTER_SECRET_HEADER)) {
+			c.JSON(iris.StatusUnauthorized, &RestError{Error: "invalid cluster secret"})
+			return
+		}
+		message := &ClusterMessage{}
+		err := c.ReadJSON(message)
+		if err != nil {
+			c.JSON(iris.StatusBadRequest, &RestError{Error: err.Error()})
+			return
+		}
+		transport.mutex.Lock()
+		handlers := transport.handlers
+		transport.mutex.Unlock()
+		for _, handler := range handlers {
+			handler(message)
+		}
+		c.JSON(iris.StatusOK, iris.Map{"status": "ok"})
+	})
+	return transport
+}
+
+//isAuthorized compares secret of peer in constant time, transport without secret accepts nothing
+func (transport *HTTPClusterTransport) isAuthorized(secret string) bool {
+	return transport.Secret != "" && hmac.Equal([]byte(secret), []byte(transport.Secret))
+}
+
+func (transport *HTTPClusterTransport) runPeer(peer string, queue chan []byte) {
+	client := &http.Client{Timeout: CLUSTER_PEER_TIMEOUT}
+	for body := range queue {
+		req, err := http.NewRequest("POST", strings.TrimSuffix(peer, "/")+CLUSTER_PATH, bytes.NewReader(body))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		req.Header.Add("Content-type", "application/json")
+		req.Header.Add(CLUSTER_SECRET_HEADER, transport.Secret)
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Println("Unable to reach cluster peer " + peer + ": " + err.Error())
+			continue
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Println("Cluster peer " + peer + " responded with " + strconv.Itoa(resp.StatusCode))
+		}
+	}
+}
+
+func (transport *HTTPClusterTransport) Publish(message *ClusterMessage) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	for peer, queue := range transport.peers {
+		select {
+		case queue <- body:
+		default:
+			log.Println("Dropping cluster message to " + peer + ", queue is full")
+		}
+	}
+	return nil
+}
+
+func (transport *HTTPClusterTransport) Subscribe(handler func(message *ClusterMessage)) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	transport.handlers = append(transport.handlers, handler)
+}
+
+//newClusterTransport creates transport configured by CLUSTER_PEERS and CLUSTER_SECRET,
+//nil disables clustering
+func newClusterTransport(app *iris.Framework) ClusterTransport {
+	peers := os.Getenv("CLUSTER_PEERS")
+	if peers == "" {
+		return nil
+	}
+	secret := os.Getenv("CLUSTER_SECRET")
+	if secret == "" {
+		log.Println("CLUSTER_SECRET is not set, clustering is disabled")
+		return nil
+	}
+	return NewHTTPClusterTransport(app, strings.Split(peers, ","), secret)
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestClusterSecret(t *testing.T) {
+	tests := []struct {
+		name       string
+		secret     string
+		received   string
+		authorized bool
+	}{
+		{"matching secret", "secret", "secret", true},
+		{"wrong secret", "secret", "other", false},
+		{"missing secret", "secret", "", false},
+		{"prefix of secret", "secret", "secr", false},
+		{"transport without secret", "", "", false},
+	}
+	for _, test := range tests {
+		transport := &HTTPClusterTransport{Secret: test.secret}
+		if transport.isAuthorized(test.received) != test.authorized {
+			t.Errorf("%s: expected authorized %v", test.name, test.authorized)
+		}
+	}
+}
+
+func TestClusterRequiresSecret(t *testing.T) {
+	t.Setenv("CLUSTER_PEERS", "http://peer:12345")
+	t.Setenv("CLUSTER_SECRET", "")
+	if newClusterTransport(nil) != nil {
+		t.Errorf("clustering enabled without CLUSTER_SECRET")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+type testClusterInstance struct {
+	hubs    *list.List
+	server  *ClientConnectionServer
+	cluster *Cluster
+}
+
+func newTestClusterInstance(bus *MemoryClusterBus) *testClusterInstance {
+	instance := &testClusterInstance{hubs: list.New()}
+	overlays := NewOverlayStore()
+	instance.server = &ClientConnectionServer{
+		HubConnections:       instance.hubs,
+		WebClientConnections: list.New(),
+		DeviceVersions:       NewDeviceVersions(),
+		Overlays:             overlays,
+		Groups:               NewGroupStore(overlays),
+	}
+	instance.cluster = NewCluster(bus.Connect(), instance.hubs, instance.server)
+	return instance
+}
+
+func waitFor(t *testing.T, description string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterInstances(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	bus := NewMemoryClusterBus()
+	first := newTestClusterInstance(bus)
+	second := newTestClusterInstance(bus)
+
+	hub, connection := newTestHubConnection(HUB_CAPABILITY_ACKNOWLEDGE)
+	defer hub.Queue.Close()
+	addHubConnection(first.hubs, hub)
+	first.cluster.PublishHubState(hub)
+
+	var remote *HubConnection
+	waitFor(t, "hub was not announced to other instance", func() bool {
+		remote = findHubConnection(second.hubs, "user", "hub")
+		return remote != nil && remote.getDevice("lamp") != nil
+	})
+	if remote.Forward == nil || !remote.supports(HUB_CAPABILITY_ACKNOWLEDGE) {
+		t.Errorf("remote hub must forward requests with capabilities of the hub")
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		accepted bool
+	}{
+		{"request of hub owner", "user", true},
+		{"request of other user", "other", false},
+	}
+	for i, test := range tests {
+		mid := int64(1000 + i)
+		responses := make(chan string, 1)
+		remote.mutex.Lock()
+		remote.Callbacks[mid] = func(response string) {
+			responses <- response
+		}
+		remote.mutex.Unlock()
+		second.cluster.publish(&ClusterMessage{
+			Type:     CLUSTER_MESSAGE_HUB_REQUEST,
+			Target:   first.cluster.ID,
+			Username: test.username,
+			HubUUID:  "hub",
+			Mid:      mid,
+			Name:     "RequestSetValue",
+			Payload:  json.RawMessage(`{"uuid":"lamp","resource":"/switch","value":{"value":false}}`),
+		})
+		if test.accepted {
+			frame := connection.nextFrame(t)
+			if frame.Get("name").String() != "RequestSetValue" || frame.Get("payload.uuid").String() != "lamp" {
+				t.Errorf("%s: unexpected hub request %s", test.name, frame.Raw)
+			}
+			hub.popCallback(frame.Get("mid").Int())(string(messageFrame(frame.Get("mid").Int(), "ResponseSetValue", `{"status":"ok"}`)))
+		}
+		select {
+		case response := <-responses:
+			if accepted := gjson.Get(response, "payload.status").String() == "ok"; accepted != test.accepted {
+				t.Errorf("%s: unexpected response %s", test.name, response)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: no response", test.name)
+		}
+	}
+	select {
+	case frame := <-connection.frames:
+		t.Errorf("request of other user reached hub %s", frame.Raw)
+	default:
+	}
+
+	client, clientConnection := newTestWebClient("client", "user", CLIENT_CAPABILITY_RESOURCE_UPDATES)
+	defer client.Queue.Close()
+	second.server.handleRequestSubscribeDevice(client, "lamp", "hub")
+	second.server.addWebClient(client)
+	first.cluster.PublishValueUpdate(hub, "lamp", "/dimming", []byte(`{"dimmingSetting":5}`))
+	for {
+		frame := clientConnection.nextFrame(t)
+		if frame.Get("name").String() == "EventResourceUpdate" {
+			if frame.Get("payload.value.dimmingSetting").Int() != 5 {
+				t.Errorf("unexpected value update %s", frame.Raw)
+			}
+			break
+		}
+	}
+
+	first.cluster.PublishHubOffline(hub)
+	waitFor(t, "offline hub was not removed", func() bool {
+		return findHubConnection(second.hubs, "user", "hub") == nil
+	})
+
+	virtual := &HubConnection{Username: "user", Uuid: getVirtualHubUUID("user"), Callbacks: make(map[int64]RequestCallback), Virtual: true}
+	virtual.Forward = func(mid int64, name string, payload string) {}
+	virtual.DeviceList.PushBack(newTestLamp())
+	addHubConnection(first.hubs, virtual)
+	first.cluster.PublishHubState(virtual)
+	waitFor(t, "virtual hub was not announced to other instance", func() bool {
+		remote := findHubConnection(second.hubs, "user", virtual.Uuid)
+		return remote != nil && remote.Remote && !remote.Virtual
+	})
+}
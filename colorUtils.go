@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	MIN_MIRED = 153 //6500K
+	MAX_MIRED = 500 //2000K
+
+	CHROMA_SATURATION_MAX = 100
+)
+
+//Colour temperature steps used by Alexa when increasing or decreasing white temperature
+var alexaColorTemperatureSteps = []int64{2200, 2700, 4000, 5500, 7000}
+
+type HSBColor struct {
+	Hue        float64 `json:"hue"`
+	Saturation float64 `json:"saturation"`
+	Brightness float64 `json:"brightness"`
+}
+
+//hsbToRgb converts hue (0-360), saturation and brightness (0-1) into rgb components (0-1)
+func hsbToRgb(color HSBColor) (float64, float64, float64) {
+	hue := math.Mod(color.Hue, 360)
+	if hue < 0 {
+		hue += 360
+	}
+	chroma := color.Brightness * color.Saturation
+	x := chroma * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+	m := color.Brightness - chroma
+
+	var r, g, b float64
+	switch {
+	case hue < 60:
+		r, g, b = chroma, x, 0
+	case hue < 120:
+		r, g, b = x, chroma, 0
+	case hue < 180:
+		r, g, b = 0, chroma, x
+	case hue < 240:
+		r, g, b = 0, x, chroma
+	case hue < 300:
+		r, g, b = x, 0, chroma
+	default:
+		r, g, b = chroma, 0, x
+	}
+	return r + m, g + m, b + m
+}
+
+func rgbToHsb(r float64, g float64, b float64) HSBColor {
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	delta := max - min
+
+	color := HSBColor{Brightness: max}
+	if max > 0 {
+		color.Saturation = delta / max
+	}
+	if delta == 0 {
+		return color
+	}
+	switch max {
+	case r:
+		color.Hue = 60 * math.Mod((g-b)/delta, 6)
+	case g:
+		color.Hue = 60 * ((b-r)/delta + 2)
+	default:
+		color.Hue = 60 * ((r-g)/delta + 4)
+	}
+	if color.Hue < 0 {
+		color.Hue += 360
+	}
+	return color
+}
+
+func kelvinToMired(kelvin int64) float64 {
+	if kelvin <= 0 {
+		return MAX_MIRED
+	}
+	return math.Round(1000000 / float64(kelvin))
+}
+
+func miredToKelvin(mired float64) int64 {
+	if mired <= 0 {
+		return 0
+	}
+	return int64(math.Round(1000000 / mired))
+}
+
+//nextColorTemperature returns next Alexa temperature step warmer or cooler than current one
+func nextColorTemperature(kelvin int64, cooler bool) int64 {
+	if cooler {
+		for _, step := range alexaColorTemperatureSteps {
+			if step > kelvin {
+				return step
+			}
+		}
+		return alexaColorTemperatureSteps[len(alexaColorTemperatureSteps)-1]
+	}
+	for i := len(alexaColorTemperatureSteps) - 1; i >= 0; i-- {
+		if alexaColorTemperatureSteps[i] < kelvin {
+			return alexaColorTemperatureSteps[i]
+		}
+	}
+	return alexaColorTemperatureSteps[0]
+}
+
+//GetColor returns current colour of rgb or chroma resource
+func (c *ResourceCapability) GetColor() HSBColor {
+	value := c.Value()
+	if c.Capability.ValueType == VALUE_TYPE_HSV {
+		return HSBColor{
+			Hue:        value.Get("hue").Float(),
+			Saturation: value.Get("saturation").Float() / CHROMA_SATURATION_MAX,
+			Brightness: 1,
+		}
+	}
+	r := c.Range()
+	scale := r.Max - r.Min
+	components := value.Get(c.Capability.Property).Array()
+	if len(components) != 3 || scale <= 0 {
+		return HSBColor{}
+	}
+	return rgbToHsb(
+		(components[0].Float()-r.Min)/scale,
+		(components[1].Float()-r.Min)/scale,
+		(components[2].Float()-r.Min)/scale)
+}
+
+//SetColor writes colour to rgb or chroma resource, chroma brightness is handled by dimming resource
+func (c *ResourceCapability) SetColor(conn *HubConnection, color HSBColor) error {
+	if c.Capability.ValueType == VALUE_TYPE_HSV {
+		hue := c.Range().clamp(math.Round(color.Hue))
+		saturation := math.Round(math.Max(0, math.Min(1, color.Saturation)) * CHROMA_SATURATION_MAX)
+		err := setDeviceValueSync(conn, c.Device.UUID, c.Variable.Href, `{"hue":`+formatNumber(hue)+`,"saturation":`+formatNumber(saturation)+`}`)
+		if err != nil {
+			return err
+		}
+
+		dimming := c.Device.getCapability(CAPABILITY_PERCENTAGE)
+		if dimming != nil {
+			return dimming.SetPercent(conn, int64(math.Round(color.Brightness*100)))
+		}
+		return nil
+	}
+	r := c.Range()
+	red, green, blue := hsbToRgb(color)
+	var components []float64
+	for _, component := range []float64{red, green, blue} {
+		components = append(components, math.Round(r.Min+component*(r.Max-r.Min)))
+	}
+	return c.SetArray(conn, components)
+}
+
+func (c *ResourceCapability) GetColorTemperature() int64 {
+	return miredToKelvin(c.GetNumber())
+}
+
+func (c *ResourceCapability) SetColorTemperature(conn *HubConnection, kelvin int64) (int64, error) {
+	mired := c.Range().clamp(kelvinToMired(kelvin))
+	err := c.SetNumber(conn, mired)
+	return miredToKelvin(mired), err
+}
+
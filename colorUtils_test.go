@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHsbToRgb(t *testing.T) {
+	tests := []struct {
+		name    string
+		color   HSBColor
+		r, g, b float64
+	}{
+		{"red", HSBColor{Hue: 0, Saturation: 1, Brightness: 1}, 1, 0, 0},
+		{"green", HSBColor{Hue: 120, Saturation: 1, Brightness: 1}, 0, 1, 0},
+		{"blue", HSBColor{Hue: 240, Saturation: 1, Brightness: 1}, 0, 0, 1},
+		{"yellow", HSBColor{Hue: 60, Saturation: 1, Brightness: 1}, 1, 1, 0},
+		{"white", HSBColor{Hue: 0, Saturation: 0, Brightness: 1}, 1, 1, 1},
+		{"black", HSBColor{Hue: 200, Saturation: 1, Brightness: 0}, 0, 0, 0},
+		{"half bright cyan", HSBColor{Hue: 180, Saturation: 1, Brightness: 0.5}, 0, 0.5, 0.5},
+		{"hue wraps", HSBColor{Hue: 480, Saturation: 1, Brightness: 1}, 0, 1, 0},
+		{"negative hue", HSBColor{Hue: -120, Saturation: 1, Brightness: 1}, 0, 0, 1},
+	}
+	for _, test := range tests {
+		r, g, b := hsbToRgb(test.color)
+		if math.Abs(r-test.r) > 1e-9 || math.Abs(g-test.g) > 1e-9 || math.Abs(b-test.b) > 1e-9 {
+			t.Errorf("%s: expected %v %v %v, got %v %v %v", test.name, test.r, test.g, test.b, r, g, b)
+		}
+		color := rgbToHsb(r, g, b)
+		back, _, _ := hsbToRgb(color)
+		if math.Abs(back-r) > 1e-9 {
+			t.Errorf("%s: round trip changed colour to %+v", test.name, color)
+		}
+	}
+}
+
+func TestRgbToHsb(t *testing.T) {
+	tests := []struct {
+		name    string
+		r, g, b float64
+		color   HSBColor
+	}{
+		{"red", 1, 0, 0, HSBColor{Hue: 0, Saturation: 1, Brightness: 1}},
+		{"magenta", 1, 0, 1, HSBColor{Hue: 300, Saturation: 1, Brightness: 1}},
+		{"orange", 1, 0.5, 0, HSBColor{Hue: 30, Saturation: 1, Brightness: 1}},
+		{"grey", 0.5, 0.5, 0.5, HSBColor{Hue: 0, Saturation: 0, Brightness: 0.5}},
+		{"black", 0, 0, 0, HSBColor{}},
+	}
+	for _, test := range tests {
+		color := rgbToHsb(test.r, test.g, test.b)
+		if math.Abs(color.Hue-test.color.Hue) > 1e-9 || math.Abs(color.Saturation-test.color.Saturation) > 1e-9 ||
+			math.Abs(color.Brightness-test.color.Brightness) > 1e-9 {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.color, color)
+		}
+	}
+}
+
+func TestColorTemperature(t *testing.T) {
+	tests := []struct {
+		kelvin int64
+		mired  float64
+		warmer int64
+		cooler int64
+	}{
+		{2000, 500, 2200, 2200},
+		{2700, 370, 2200, 4000},
+		{4000, 250, 2700, 5500},
+		{6500, 154, 5500, 7000},
+		{7000, 143, 5500, 7000},
+	}
+	for _, test := range tests {
+		if mired := kelvinToMired(test.kelvin); mired != test.mired {
+			t.Errorf("%dK: expected %v mired, got %v", test.kelvin, test.mired, mired)
+		}
+		if kelvin := miredToKelvin(test.mired); math.Abs(float64(kelvin-test.kelvin)) > 20 {
+			t.Errorf("%v mired: expected about %dK, got %dK", test.mired, test.kelvin, kelvin)
+		}
+		if warmer := nextColorTemperature(test.kelvin, false); warmer != test.warmer {
+			t.Errorf("%dK: expected warmer %dK, got %dK", test.kelvin, test.warmer, warmer)
+		}
+		if cooler := nextColorTemperature(test.kelvin, true); cooler != test.cooler {
+			t.Errorf("%dK: expected cooler %dK, got %dK", test.kelvin, test.cooler, cooler)
+		}
+	}
+	if kelvinToMired(0) != MAX_MIRED || miredToKelvin(0) != 0 {
+		t.Errorf("zero values must not divide by zero")
+	}
+}
+
+func TestGetColor(t *testing.T) {
+	tests := []struct {
+		name         string
+		resourceType string
+		value        string
+		color        HSBColor
+	}{
+		{"rgb", "oic.r.colour.rgb", `{"rgbValue":[255,0,0]}`, HSBColor{Hue: 0, Saturation: 1, Brightness: 1}},
+		{"rgb with advertised range", "oic.r.colour.rgb", `{"rgbValue":[0,100,0],"range":[0,100]}`, HSBColor{Hue: 120, Saturation: 1, Brightness: 1}},
+		{"rgb with missing component", "oic.r.colour.rgb", `{"rgbValue":[255,0]}`, HSBColor{}},
+		{"chroma", "oic.r.colour.chroma", `{"hue":240,"saturation":50}`, HSBColor{Hue: 240, Saturation: 0.5, Brightness: 1}},
+	}
+	for _, test := range tests {
+		device := &IotDevice{UUID: "light", Variables: []*IotVariable{
+			newTestVariable("/colour", test.resourceType, INTERFACE_ACTUATOR, test.value),
+		}}
+		capability := device.getCapability(CAPABILITY_COLOR)
+		if capability == nil {
+			t.Errorf("%s: colour capability not found", test.name)
+			continue
+		}
+		color := capability.GetColor()
+		if math.Abs(color.Hue-test.color.Hue) > 1e-9 || math.Abs(color.Saturation-test.color.Saturation) > 1e-9 ||
+			math.Abs(color.Brightness-test.color.Brightness) > 1e-9 {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.color, color)
+		}
+	}
+}
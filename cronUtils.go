@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//CronSpec is parsed five field cron expression: minute hour day-of-month month day-of-week
+type CronSpec struct {
+	minutes  [60]bool
+	hours    [24]bool
+	days     [32]bool
+	months   [13]bool
+	weekdays [7]bool
+
+	anyDay     bool
+	anyWeekday bool
+}
+
+func parseCronField(field string, min int, max int, values []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return errors.New("invalid cron step " + part)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			from, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return errors.New("invalid cron value " + part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				to, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return errors.New("invalid cron value " + part)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return errors.New("cron value out of range " + part)
+		}
+		for value := from; value <= to; value += step {
+			values[value] = true
+		}
+	}
+	return nil
+}
+
+func parseCron(expression string) (*CronSpec, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression requires 5 fields")
+	}
+	spec := &CronSpec{
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+	err := parseCronField(fields[0], 0, 59, spec.minutes[:])
+	if err == nil {
+		err = parseCronField(fields[1], 0, 23, spec.hours[:])
+	}
+	if err == nil {
+		err = parseCronField(fields[2], 1, 31, spec.days[:])
+	}
+	if err == nil {
+		err = parseCronField(fields[3], 1, 12, spec.months[:])
+	}
+	if err == nil {
+		//7 is accepted as sunday
+		weekdays := make([]bool, 8)
+		err = parseCronField(fields[4], 0, 7, weekdays)
+		for i := range spec.weekdays {
+			spec.weekdays[i] = weekdays[i]
+		}
+		spec.weekdays[0] = spec.weekdays[0] || weekdays[7]
+	}
+	if err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+func (spec *CronSpec) matchesDay(t time.Time) bool {
+	if !spec.months[t.Month()] {
+		return false
+	}
+	day := spec.days[t.Day()]
+	weekday := spec.weekdays[t.Weekday()]
+	if spec.anyDay && spec.anyWeekday {
+		return true
+	}
+	if spec.anyDay {
+		return weekday
+	}
+	if spec.anyWeekday {
+		return day
+	}
+	return day || weekday
+}
+
+func sameWallClock(a time.Time, b time.Time) bool {
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay() && a.Hour() == b.Hour() && a.Minute() == b.Minute()
+}
+
+//Next returns first time after given one matching the expression in location,
+//wall clock times skipped by DST are not run and repeated ones run once
+func (spec *CronSpec) Next(after time.Time, location *time.Location) (time.Time, bool) {
+	after = after.In(location)
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		//time.Date maps wall clock skipped by DST backwards, so hours are stepped in absolute time
+		nextHour := t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		if !spec.matchesDay(t) {
+			nextDay := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, location)
+			if !nextDay.After(t) {
+				nextDay = nextHour
+			}
+			t = nextDay
+			continue
+		}
+		if !spec.hours[t.Hour()] {
+			t = nextHour
+			continue
+		}
+		if !spec.minutes[t.Minute()] || sameWallClock(t, after) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		expression string
+		after      time.Time
+		expected   time.Time
+	}{
+		{"weekday morning", "0 9 * * 1-5", time.Date(2026, 3, 6, 10, 0, 0, 0, newYork), time.Date(2026, 3, 9, 9, 0, 0, 0, newYork)},
+		{"sunday as seven", "0 9 * * 7", time.Date(2026, 3, 6, 10, 0, 0, 0, newYork), time.Date(2026, 3, 8, 9, 0, 0, 0, newYork)},
+		{"day of month or weekday", "0 0 1 * 1", time.Date(2026, 3, 24, 0, 0, 0, 0, newYork), time.Date(2026, 3, 30, 0, 0, 0, 0, newYork)},
+		{"step", "*/20 * * * *", time.Date(2026, 3, 6, 10, 41, 0, 0, newYork), time.Date(2026, 3, 6, 11, 0, 0, 0, newYork)},
+		{"time skipped by spring forward", "30 2 * * *", time.Date(2026, 3, 7, 3, 0, 0, 0, newYork), time.Date(2026, 3, 9, 2, 30, 0, 0, newYork)},
+		{"hour after spring forward", "30 3 * * *", time.Date(2026, 3, 8, 1, 0, 0, 0, newYork), time.Date(2026, 3, 8, 3, 30, 0, 0, newYork)},
+		{"time repeated by fall back runs once", "30 1 * * *", time.Date(2026, 11, 1, 1, 30, 0, 0, newYork), time.Date(2026, 11, 2, 1, 30, 0, 0, newYork)},
+		{"hourly across fall back", "0 * * * *", time.Date(2026, 11, 1, 1, 0, 0, 0, newYork), time.Date(2026, 11, 1, 2, 0, 0, 0, newYork)},
+	}
+	for _, test := range tests {
+		spec, err := parseCron(test.expression)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		next, ok := spec.Next(test.after, newYork)
+		if !ok || !next.Equal(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, next)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	tests := []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	}
+	for _, expression := range tests {
+		if _, err := parseCron(expression); err == nil {
+			t.Errorf("%s: expected error", expression)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DEVICE_CHANGE_ADDED   = "added"
+	DEVICE_CHANGE_REMOVED = "removed"
+	DEVICE_CHANGE_CHANGED = "changed"
+
+	DEVICE_CHANGE_LOG_SIZE = 1000
+)
+
+//DeviceChange is a single entry of user device list change log
+type DeviceChange struct {
+	Version    int64      `json:"version"`
+	Type       string     `json:"type"`
+	HubUUID    string     `json:"hubUuid"`
+	HubName    string     `json:"hubName,omitempty"`
+	DeviceUUID string     `json:"uuid"`
+	Device     *IotDevice `json:"device,omitempty"`
+}
+
+//DeviceVersions keeps version of every user device list with bounded log of changes,
+//versions start at process start time so they keep growing across gateway restarts
+type DeviceVersions struct {
+	mutex    sync.Mutex
+	base     int64
+	versions map[string]int64
+	changes  map[string][]*DeviceChange
+	//oldest is the lowest version from which change log is complete
+	oldest map[string]int64
+}
+
+func NewDeviceVersions() *DeviceVersions {
+	return &DeviceVersions{
+		base:     time.Now().UnixNano() / int64(time.Millisecond),
+		versions: make(map[string]int64),
+		changes:  make(map[string][]*DeviceChange),
+		oldest:   make(map[string]int64),
+	}
+}
+
+func (versions *DeviceVersions) currentVersion(username string) int64 {
+	if version, ok := versions.versions[username]; ok {
+		return version
+	}
+	return versions.base
+}
+
+func (versions *DeviceVersions) getVersion(username string) int64 {
+	versions.mutex.Lock()
+	defer versions.mutex.Unlock()
+	return versions.currentVersion(username)
+}
+
+//record stores change of devices and returns new version of user device list
+func (versions *DeviceVersions) record(username string, changeType string, hubUUID string, hubName string, devices []*IotDevice) int64 {
+	versions.mutex.Lock()
+	defer versions.mutex.Unlock()
+	version := versions.currentVersion(username) + 1
+	changes := versions.changes[username]
+	for _, device := range devices {
+		change := &DeviceChange{
+			Version:    version,
+			Type:       changeType,
+			HubUUID:    hubUUID,
+			HubName:    hubName,
+			DeviceUUID: device.UUID,
+		}
+		if changeType != DEVICE_CHANGE_REMOVED {
+			change.Device = device
+		}
+		changes = append(changes, change)
+	}
+	if len(changes) > DEVICE_CHANGE_LOG_SIZE {
+		dropped := len(changes) - DEVICE_CHANGE_LOG_SIZE
+		versions.oldest[username] = changes[dropped-1].Version
+		changes = changes[dropped:]
+	}
+	versions.changes[username] = changes
+	versions.versions[username] = version
+	return version
+}
+
+//getChangesSince returns changes newer than given version, false means the log
+//does not reach back that far and client has to fetch full list
+func (versions *DeviceVersions) getChangesSince(username string, since int64) ([]*DeviceChange, int64, bool) {
+	versions.mutex.Lock()
+	defer versions.mutex.Unlock()
+	current := versions.currentVersion(username)
+	if since == current {
+		return []*DeviceChange{}, current, true
+	}
+	if since > current || since < versions.base || since < versions.oldest[username] {
+		return nil, current, false
+	}
+	result := []*DeviceChange{}
+	for _, change := range versions.changes[username] {
+		if change.Version > since {
+			result = append(result, change)
+		}
+	}
+	return result, current, true
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	GROUPS_STORAGE = "groups"
+
+	//GROUP_HUB_UUID is synthetic hub under which groups are exposed as virtual devices, it uses
+	//reserved prefix so no real hub can take it
+	GROUP_HUB_UUID = RESERVED_HUB_UUID_PREFIX + "groups"
+	GROUP_HUB_NAME = "Groups"
+
+	//GROUP_TYPE_ROOM groups are not stored, they are derived from room of device overlays
+	GROUP_TYPE_ROOM  = "room"
+	GROUP_TYPE_GROUP = "group"
+
+	ROOM_GROUP_ID_PREFIX = "room-"
+
+	GROUP_POWER_HREF   = "/power"
+	GROUP_DIMMING_HREF = "/dimming"
+)
+
+//GroupMember is whole device or its single resource when Resource is set
+type GroupMember struct {
+	HubUUID    string `json:"hubUuid"`
+	DeviceUUID string `json:"uuid"`
+	Resource   string `json:"resource,omitempty"`
+}
+
+type DeviceGroup struct {
+	ID      string         `json:"id"`
+	Name    string         `json:"name"`
+	Type    string         `json:"type"`
+	Members []*GroupMember `json:"members"`
+}
+
+//groupResource is virtual resource of group aggregating one capability of members
+type groupResource struct {
+	Href         string
+	Name         string
+	ResourceType string
+	Property     string
+	Capability   string
+}
+
+var groupResources = []*groupResource{
+	{Href: GROUP_POWER_HREF, Name: "Power", ResourceType: "oic.r.switch.binary", Property: "value", Capability: CAPABILITY_POWER},
+	{Href: GROUP_DIMMING_HREF, Name: "Brightness", ResourceType: "oic.r.light.dimming", Property: "dimmingSetting", Capability: CAPABILITY_PERCENTAGE},
+}
+
+func getGroupResource(href string) *groupResource {
+	for _, resource := range groupResources {
+		if resource.Href == href {
+			return resource
+		}
+	}
+	return nil
+}
+
+type GroupStore struct {
+	Overlays *OverlayStore
+
+	mutex  sync.Mutex
+	groups map[string][]*DeviceGroup
+}
+
+func NewGroupStore(overlays *OverlayStore) *GroupStore {
+	store := &GroupStore{
+		Overlays: overlays,
+		groups:   make(map[string][]*DeviceGroup),
+	}
+	err := loadData(GROUPS_STORAGE, &store.groups)
+	if err != nil {
+		log.Println(err)
+	}
+	store.migrateRooms()
+	return store
+}
+
+//migrateRooms moves stored room groups to room of their device members overlays, rooms with
+//resource members can not be expressed by overlays and are kept as plain groups
+func (store *GroupStore) migrateRooms() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	migrated := false
+	for username, groups := range store.groups {
+		var kept []*DeviceGroup
+		for _, group := range groups {
+			if group.Type != GROUP_TYPE_ROOM {
+				kept = append(kept, group)
+				continue
+			}
+			migrated = true
+			hasResources := false
+			for _, member := range group.Members {
+				if member.Resource != "" {
+					hasResources = true
+					continue
+				}
+				store.setOverlayRoom(username, member.HubUUID, member.DeviceUUID, group.Name)
+			}
+			if hasResources {
+				log.Println("Room " + group.Name + " of " + username + " has resource members, keeping it as group")
+				group.Type = GROUP_TYPE_GROUP
+				kept = append(kept, group)
+			} else {
+				log.Println("Room " + group.Name + " of " + username + " moved to device overlays")
+			}
+		}
+		store.groups[username] = kept
+	}
+	if migrated {
+		store.save()
+	}
+}
+
+//setOverlayRoom sets room of device unless user already placed it in another room
+func (store *GroupStore) setOverlayRoom(username string, hubUUID string, deviceUUID string, room string) {
+	overlay := &DeviceOverlay{HubUUID: hubUUID, DeviceUUID: deviceUUID}
+	if existing := store.Overlays.getOverlay(username, hubUUID, deviceUUID); existing != nil {
+		if existing.Room != "" {
+			return
+		}
+		*overlay = *existing
+	}
+	overlay.Room = room
+	err := store.Overlays.setOverlay(username, overlay)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (store *GroupStore) save() {
+	err := saveData(GROUPS_STORAGE, store.groups)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//getGroups returns stored groups of user followed by rooms
+func (store *GroupStore) getGroups(username string) []*DeviceGroup {
+	store.mutex.Lock()
+	groups := append([]*DeviceGroup{}, store.groups[username]...)
+	store.mutex.Unlock()
+	return append(groups, store.getRooms(username)...)
+}
+
+func getRoomGroupID(room string) string {
+	hash := sha256.Sum256([]byte(room))
+	return ROOM_GROUP_ID_PREFIX + hex.EncodeToString(hash[:8])
+}
+
+//getRooms derives room group of every room used in device overlays of user
+func (store *GroupStore) getRooms(username string) []*DeviceGroup {
+	var rooms []*DeviceGroup
+	index := make(map[string]*DeviceGroup)
+	for _, overlay := range store.Overlays.getOverlays(username) {
+		if overlay.Room == "" || overlay.HubUUID == GROUP_HUB_UUID {
+			continue
+		}
+		room := index[overlay.Room]
+		if room == nil {
+			room = &DeviceGroup{ID: getRoomGroupID(overlay.Room), Name: overlay.Room, Type: GROUP_TYPE_ROOM}
+			index[overlay.Room] = room
+			rooms = append(rooms, room)
+		}
+		room.Members = append(room.Members, &GroupMember{HubUUID: overlay.HubUUID, DeviceUUID: overlay.DeviceUUID})
+	}
+	return rooms
+}
+
+func findGroup(groups []*DeviceGroup, id string) *DeviceGroup {
+	for _, group := range groups {
+		if group.ID == id {
+			return group
+		}
+	}
+	return nil
+}
+
+//hasSameMembers tells if both groups consist of the same members regardless of their order
+func hasSameMembers(first []*GroupMember, second []*GroupMember) bool {
+	if len(first) != len(second) {
+		return false
+	}
+	members := make(map[GroupMember]int)
+	for _, member := range first {
+		members[*member]++
+	}
+	for _, member := range second {
+		if members[*member] == 0 {
+			return false
+		}
+		members[*member]--
+	}
+	return true
+}
+
+func (store *GroupStore) getGroup(username string, id string) *DeviceGroup {
+	return findGroup(store.getGroups(username), id)
+}
+
+func (store *GroupStore) addGroup(username string, group *DeviceGroup) error {
+	if group.Name == "" {
+		return errors.New("group name is missing")
+	}
+	if group.Type == "" {
+		group.Type = GROUP_TYPE_GROUP
+	}
+	if group.Type == GROUP_TYPE_ROOM {
+		return errors.New("rooms are created by setting room of device overlays")
+	}
+	if group.Type != GROUP_TYPE_GROUP {
+		return errors.New("unknown group type " + group.Type)
+	}
+	if len(group.Members) == 0 {
+		return errors.New("group has no members")
+	}
+	for _, member := range group.Members {
+		if member.HubUUID == "" || member.DeviceUUID == "" {
+			return errors.New("group member requires hubUuid and uuid")
+		}
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.groups[username] = append(store.groups[username], group)
+	store.save()
+	return nil
+}
+
+func (store *GroupStore) deleteGroup(username string, id string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	groups := store.groups[username]
+	for i, group := range groups {
+		if group.ID == id {
+			store.groups[username] = append(groups[:i:i], groups[i+1:]...)
+			store.save()
+			return true
+		}
+	}
+	return false
+}
+
+//getGroupsWithMember returns groups containing the device or given resource of it
+func (store *GroupStore) getGroupsWithMember(username string, hubUUID string, deviceUUID string, href string) []*DeviceGroup {
+	var result []*DeviceGroup
+	for _, group := range store.getGroups(username) {
+		for _, member := range group.Members {
+			if member.HubUUID == hubUUID && member.DeviceUUID == deviceUUID && (member.Resource == "" || member.Resource == href) {
+				result = append(result, group)
+				break
+			}
+		}
+	}
+	return result
+}
+
+//getMemberCapability returns resource of member providing capability, device members use their
+//first resource with the capability, nil without error means member does not support it
+func getMemberCapability(hubConnections *list.List, username string, member *GroupMember, name string) (*ResourceCapability, error) {
+	hub := findHubConnection(hubConnections, username, member.HubUUID)
+	if hub == nil {
+		return nil, errHubOffline
+	}
+	device := hub.getDevice(member.DeviceUUID)
+	if device == nil {
+		return nil, errNoSuchDevice
+	}
+	if member.Resource == "" {
+		return device.getCapability(name), nil
+	}
+	return device.getResourceCapability(member.Resource, name), nil
+}
+
+func getMemberCapabilities(hubConnections *list.List, username string, group *DeviceGroup, name string) []*ResourceCapability {
+	var result []*ResourceCapability
+	for _, member := range group.Members {
+		capability, _ := getMemberCapability(hubConnections, username, member, name)
+		if capability != nil {
+			result = append(result, capability)
+		}
+	}
+	return result
+}
+
+//aggregateGroupValue returns value of virtual resource, power is on when any member is on
+//and brightness is average of members
+func aggregateGroupValue(resource *groupResource, capabilities []*ResourceCapability) string {
+	if resource.Capability == CAPABILITY_POWER {
+		on := false
+		for _, capability := range capabilities {
+			on = on || capability.GetBool()
+		}
+		return `{"` + resource.Property + `":` + strconv.FormatBool(on) + `}`
+	}
+	var sum int64
+	for _, capability := range capabilities {
+		sum += capability.GetPercent()
+	}
+	average := math.Round(float64(sum) / float64(len(capabilities)))
+	return `{"` + resource.Property + `":` + formatNumber(average) + `}`
+}
+
+//createGroupDevice builds virtual device of group from current state of online members,
+//resources are present only when at least one member supports them
+func createGroupDevice(hubConnections *list.List, username string, group *DeviceGroup) *IotDevice {
+	device := &IotDevice{
+		UUID:    group.ID,
+		HubUUID: GROUP_HUB_UUID,
+		Name:    group.Name,
+	}
+	if group.Type == GROUP_TYPE_ROOM {
+		device.Room = group.Name
+	}
+	for _, resource := range groupResources {
+		capabilities := getMemberCapabilities(hubConnections, username, group, resource.Capability)
+		if len(capabilities) == 0 {
+			continue
+		}
+		device.Variables = append(device.Variables, &IotVariable{
+			Interface:     INTERFACE_ACTUATOR,
+			ResourceType:  resource.ResourceType,
+			Href:          resource.Href,
+			Name:          resource.Name,
+			VariableValue: VariableValue{Value: gjson.Parse(aggregateGroupValue(resource, capabilities))},
+			Writable:      true,
+		})
+	}
+	return device
+}
+
+func createGroupDevices(hubConnections *list.List, username string, groups *GroupStore) []*IotDevice {
+	var devices []*IotDevice
+	for _, group := range groups.getGroups(username) {
+		devices = append(devices, createGroupDevice(hubConnections, username, group))
+	}
+	return devices
+}
+
+//getMemberValue converts value of virtual resource to value of member resource
+func getMemberValue(resource *groupResource, capability *ResourceCapability, value gjson.Result) (string, error) {
+	property := value.Get(resource.Property)
+	if resource.Capability == CAPABILITY_POWER {
+		if property.Type != gjson.True && property.Type != gjson.False {
+			return "", errors.New("group power requires boolean " + resource.Property)
+		}
+		return `{"` + capability.Capability.Property + `":` + strconv.FormatBool(property.Bool()) + `}`, nil
+	}
+	if property.Type != gjson.Number {
+		return "", errors.New("group brightness requires numeric " + resource.Property)
+	}
+	if !(ValueRange{Min: 0, Max: 100}).contains(property.Float()) {
+		return "", &ValueOutOfRangeError{Range: ValueRange{Min: 0, Max: 100}}
+	}
+	target := capability.Range().clamp(capability.percentToValue(property.Int()))
+	return `{"` + capability.Capability.Property + `":` + formatNumber(target) + `}`, nil
+}
+
+//setGroupValue fans value of virtual resource out to all members supporting it, members
+//which are offline are reported as failed and members without the capability or with
+//read-only resource are skipped
+func setGroupValue(hubConnections *list.List, username string, group *DeviceGroup, href string, value gjson.Result) ([]*SceneActionResult, error) {
+	resource := getGroupResource(href)
+	if resource == nil {
+		return nil, errors.New("unknown group resource " + href)
+	}
+	var actions []*SceneAction
+	var failed []*SceneActionResult
+	for _, member := range group.Members {
+		capability, err := getMemberCapability(hubConnections, username, member, resource.Capability)
+		if err != nil {
+			failed = append(failed, &SceneActionResult{
+				HubUUID:    member.HubUUID,
+				DeviceUUID: member.DeviceUUID,
+				Resource:   member.Resource,
+				Status:     "error",
+				Error:      err.Error(),
+			})
+			continue
+		}
+		if capability == nil || !capability.Variable.isWritable() {
+			continue
+		}
+		memberValue, err := getMemberValue(resource, capability, value)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, &SceneAction{
+			HubUUID:    member.HubUUID,
+			DeviceUUID: member.DeviceUUID,
+			Resource:   capability.Variable.Href,
+			Value:      json.RawMessage(memberValue),
+		})
+	}
+	if len(actions) == 0 && len(failed) == 0 {
+		return nil, errUnsupportedOperation
+	}
+	return append(activateScene(hubConnections, username, actions), failed...), nil
+}
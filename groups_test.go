@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRoomsFromOverlays(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	overlays := NewOverlayStore()
+	groups := NewGroupStore(overlays)
+	overlays.setOverlay("user", &DeviceOverlay{HubUUID: "hub", DeviceUUID: "lamp", Room: "Kitchen"})
+	overlays.setOverlay("user", &DeviceOverlay{HubUUID: "hub", DeviceUUID: "fan", Room: "Kitchen"})
+	overlays.setOverlay("user", &DeviceOverlay{HubUUID: "hub", DeviceUUID: "tv", Room: "Living room"})
+	overlays.setOverlay("user", &DeviceOverlay{HubUUID: "hub", DeviceUUID: "plug", Name: "Plug"})
+	overlays.setOverlay("other", &DeviceOverlay{HubUUID: "hub", DeviceUUID: "lamp", Room: "Kitchen"})
+
+	tests := []struct {
+		room    string
+		members int
+	}{
+		{"Kitchen", 2},
+		{"Living room", 1},
+	}
+	rooms := groups.getGroups("user")
+	if len(rooms) != len(tests) {
+		t.Fatalf("expected %d rooms, got %d", len(tests), len(rooms))
+	}
+	for i, test := range tests {
+		room := rooms[i]
+		if room.Name != test.room || room.Type != GROUP_TYPE_ROOM || len(room.Members) != test.members {
+			t.Errorf("%s: unexpected room %+v", test.room, room)
+		}
+		if groups.getGroup("user", getRoomGroupID(test.room)) == nil {
+			t.Errorf("%s: room not found by id", test.room)
+		}
+	}
+	if groups.deleteGroup("user", getRoomGroupID("Kitchen")) {
+		t.Errorf("derived room must not be deleted as group")
+	}
+}
+
+func TestAddGroupValidation(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	groups := NewGroupStore(NewOverlayStore())
+	members := []*GroupMember{{HubUUID: "hub", DeviceUUID: "lamp"}}
+	tests := []struct {
+		name  string
+		group *DeviceGroup
+		valid bool
+	}{
+		{"default type", &DeviceGroup{ID: "1", Name: "Lights", Members: members}, true},
+		{"room type", &DeviceGroup{ID: "2", Name: "Kitchen", Type: GROUP_TYPE_ROOM, Members: members}, false},
+		{"unknown type", &DeviceGroup{ID: "3", Name: "Lights", Type: "zone", Members: members}, false},
+		{"missing name", &DeviceGroup{ID: "4", Members: members}, false},
+		{"no members", &DeviceGroup{ID: "5", Name: "Lights"}, false},
+	}
+	for _, test := range tests {
+		if err := groups.addGroup("user", test.group); (err == nil) != test.valid {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+	}
+}
+
+func TestLegacyRoomMigration(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	saveData(GROUPS_STORAGE, map[string][]*DeviceGroup{"user": {
+		{ID: "kitchen", Name: "Kitchen", Type: GROUP_TYPE_ROOM, Members: []*GroupMember{
+			{HubUUID: "hub", DeviceUUID: "lamp"},
+			{HubUUID: "hub", DeviceUUID: "fan"},
+		}},
+		{ID: "hall", Name: "Hall", Type: GROUP_TYPE_ROOM, Members: []*GroupMember{
+			{HubUUID: "hub", DeviceUUID: "sensor", Resource: "/temperature"},
+		}},
+		{ID: "lights", Name: "Lights", Type: GROUP_TYPE_GROUP, Members: []*GroupMember{
+			{HubUUID: "hub", DeviceUUID: "lamp"},
+		}},
+	}})
+	overlays := NewOverlayStore()
+	overlays.setOverlay("user", &DeviceOverlay{HubUUID: "hub", DeviceUUID: "fan", Name: "Fan", Room: "Bedroom"})
+	groups := NewGroupStore(overlays)
+
+	tests := []struct {
+		device string
+		name   string
+		room   string
+	}{
+		{"lamp", "", "Kitchen"},
+		{"fan", "Fan", "Bedroom"},
+	}
+	for _, test := range tests {
+		overlay := overlays.getOverlay("user", "hub", test.device)
+		if overlay == nil || overlay.Name != test.name || overlay.Room != test.room {
+			t.Errorf("%s: unexpected overlay %+v", test.device, overlay)
+		}
+	}
+	for _, id := range []string{"hall", "lights"} {
+		if group := groups.getGroup("user", id); group == nil || group.Type != GROUP_TYPE_GROUP {
+			t.Errorf("%s: expected stored group, got %+v", id, group)
+		}
+	}
+	if groups.getGroup("user", "kitchen") != nil {
+		t.Errorf("room with device members must be moved to overlays")
+	}
+	if groups.getGroup("user", getRoomGroupID("Kitchen")) == nil {
+		t.Errorf("migrated room must be derived from overlays")
+	}
+}
+
+func TestHasSameMembers(t *testing.T) {
+	lamp := &GroupMember{HubUUID: "hub", DeviceUUID: "lamp"}
+	fan := &GroupMember{HubUUID: "hub", DeviceUUID: "fan"}
+	dimming := &GroupMember{HubUUID: "hub", DeviceUUID: "lamp", Resource: "/dimming"}
+	tests := []struct {
+		name   string
+		first  []*GroupMember
+		second []*GroupMember
+		same   bool
+	}{
+		{"same order", []*GroupMember{lamp, fan}, []*GroupMember{lamp, fan}, true},
+		{"other order", []*GroupMember{lamp, fan}, []*GroupMember{fan, lamp}, true},
+		{"swapped member", []*GroupMember{lamp}, []*GroupMember{fan}, false},
+		{"other resource", []*GroupMember{lamp}, []*GroupMember{dimming}, false},
+		{"duplicated member", []*GroupMember{lamp, lamp}, []*GroupMember{lamp, fan}, false},
+		{"added member", []*GroupMember{lamp}, []*GroupMember{lamp, fan}, false},
+	}
+	for _, test := range tests {
+		if same := hasSameMembers(test.first, test.second); same != test.same {
+			t.Errorf("%s: expected %v, got %v", test.name, test.same, same)
+		}
+	}
+}
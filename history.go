@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	HISTORY_DIR            = "history"
+	HISTORY_DAY_FORMAT     = "2006-01-02"
+	HISTORY_RAW_SUFFIX     = ".log"
+	HISTORY_COMPACT_SUFFIX = ".ds.log"
+
+	HISTORY_COMPACTION_INTERVAL = time.Hour
+	HISTORY_MAX_SAMPLES         = 10000
+	HISTORY_MAX_OPEN_SEGMENTS   = 256
+)
+
+//HistoryRecord is a single line of history segment file
+type HistoryRecord struct {
+	Username   string          `json:"u"`
+	HubUUID    string          `json:"h"`
+	DeviceUUID string          `json:"d"`
+	Resource   string          `json:"r"`
+	Time       int64           `json:"t"`
+	Value      json.RawMessage `json:"v"`
+}
+
+type HistorySample struct {
+	Time  int64           `json:"time"`
+	Value json.RawMessage `json:"value"`
+}
+
+type HistoryQuery struct {
+	Username   string
+	HubUUID    string
+	DeviceUUID string
+	Resource   string
+	From       time.Time
+	To         time.Time
+	Interval   time.Duration
+}
+
+//HistoryStore keeps resource values in daily append only segments partitioned by user and device,
+//segments older than raw retention are downsampled and old ones removed
+type HistoryStore struct {
+	Dir                string
+	Retention          time.Duration
+	RawRetention       time.Duration
+	DownsampleInterval time.Duration
+
+	mutex    sync.Mutex
+	day      string
+	segments map[string]*os.File
+}
+
+func getEnvInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func NewHistoryStore() *HistoryStore {
+	store := &HistoryStore{
+		Dir:                filepath.Join(getDataDir(), HISTORY_DIR),
+		Retention:          time.Duration(getEnvInt("HISTORY_RETENTION_DAYS", 30)) * 24 * time.Hour,
+		RawRetention:       time.Duration(getEnvInt("HISTORY_RAW_RETENTION_DAYS", 2)) * 24 * time.Hour,
+		DownsampleInterval: time.Duration(getEnvInt("HISTORY_DOWNSAMPLE_MINUTES", 5)) * time.Minute,
+		segments:           make(map[string]*os.File),
+	}
+	err := os.MkdirAll(store.Dir, 0700)
+	if err != nil {
+		log.Println(err)
+	}
+	go store.runCompaction()
+	return store
+}
+
+func hashHistoryName(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:16])
+}
+
+//partitionDir returns directory with segments of one device, names are hashed so any uuid is a safe path
+func (store *HistoryStore) partitionDir(username string, hubUUID string, deviceUUID string) string {
+	return filepath.Join(store.Dir, hashHistoryName(username), hashHistoryName(hubUUID+"\x00"+deviceUUID))
+}
+
+func segmentPath(dir string, day string, suffix string) string {
+	return filepath.Join(dir, day+suffix)
+}
+
+func (store *HistoryStore) closeSegments() {
+	for path, segment := range store.segments {
+		segment.Close()
+		delete(store.segments, path)
+	}
+}
+
+//Record appends new resource value to current segment
+func (store *HistoryStore) Record(username string, hubUUID string, deviceUUID string, resource string, value gjson.Result) {
+	//time is taken under the lock so records of segment are in time order
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now().UTC()
+	line, err := json.Marshal(&HistoryRecord{
+		Username:   username,
+		HubUUID:    hubUUID,
+		DeviceUUID: deviceUUID,
+		Resource:   resource,
+		Time:       now.UnixNano() / int64(time.Millisecond),
+		Value:      json.RawMessage(value.Raw),
+	})
+	if err != nil || value.Raw == "" {
+		return
+	}
+
+	day := now.Format(HISTORY_DAY_FORMAT)
+	if store.day != day || len(store.segments) >= HISTORY_MAX_OPEN_SEGMENTS {
+		store.closeSegments()
+		store.day = day
+	}
+	dir := store.partitionDir(username, hubUUID, deviceUUID)
+	path := segmentPath(dir, day, HISTORY_RAW_SUFFIX)
+	segment := store.segments[path]
+	if segment == nil {
+		err = os.MkdirAll(dir, 0700)
+		if err == nil {
+			segment, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		}
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		store.segments[path] = segment
+	}
+	_, err = segment.Write(append(line, '\n'))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//scanSegment passes records of segment to visit until it returns false
+func scanSegment(path string, visit func(record *HistoryRecord) bool) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		record := &HistoryRecord{}
+		if json.Unmarshal(scanner.Bytes(), record) != nil {
+			continue
+		}
+		if !visit(record) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+func readSegment(path string, filter func(record *HistoryRecord) bool) ([]*HistoryRecord, error) {
+	var records []*HistoryRecord
+	err := scanSegment(path, func(record *HistoryRecord) bool {
+		if filter(record) {
+			records = append(records, record)
+		}
+		return true
+	})
+	return records, err
+}
+
+//sampleBuckets merges samples added in time order into buckets of given size in milliseconds,
+//numeric properties are averaged and others take last value, size 0 keeps samples as they are
+type sampleBuckets struct {
+	size   int64
+	bucket []*HistorySample
+	result []*HistorySample
+}
+
+func (buckets *sampleBuckets) add(sample *HistorySample) {
+	if buckets.size <= 0 {
+		buckets.result = append(buckets.result, sample)
+		return
+	}
+	if len(buckets.bucket) > 0 && sample.Time/buckets.size != buckets.bucket[0].Time/buckets.size {
+		buckets.flush()
+	}
+	buckets.bucket = append(buckets.bucket, sample)
+}
+
+func (buckets *sampleBuckets) flush() {
+	bucket := buckets.bucket
+	if len(bucket) == 0 {
+		return
+	}
+	sums := make(map[string]float64)
+	counts := make(map[string]int)
+	merged := make(map[string]json.RawMessage)
+	var order []string
+	for _, sample := range bucket {
+		value := gjson.ParseBytes(sample.Value)
+		if !value.IsObject() {
+			merged[""] = sample.Value
+			continue
+		}
+		value.ForEach(func(key, property gjson.Result) bool {
+			name := key.String()
+			if _, ok := merged[name]; !ok {
+				order = append(order, name)
+			}
+			merged[name] = json.RawMessage(property.Raw)
+			if property.Type == gjson.Number {
+				sums[name] += property.Float()
+				counts[name]++
+			}
+			return true
+		})
+	}
+	var value json.RawMessage
+	if raw, ok := merged[""]; ok && len(order) == 0 {
+		value = raw
+	} else {
+		object := make(map[string]json.RawMessage)
+		for _, name := range order {
+			object[name] = merged[name]
+			if counts[name] > 0 {
+				object[name] = json.RawMessage(formatNumber(sums[name] / float64(counts[name])))
+			}
+		}
+		value, _ = json.Marshal(object)
+	}
+	buckets.result = append(buckets.result, &HistorySample{
+		Time:  bucket[0].Time / buckets.size * buckets.size,
+		Value: value,
+	})
+	buckets.bucket = nil
+}
+
+//downsample merges samples into buckets of interval
+func downsample(samples []*HistorySample, interval time.Duration) []*HistorySample {
+	if interval <= 0 || len(samples) == 0 {
+		return samples
+	}
+	buckets := &sampleBuckets{size: int64(interval / time.Millisecond)}
+	for _, sample := range samples {
+		buckets.add(sample)
+	}
+	buckets.flush()
+	return buckets.result
+}
+
+//Query returns samples of resource in time range ordered by time
+func (store *HistoryStore) Query(query *HistoryQuery) ([]*HistorySample, error) {
+	if query.To.Before(query.From) {
+		return nil, errors.New("invalid time range")
+	}
+	from := query.From.UnixNano() / int64(time.Millisecond)
+	to := query.To.UnixNano() / int64(time.Millisecond)
+	filter := func(record *HistoryRecord) bool {
+		return record.Username == query.Username && record.HubUUID == query.HubUUID &&
+			record.DeviceUUID == query.DeviceUUID && record.Resource == query.Resource &&
+			record.Time >= from && record.Time <= to
+	}
+
+	errTooManySamples := errors.New("too many samples, use larger interval")
+	//segments are append only and compaction keeps order so samples are streamed in time order
+	//and reading stops as soon as the result is over the limit
+	dir := store.partitionDir(query.Username, query.HubUUID, query.DeviceUUID)
+	buckets := &sampleBuckets{size: int64(query.Interval / time.Millisecond)}
+	for day := query.From.UTC().Truncate(24 * time.Hour); !day.After(query.To); day = day.Add(24 * time.Hour) {
+		for _, suffix := range []string{HISTORY_COMPACT_SUFFIX, HISTORY_RAW_SUFFIX} {
+			err := scanSegment(segmentPath(dir, day.Format(HISTORY_DAY_FORMAT), suffix), func(record *HistoryRecord) bool {
+				if filter(record) {
+					buckets.add(&HistorySample{Time: record.Time, Value: record.Value})
+				}
+				return len(buckets.result) <= HISTORY_MAX_SAMPLES
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(buckets.result) > HISTORY_MAX_SAMPLES {
+				return nil, errTooManySamples
+			}
+		}
+	}
+	buckets.flush()
+	if len(buckets.result) > HISTORY_MAX_SAMPLES {
+		return nil, errTooManySamples
+	}
+	return buckets.result, nil
+}
+
+func (store *HistoryStore) compactSegment(dir string, day string) error {
+	records, err := readSegment(segmentPath(dir, day, HISTORY_RAW_SUFFIX), func(record *HistoryRecord) bool {
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	series := make(map[string][]*HistoryRecord)
+	var keys []string
+	for _, record := range records {
+		key := record.Username + "\x00" + record.HubUUID + "\x00" + record.DeviceUUID + "\x00" + record.Resource
+		if _, ok := series[key]; !ok {
+			keys = append(keys, key)
+		}
+		series[key] = append(series[key], record)
+	}
+
+	var lines []string
+	for _, key := range keys {
+		first := series[key][0]
+		var samples []*HistorySample
+		for _, record := range series[key] {
+			samples = append(samples, &HistorySample{Time: record.Time, Value: record.Value})
+		}
+		for _, sample := range downsample(samples, store.DownsampleInterval) {
+			line, err := json.Marshal(&HistoryRecord{
+				Username:   first.Username,
+				HubUUID:    first.HubUUID,
+				DeviceUUID: first.DeviceUUID,
+				Resource:   first.Resource,
+				Time:       sample.Time,
+				Value:      sample.Value,
+			})
+			if err != nil {
+				return err
+			}
+			lines = append(lines, string(line))
+		}
+	}
+	path := segmentPath(dir, day, HISTORY_COMPACT_SUFFIX)
+	err = ioutil.WriteFile(path+".tmp", []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+	return os.Remove(segmentPath(dir, day, HISTORY_RAW_SUFFIX))
+}
+
+func (store *HistoryStore) compact(now time.Time) {
+	today := now.UTC().Format(HISTORY_DAY_FORMAT)
+	err := filepath.Walk(store.Dir, func(path string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := file.Name()
+		if !file.IsDir() && len(name) >= len(HISTORY_DAY_FORMAT) {
+			store.compactFile(filepath.Dir(path), name, today, now)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//compactFile removes segment file after retention or downsamples raw segment after raw retention
+func (store *HistoryStore) compactFile(dir string, name string, today string, now time.Time) {
+	day := name[:len(HISTORY_DAY_FORMAT)]
+	dayTime, err := time.Parse(HISTORY_DAY_FORMAT, day)
+	if err != nil {
+		return
+	}
+	dayEnd := dayTime.Add(24 * time.Hour)
+	if now.Sub(dayEnd) > store.Retention {
+		log.Println("Removing history segment " + filepath.Join(dir, name))
+		os.Remove(filepath.Join(dir, name))
+		return
+	}
+	if day != today && strings.HasSuffix(name, HISTORY_RAW_SUFFIX) && !strings.HasSuffix(name, HISTORY_COMPACT_SUFFIX) &&
+		now.Sub(dayEnd) > store.RawRetention {
+		log.Println("Downsampling history segment " + filepath.Join(dir, name))
+		err := store.compactSegment(dir, day)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (store *HistoryStore) runCompaction() {
+	for {
+		store.compact(time.Now())
+		time.Sleep(HISTORY_COMPACTION_INTERVAL)
+	}
+}
+
+//parseHistoryTime accepts unix milliseconds or RFC3339 time
+func parseHistoryTime(value string, defaultValue time.Time) (time.Time, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return time.Unix(0, millis*int64(time.Millisecond)), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func parseHistoryQuery(username string, hubUUID string, deviceUUID string, resource string, from string, to string, interval int64) (*HistoryQuery, error) {
+	if hubUUID == "" || deviceUUID == "" || resource == "" {
+		return nil, errors.New("hubUuid, uuid and resource are required")
+	}
+	now := time.Now()
+	query := &HistoryQuery{
+		Username:   username,
+		HubUUID:    hubUUID,
+		DeviceUUID: deviceUUID,
+		Resource:   resource,
+		Interval:   time.Duration(interval) * time.Second,
+	}
+	var err error
+	query.From, err = parseHistoryTime(from, now.Add(-24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	query.To, err = parseHistoryTime(to, now)
+	if err != nil {
+		return nil, err
+	}
+	return query, nil
+}
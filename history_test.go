@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestHistoryPartitions(t *testing.T) {
+	store := &HistoryStore{Dir: t.TempDir(), Retention: time.Hour, RawRetention: time.Hour, segments: make(map[string]*os.File)}
+	defer store.closeSegments()
+	store.Record("alice", "hub", "lamp", "/switch", gjson.Parse(`{"value":true}`))
+	store.Record("alice", "hub", "lamp", "/dimming", gjson.Parse(`{"dimmingSetting":10}`))
+	store.Record("alice", "hub", "fan", "/switch", gjson.Parse(`{"value":false}`))
+	store.Record("bob", "hub", "lamp", "/switch", gjson.Parse(`{"value":false}`))
+
+	tests := []struct {
+		username string
+		device   string
+		resource string
+		expected []string
+	}{
+		{"alice", "lamp", "/switch", []string{`{"value":true}`}},
+		{"alice", "lamp", "/dimming", []string{`{"dimmingSetting":10}`}},
+		{"alice", "fan", "/switch", []string{`{"value":false}`}},
+		{"bob", "lamp", "/switch", []string{`{"value":false}`}},
+		{"bob", "fan", "/switch", nil},
+	}
+	now := time.Now()
+	for _, test := range tests {
+		samples, err := store.Query(&HistoryQuery{Username: test.username, HubUUID: "hub", DeviceUUID: test.device,
+			Resource: test.resource, From: now.Add(-time.Minute), To: now.Add(time.Minute)})
+		if err != nil || len(samples) != len(test.expected) {
+			t.Errorf("%s %s%s: expected %v, got %v %v", test.username, test.device, test.resource, test.expected, samples, err)
+			continue
+		}
+		for i, sample := range samples {
+			if string(sample.Value) != test.expected[i] {
+				t.Errorf("%s %s%s: expected %s, got %s", test.username, test.device, test.resource, test.expected[i], sample.Value)
+			}
+		}
+	}
+
+	if store.partitionDir("alice", "hub", "lamp") == store.partitionDir("bob", "hub", "lamp") {
+		t.Errorf("users share history partition")
+	}
+	store.closeSegments()
+	store.compact(now.Add(48 * time.Hour))
+	samples, _ := store.Query(&HistoryQuery{Username: "alice", HubUUID: "hub", DeviceUUID: "lamp", Resource: "/switch",
+		From: now.Add(-time.Minute), To: now.Add(time.Minute)})
+	if len(samples) != 0 {
+		t.Errorf("expired segments were not removed, got %v", samples)
+	}
+}
+
+func TestHistoryQueryLimit(t *testing.T) {
+	store := &HistoryStore{Dir: t.TempDir(), Retention: time.Hour, RawRetention: time.Hour, segments: make(map[string]*os.File)}
+	defer store.closeSegments()
+	for i := 0; i <= HISTORY_MAX_SAMPLES; i++ {
+		store.Record("alice", "hub", "lamp", "/dimming", gjson.Parse(`{"dimmingSetting":10}`))
+	}
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		valid    bool
+	}{
+		{"raw samples over limit", 0, false},
+		{"downsampled samples", time.Hour, true},
+	}
+	now := time.Now()
+	for _, test := range tests {
+		samples, err := store.Query(&HistoryQuery{Username: "alice", HubUUID: "hub", DeviceUUID: "lamp", Resource: "/dimming",
+			From: now.Add(-time.Minute), To: now.Add(time.Minute), Interval: test.interval})
+		if (err == nil) != test.valid {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+		if test.valid && (len(samples) == 0 || len(samples) > 2 || string(samples[0].Value) != `{"dimmingSetting":10}`) {
+			t.Errorf("%s: unexpected samples %v", test.name, samples)
+		}
+	}
+}
@@ -2,18 +2,52 @@ package main
 
 import (
 	"container/list"
+	"encoding/json"
+	"errors"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/tidwall/gjson"
 
 	"gopkg.in/kataras/iris.v6/adaptors/websocket"
 )
 
+const (
+	HUB_REQUEST_TIMEOUT = 5 * time.Second
+
+	HUB_ERROR_OUT_OF_RANGE = "out_of_range"
+
+	//RESERVED_HUB_UUID_PREFIX is used by hubs implemented inside gateway, hubs using it are refused
+	RESERVED_HUB_UUID_PREFIX = "gateway-"
+)
+
+var (
+	errHubOffline   = errors.New("hub is offline")
+	errHubTimeout   = errors.New("hub did not respond in time")
+	errNoSuchDevice = errors.New("no such device")
+)
+
+//HubRequestError is returned when hub responds to request with error status
+type HubRequestError struct {
+	Code    string
+	Message string
+}
+
+func (e *HubRequestError) Error() string {
+	return "hub request failed " + e.Code + " " + e.Message
+}
+
 type HubConnectionEndpoint struct {
 	WebSocketServer        websocket.Server
 	HubConnections         *list.List
 	ClientConnectionServer *ClientConnectionServer
+	AlexaEvents            *AlexaEventGateway
+	Rules                  *RuleEngine
+	History                *HistoryStore
+	Webhooks               *WebhookDispatcher
+	Cluster                *Cluster
 }
 
 type IotVariable struct {
@@ -22,6 +56,10 @@ type IotVariable struct {
 	Href          string        `json:"href"`
 	Name          string        `json:"n"`
 	VariableValue VariableValue `json:"value"`
+	Writable      bool          `json:"writable"`
+	Hidden        bool          `json:"hidden,omitempty"`
+	//Computed is set only on resources of virtual devices
+	Computed *ComputedValue `json:"computed,omitempty"`
 }
 
 type IotDevice struct {
@@ -29,6 +67,13 @@ type IotDevice struct {
 	HubUUID   string         `json:"hubUuid"`
 	Name      string         `json:"name"`
 	Variables []*IotVariable `json:"variables"`
+
+	//user overlay fields
+	OriginalName string   `json:"originalName,omitempty"`
+	Room         string   `json:"room,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Icon         string   `json:"icon,omitempty"`
+	Hidden       bool     `json:"hidden,omitempty"`
 }
 
 type VariableValue struct {
@@ -39,6 +84,11 @@ func (value VariableValue) MarshalJSON() ([]byte, error) {
 	return []byte(value.Value.String()), nil
 }
 
+func (value *VariableValue) UnmarshalJSON(data []byte) error {
+	value.Value = gjson.ParseBytes(data)
+	return nil
+}
+
 func (device *IotDevice) getVariable(href string) *IotVariable {
 	for _, variable := range device.Variables {
 		if variable.Href == href {
@@ -48,7 +98,52 @@ func (device *IotDevice) getVariable(href string) *IotVariable {
 	return nil
 }
 
+//copy returns device with own copies of resources so it can be read without hubsMutex
+func (device *IotDevice) copy() *IotDevice {
+	result := *device
+	result.Variables = make([]*IotVariable, 0, len(device.Variables))
+	for _, variable := range device.Variables {
+		v := *variable
+		result.Variables = append(result.Variables, &v)
+	}
+	result.Tags = append([]string(nil), device.Tags...)
+	return &result
+}
+
+//getDevice returns copy of hub device
 func (connection *HubConnection) getDevice(uuid string) *IotDevice {
+	hubsMutex.RLock()
+	defer hubsMutex.RUnlock()
+	device := connection.findDevice(uuid)
+	if device == nil {
+		return nil
+	}
+	return device.copy()
+}
+
+//updateValue stores value of device resource under hubsMutex, merging it into previous value
+//when it is delta, and returns copy of updated device with previous value of resource
+func (connection *HubConnection) updateValue(uuid string, href string, value gjson.Result, delta bool) (*IotDevice, gjson.Result, error) {
+	hubsMutex.Lock()
+	defer hubsMutex.Unlock()
+	device := connection.findDevice(uuid)
+	if device == nil {
+		return nil, gjson.Result{}, errors.New("Unable to find device with ID " + uuid)
+	}
+	variable := device.getVariable(href)
+	if variable == nil {
+		return nil, gjson.Result{}, errors.New("Unable to find resource " + href + " of device " + uuid)
+	}
+	previous := variable.VariableValue.Value
+	if delta {
+		value = mergeValueDelta(previous, value)
+	}
+	variable.VariableValue.Value = value
+	return device.copy(), previous, nil
+}
+
+//findDevice looks up device while caller holds hubsMutex
+func (connection *HubConnection) findDevice(uuid string) *IotDevice {
 	for device := connection.DeviceList.Front(); device != nil; device = device.Next() {
 		if device.Value.(*IotDevice).UUID == uuid {
 			return device.Value.(*IotDevice)
@@ -57,14 +152,31 @@ func (connection *HubConnection) getDevice(uuid string) *IotDevice {
 	return nil
 }
 
+func findHubConnection(hubConnections *list.List, username string, hubUUID string) *HubConnection {
+	hubsMutex.RLock()
+	defer hubsMutex.RUnlock()
+	for e := hubConnections.Front(); e != nil; e = e.Next() {
+		con := e.Value.(*HubConnection)
+		if con.Uuid == hubUUID && con.Username != "" && con.Username == username {
+			return con
+		}
+	}
+	return nil
+}
+
 //New client connection server
-func NewHubEndpoint(hubConnections *list.List, clientConnectionServer *ClientConnectionServer) *HubConnectionEndpoint {
+func NewHubEndpoint(hubConnections *list.List, clientConnectionServer *ClientConnectionServer, alexaEvents *AlexaEventGateway, rules *RuleEngine, history *HistoryStore, webhooks *WebhookDispatcher, cluster *Cluster) *HubConnectionEndpoint {
 	server := HubConnectionEndpoint{}
 	server.HubConnections = hubConnections
 	server.ClientConnectionServer = clientConnectionServer
+	server.AlexaEvents = alexaEvents
+	server.Rules = rules
+	server.History = history
+	server.Webhooks = webhooks
+	server.Cluster = cluster
 	server.WebSocketServer = websocket.New(websocket.Config{
 		Endpoint:       "/connect",
-		MaxMessageSize: 102400,
+		MaxMessageSize: HUB_MAX_MESSAGE_SIZE,
 	})
 	server.WebSocketServer.OnConnection(func(c websocket.Connection) {
 		server.onHubConnect(c, server.HubConnections)
@@ -77,19 +189,23 @@ func (server *HubConnectionEndpoint) onHubConnect(c websocket.Connection, hubCon
 	newConnection := &HubConnection{
 		Connection: c,
 		Mid:        1,
-		Callbacks:  make(map[int64]RequestCallback)}
-	hubConnections.PushBack(newConnection)
+		Callbacks:  make(map[int64]RequestCallback),
+		Closed:     make(chan struct{}),
+		Queue:      NewOutboundQueue(c)}
 
 	c.OnMessage(func(messageBytes []byte) {
-		message := string(messageBytes)
+		message, err := decodeHubMessage(newConnection, string(messageBytes))
+		if err != nil {
+			log.Println(err)
+			return
+		}
 		messageJson := gjson.Parse(message)
 
 		mid := gjson.Get(message, "mid").Int()
 
-		callback := newConnection.Callbacks[mid]
+		callback := newConnection.popCallback(mid)
 		if callback != nil {
 			callback(message)
-			delete(newConnection.Callbacks, mid)
 		}
 
 		eventName := messageJson.Get("name").String()
@@ -108,36 +224,81 @@ func (server *HubConnectionEndpoint) onHubConnect(c websocket.Connection, hubCon
 				c.Disconnect()
 				return
 			}
+			if newConnection.Username != "" {
+				log.Println("HUB connection " + c.ID() + " is already authorized")
+				return
+			}
+			err = negotiateHubProtocol(newConnection, messageJson.Get("payload"))
+			if err == nil && strings.HasPrefix(messageJson.Get("payload.uuid").String(), RESERVED_HUB_UUID_PREFIX) {
+				err = errors.New("hub uuid prefix " + RESERVED_HUB_UUID_PREFIX + " is reserved for gateway")
+			}
+			if err != nil {
+				log.Println(err)
+				errorMessage, _ := json.Marshal(err.Error())
+				sendResponse(c, mid, "ResponseAuthorize", `{"status":"error","error":`+string(errorMessage)+`}`)
+				c.Disconnect()
+				return
+			}
 			log.Println("New HUB connection authorized for " + userInfo.Username)
-			sendRequest(newConnection, "RequestGetDevices", "{}", func(response string) {
-				parseDeviceList(newConnection, response)
-			})
+			//legacy hubs do not expect response
+			if messageJson.Get("payload.protocolVersion").Exists() {
+				capabilities, _ := json.Marshal(newConnection.getCapabilityList())
+				newConnection.Queue.Enqueue("", messageFrame(mid, "ResponseAuthorize", `{"status":"ok","protocolVersion":`+
+					strconv.Itoa(HUB_PROTOCOL_VERSION)+`,"capabilities":`+string(capabilities)+`}`))
+			}
+			//hub is listed only once authorized so readers never see its identity change
 			newConnection.Username = userInfo.Username
 			newConnection.Uuid = messageJson.Get("payload.uuid").String()
 			newConnection.Name = messageJson.Get("payload.name").String()
+			addHubConnection(hubConnections, newConnection)
+			sendRequest(newConnection, "RequestGetDevices", "{}", func(response string) {
+				added, _, _ := parseDeviceList(newConnection, response)
+				server.ClientConnectionServer.notifyDevicesAdded(newConnection, added)
+				server.Cluster.PublishHubState(newConnection)
+			})
+			server.Rules.OnHubStateChange(newConnection.Username, newConnection.Uuid, true)
+			server.Webhooks.Dispatch(newConnection.Username, WEBHOOK_EVENT_HUB_CONNECTED, newConnection.Uuid, "", map[string]string{"name": newConnection.Name})
 
 		} else if eventName == "EventDeviceListUpdate" {
-			parseDeviceList(newConnection, message)
-			server.ClientConnectionServer.notifyDeviceListChange()
+			server.handleDeviceListUpdate(newConnection, message)
 		} else if eventName == "EventValueUpdate" {
 			server.handleValueUpdate(newConnection, messageJson)
 		}
 	})
 
 	c.OnDisconnect(func() {
-		for e := hubConnections.Front(); e != nil; e = e.Next() {
-			con := e.Value.(*HubConnection)
-			if con.Connection.ID() == c.ID() {
-				hubConnections.Remove(e)
-				break
-			}
+		close(newConnection.Closed)
+		newConnection.Queue.Close()
+		removeHubConnection(hubConnections, newConnection)
+		server.ClientConnectionServer.notifyDevicesRemoved(newConnection, newConnection.getDevices())
+		if newConnection.Username != "" {
+			server.Cluster.PublishHubOffline(newConnection)
+			server.Rules.OnHubStateChange(newConnection.Username, newConnection.Uuid, false)
+			server.Webhooks.Dispatch(newConnection.Username, WEBHOOK_EVENT_HUB_DISCONNECTED, newConnection.Uuid, "", map[string]string{"name": newConnection.Name})
 		}
-		server.ClientConnectionServer.notifyDeviceListChange()
 		log.Println("HUB Connection with ID: " + c.ID() + " has been disconnected!")
 	})
 
 }
 
+func (server *HubConnectionEndpoint) handleDeviceListUpdate(conn *HubConnection, message string) {
+	added, removed, changed := parseDeviceList(conn, message)
+	server.ClientConnectionServer.notifyDevicesAdded(conn, added)
+	server.ClientConnectionServer.notifyDevicesRemoved(conn, removed)
+	for _, device := range changed {
+		server.ClientConnectionServer.notifyDeviceChanged(conn, device)
+	}
+	server.Cluster.PublishHubState(conn)
+	server.AlexaEvents.ReportDiscoveryChange(conn.Username, conn.Uuid,
+		server.ClientConnectionServer.Overlays.applyAll(conn.Username, conn.Uuid, append(added, changed...)), removed)
+	for _, device := range added {
+		server.Webhooks.Dispatch(conn.Username, WEBHOOK_EVENT_DEVICE_ADDED, conn.Uuid, device.UUID, device)
+	}
+	for _, device := range removed {
+		server.Webhooks.Dispatch(conn.Username, WEBHOOK_EVENT_DEVICE_REMOVED, conn.Uuid, device.UUID, nil)
+	}
+}
+
 func (server *HubConnectionEndpoint) handleValueUpdate(conn *HubConnection, message gjson.Result) {
 
 	deviceID := message.Get("payload.uuid").String()
@@ -146,50 +307,102 @@ func (server *HubConnectionEndpoint) handleValueUpdate(conn *HubConnection, mess
 
 	log.Println("handleValueUpdate " + deviceID + " " + resourceID)
 
-	device := conn.getDevice(deviceID)
-	if device == nil {
-		log.Println("Unable to find device with ID" + deviceID)
+	delta := conn.supports(HUB_CAPABILITY_RESOURCE_DELTAS) && message.Get("payload.delta").Bool()
+	device, previous, err := conn.updateValue(deviceID, resourceID, value, delta)
+	if err != nil {
+		log.Println(err)
 		return
 	}
+	value = device.getVariable(resourceID).VariableValue.Value
+
+	log.Println("handleValueUpdate " + value.String())
+
+	server.History.Record(conn.Username, conn.Uuid, device.UUID, resourceID, value)
+	server.Cluster.PublishValueUpdate(conn, device.UUID, resourceID, []byte(value.Raw))
+	server.ClientConnectionServer.notifyDeviceResourceChange(device.HubUUID, device.UUID, resourceID, value)
+	server.AlexaEvents.ReportChange(conn.Username, conn.Uuid, server.ClientConnectionServer.Overlays.apply(conn.Username, conn.Uuid, device), resourceID)
+	server.Rules.OnValueUpdate(conn.Username, conn.Uuid, device.UUID, resourceID, previous, value)
+	server.Webhooks.Dispatch(conn.Username, WEBHOOK_EVENT_VALUE_CHANGE, conn.Uuid, device.UUID, map[string]interface{}{
+		"resource": resourceID,
+		"value":    json.RawMessage(value.Raw),
+	})
+}
 
-	device.getVariable(resourceID).VariableValue.Value = value
-
-	log.Println("handleValueUpdate " + conn.getDevice(deviceID).getVariable(resourceID).VariableValue.Value.String())
+//parseVariable reads resource description sent by hub
+func parseVariable(variableData gjson.Result) *IotVariable {
+	v := &IotVariable{
+		Href:         variableData.Get("href").String(),
+		Name:         variableData.Get("n").String(),
+		Interface:    variableData.Get("if").String(),
+		ResourceType: variableData.Get("rt").String(),
+	}
+	v.VariableValue.Value = variableData.Get("values")
+	v.Writable = v.isWritable()
+	return v
+}
 
-	server.ClientConnectionServer.notifyDeviceResourceChange(device.HubUUID, device.UUID)
+//reconcileDevice updates name and resources of known device, returns true if description changed
+func reconcileDevice(device *IotDevice, deviceData gjson.Result) bool {
+	changed := false
+	if name := deviceData.Get("name").String(); device.Name != name {
+		device.Name = name
+		changed = true
+	}
+	var variables []*IotVariable
+	for _, variableData := range deviceData.Get("variables").Array() {
+		current := parseVariable(variableData)
+		existing := device.getVariable(current.Href)
+		if existing == nil {
+			changed = true
+		} else if existing.Name != current.Name || existing.Interface != current.Interface || existing.ResourceType != current.ResourceType {
+			changed = true
+		}
+		if existing != nil && !variableData.Get("values").Exists() {
+			current.VariableValue = existing.VariableValue
+		}
+		variables = append(variables, current)
+	}
+	if len(variables) != len(device.Variables) {
+		changed = true
+	}
+	device.Variables = variables
+	return changed
 }
-func parseDeviceList(conn *HubConnection, message string) {
+
+//parseDeviceList updates device list of hub and returns added, removed and changed devices
+func parseDeviceList(conn *HubConnection, message string) ([]*IotDevice, []*IotDevice, []*IotDevice) {
+	var added, removed, changed []*IotDevice
 	devices := gjson.Get(message, "payload.devices").Array()
+	hubsMutex.Lock()
 	//Add new devices
 	for _, deviceData := range devices {
 		deviceID := deviceData.Get("id").String()
 
-		if conn.getDevice(deviceID) != nil {
+		if existing := conn.findDevice(deviceID); existing != nil {
+			if reconcileDevice(existing, deviceData) {
+				log.Println("Device id" + deviceID + " changed")
+				changed = append(changed, existing.copy())
+			}
 			continue
 		}
 		log.Println("Add new device id" + deviceID)
 		d := &IotDevice{
-			UUID: deviceID,
-			Name: deviceData.Get("name").String(),
+			UUID:    deviceID,
+			HubUUID: conn.Uuid,
+			Name:    deviceData.Get("name").String(),
 		}
 
-		sendRequest(conn, "RequestSubscribeDevice", `{"uuid":"`+d.UUID+`"}`, nil)
-
 		for _, variableData := range deviceData.Get("variables").Array() {
-			v := &IotVariable{
-				Href:         variableData.Get("href").String(),
-				Name:         variableData.Get("n").String(),
-				Interface:    variableData.Get("if").String(),
-				ResourceType: variableData.Get("rt").String(),
-			}
-			v.VariableValue.Value = variableData.Get("values")
-			d.Variables = append(d.Variables, v)
+			d.Variables = append(d.Variables, parseVariable(variableData))
 		}
 		conn.DeviceList.PushBack(d)
+		added = append(added, d.copy())
 	}
 	deviceIDs := gjson.Get(message, "payload.devices.#.id").Array()
 
-	for device := conn.DeviceList.Front(); device != nil; device = device.Next() {
+	var next *list.Element
+	for device := conn.DeviceList.Front(); device != nil; device = next {
+		next = device.Next()
 		found := false
 		for _, deviceID := range deviceIDs {
 			if device.Value.(*IotDevice).UUID == deviceID.String() {
@@ -198,23 +411,77 @@ func parseDeviceList(conn *HubConnection, message string) {
 		}
 		if !found {
 			log.Println("Remove device id" + device.Value.(*IotDevice).UUID)
-
-			sendRequest(conn, "RequestUnsubscribeDevice", `{"uuid":"`+device.Value.(*IotDevice).UUID+`"}`, nil)
 			conn.DeviceList.Remove(device)
+			removed = append(removed, device.Value.(*IotDevice))
 		}
 	}
+	hubsMutex.Unlock()
 
+	for _, device := range added {
+		sendRequest(conn, "RequestSubscribeDevice", `{"uuid":"`+device.UUID+`"}`, nil)
+	}
+	for _, device := range removed {
+		sendRequest(conn, "RequestUnsubscribeDevice", `{"uuid":"`+device.UUID+`"}`, nil)
+	}
+	return added, removed, changed
+}
+func (conn *HubConnection) popCallback(mid int64) RequestCallback {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	callback := conn.Callbacks[mid]
+	delete(conn.Callbacks, mid)
+	return callback
 }
-func sendRequest(conn *HubConnection, name string, payload string, callback RequestCallback) {
+
+func sendRequest(conn *HubConnection, name string, payload string, callback RequestCallback) int64 {
 	log.Println("sendRequest " + name + " " + payload)
+	conn.mutex.Lock()
+	mid := conn.Mid
+	conn.Mid++
 	if callback != nil {
-		conn.Callbacks[conn.Mid] = callback
+		conn.Callbacks[mid] = callback
 	}
-	conn.Connection.EmitMessage([]byte(`{ "mid":` + strconv.FormatInt(conn.Mid, 10) + `, "name":"` + name + `", "payload":` + payload + `}`))
-	conn.Mid++
+	conn.mutex.Unlock()
+	if conn.Forward != nil {
+		conn.Forward(mid, name, payload)
+		return mid
+	}
+	conn.Queue.Enqueue("", messageFrame(mid, name, payload))
+	return mid
+}
+
+//sendRequestSync sends request and waits for hub response until timeout
+func sendRequestSync(conn *HubConnection, name string, payload string, timeout time.Duration) (gjson.Result, error) {
+	responses := make(chan string, 1)
+	mid := sendRequest(conn, name, payload, func(response string) {
+		responses <- response
+	})
+
+	select {
+	case response := <-responses:
+		result := gjson.Parse(response)
+		status := result.Get("payload.status").String()
+		if status == "error" || result.Get("payload.error").Exists() {
+			return result, &HubRequestError{
+				Code:    result.Get("payload.code").String(),
+				Message: result.Get("payload.error").String(),
+			}
+		}
+		return result, nil
+	case <-conn.Closed:
+		conn.popCallback(mid)
+		return gjson.Result{}, errHubOffline
+	case <-time.After(timeout):
+		conn.popCallback(mid)
+		return gjson.Result{}, errHubTimeout
+	}
+}
+
+func messageFrame(mid int64, name string, payload string) []byte {
+	return []byte(`{ "mid":` + strconv.FormatInt(mid, 10) + `,"name":"` + name + `", "payload":` + payload + `}`)
 }
 
 func sendResponse(conn websocket.Connection, mid int64, name string, payload string) {
 	log.Println("sendResponse" + payload)
-	conn.EmitMessage([]byte(`{ "mid":` + strconv.FormatInt(mid, 10) + `,"name":"` + name + `", "payload":` + payload + `}`))
+	conn.EmitMessage(messageFrame(mid, name, payload))
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	//HUB_PROTOCOL_VERSION is the newest hub protocol version gateway speaks, hubs which
+	//do not send protocolVersion are legacy hubs of version 1
+	HUB_PROTOCOL_VERSION        = 2
+	HUB_LEGACY_PROTOCOL_VERSION = 1
+
+	//HUB_CAPABILITY_ACKNOWLEDGE means hub answers RequestSetValue with ResponseSetValue carrying
+	//{"status":"ok"} or {"status":"error","code":"out_of_range","error":"..."}, legacy hubs never answer
+	HUB_CAPABILITY_ACKNOWLEDGE = "acknowledge"
+	//HUB_CAPABILITY_BATCH allows RequestSetValues with several values in one request answered with
+	//result of every value
+	HUB_CAPABILITY_BATCH = "batch"
+	//HUB_CAPABILITY_RESOURCE_DELTAS allows EventValueUpdate carrying only changed properties
+	HUB_CAPABILITY_RESOURCE_DELTAS = "resourceDeltas"
+	//HUB_CAPABILITY_COMPRESSION allows gzip encoded payloads
+	HUB_CAPABILITY_COMPRESSION = "compression"
+
+	PAYLOAD_ENCODING_GZIP = "gzip"
+
+	//HUB_MAX_MESSAGE_SIZE limits size of websocket frame sent by hub
+	HUB_MAX_MESSAGE_SIZE = 102400
+	//HUB_MAX_COMPRESSION_RATIO limits size of inflated payload to HUB_MAX_MESSAGE_SIZE times this ratio
+	HUB_MAX_COMPRESSION_RATIO = 20
+)
+
+var gatewayHubCapabilities = []string{HUB_CAPABILITY_ACKNOWLEDGE, HUB_CAPABILITY_BATCH, HUB_CAPABILITY_RESOURCE_DELTAS, HUB_CAPABILITY_COMPRESSION}
+
+func getMinHubProtocolVersion() int {
+	return getEnvInt("HUB_MIN_PROTOCOL_VERSION", HUB_LEGACY_PROTOCOL_VERSION)
+}
+
+//negotiateHubProtocol checks protocol version of hub and enables capabilities supported by both sides
+func negotiateHubProtocol(conn *HubConnection, payload gjson.Result) error {
+	version := HUB_LEGACY_PROTOCOL_VERSION
+	if payload.Get("protocolVersion").Exists() {
+		version = int(payload.Get("protocolVersion").Int())
+	}
+	if version < getMinHubProtocolVersion() || version > HUB_PROTOCOL_VERSION {
+		return errors.New("unsupported hub protocol version " + strconv.Itoa(version) + ", gateway supports versions " +
+			strconv.Itoa(getMinHubProtocolVersion()) + " to " + strconv.Itoa(HUB_PROTOCOL_VERSION))
+	}
+	conn.ProtocolVersion = version
+	conn.Capabilities = make(map[string]bool)
+	for _, capability := range payload.Get("capabilities").Array() {
+		for _, supported := range gatewayHubCapabilities {
+			if capability.String() == supported {
+				conn.Capabilities[supported] = true
+			}
+		}
+	}
+	return nil
+}
+
+func (conn *HubConnection) supports(capability string) bool {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.Capabilities[capability]
+}
+
+func (conn *HubConnection) getCapabilityList() []string {
+	capabilities := []string{}
+	for _, capability := range gatewayHubCapabilities {
+		if conn.supports(capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	return capabilities
+}
+
+//decodeHubMessage replaces gzip encoded payload {"encoding":"gzip","data":"<base64>"} with decoded one
+func decodeHubMessage(conn *HubConnection, message string) (string, error) {
+	payload := gjson.Get(message, "payload")
+	if !conn.supports(HUB_CAPABILITY_COMPRESSION) || payload.Get("encoding").String() != PAYLOAD_ENCODING_GZIP {
+		return message, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(payload.Get("data").String())
+	if err != nil {
+		return "", err
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	//read one byte over the limit to tell payload at the limit from larger one without inflating all of it
+	limit := int64(HUB_MAX_MESSAGE_SIZE * HUB_MAX_COMPRESSION_RATIO)
+	decoded, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(decoded)) > limit {
+		return "", errors.New("compressed payload exceeds " + strconv.FormatInt(limit, 10) + " bytes when inflated")
+	}
+	if !gjson.ValidBytes(decoded) {
+		return "", errors.New("compressed payload is not valid json")
+	}
+	name, _ := json.Marshal(gjson.Get(message, "name").String())
+	return `{ "mid":` + strconv.FormatInt(gjson.Get(message, "mid").Int(), 10) + `,"name":` + string(name) + `, "payload":` + string(decoded) + `}`, nil
+}
+
+//mergeValueDelta applies properties of delta to previous resource value
+func mergeValueDelta(previous gjson.Result, delta gjson.Result) gjson.Result {
+	if !previous.IsObject() || !delta.IsObject() {
+		return delta
+	}
+	merged := make(map[string]json.RawMessage)
+	var order []string
+	for _, value := range []gjson.Result{previous, delta} {
+		value.ForEach(func(key, property gjson.Result) bool {
+			if _, ok := merged[key.String()]; !ok {
+				order = append(order, key.String())
+			}
+			merged[key.String()] = json.RawMessage(property.Raw)
+			return true
+		})
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	for i, key := range order {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		name, _ := json.Marshal(key)
+		buffer.Write(name)
+		buffer.WriteString(":")
+		buffer.Write(merged[key])
+	}
+	buffer.WriteString("}")
+	return gjson.ParseBytes(buffer.Bytes())
+}
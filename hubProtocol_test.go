@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"gopkg.in/kataras/iris.v6/adaptors/websocket"
+)
+
+//testConnection is websocket connection recording emitted frames
+type testConnection struct {
+	websocket.Connection
+	id     string
+	frames chan gjson.Result
+}
+
+func newTestConnection(id string) *testConnection {
+	return &testConnection{id: id, frames: make(chan gjson.Result, 100)}
+}
+
+func (c *testConnection) ID() string {
+	return c.id
+}
+
+func (c *testConnection) EmitMessage(frame []byte) error {
+	c.frames <- gjson.ParseBytes(frame)
+	return nil
+}
+
+func (c *testConnection) Disconnect() error {
+	return nil
+}
+
+func (c *testConnection) nextFrame(t *testing.T) gjson.Result {
+	select {
+	case frame := <-c.frames:
+		return frame
+	case <-time.After(5 * time.Second):
+		t.Fatal("frame was not sent")
+	}
+	return gjson.Result{}
+}
+
+func newTestHubConnection(capabilities ...string) (*HubConnection, *testConnection) {
+	connection := newTestConnection("hub")
+	conn := &HubConnection{
+		Username:     "user",
+		Uuid:         "hub",
+		Connection:   connection,
+		Mid:          1,
+		Callbacks:    make(map[int64]RequestCallback),
+		Capabilities: make(map[string]bool),
+		Closed:       make(chan struct{}),
+		Queue:        NewOutboundQueue(connection),
+	}
+	for _, capability := range capabilities {
+		conn.Capabilities[capability] = true
+	}
+	conn.DeviceList.PushBack(newTestLamp())
+	return conn, connection
+}
+
+func TestSetDeviceValueSync(t *testing.T) {
+	tests := []struct {
+		name         string
+		capabilities []string
+		response     string
+		code         string
+	}{
+		{"legacy hub is not awaited", nil, "", ""},
+		{"acknowledged value", []string{HUB_CAPABILITY_ACKNOWLEDGE}, `{"status":"ok"}`, ""},
+		{"rejected value", []string{HUB_CAPABILITY_ACKNOWLEDGE}, `{"status":"error","code":"out_of_range","error":"too bright"}`, HUB_ERROR_OUT_OF_RANGE},
+	}
+	for _, test := range tests {
+		conn, connection := newTestHubConnection(test.capabilities...)
+		result := make(chan error, 1)
+		go func() {
+			result <- setDeviceValueSync(conn, "lamp", "/dimming", `{"dimmingSetting":10}`)
+		}()
+		frame := connection.nextFrame(t)
+		if frame.Get("name").String() != "RequestSetValue" || frame.Get("payload.value.dimmingSetting").Int() != 10 {
+			t.Errorf("%s: unexpected request %s", test.name, frame.Raw)
+		}
+		if test.response != "" {
+			mid := frame.Get("mid").Int()
+			conn.popCallback(mid)(string(messageFrame(mid, "ResponseSetValue", test.response)))
+		}
+		select {
+		case err := <-result:
+			hubErr, _ := err.(*HubRequestError)
+			if (test.code == "" && err != nil) || (test.code != "" && (hubErr == nil || hubErr.Code != test.code)) {
+				t.Errorf("%s: unexpected result %v", test.name, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: value was not acknowledged", test.name)
+		}
+		conn.Queue.Close()
+	}
+}
+
+func TestSetDeviceValuesSync(t *testing.T) {
+	actions := []*SceneAction{
+		{DeviceUUID: "lamp", Resource: "/switch", Value: []byte(`{"value":false}`)},
+		{DeviceUUID: "lamp", Resource: "/dimming", Value: []byte(`{"dimmingSetting":101}`)},
+		{DeviceUUID: "lamp", Resource: "/dimming", Value: []byte(`{"dimmingSetting":20}`)},
+	}
+	tests := []struct {
+		name         string
+		capabilities []string
+		requests     []string
+		response     string
+		failed       []bool
+	}{
+		{"legacy hub gets single values", nil, []string{"RequestSetValue", "RequestSetValue"}, "", []bool{false, true, false}},
+		{"batch of valid values", []string{HUB_CAPABILITY_BATCH}, []string{"RequestSetValues"},
+			`{"results":[{"status":"ok"},{"status":"ok"}]}`, []bool{false, true, false}},
+		{"batch value rejected by hub", []string{HUB_CAPABILITY_BATCH}, []string{"RequestSetValues"},
+			`{"results":[{"status":"ok"},{"status":"error","code":"out_of_range","error":"too bright"}]}`, []bool{false, true, true}},
+		{"batch without results", []string{HUB_CAPABILITY_BATCH}, []string{"RequestSetValues"},
+			`{"results":[{"status":"ok"}]}`, []bool{false, true, true}},
+	}
+	for _, test := range tests {
+		conn, connection := newTestHubConnection(test.capabilities...)
+		result := make(chan []error, 1)
+		go func() {
+			result <- setDeviceValuesSync(conn, actions)
+		}()
+		for _, request := range test.requests {
+			frame := connection.nextFrame(t)
+			if frame.Get("name").String() != request {
+				t.Errorf("%s: unexpected request %s", test.name, frame.Raw)
+			}
+			if request == "RequestSetValues" && frame.Get("payload.values.#").Int() != 2 {
+				t.Errorf("%s: invalid value was sent in batch %s", test.name, frame.Raw)
+			}
+			if test.response != "" {
+				mid := frame.Get("mid").Int()
+				conn.popCallback(mid)(string(messageFrame(mid, "ResponseSetValues", test.response)))
+			}
+		}
+		select {
+		case errs := <-result:
+			for i, err := range errs {
+				if (err != nil) != test.failed[i] {
+					t.Errorf("%s: unexpected result of value %d: %v", test.name, i, err)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: values were not set", test.name)
+		}
+		conn.Queue.Close()
+	}
+
+	for _, err := range setDeviceValuesSync(nil, actions) {
+		if err != errHubOffline {
+			t.Errorf("unexpected error of offline hub %v", err)
+		}
+	}
+}
+
+func TestParseDeviceList(t *testing.T) {
+	switchData := `{"href":"/switch","n":"/switch","if":"oic.if.a","rt":"oic.r.switch.binary","values":{"value":true}}`
+	dimmingData := `{"href":"/dimming","n":"/dimming","if":"oic.if.a","rt":"oic.r.light.dimming","values":{"dimmingSetting":50}}`
+	sensorData := `{"href":"/temperature","n":"/temperature","if":"oic.if.s","rt":"oic.r.temperature","values":{"temperature":70,"units":"F"}}`
+	lampData := func(name string, variables ...string) string {
+		return `{"id":"lamp","name":"` + name + `","variables":[` + strings.Join(variables, ",") + `]}`
+	}
+
+	tests := []struct {
+		name      string
+		devices   string
+		added     int
+		removed   int
+		changed   int
+		resources int
+	}{
+		{"same description", lampData("Lamp", switchData, dimmingData, sensorData), 0, 0, 0, 3},
+		{"renamed device", lampData("Desk Lamp", switchData, dimmingData, sensorData), 0, 0, 1, 3},
+		{"removed resource", lampData("Lamp", switchData, dimmingData), 0, 0, 1, 2},
+		{"added resource", lampData("Lamp", switchData, dimmingData, sensorData, `{"href":"/rgb","n":"/rgb","if":"oic.if.a","rt":"oic.r.colour.rgb","values":{"rgbValue":[0,0,0]}}`), 0, 0, 1, 4},
+		{"changed resource type", lampData("Lamp", switchData, strings.Replace(dimmingData, "oic.r.light.dimming", "oic.r.colour.chroma", 1), sensorData), 0, 0, 1, 3},
+		{"value only", lampData("Lamp", switchData, strings.Replace(dimmingData, "50", "80", 1), sensorData), 0, 0, 0, 3},
+		{"new device", lampData("Lamp", switchData, dimmingData, sensorData) + `,{"id":"plug","name":"Plug","variables":[` + switchData + `]}`, 1, 0, 0, 3},
+		{"removed device", `{"id":"plug","name":"Plug","variables":[` + switchData + `]}`, 1, 1, 0, 0},
+	}
+	for _, test := range tests {
+		conn, _ := newTestHubConnection()
+		added, removed, changed := parseDeviceList(conn, `{"payload":{"devices":[`+test.devices+`]}}`)
+		if len(added) != test.added || len(removed) != test.removed || len(changed) != test.changed {
+			t.Errorf("%s: unexpected result %d added, %d removed, %d changed", test.name, len(added), len(removed), len(changed))
+		}
+		resources := 0
+		if lamp := conn.getDevice("lamp"); lamp != nil {
+			resources = len(lamp.Variables)
+		}
+		if resources != test.resources {
+			t.Errorf("%s: expected %d resources, got %d", test.name, test.resources, resources)
+		}
+		conn.Queue.Close()
+	}
+}
+
+func TestReconcileKeepsValue(t *testing.T) {
+	device := newTestLamp()
+	changed := reconcileDevice(device, gjson.Parse(`{"id":"lamp","name":"Lamp","variables":[{"href":"/dimming","n":"/dimming","if":"oic.if.a","rt":"oic.r.light.dimming"}]}`))
+	if !changed || len(device.Variables) != 1 {
+		t.Fatalf("removed resources were not reconciled")
+	}
+	if value := device.getVariable("/dimming").VariableValue.Value.Get("dimmingSetting").Int(); value != 50 {
+		t.Errorf("value of resource without values was not kept, got %d", value)
+	}
+}
+
+func TestMergeValueDelta(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous string
+		delta    string
+		merged   string
+	}{
+		{"changed property", `{"value":true,"id":"switch"}`, `{"value":false}`, `{"value":false,"id":"switch"}`},
+		{"new property", `{"dimmingSetting":50}`, `{"range":[0,100]}`, `{"dimmingSetting":50,"range":[0,100]}`},
+		{"nested object replaced", `{"color":{"r":1,"g":2}}`, `{"color":{"r":3}}`, `{"color":{"r":3}}`},
+		{"previous not object", `null`, `{"value":true}`, `{"value":true}`},
+		{"delta not object", `{"value":true}`, `5`, `5`},
+	}
+	for _, test := range tests {
+		merged := mergeValueDelta(gjson.Parse(test.previous), gjson.Parse(test.delta))
+		if merged.Raw != test.merged {
+			t.Errorf("%s: expected %s, got %s", test.name, test.merged, merged.Raw)
+		}
+	}
+}
+
+func compressTestPayload(payload []byte) string {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write(payload)
+	writer.Close()
+	return `{"mid":3,"name":"EventDeviceListUpdate","payload":{"encoding":"gzip","data":"` + base64.StdEncoding.EncodeToString(buffer.Bytes()) + `"}}`
+}
+
+func TestDecodeHubMessage(t *testing.T) {
+	limit := HUB_MAX_MESSAGE_SIZE * HUB_MAX_COMPRESSION_RATIO
+	tests := []struct {
+		name    string
+		message string
+		payload string
+		valid   bool
+	}{
+		{"plain message", `{"mid":3,"name":"EventDeviceListUpdate","payload":{"devices":[]}}`, `{"devices":[]}`, true},
+		{"compressed message", compressTestPayload([]byte(`{"devices":[]}`)), `{"devices":[]}`, true},
+		{"inflated to limit", compressTestPayload([]byte(`"` + strings.Repeat("a", limit-2) + `"`)), "", true},
+		{"inflated over limit", compressTestPayload([]byte(`"` + strings.Repeat("a", limit-1) + `"`)), "", false},
+		{"invalid json", compressTestPayload([]byte(`{"devices":`)), "", false},
+		{"invalid base64", `{"mid":3,"name":"EventDeviceListUpdate","payload":{"encoding":"gzip","data":"!"}}`, "", false},
+	}
+	hub, _ := newTestHubConnection(HUB_CAPABILITY_COMPRESSION)
+	defer hub.Queue.Close()
+	for _, test := range tests {
+		message, err := decodeHubMessage(hub, test.message)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if test.payload != "" && gjson.Get(message, "payload").Raw != test.payload {
+			t.Errorf("%s: expected payload %s, got %s", test.name, test.payload, message)
+		}
+	}
+}
+
+func TestUpdateValueConcurrentWithReaders(t *testing.T) {
+	hub, _ := newTestHubConnection()
+	defer hub.Queue.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			for _, device := range hub.getDevices() {
+				device.getVariable("/dimming").VariableValue.Value.Get("dimmingSetting").Int()
+			}
+		}
+	}()
+
+	tests := []struct {
+		name     string
+		device   string
+		resource string
+		value    string
+		delta    bool
+		stored   string
+		valid    bool
+	}{
+		{"whole value", "lamp", "/dimming", `{"dimmingSetting":20}`, false, `{"dimmingSetting":20}`, true},
+		{"delta", "lamp", "/dimming", `{"range":[0,100]}`, true, `{"dimmingSetting":20,"range":[0,100]}`, true},
+		{"unknown resource", "lamp", "/missing", `{"value":true}`, false, "", false},
+		{"unknown device", "fan", "/dimming", `{"dimmingSetting":20}`, false, "", false},
+	}
+	for _, test := range tests {
+		device, _, err := hub.updateValue(test.device, test.resource, gjson.Parse(test.value), test.delta)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if stored := device.getVariable(test.resource).VariableValue.Value.Raw; stored != test.stored {
+			t.Errorf("%s: expected %s, got %s", test.name, test.stored, stored)
+		}
+		device.getVariable(test.resource).VariableValue.Value = gjson.Parse(`{}`)
+		if stored := hub.getDevice(test.device).getVariable(test.resource).VariableValue.Value.Raw; stored != test.stored {
+			t.Errorf("%s: copy of device must not change stored value, got %s", test.name, stored)
+		}
+	}
+	<-done
+}
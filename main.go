@@ -4,6 +4,10 @@ import (
 	"github.com/twinj/uuid"
 
 	"container/list"
+	"errors"
+	"log"
+	"strings"
+	"sync"
 
 	"gopkg.in/kataras/iris.v6"
 	"gopkg.in/kataras/iris.v6/adaptors/httprouter"
@@ -19,6 +23,68 @@ type HubConnection struct {
 	Mid       int64
 	Uuid      string
 	Name      string
+
+	ProtocolVersion int
+	Capabilities    map[string]bool
+
+	Closed chan struct{}
+	Queue  *OutboundQueue
+	//Forward sends requests of hubs without websocket connection, these are hubs connected
+	//to other cluster instance marked Remote and hubs implemented inside gateway marked Virtual
+	Forward func(mid int64, name string, payload string)
+	Remote  bool
+	Virtual bool
+	mutex   sync.Mutex
+}
+
+//hubsMutex guards hub connection lists and device lists of hubs, code iterating them works
+//on snapshots so nothing else runs with the lock held
+var hubsMutex sync.RWMutex
+
+func addHubConnection(hubConnections *list.List, conn *HubConnection) {
+	hubsMutex.Lock()
+	defer hubsMutex.Unlock()
+	hubConnections.PushBack(conn)
+}
+
+func removeHubConnection(hubConnections *list.List, conn *HubConnection) {
+	hubsMutex.Lock()
+	defer hubsMutex.Unlock()
+	for e := hubConnections.Front(); e != nil; e = e.Next() {
+		if e.Value.(*HubConnection) == conn {
+			hubConnections.Remove(e)
+			return
+		}
+	}
+}
+
+//getHubConnections returns snapshot of hub connections
+func getHubConnections(hubConnections *list.List) []*HubConnection {
+	hubsMutex.RLock()
+	defer hubsMutex.RUnlock()
+	hubs := make([]*HubConnection, 0, hubConnections.Len())
+	for e := hubConnections.Front(); e != nil; e = e.Next() {
+		hubs = append(hubs, e.Value.(*HubConnection))
+	}
+	return hubs
+}
+
+//getName returns hub name, cluster updates name of remote hubs while they are listed
+func (connection *HubConnection) getName() string {
+	hubsMutex.RLock()
+	defer hubsMutex.RUnlock()
+	return connection.Name
+}
+
+//getDevices returns copies of hub devices
+func (connection *HubConnection) getDevices() []*IotDevice {
+	hubsMutex.RLock()
+	defer hubsMutex.RUnlock()
+	devices := make([]*IotDevice, 0, connection.DeviceList.Len())
+	for d := connection.DeviceList.Front(); d != nil; d = d.Next() {
+		devices = append(devices, d.Value.(*IotDevice).copy())
+	}
+	return devices
 }
 
 type RequestCallback func(string)
@@ -45,8 +111,85 @@ type EventDeviceListMessage struct {
 func generateMessageUUID() string {
 	return uuid.NewV4().String()
 }
-func setDeviceValue(clientConnection *HubConnection, deviceID string, resourceID string, valueObject string) {
+//setDeviceValue sends value without waiting for hub, only offline hub and invalid value are reported
+func setDeviceValue(clientConnection *HubConnection, deviceID string, resourceID string, valueObject string) error {
+	if clientConnection == nil {
+		log.Println("Unable to set value of " + deviceID + resourceID + ", hub is offline")
+		return errHubOffline
+	}
+	if err := validateDeviceValue(clientConnection, deviceID, resourceID, valueObject); err != nil {
+		return err
+	}
 	sendRequest(clientConnection, "RequestSetValue", `{"uuid":"`+deviceID+`","resource":"`+resourceID+`", "value":`+valueObject+`}`, nil)
+	return nil
+}
+
+//setDeviceValueSync waits until hub acknowledges new value, hubs which did not negotiate
+//acknowledgements get the value the same way as with setDeviceValue
+func setDeviceValueSync(clientConnection *HubConnection, deviceID string, resourceID string, valueObject string) error {
+	if clientConnection == nil || !clientConnection.supports(HUB_CAPABILITY_ACKNOWLEDGE) {
+		return setDeviceValue(clientConnection, deviceID, resourceID, valueObject)
+	}
+	if err := validateDeviceValue(clientConnection, deviceID, resourceID, valueObject); err != nil {
+		return err
+	}
+	_, err := sendRequestSync(clientConnection, "RequestSetValue", `{"uuid":"`+deviceID+`","resource":"`+resourceID+`", "value":`+valueObject+`}`, HUB_REQUEST_TIMEOUT)
+	return err
+}
+
+//setDeviceValuesSync sets several values of hub in one batch request and returns error of every value,
+//hubs without batch support get individual requests
+func setDeviceValuesSync(clientConnection *HubConnection, actions []*SceneAction) []error {
+	errs := make([]error, len(actions))
+	if clientConnection == nil {
+		for i := range errs {
+			errs[i] = errHubOffline
+		}
+		return errs
+	}
+	if !clientConnection.supports(HUB_CAPABILITY_BATCH) {
+		var hubErr error
+		for i, action := range actions {
+			err := hubErr
+			if err == nil {
+				err = setDeviceValueSync(clientConnection, action.DeviceUUID, action.Resource, string(action.Value))
+			}
+			if err == errHubOffline || err == errHubTimeout {
+				hubErr = err
+			}
+			errs[i] = err
+		}
+		return errs
+	}
+
+	//invalid values are rejected here and are not part of batch
+	var values []string
+	var indexes []int
+	for i, action := range actions {
+		errs[i] = validateDeviceValue(clientConnection, action.DeviceUUID, action.Resource, string(action.Value))
+		if errs[i] == nil {
+			values = append(values, `{"uuid":"`+action.DeviceUUID+`","resource":"`+action.Resource+`", "value":`+string(action.Value)+`}`)
+			indexes = append(indexes, i)
+		}
+	}
+	if len(values) == 0 {
+		return errs
+	}
+	response, err := sendRequestSync(clientConnection, "RequestSetValues", `{"values":[`+strings.Join(values, ",")+`]}`, HUB_REQUEST_TIMEOUT)
+	results := response.Get("payload.results").Array()
+	for j, i := range indexes {
+		if err != nil {
+			errs[i] = err
+		} else if j >= len(results) {
+			errs[i] = errors.New("hub did not return result")
+		} else if results[j].Get("status").String() == "error" {
+			errs[i] = &HubRequestError{
+				Code:    results[j].Get("code").String(),
+				Message: results[j].Get("error").String(),
+			}
+		}
+	}
+	return errs
 }
 
 func main() {
@@ -55,14 +198,33 @@ func main() {
 	app := iris.New()
 	app.Adapt(iris.DevLogger(), httprouter.New())
 
-	clientConnectionServer := NewClientEndpoint(hubConnections, webClietnConnections)
+	scenes := NewSceneStore()
+	rules := NewRuleEngine(hubConnections, scenes)
+	scheduler := NewScheduler(hubConnections)
+	history := NewHistoryStore()
+	webhooks := NewWebhookDispatcher()
+
+	overlays := NewOverlayStore()
+	groups := NewGroupStore(overlays)
+	virtualHub := NewVirtualHub()
+	alexaEvents := NewAlexaEventGateway()
+	clientConnectionServer := NewClientEndpoint(hubConnections, webClietnConnections, scenes, rules, scheduler, history, webhooks, overlays, groups, virtualHub, alexaEvents)
 	app.Adapt(clientConnectionServer.WebSocketServer)
 
-	hubConnectionServer := NewHubEndpoint(hubConnections, clientConnectionServer)
+	var cluster *Cluster
+	if transport := newClusterTransport(app); transport != nil {
+		cluster = NewCluster(transport, hubConnections, clientConnectionServer)
+	}
+
+	hubConnectionServer := NewHubEndpoint(hubConnections, clientConnectionServer, alexaEvents, rules, history, webhooks, cluster)
 	app.Adapt(hubConnectionServer.WebSocketServer)
+	virtualHub.Start(hubConnectionServer)
 
-	alexaEndpoint := NewAlexaEndpoint(app, hubConnections)
+	alexaEndpoint := NewAlexaEndpoint(app, hubConnections, alexaEvents, scenes, overlays, groups)
 	_ = alexaEndpoint
 
+	restEndpoint := NewRestEndpoint(app, hubConnections, clientConnectionServer, history, webhooks, overlays, groups)
+	_ = restEndpoint
+
 	app.Listen(":12345")
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+)
+
+//blockedNetworks lists ranges not covered by net.IP helpers that must not be reached from user supplied urls
+var blockedNetworks = parseNetworks("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "64:ff9b::/96")
+
+var errPrivateTarget = errors.New("url targets loopback, link-local or private network")
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+//isPrivateNetworkAllowed lets self hosted gateways call services on their own network
+func isPrivateNetworkAllowed() bool {
+	return os.Getenv("OUTBOUND_ALLOW_PRIVATE_NETWORKS") == "true"
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+//validateOutboundURL checks user supplied url is http or https and resolves only to public addresses
+func validateOutboundURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return errors.New("url must be absolute http or https url")
+	}
+	if isPrivateNetworkAllowed() {
+		return nil
+	}
+	host := parsed.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIP(ip) {
+			return errPrivateTarget
+		}
+		return nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return errors.New("unable to resolve " + host)
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return errPrivateTarget
+		}
+	}
+	return nil
+}
+
+//checkDialAddress rejects connections to non public addresses after name resolution, this covers redirects and dns rebinding
+func checkDialAddress(network string, address string, c syscall.RawConn) error {
+	if isPrivateNetworkAllowed() {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return errPrivateTarget
+	}
+	return nil
+}
+
+//newOutboundHTTPClient returns client for user supplied urls which refuses to connect to private networks
+func newOutboundHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: checkDialAddress,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConnsPerHost: 2,
+		},
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	INTERFACE_ACTUATOR   = "oic.if.a"
+	INTERFACE_SENSOR     = "oic.if.s"
+	INTERFACE_READ_WRITE = "oic.if.rw"
+	INTERFACE_READ_ONLY  = "oic.if.r"
+	INTERFACE_BASELINE   = "oic.if.baseline"
+
+	//resource types of sensors are read-only whatever interface they declare
+	SENSOR_RESOURCE_TYPE_PREFIX = "oic.r.sensor"
+)
+
+func (variable *IotVariable) hasInterface(name string) bool {
+	for _, item := range strings.FieldsFunc(variable.Interface, func(r rune) bool { return r == ' ' || r == ',' }) {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+//hasWritableResourceType checks if resource type allows writes, resource is writable when
+//any of its known types has writable property, only resources whose types are all unknown
+//are assumed writable
+func (variable *IotVariable) hasWritableResourceType() bool {
+	resourceTypes := getResourceTypes(variable)
+	for _, resourceType := range resourceTypes {
+		if strings.HasPrefix(resourceType, SENSOR_RESOURCE_TYPE_PREFIX) {
+			return false
+		}
+	}
+	known := false
+	for _, resourceType := range resourceTypes {
+		properties, ok := resourceSchemas[resourceType]
+		if !ok {
+			continue
+		}
+		known = true
+		for _, schema := range properties {
+			if !schema.ReadOnly {
+				return true
+			}
+		}
+	}
+	return !known
+}
+
+//isWritable interprets OCF interface and resource type of resource, actuator and read-write
+//interfaces allow writes while sensor and read-only ones don't, resources declaring only
+//baseline interface or none at all (legacy hubs) are decided by resource type
+func (variable *IotVariable) isWritable() bool {
+	if variable.hasInterface(INTERFACE_SENSOR) || variable.hasInterface(INTERFACE_READ_ONLY) {
+		if !variable.hasInterface(INTERFACE_ACTUATOR) && !variable.hasInterface(INTERFACE_READ_WRITE) {
+			return false
+		}
+	}
+	return variable.hasWritableResourceType()
+}
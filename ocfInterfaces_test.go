@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIsWritable(t *testing.T) {
+	tests := []struct {
+		name         string
+		resourceType string
+		iface        string
+		writable     bool
+	}{
+		{"actuator switch", "oic.r.switch.binary", INTERFACE_ACTUATOR, true},
+		{"read-write switch", "oic.r.switch.binary", INTERFACE_READ_WRITE, true},
+		{"sensor interface", "oic.r.switch.binary", INTERFACE_SENSOR, false},
+		{"read-only interface", "oic.r.switch.binary", INTERFACE_READ_ONLY, false},
+		{"sensor with actuator interface", "oic.r.light.dimming", INTERFACE_SENSOR + " " + INTERFACE_ACTUATOR, true},
+		{"baseline only", "oic.r.switch.binary", INTERFACE_BASELINE, true},
+		{"legacy hub without interface", "oic.r.switch.binary", "", true},
+		{"sensor resource type", "oic.r.sensor.contact", INTERFACE_ACTUATOR, false},
+		{"sensor resource type among others", "oic.r.switch.binary oic.r.sensor.motion", INTERFACE_ACTUATOR, false},
+		{"known type with writable property", "oic.r.humidity", INTERFACE_BASELINE, true},
+		{"unknown type", "x.vendor.thing", INTERFACE_BASELINE, true},
+		{"no resource type", "", INTERFACE_BASELINE, true},
+		{"unknown before writable type", "x.vendor.thing,oic.r.switch.binary", INTERFACE_BASELINE, true},
+		{"unknown before read-only type", "x.vendor.thing,oic.r.mode.readonly", INTERFACE_BASELINE, false},
+		{"read-only before unknown type", "oic.r.mode.readonly x.vendor.thing", INTERFACE_BASELINE, false},
+	}
+	registerResourceSchema("oic.r.mode.readonly", map[string]*PropertySchema{
+		"supportedModes": {Type: SCHEMA_TYPE_ARRAY, ReadOnly: true},
+	})
+	defer delete(resourceSchemas, "oic.r.mode.readonly")
+	for _, test := range tests {
+		variable := newTestVariable("/resource", test.resourceType, test.iface, `{}`)
+		if writable := variable.isWritable(); writable != test.writable {
+			t.Errorf("%s: expected writable %v, got %v", test.name, test.writable, writable)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/kataras/iris.v6/adaptors/websocket"
+)
+
+const (
+	OUTBOUND_QUEUE_SIZE = 1000
+	//OUTBOUND_COALESCE_THRESHOLD is queue length from which messages with the same key replace each other
+	OUTBOUND_COALESCE_THRESHOLD = 100
+	//OUTBOUND_SLOW_TIMEOUT is how long queue may stay full before connection is dropped
+	OUTBOUND_SLOW_TIMEOUT = 30 * time.Second
+)
+
+//OutboundMetrics are counters of outbound queue
+type OutboundMetrics struct {
+	Enqueued        int64 `json:"enqueued"`
+	Sent            int64 `json:"sent"`
+	Coalesced       int64 `json:"coalesced"`
+	Dropped         int64 `json:"dropped"`
+	SlowDisconnects int64 `json:"slowDisconnects"`
+}
+
+//add increments counters by values of delta
+func (metrics *OutboundMetrics) add(delta OutboundMetrics) {
+	atomic.AddInt64(&metrics.Enqueued, delta.Enqueued)
+	atomic.AddInt64(&metrics.Sent, delta.Sent)
+	atomic.AddInt64(&metrics.Coalesced, delta.Coalesced)
+	atomic.AddInt64(&metrics.Dropped, delta.Dropped)
+	atomic.AddInt64(&metrics.SlowDisconnects, delta.SlowDisconnects)
+}
+
+func (metrics *OutboundMetrics) load() OutboundMetrics {
+	return OutboundMetrics{
+		Enqueued:        atomic.LoadInt64(&metrics.Enqueued),
+		Sent:            atomic.LoadInt64(&metrics.Sent),
+		Coalesced:       atomic.LoadInt64(&metrics.Coalesced),
+		Dropped:         atomic.LoadInt64(&metrics.Dropped),
+		SlowDisconnects: atomic.LoadInt64(&metrics.SlowDisconnects),
+	}
+}
+
+//getUserOutboundMetrics sums metrics of queues of hubs and web clients of user
+func getUserOutboundMetrics(username string, hubs []*HubConnection, clients []*WebClientConnection) OutboundMetrics {
+	result := OutboundMetrics{}
+	for _, hub := range hubs {
+		if hub.Username == username && hub.Queue != nil {
+			result.add(hub.Queue.Metrics())
+		}
+	}
+	for _, client := range clients {
+		if client.Username == username && client.Queue != nil {
+			result.add(client.Queue.Metrics())
+		}
+	}
+	return result
+}
+
+//OutboundMessage is queued frame, frame of message replaced by coalescing is set to nil
+type OutboundMessage struct {
+	Key   string
+	Frame []byte
+}
+
+//OutboundQueue is bounded queue of frames written to websocket by its own goroutine,
+//so slow receiver does not block the code producing messages
+type OutboundQueue struct {
+	Connection websocket.Connection
+
+	mutex    sync.Mutex
+	messages []*OutboundMessage
+	//keys maps key to its queued message, length counts queued messages which were not coalesced
+	keys      map[string]*OutboundMessage
+	length    int
+	fullSince time.Time
+	dropped   int64
+	closed    bool
+	metrics   OutboundMetrics
+	signal    chan struct{}
+	done      chan struct{}
+}
+
+func NewOutboundQueue(connection websocket.Connection) *OutboundQueue {
+	queue := &OutboundQueue{
+		Connection: connection,
+		keys:       make(map[string]*OutboundMessage),
+		signal:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	go queue.run()
+	return queue
+}
+
+//Enqueue adds frame to the queue, when queue backs up queued frame with the same non empty key
+//is dropped and the new one goes to the tail so frames stay in sequence order, when queue is full
+//frame is dropped
+func (queue *OutboundQueue) Enqueue(key string, frame []byte) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if queue.closed {
+		return
+	}
+	queue.metrics.add(OutboundMetrics{Enqueued: 1})
+	if queued := queue.keys[key]; key != "" && queued != nil && queue.length >= OUTBOUND_COALESCE_THRESHOLD {
+		queued.Frame = nil
+		queue.length--
+		queue.metrics.add(OutboundMetrics{Coalesced: 1})
+	} else if queue.length >= OUTBOUND_QUEUE_SIZE {
+		queue.metrics.add(OutboundMetrics{Dropped: 1})
+		queue.dropped++
+		if queue.fullSince.IsZero() {
+			queue.fullSince = time.Now()
+		} else if time.Since(queue.fullSince) > OUTBOUND_SLOW_TIMEOUT {
+			log.Println("Disconnecting slow connection " + queue.Connection.ID())
+			queue.metrics.add(OutboundMetrics{SlowDisconnects: 1})
+			queue.closed = true
+			close(queue.done)
+			go queue.Connection.Disconnect()
+		}
+		return
+	}
+	message := &OutboundMessage{Key: key, Frame: frame}
+	queue.messages = append(queue.messages, message)
+	queue.length++
+	if key != "" {
+		queue.keys[key] = message
+	}
+	//drop replaced messages once they outnumber queued ones so coalescing keeps queue bounded
+	if len(queue.messages) > 2*queue.length {
+		queued := queue.messages[:0]
+		for _, message := range queue.messages {
+			if message.Frame != nil {
+				queued = append(queued, message)
+			}
+		}
+		queue.messages = queued
+	}
+	select {
+	case queue.signal <- struct{}{}:
+	default:
+	}
+}
+
+//Metrics returns counters of the queue
+func (queue *OutboundQueue) Metrics() OutboundMetrics {
+	return queue.metrics.load()
+}
+
+//Close stops writer goroutine, queued frames are discarded
+func (queue *OutboundQueue) Close() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if queue.closed {
+		return
+	}
+	queue.closed = true
+	close(queue.done)
+	if queue.dropped > 0 {
+		log.Println("Outbound queue of", queue.Connection.ID(), "dropped", queue.dropped, "messages")
+	}
+}
+
+func (queue *OutboundQueue) run() {
+	for {
+		select {
+		case <-queue.done:
+			return
+		case <-queue.signal:
+		}
+		queue.mutex.Lock()
+		messages := queue.messages
+		queue.messages = nil
+		queue.keys = make(map[string]*OutboundMessage)
+		queue.length = 0
+		queue.fullSince = time.Time{}
+		queue.mutex.Unlock()
+
+		for _, message := range messages {
+			select {
+			case <-queue.done:
+				return
+			default:
+			}
+			if message.Frame == nil {
+				continue
+			}
+			err := queue.Connection.EmitMessage(message.Frame)
+			if err != nil {
+				log.Println(err)
+			}
+			queue.metrics.add(OutboundMetrics{Sent: 1})
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+//blockingConnection holds writer of outbound queue until released
+type blockingConnection struct {
+	*testConnection
+	release chan struct{}
+}
+
+func (c *blockingConnection) EmitMessage(frame []byte) error {
+	<-c.release
+	return c.testConnection.EmitMessage(frame)
+}
+
+func TestOutboundQueueCoalescingKeepsOrder(t *testing.T) {
+	connection := &blockingConnection{testConnection: newTestConnection("client"), release: make(chan struct{})}
+	queue := NewOutboundQueue(connection)
+	defer queue.Close()
+
+	//writer takes first frame and blocks so the rest backs up
+	queue.Enqueue("", eventFrame(0, "EventFirst", "{}"))
+	for {
+		queue.mutex.Lock()
+		taken := len(queue.messages) == 0
+		queue.mutex.Unlock()
+		if taken {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	sequence := int64(1)
+	for ; sequence <= OUTBOUND_COALESCE_THRESHOLD; sequence++ {
+		queue.Enqueue("resource"+strconv.FormatInt(sequence%10, 10), eventFrame(sequence, "EventResourceUpdate", "{}"))
+	}
+	queue.Enqueue("resource1", eventFrame(sequence, "EventResourceUpdate", "{}"))
+	close(connection.release)
+
+	previous := int64(-1)
+	for i := int64(0); i <= OUTBOUND_COALESCE_THRESHOLD; i++ {
+		frame := connection.nextFrame(t)
+		if frame.Get("seq").Int() <= previous {
+			t.Fatalf("frame %d sent after %d", frame.Get("seq").Int(), previous)
+		}
+		previous = frame.Get("seq").Int()
+	}
+	if previous != sequence {
+		t.Errorf("coalesced frame %d was not sent last, got %d", sequence, previous)
+	}
+}
+
+func TestOutboundQueueCoalescingStaysBounded(t *testing.T) {
+	connection := &blockingConnection{testConnection: newTestConnection("client"), release: make(chan struct{})}
+	queue := NewOutboundQueue(connection)
+	defer queue.Close()
+
+	queue.Enqueue("", eventFrame(0, "EventFirst", "{}"))
+	for {
+		queue.mutex.Lock()
+		taken := len(queue.messages) == 0
+		queue.mutex.Unlock()
+		if taken {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < OUTBOUND_COALESCE_THRESHOLD; i++ {
+		queue.Enqueue("resource"+strconv.Itoa(i), eventFrame(int64(i+1), "EventResourceUpdate", "{}"))
+	}
+	for i := 0; i < 10*OUTBOUND_QUEUE_SIZE; i++ {
+		queue.Enqueue("resource1", eventFrame(int64(OUTBOUND_COALESCE_THRESHOLD+i+1), "EventResourceUpdate", "{}"))
+	}
+	queue.mutex.Lock()
+	queued, length := len(queue.messages), queue.length
+	queue.mutex.Unlock()
+	if length != OUTBOUND_COALESCE_THRESHOLD || queued > 2*OUTBOUND_COALESCE_THRESHOLD {
+		t.Errorf("queue grew to %d messages holding %d frames", queued, length)
+	}
+	if metrics := queue.Metrics(); metrics.Coalesced != 10*OUTBOUND_QUEUE_SIZE || metrics.Dropped != 0 {
+		t.Errorf("unexpected metrics %+v", metrics)
+	}
+}
+
+func TestUserOutboundMetrics(t *testing.T) {
+	hub, _ := newTestHubConnection()
+	defer hub.Queue.Close()
+	client, _ := newTestWebClient("client", "user")
+	defer client.Queue.Close()
+	other, _ := newTestWebClient("other", "other")
+	defer other.Queue.Close()
+	remote := &HubConnection{Username: "user", Uuid: "remote", Remote: true}
+
+	hub.Queue.metrics.add(OutboundMetrics{Enqueued: 2, Sent: 2})
+	client.Queue.metrics.add(OutboundMetrics{Enqueued: 3, Dropped: 1})
+	other.Queue.metrics.add(OutboundMetrics{Enqueued: 5, SlowDisconnects: 1})
+
+	tests := []struct {
+		username string
+		expected OutboundMetrics
+	}{
+		{"user", OutboundMetrics{Enqueued: 5, Sent: 2, Dropped: 1}},
+		{"other", OutboundMetrics{Enqueued: 5, SlowDisconnects: 1}},
+		{"nobody", OutboundMetrics{}},
+	}
+	for _, test := range tests {
+		metrics := getUserOutboundMetrics(test.username, []*HubConnection{hub, remote}, []*WebClientConnection{client, other})
+		if metrics != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.username, test.expected, metrics)
+		}
+	}
+}
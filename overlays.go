@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+const (
+	DEVICE_OVERLAYS_STORAGE = "deviceOverlays"
+)
+
+type ResourceOverlay struct {
+	Name   string `json:"name,omitempty"`
+	Hidden bool   `json:"hidden,omitempty"`
+}
+
+//DeviceOverlay is user defined metadata of device applied over data received from hub
+type DeviceOverlay struct {
+	HubUUID    string                      `json:"hubUuid"`
+	DeviceUUID string                      `json:"uuid"`
+	Name       string                      `json:"name,omitempty"`
+	Room       string                      `json:"room,omitempty"`
+	Tags       []string                    `json:"tags,omitempty"`
+	Icon       string                      `json:"icon,omitempty"`
+	Hidden     bool                        `json:"hidden,omitempty"`
+	Resources  map[string]*ResourceOverlay `json:"resources,omitempty"`
+}
+
+type OverlayStore struct {
+	mutex    sync.Mutex
+	overlays map[string][]*DeviceOverlay
+}
+
+func NewOverlayStore() *OverlayStore {
+	store := &OverlayStore{
+		overlays: make(map[string][]*DeviceOverlay),
+	}
+	err := loadData(DEVICE_OVERLAYS_STORAGE, &store.overlays)
+	if err != nil {
+		log.Println(err)
+	}
+	return store
+}
+
+func (store *OverlayStore) save() {
+	err := saveData(DEVICE_OVERLAYS_STORAGE, store.overlays)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (store *OverlayStore) getOverlays(username string) []*DeviceOverlay {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return append([]*DeviceOverlay{}, store.overlays[username]...)
+}
+
+func (store *OverlayStore) getOverlay(username string, hubUUID string, deviceUUID string) *DeviceOverlay {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, overlay := range store.overlays[username] {
+		if overlay.HubUUID == hubUUID && overlay.DeviceUUID == deviceUUID {
+			return overlay
+		}
+	}
+	return nil
+}
+
+//setOverlay stores overlay replacing previous one of the same device
+func (store *OverlayStore) setOverlay(username string, overlay *DeviceOverlay) error {
+	if overlay.HubUUID == "" || overlay.DeviceUUID == "" {
+		return errors.New("overlay requires hubUuid and uuid")
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	overlays := store.overlays[username]
+	for i, existing := range overlays {
+		if existing.HubUUID == overlay.HubUUID && existing.DeviceUUID == overlay.DeviceUUID {
+			overlays[i] = overlay
+			store.save()
+			return nil
+		}
+	}
+	store.overlays[username] = append(overlays, overlay)
+	store.save()
+	return nil
+}
+
+func (store *OverlayStore) deleteOverlay(username string, hubUUID string, deviceUUID string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	overlays := store.overlays[username]
+	for i, overlay := range overlays {
+		if overlay.HubUUID == hubUUID && overlay.DeviceUUID == deviceUUID {
+			store.overlays[username] = append(overlays[:i:i], overlays[i+1:]...)
+			store.save()
+			return true
+		}
+	}
+	return false
+}
+
+//apply returns copy of device with user overlay applied, device itself is shared by all users and is not modified
+func (store *OverlayStore) apply(username string, hubUUID string, device *IotDevice) *IotDevice {
+	overlay := store.getOverlay(username, hubUUID, device.UUID)
+	if overlay == nil {
+		return device
+	}
+	result := *device
+	if overlay.Name != "" {
+		result.OriginalName = device.Name
+		result.Name = overlay.Name
+	}
+	result.Room = overlay.Room
+	result.Tags = overlay.Tags
+	result.Icon = overlay.Icon
+	result.Hidden = overlay.Hidden
+	result.Variables = nil
+	for _, variable := range device.Variables {
+		resource := overlay.Resources[variable.Href]
+		if resource == nil {
+			result.Variables = append(result.Variables, variable)
+			continue
+		}
+		v := *variable
+		if resource.Name != "" {
+			v.Name = resource.Name
+		}
+		v.Hidden = resource.Hidden
+		result.Variables = append(result.Variables, &v)
+	}
+	return &result
+}
+
+func (store *OverlayStore) applyAll(username string, hubUUID string, devices []*IotDevice) []*IotDevice {
+	var result []*IotDevice
+	for _, device := range devices {
+		result = append(result, store.apply(username, hubUUID, device))
+	}
+	return result
+}
+
+//filterVariables returns copy of device with only hidden or only visible variables
+func (device *IotDevice) filterVariables(hidden bool) *IotDevice {
+	result := *device
+	result.Variables = nil
+	for _, variable := range device.Variables {
+		if variable.Hidden == hidden {
+			result.Variables = append(result.Variables, variable)
+		}
+	}
+	return &result
+}
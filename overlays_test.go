@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOverlayApply(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	store := NewOverlayStore()
+	store.setOverlay("user", &DeviceOverlay{
+		HubUUID:    "hub",
+		DeviceUUID: "lamp",
+		Name:       "Desk Lamp",
+		Room:       "Office",
+		Tags:       []string{"work"},
+		Resources: map[string]*ResourceOverlay{
+			"/dimming":     {Name: "Brightness"},
+			"/temperature": {Hidden: true},
+		},
+	})
+	store.setOverlay("other", &DeviceOverlay{HubUUID: "hub", DeviceUUID: "lamp", Room: "Kitchen"})
+
+	tests := []struct {
+		name         string
+		username     string
+		hubUUID      string
+		deviceName   string
+		originalName string
+		room         string
+		dimming      string
+		visible      int
+	}{
+		{"owner overlay", "user", "hub", "Desk Lamp", "Lamp", "Office", "Brightness", 2},
+		{"overlay without name", "other", "hub", "Lamp", "", "Kitchen", "/dimming", 3},
+		{"no overlay", "nobody", "hub", "Lamp", "", "", "/dimming", 3},
+		{"overlay of other hub", "user", "other", "Lamp", "", "", "/dimming", 3},
+	}
+	for _, test := range tests {
+		device := newTestLamp()
+		result := store.apply(test.username, test.hubUUID, device)
+		if result.Name != test.deviceName || result.OriginalName != test.originalName || result.Room != test.room {
+			t.Errorf("%s: unexpected device %s %s %s", test.name, result.Name, result.OriginalName, result.Room)
+		}
+		if name := result.getVariable("/dimming").Name; name != test.dimming {
+			t.Errorf("%s: expected resource name %s, got %s", test.name, test.dimming, name)
+		}
+		if visible := len(result.filterVariables(false).Variables); visible != test.visible {
+			t.Errorf("%s: expected %d visible resources, got %d", test.name, test.visible, visible)
+		}
+		if device.Name != "Lamp" || device.getVariable("/dimming").Name != "/dimming" || device.getVariable("/temperature").Hidden {
+			t.Errorf("%s: shared device was modified", test.name)
+		}
+	}
+}
+
+func TestSetOverlay(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	store := NewOverlayStore()
+
+	tests := []struct {
+		name     string
+		overlay  *DeviceOverlay
+		valid    bool
+		overlays int
+	}{
+		{"missing hub", &DeviceOverlay{DeviceUUID: "lamp", Name: "Lamp"}, false, 0},
+		{"missing device", &DeviceOverlay{HubUUID: "hub", Name: "Lamp"}, false, 0},
+		{"new overlay", &DeviceOverlay{HubUUID: "hub", DeviceUUID: "lamp", Name: "Lamp"}, true, 1},
+		{"replaced overlay", &DeviceOverlay{HubUUID: "hub", DeviceUUID: "lamp", Name: "Desk Lamp"}, true, 1},
+		{"other device", &DeviceOverlay{HubUUID: "hub", DeviceUUID: "plug", Name: "Plug"}, true, 2},
+	}
+	for _, test := range tests {
+		err := store.setOverlay("user", test.overlay)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if overlays := len(store.getOverlays("user")); overlays != test.overlays {
+			t.Errorf("%s: expected %d overlays, got %d", test.name, test.overlays, overlays)
+		}
+	}
+	if overlay := store.getOverlay("user", "hub", "lamp"); overlay == nil || overlay.Name != "Desk Lamp" {
+		t.Errorf("overlay was not replaced %+v", overlay)
+	}
+
+	reloaded := NewOverlayStore()
+	if len(reloaded.getOverlays("user")) != 2 {
+		t.Errorf("overlays were not stored")
+	}
+	if !reloaded.deleteOverlay("user", "hub", "lamp") || reloaded.deleteOverlay("user", "hub", "lamp") {
+		t.Errorf("overlay must be deleted exactly once")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	SCHEMA_TYPE_BOOLEAN = "boolean"
+	SCHEMA_TYPE_INTEGER = "integer"
+	SCHEMA_TYPE_NUMBER  = "number"
+	SCHEMA_TYPE_STRING  = "string"
+	SCHEMA_TYPE_ARRAY   = "array"
+)
+
+//PropertySchema describes one property of OCF resource, Range is used when resource
+//does not advertise own valid range, temperature Range is in Celsius and is converted
+//to units of the value
+type PropertySchema struct {
+	Type          string
+	Range         *ValueRange
+	ResourceRange bool
+	Temperature   bool
+	Enum          []string
+	ReadOnly      bool
+	Items         *PropertySchema
+	Length        int
+}
+
+//ValueValidationError describes value rejected by resource schema before it was sent to hub
+type ValueValidationError struct {
+	ResourceType string
+	Property     string
+	Message      string
+}
+
+func (e *ValueValidationError) Error() string {
+	if e.Property == "" {
+		return "invalid " + e.ResourceType + " value, " + e.Message
+	}
+	return "invalid " + e.ResourceType + " value, property " + e.Property + " " + e.Message
+}
+
+var resourceSchemas = make(map[string]map[string]*PropertySchema)
+
+//common properties describe resource itself and are never written by clients
+var commonPropertySchemas = map[string]*PropertySchema{
+	"rt":        {Type: SCHEMA_TYPE_ARRAY, ReadOnly: true},
+	"if":        {Type: SCHEMA_TYPE_ARRAY, ReadOnly: true},
+	"n":         {Type: SCHEMA_TYPE_STRING, ReadOnly: true},
+	"id":        {Type: SCHEMA_TYPE_STRING, ReadOnly: true},
+	"range":     {Type: SCHEMA_TYPE_ARRAY, ReadOnly: true},
+	"step":      {Type: SCHEMA_TYPE_NUMBER, ReadOnly: true},
+	"precision": {Type: SCHEMA_TYPE_NUMBER, ReadOnly: true},
+}
+
+func registerResourceSchema(resourceType string, properties map[string]*PropertySchema) {
+	resourceSchemas[resourceType] = properties
+}
+
+func init() {
+	percent := &ValueRange{Min: 0, Max: 100}
+	registerResourceSchema("oic.r.switch.binary", map[string]*PropertySchema{
+		"value": {Type: SCHEMA_TYPE_BOOLEAN},
+	})
+	registerResourceSchema("oic.r.light.dimming", map[string]*PropertySchema{
+		"dimmingSetting": {Type: SCHEMA_TYPE_INTEGER, Range: percent, ResourceRange: true},
+	})
+	registerResourceSchema("oic.r.light.brightness", map[string]*PropertySchema{
+		"brightness": {Type: SCHEMA_TYPE_INTEGER, Range: percent},
+	})
+	registerResourceSchema("oic.r.colour.rgb", map[string]*PropertySchema{
+		"rgbValue": {Type: SCHEMA_TYPE_ARRAY, Length: 3, Items: &PropertySchema{Type: SCHEMA_TYPE_INTEGER, Range: &ValueRange{Min: 0, Max: 255}, ResourceRange: true}},
+	})
+	registerResourceSchema("oic.r.colour.chroma", map[string]*PropertySchema{
+		"hue":        {Type: SCHEMA_TYPE_NUMBER, Range: &ValueRange{Min: 0, Max: 360}},
+		"saturation": {Type: SCHEMA_TYPE_NUMBER, Range: percent},
+		"ct":         {Type: SCHEMA_TYPE_INTEGER, Range: &ValueRange{Min: MIN_MIRED, Max: MAX_MIRED}},
+		"csc":        {Type: SCHEMA_TYPE_ARRAY, Length: 2, Items: &PropertySchema{Type: SCHEMA_TYPE_NUMBER, Range: &ValueRange{Min: 0, Max: 1}}},
+	})
+	registerResourceSchema("oic.r.temperature", map[string]*PropertySchema{
+		"temperature": {Type: SCHEMA_TYPE_NUMBER, Range: &ValueRange{Min: -40, Max: 125}, ResourceRange: true, Temperature: true},
+		"units":       {Type: SCHEMA_TYPE_STRING, Enum: []string{"C", "F", "K"}},
+	})
+	registerResourceSchema("oic.r.humidity", map[string]*PropertySchema{
+		"humidity":        {Type: SCHEMA_TYPE_NUMBER, Range: percent, ReadOnly: true},
+		"desiredHumidity": {Type: SCHEMA_TYPE_NUMBER, Range: percent},
+	})
+	registerResourceSchema("oic.r.openlevel", map[string]*PropertySchema{
+		"openLevel": {Type: SCHEMA_TYPE_INTEGER, Range: percent, ResourceRange: true},
+	})
+	registerResourceSchema("oic.r.audio", map[string]*PropertySchema{
+		"volume": {Type: SCHEMA_TYPE_INTEGER, Range: percent},
+		"mute":   {Type: SCHEMA_TYPE_BOOLEAN},
+	})
+	registerResourceSchema("oic.r.mode", map[string]*PropertySchema{
+		"modes":          {Type: SCHEMA_TYPE_ARRAY, Items: &PropertySchema{Type: SCHEMA_TYPE_STRING}},
+		"supportedModes": {Type: SCHEMA_TYPE_ARRAY, ReadOnly: true},
+	})
+	registerResourceSchema("oic.r.sensor.contact", map[string]*PropertySchema{
+		"value": {Type: SCHEMA_TYPE_BOOLEAN, ReadOnly: true},
+	})
+	registerResourceSchema("oic.r.sensor.motion", map[string]*PropertySchema{
+		"value": {Type: SCHEMA_TYPE_BOOLEAN, ReadOnly: true},
+	})
+}
+
+func getResourceTypes(variable *IotVariable) []string {
+	return strings.FieldsFunc(variable.ResourceType, func(r rune) bool { return r == ' ' || r == ',' })
+}
+
+//getPropertySchema returns schema of property in any resource type of resource, false means
+//none of resource types is known so value can't be validated
+func getPropertySchema(variable *IotVariable, name string) (*PropertySchema, bool) {
+	known := false
+	for _, resourceType := range getResourceTypes(variable) {
+		properties, ok := resourceSchemas[resourceType]
+		if !ok {
+			continue
+		}
+		known = true
+		if schema := properties[name]; schema != nil {
+			return schema, true
+		}
+	}
+	if schema := commonPropertySchemas[name]; schema != nil && known {
+		return schema, true
+	}
+	return nil, known
+}
+
+//validRange returns range advertised by resource when schema allows it, malformed ranges are ignored,
+//temperature ranges are converted to units of written value
+func (schema *PropertySchema) validRange(variable *IotVariable, units string) *ValueRange {
+	if schema.ResourceRange {
+		if r, ok := parseRange(variable.VariableValue.Value.Get("range")); ok {
+			if resourceUnits := getResourceUnits(variable); schema.Temperature && resourceUnits != units {
+				r = ValueRange{Min: fromCelsius(toCelsius(r.Min, resourceUnits), units), Max: fromCelsius(toCelsius(r.Max, resourceUnits), units)}
+			}
+			return &r
+		}
+	}
+	if schema.Temperature && schema.Range != nil {
+		return &ValueRange{Min: fromCelsius(schema.Range.Min, units), Max: fromCelsius(schema.Range.Max, units)}
+	}
+	return schema.Range
+}
+
+//allowsResourceRange tells if range advertised by resource applies to property or its items
+func (schema *PropertySchema) allowsResourceRange() bool {
+	return schema.ResourceRange || schema.Items != nil && schema.Items.ResourceRange
+}
+
+func getResourceUnits(variable *IotVariable) string {
+	if units := variable.VariableValue.Value.Get("units").String(); units != "" {
+		return units
+	}
+	return TEMPERATURE_UNIT_CELSIUS
+}
+
+//getValueUnits returns temperature units of written value, value without units is in units of resource
+func getValueUnits(variable *IotVariable, value gjson.Result) string {
+	if units := value.Get("units").String(); units != "" {
+		return units
+	}
+	return getResourceUnits(variable)
+}
+
+func (schema *PropertySchema) validate(variable *IotVariable, name string, value gjson.Result, units string) error {
+	invalid := func(message string) error {
+		return &ValueValidationError{ResourceType: variable.ResourceType, Property: name, Message: message}
+	}
+	switch schema.Type {
+	case SCHEMA_TYPE_BOOLEAN:
+		if value.Type != gjson.True && value.Type != gjson.False {
+			return invalid("has to be boolean")
+		}
+	case SCHEMA_TYPE_INTEGER, SCHEMA_TYPE_NUMBER:
+		if value.Type != gjson.Number {
+			return invalid("has to be " + schema.Type)
+		}
+		if schema.Type == SCHEMA_TYPE_INTEGER && value.Float() != float64(value.Int()) {
+			return invalid("has to be integer")
+		}
+		if r := schema.validRange(variable, units); r != nil && !r.contains(value.Float()) {
+			return &ValueOutOfRangeError{Range: *r, Property: name}
+		}
+	case SCHEMA_TYPE_STRING:
+		if value.Type != gjson.String {
+			return invalid("has to be string")
+		}
+		if len(schema.Enum) > 0 {
+			for _, allowed := range schema.Enum {
+				if value.String() == allowed {
+					return nil
+				}
+			}
+			return invalid("has to be one of " + strings.Join(schema.Enum, ", "))
+		}
+	case SCHEMA_TYPE_ARRAY:
+		if !value.IsArray() {
+			return invalid("has to be array")
+		}
+		items := value.Array()
+		if schema.Length > 0 && len(items) != schema.Length {
+			return invalid("has to have " + formatNumber(float64(schema.Length)) + " items")
+		}
+		if schema.Items != nil {
+			for _, item := range items {
+				if err := schema.Items.validate(variable, name, item, units); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//validateResourceValue rejects writes to read-only resources and checks value against schemas
+//of resource types, values of unknown resource types are passed to hub unchecked
+func validateResourceValue(variable *IotVariable, valueObject string) error {
+	if !gjson.Valid(valueObject) {
+		return &ValueValidationError{ResourceType: variable.ResourceType, Message: "value is not valid json"}
+	}
+	if !variable.isWritable() {
+		return &ValueValidationError{ResourceType: variable.ResourceType, Message: "resource " + variable.Href + " is read-only"}
+	}
+	value := gjson.Parse(valueObject)
+	if _, known := getPropertySchema(variable, ""); !known {
+		return nil
+	}
+	if !value.IsObject() {
+		return &ValueValidationError{ResourceType: variable.ResourceType, Message: "value has to be an object"}
+	}
+	units := getValueUnits(variable, value)
+	var err error
+	value.ForEach(func(key, property gjson.Result) bool {
+		schema, _ := getPropertySchema(variable, key.String())
+		if schema == nil {
+			err = &ValueValidationError{ResourceType: variable.ResourceType, Property: key.String(), Message: "is unknown"}
+		} else if schema.ReadOnly {
+			err = &ValueValidationError{ResourceType: variable.ResourceType, Property: key.String(), Message: "is read-only"}
+		} else {
+			err = schema.validate(variable, key.String(), property, units)
+		}
+		return err == nil
+	})
+	return err
+}
+
+//validateDeviceValue validates value before it is sent to hub, devices and resources unknown
+//to gateway are left for hub to report
+func validateDeviceValue(conn *HubConnection, deviceID string, resourceID string, valueObject string) error {
+	device := conn.getDevice(deviceID)
+	if device == nil {
+		return nil
+	}
+	variable := device.getVariable(resourceID)
+	if variable == nil {
+		return nil
+	}
+	return validateResourceValue(variable, valueObject)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateResourceValue(t *testing.T) {
+	tests := []struct {
+		name         string
+		resourceType string
+		iface        string
+		current      string
+		value        string
+		valid        bool
+	}{
+		{"boolean switch", "oic.r.switch.binary", INTERFACE_ACTUATOR, `{"value":true}`, `{"value":false}`, true},
+		{"switch with number", "oic.r.switch.binary", INTERFACE_ACTUATOR, `{"value":true}`, `{"value":1}`, false},
+		{"unknown property", "oic.r.switch.binary", INTERFACE_ACTUATOR, `{"value":true}`, `{"state":true}`, false},
+		{"read-only common property", "oic.r.switch.binary", INTERFACE_ACTUATOR, `{"value":true}`, `{"rt":["oic.r.switch.binary"]}`, false},
+		{"sensor interface", "oic.r.switch.binary", INTERFACE_SENSOR, `{"value":true}`, `{"value":false}`, false},
+		{"invalid json", "oic.r.switch.binary", INTERFACE_ACTUATOR, `{"value":true}`, `{"value":`, false},
+		{"dimming in default range", "oic.r.light.dimming", INTERFACE_ACTUATOR, `{"dimmingSetting":50}`, `{"dimmingSetting":100}`, true},
+		{"dimming over default range", "oic.r.light.dimming", INTERFACE_ACTUATOR, `{"dimmingSetting":50}`, `{"dimmingSetting":101}`, false},
+		{"dimming over advertised range", "oic.r.light.dimming", INTERFACE_ACTUATOR, `{"dimmingSetting":50,"range":[0,10]}`, `{"dimmingSetting":20}`, false},
+		{"dimming fraction", "oic.r.light.dimming", INTERFACE_ACTUATOR, `{"dimmingSetting":50}`, `{"dimmingSetting":5.5}`, false},
+		{"rgb item out of range", "oic.r.colour.rgb", INTERFACE_ACTUATOR, `{"rgbValue":[0,0,0]}`, `{"rgbValue":[0,256,0]}`, false},
+		{"rgb wrong length", "oic.r.colour.rgb", INTERFACE_ACTUATOR, `{"rgbValue":[0,0,0]}`, `{"rgbValue":[0,0]}`, false},
+		{"celsius setpoint", "oic.r.temperature", INTERFACE_ACTUATOR, `{"temperature":21,"units":"C"}`, `{"temperature":30}`, true},
+		{"celsius over default range", "oic.r.temperature", INTERFACE_ACTUATOR, `{"temperature":21,"units":"C"}`, `{"temperature":130}`, false},
+		{"fahrenheit setpoint", "oic.r.temperature", INTERFACE_ACTUATOR, `{"temperature":70,"units":"F"}`, `{"temperature":250}`, true},
+		{"fahrenheit over default range", "oic.r.temperature", INTERFACE_ACTUATOR, `{"temperature":70,"units":"F"}`, `{"temperature":260}`, false},
+		{"kelvin setpoint", "oic.r.temperature", INTERFACE_ACTUATOR, `{"temperature":294,"units":"K"}`, `{"temperature":300}`, true},
+		{"kelvin under default range", "oic.r.temperature", INTERFACE_ACTUATOR, `{"temperature":294,"units":"K"}`, `{"temperature":200}`, false},
+		{"units of written value", "oic.r.temperature", INTERFACE_ACTUATOR, `{"temperature":70,"units":"F"}`, `{"temperature":130,"units":"C"}`, false},
+		{"advertised fahrenheit range", "oic.r.temperature", INTERFACE_ACTUATOR, `{"temperature":70,"units":"F","range":[50,90]}`, `{"temperature":90}`, true},
+		{"advertised range in other units", "oic.r.temperature", INTERFACE_ACTUATOR, `{"temperature":70,"units":"F","range":[50,90]}`, `{"temperature":35,"units":"C"}`, false},
+		{"unknown units", "oic.r.temperature", INTERFACE_ACTUATOR, `{"temperature":21}`, `{"units":"X"}`, false},
+		{"unknown resource type", "x.vendor.thing", INTERFACE_ACTUATOR, `{}`, `{"anything":[1]}`, true},
+	}
+	for _, test := range tests {
+		variable := newTestVariable("/resource", test.resourceType, test.iface, test.current)
+		if err := validateResourceValue(variable, test.value); (err == nil) != test.valid {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+	}
+}
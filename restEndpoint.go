@@ -0,0 +1,130 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"strconv"
+	"strings"
+
+	iris "gopkg.in/kataras/iris.v6"
+)
+
+type RestEndpoint struct {
+	HubConnections         *list.List
+	ClientConnectionServer *ClientConnectionServer
+	History                *HistoryStore
+	Webhooks               *WebhookDispatcher
+	Overlays               *OverlayStore
+	Groups                 *GroupStore
+}
+
+type RestError struct {
+	Error string `json:"error"`
+}
+
+func NewRestEndpoint(app *iris.Framework, hubConnections *list.List, clientConnectionServer *ClientConnectionServer, history *HistoryStore, webhooks *WebhookDispatcher, overlays *OverlayStore, groups *GroupStore) *RestEndpoint {
+	endpoint := &RestEndpoint{
+		HubConnections:         hubConnections,
+		ClientConnectionServer: clientConnectionServer,
+		History:                history,
+		Webhooks:               webhooks,
+		Overlays:               overlays,
+		Groups:                 groups,
+	}
+
+	app.Get("/api/history/:hubUuid/:uuid", func(c *iris.Context) {
+		userInfo := authorizeRestRequest(c)
+		if userInfo == nil {
+			return
+		}
+		endpoint.handleGetHistory(userInfo, c)
+	})
+	app.Get("/api/devices", func(c *iris.Context) {
+		userInfo := authorizeRestRequest(c)
+		if userInfo == nil {
+			return
+		}
+		hubs := createDeviceList(userInfo.Username, endpoint.HubConnections, endpoint.Overlays, endpoint.Groups)
+		if hubs == nil {
+			hubs = []ResponseIotHubDevices{}
+		}
+		c.JSON(iris.StatusOK, iris.Map{"hubs": hubs})
+	})
+	app.Get("/api/metrics", func(c *iris.Context) {
+		userInfo := authorizeRestRequest(c)
+		if userInfo == nil {
+			return
+		}
+		metrics := getUserOutboundMetrics(userInfo.Username, getHubConnections(endpoint.HubConnections), endpoint.ClientConnectionServer.getWebClients())
+		c.JSON(iris.StatusOK, iris.Map{"outbound": metrics})
+	})
+	app.Get("/api/webhooks", func(c *iris.Context) {
+		userInfo := authorizeRestRequest(c)
+		if userInfo == nil {
+			return
+		}
+		webhooks := endpoint.Webhooks.getWebhooks(userInfo.Username)
+		if webhooks == nil {
+			webhooks = []Webhook{}
+		}
+		c.JSON(iris.StatusOK, iris.Map{"webhooks": webhooks})
+	})
+	app.Get("/api/webhooks/:id/deliveries", func(c *iris.Context) {
+		userInfo := authorizeRestRequest(c)
+		if userInfo == nil {
+			return
+		}
+		recent, deadLetters, ok := endpoint.Webhooks.getDeliveries(userInfo.Username, c.Param("id"))
+		if !ok {
+			c.JSON(iris.StatusNotFound, &RestError{Error: "webhook not found"})
+			return
+		}
+		if recent == nil {
+			recent = []WebhookDelivery{}
+		}
+		if deadLetters == nil {
+			deadLetters = []WebhookDelivery{}
+		}
+		c.JSON(iris.StatusOK, iris.Map{"deliveries": recent, "deadLetters": deadLetters})
+	})
+	return endpoint
+}
+
+//authorizeRestRequest validates bearer token and writes error response when it is invalid
+func authorizeRestRequest(c *iris.Context) *AuthUserData {
+	token := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		c.JSON(iris.StatusUnauthorized, &RestError{Error: "missing access token"})
+		return nil
+	}
+	userInfo, err := GetUserInfo(token, getAuthData(AUTH_WEB))
+	if err != nil {
+		log.Println(err)
+		c.JSON(iris.StatusInternalServerError, &RestError{Error: "unable to verify access token"})
+		return nil
+	}
+	if userInfo.Username == "" {
+		c.JSON(iris.StatusUnauthorized, &RestError{Error: "invalid access token"})
+		return nil
+	}
+	return userInfo
+}
+
+func (endpoint *RestEndpoint) handleGetHistory(userInfo *AuthUserData, c *iris.Context) {
+	interval, _ := strconv.ParseInt(c.URLParam("interval"), 10, 64)
+	query, err := parseHistoryQuery(userInfo.Username, c.Param("hubUuid"), c.Param("uuid"), c.URLParam("resource"),
+		c.URLParam("from"), c.URLParam("to"), interval)
+	if err != nil {
+		c.JSON(iris.StatusBadRequest, &RestError{Error: err.Error()})
+		return
+	}
+	samples, err := endpoint.History.Query(query)
+	if err != nil {
+		c.JSON(iris.StatusBadRequest, &RestError{Error: err.Error()})
+		return
+	}
+	if samples == nil {
+		samples = []*HistorySample{}
+	}
+	c.JSON(iris.StatusOK, iris.Map{"samples": samples})
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	RULES_STORAGE = "rules"
+
+	TRIGGER_VALUE       = "value"
+	TRIGGER_THRESHOLD   = "threshold"
+	TRIGGER_HUB_ONLINE  = "hubOnline"
+	TRIGGER_HUB_OFFLINE = "hubOffline"
+	TRIGGER_TIME        = "time"
+
+	CONDITION_VALUE = "value"
+	CONDITION_TIME  = "time"
+
+	ACTION_SET_VALUE = "setValue"
+	ACTION_SCENE     = "scene"
+	ACTION_WEBHOOK   = "webhook"
+
+	OPERATOR_EQ = "eq"
+	OPERATOR_NE = "ne"
+	OPERATOR_GT = "gt"
+	OPERATOR_GE = "ge"
+	OPERATOR_LT = "lt"
+	OPERATOR_LE = "le"
+
+	RULE_MAX_FIRINGS_PER_MINUTE = 10
+	RULE_MAX_CHAIN_DEPTH        = 5
+	RULE_CAUSE_TIMEOUT          = 2 * HUB_REQUEST_TIMEOUT
+	RULE_WEBHOOK_TIMEOUT        = 10 * time.Second
+)
+
+type RuleTrigger struct {
+	Type       string          `json:"type"`
+	HubUUID    string          `json:"hubUuid,omitempty"`
+	DeviceUUID string          `json:"uuid,omitempty"`
+	Resource   string          `json:"resource,omitempty"`
+	Property   string          `json:"property,omitempty"`
+	Operator   string          `json:"operator,omitempty"`
+	Value      json.RawMessage `json:"value,omitempty"`
+	Time       string          `json:"time,omitempty"`
+	Days       []time.Weekday  `json:"days,omitempty"`
+}
+
+type RuleCondition struct {
+	Type       string          `json:"type"`
+	HubUUID    string          `json:"hubUuid,omitempty"`
+	DeviceUUID string          `json:"uuid,omitempty"`
+	Resource   string          `json:"resource,omitempty"`
+	Property   string          `json:"property,omitempty"`
+	Operator   string          `json:"operator,omitempty"`
+	Value      json.RawMessage `json:"value,omitempty"`
+	From       string          `json:"from,omitempty"`
+	To         string          `json:"to,omitempty"`
+}
+
+type RuleAction struct {
+	Type       string          `json:"type"`
+	HubUUID    string          `json:"hubUuid,omitempty"`
+	DeviceUUID string          `json:"uuid,omitempty"`
+	Resource   string          `json:"resource,omitempty"`
+	Value      json.RawMessage `json:"value,omitempty"`
+	SceneID    string          `json:"sceneId,omitempty"`
+	URL        string          `json:"url,omitempty"`
+}
+
+type Rule struct {
+	ID         string           `json:"id"`
+	Name       string           `json:"name"`
+	Enabled    bool             `json:"enabled"`
+	Triggers   []*RuleTrigger   `json:"triggers"`
+	Conditions []*RuleCondition `json:"conditions"`
+	Actions    []*RuleAction    `json:"actions"`
+}
+
+//RuleEvent describes what happened when rule triggers are evaluated
+type RuleEvent struct {
+	Type       string          `json:"type"`
+	HubUUID    string          `json:"hubUuid,omitempty"`
+	DeviceUUID string          `json:"uuid,omitempty"`
+	Resource   string          `json:"resource,omitempty"`
+	Value      json.RawMessage `json:"value,omitempty"`
+	Time       time.Time       `json:"time"`
+
+	previous gjson.Result
+	current  gjson.Result
+	//chain lists rules whose actions led to this event, oldest first
+	chain []string
+}
+
+//ruleCause remembers which rules wrote resource so resulting value update can be traced back to them
+type ruleCause struct {
+	chain   []string
+	expires time.Time
+}
+
+type RuleEngine struct {
+	HubConnections *list.List
+	Scenes         *SceneStore
+
+	mutex   sync.Mutex
+	rules   map[string][]*Rule
+	firings map[string][]time.Time
+	causes  map[string]*ruleCause
+}
+
+func NewRuleEngine(hubConnections *list.List, scenes *SceneStore) *RuleEngine {
+	engine := &RuleEngine{
+		HubConnections: hubConnections,
+		Scenes:         scenes,
+		rules:          make(map[string][]*Rule),
+		firings:        make(map[string][]time.Time),
+		causes:         make(map[string]*ruleCause),
+	}
+	err := loadData(RULES_STORAGE, &engine.rules)
+	if err != nil {
+		log.Println(err)
+	}
+	go engine.runTimeTriggers()
+	return engine
+}
+
+func (engine *RuleEngine) save() {
+	err := saveData(RULES_STORAGE, engine.rules)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//getRules returns copies of user rules so they can be evaluated without holding the mutex
+func (engine *RuleEngine) getRules(username string) []*Rule {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	var result []*Rule
+	for _, rule := range engine.rules[username] {
+		item := *rule
+		result = append(result, &item)
+	}
+	return result
+}
+
+func (engine *RuleEngine) addRule(username string, rule *Rule) error {
+	err := validateRule(rule)
+	if err != nil {
+		return err
+	}
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	engine.rules[username] = append(engine.rules[username], rule)
+	engine.save()
+	return nil
+}
+
+func (engine *RuleEngine) deleteRule(username string, id string) bool {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	rules := engine.rules[username]
+	for i, rule := range rules {
+		if rule.ID == id {
+			engine.rules[username] = append(rules[:i:i], rules[i+1:]...)
+			delete(engine.firings, id)
+			engine.save()
+			return true
+		}
+	}
+	return false
+}
+
+func (engine *RuleEngine) setRuleEnabled(username string, id string, enabled bool) bool {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	for _, rule := range engine.rules[username] {
+		if rule.ID == id {
+			rule.Enabled = enabled
+			engine.save()
+			return true
+		}
+	}
+	return false
+}
+
+func parseTimeOfDay(value string) (int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return 0, errors.New("invalid time " + value)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, errors.New("invalid time " + value)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || minute < 0 || minute > 59 {
+		return 0, errors.New("invalid time " + value)
+	}
+	return hour*60 + minute, nil
+}
+
+func validateRule(rule *Rule) error {
+	if rule.Name == "" {
+		return errors.New("rule name is missing")
+	}
+	if len(rule.Triggers) == 0 || len(rule.Actions) == 0 {
+		return errors.New("rule requires at least one trigger and action")
+	}
+	for _, trigger := range rule.Triggers {
+		switch trigger.Type {
+		case TRIGGER_VALUE, TRIGGER_THRESHOLD:
+			if trigger.HubUUID == "" || trigger.DeviceUUID == "" || trigger.Resource == "" || trigger.Property == "" {
+				return errors.New("value trigger requires hubUuid, uuid, resource and property")
+			}
+			if trigger.Type == TRIGGER_THRESHOLD && (len(trigger.Value) == 0 || !isOrderOperator(trigger.Operator)) {
+				return errors.New("threshold trigger requires value and gt, ge, lt or le operator")
+			}
+		case TRIGGER_HUB_ONLINE, TRIGGER_HUB_OFFLINE:
+			if trigger.HubUUID == "" {
+				return errors.New("hub trigger requires hubUuid")
+			}
+		case TRIGGER_TIME:
+			_, err := parseTimeOfDay(trigger.Time)
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.New("unknown trigger type " + trigger.Type)
+		}
+	}
+	for _, condition := range rule.Conditions {
+		switch condition.Type {
+		case CONDITION_VALUE:
+			if condition.HubUUID == "" || condition.DeviceUUID == "" || condition.Resource == "" || condition.Property == "" || len(condition.Value) == 0 {
+				return errors.New("value condition requires hubUuid, uuid, resource, property and value")
+			}
+		case CONDITION_TIME:
+			_, err := parseTimeOfDay(condition.From)
+			if err != nil {
+				return err
+			}
+			_, err = parseTimeOfDay(condition.To)
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.New("unknown condition type " + condition.Type)
+		}
+	}
+	for _, action := range rule.Actions {
+		switch action.Type {
+		case ACTION_SET_VALUE:
+			if action.HubUUID == "" || action.DeviceUUID == "" || action.Resource == "" || !gjson.Valid(string(action.Value)) {
+				return errors.New("setValue action requires hubUuid, uuid, resource and value")
+			}
+		case ACTION_SCENE:
+			if action.SceneID == "" {
+				return errors.New("scene action requires sceneId")
+			}
+		case ACTION_WEBHOOK:
+			err := validateOutboundURL(action.URL)
+			if err != nil {
+				return errors.New("webhook action: " + err.Error())
+			}
+		default:
+			return errors.New("unknown action type " + action.Type)
+		}
+	}
+	return nil
+}
+
+func isOrderOperator(operator string) bool {
+	return operator == OPERATOR_GT || operator == OPERATOR_GE || operator == OPERATOR_LT || operator == OPERATOR_LE
+}
+
+//compareValue checks value against expected raw json using operator, equality is default
+func compareValue(value gjson.Result, operator string, expected json.RawMessage) bool {
+	if !value.Exists() {
+		return false
+	}
+	expectedValue := gjson.ParseBytes(expected)
+	if isOrderOperator(operator) {
+		if value.Type != gjson.Number || expectedValue.Type != gjson.Number {
+			return false
+		}
+		switch operator {
+		case OPERATOR_GT:
+			return value.Float() > expectedValue.Float()
+		case OPERATOR_GE:
+			return value.Float() >= expectedValue.Float()
+		case OPERATOR_LT:
+			return value.Float() < expectedValue.Float()
+		default:
+			return value.Float() <= expectedValue.Float()
+		}
+	}
+	equal := false
+	if value.Type == gjson.Number && expectedValue.Type == gjson.Number {
+		equal = value.Float() == expectedValue.Float()
+	} else if value.Type == expectedValue.Type && value.Type != gjson.JSON {
+		equal = value.String() == expectedValue.String()
+	} else {
+		equal = strings.Join(strings.Fields(value.Raw), "") == strings.Join(strings.Fields(expectedValue.Raw), "")
+	}
+	if operator == OPERATOR_NE {
+		return !equal
+	}
+	return equal
+}
+
+func (trigger *RuleTrigger) matches(event *RuleEvent) bool {
+	if trigger.Type != event.Type {
+		return false
+	}
+	switch trigger.Type {
+	case TRIGGER_VALUE, TRIGGER_THRESHOLD:
+		if trigger.HubUUID != event.HubUUID || trigger.DeviceUUID != event.DeviceUUID || trigger.Resource != event.Resource {
+			return false
+		}
+		previous := event.previous.Get(trigger.Property)
+		current := event.current.Get(trigger.Property)
+		if !current.Exists() || previous.Raw == current.Raw {
+			return false
+		}
+		if len(trigger.Value) == 0 {
+			return true
+		}
+		//fire only when value crosses into matching state
+		return compareValue(current, trigger.Operator, trigger.Value) && !compareValue(previous, trigger.Operator, trigger.Value)
+	case TRIGGER_HUB_ONLINE, TRIGGER_HUB_OFFLINE:
+		return trigger.HubUUID == event.HubUUID
+	case TRIGGER_TIME:
+		minutes, _ := parseTimeOfDay(trigger.Time)
+		if event.Time.Hour()*60+event.Time.Minute() != minutes {
+			return false
+		}
+		if len(trigger.Days) == 0 {
+			return true
+		}
+		for _, day := range trigger.Days {
+			if day == event.Time.Weekday() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isInTimeWindow(now time.Time, from string, to string) bool {
+	fromMinutes, _ := parseTimeOfDay(from)
+	toMinutes, _ := parseTimeOfDay(to)
+	minutes := now.Hour()*60 + now.Minute()
+	if fromMinutes <= toMinutes {
+		return minutes >= fromMinutes && minutes < toMinutes
+	}
+	return minutes >= fromMinutes || minutes < toMinutes
+}
+
+func (engine *RuleEngine) checkConditions(username string, rule *Rule, now time.Time) bool {
+	for _, condition := range rule.Conditions {
+		switch condition.Type {
+		case CONDITION_VALUE:
+			conn := findHubConnection(engine.HubConnections, username, condition.HubUUID)
+			if conn == nil {
+				return false
+			}
+			device := conn.getDevice(condition.DeviceUUID)
+			if device == nil || device.getVariable(condition.Resource) == nil {
+				return false
+			}
+			value := device.getVariable(condition.Resource).VariableValue.Value.Get(condition.Property)
+			if !compareValue(value, condition.Operator, condition.Value) {
+				return false
+			}
+		case CONDITION_TIME:
+			if !isInTimeWindow(now, condition.From, condition.To) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//allowFiring limits how often a rule can fire, it is backstop for loops the causal chain can't see
+func (engine *RuleEngine) allowFiring(rule *Rule, now time.Time) bool {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	var recent []time.Time
+	for _, fired := range engine.firings[rule.ID] {
+		if now.Sub(fired) < time.Minute {
+			recent = append(recent, fired)
+		}
+	}
+	if len(recent) >= RULE_MAX_FIRINGS_PER_MINUTE {
+		engine.firings[rule.ID] = recent
+		return false
+	}
+	engine.firings[rule.ID] = append(recent, now)
+	return true
+}
+
+func (engine *RuleEngine) evaluate(username string, event *RuleEvent) {
+	for _, rule := range engine.getRules(username) {
+		if !rule.Enabled {
+			continue
+		}
+		triggered := false
+		for _, trigger := range rule.Triggers {
+			if trigger.matches(event) {
+				triggered = true
+				break
+			}
+		}
+		if !triggered || !engine.checkConditions(username, rule, event.Time) {
+			continue
+		}
+		if isInChain(event.chain, rule.ID) {
+			log.Println("Rule " + rule.Name + " triggered by its own action through " + strings.Join(event.chain, " -> ") + ", loop detected, skipping")
+			continue
+		}
+		if len(event.chain) >= RULE_MAX_CHAIN_DEPTH {
+			log.Println("Rule " + rule.Name + " triggered through " + strconv.Itoa(len(event.chain)) + " rules, chain too deep, skipping")
+			continue
+		}
+		if !engine.allowFiring(rule, event.Time) {
+			log.Println("Rule " + rule.Name + " fired too often, possible loop, skipping")
+			continue
+		}
+		log.Println("Rule " + rule.Name + " triggered by " + event.Type)
+		go engine.execute(username, rule, event)
+	}
+}
+
+func isInChain(chain []string, ruleID string) bool {
+	for _, id := range chain {
+		if id == ruleID {
+			return true
+		}
+	}
+	return false
+}
+
+func getCauseKey(username string, hubUUID string, deviceUUID string, resource string) string {
+	return username + "/" + hubUUID + "/" + deviceUUID + "/" + resource
+}
+
+//recordCause remembers chain of rules writing resource until hub reports the value or cause expires
+func (engine *RuleEngine) recordCause(username string, hubUUID string, deviceUUID string, resource string, chain []string) {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	now := time.Now()
+	for key, cause := range engine.causes {
+		if now.After(cause.expires) {
+			delete(engine.causes, key)
+		}
+	}
+	engine.causes[getCauseKey(username, hubUUID, deviceUUID, resource)] = &ruleCause{
+		chain:   chain,
+		expires: now.Add(RULE_CAUSE_TIMEOUT),
+	}
+}
+
+//takeCause returns chain of rules which wrote resource and forgets it
+func (engine *RuleEngine) takeCause(username string, hubUUID string, deviceUUID string, resource string) []string {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	key := getCauseKey(username, hubUUID, deviceUUID, resource)
+	cause := engine.causes[key]
+	if cause == nil {
+		return nil
+	}
+	delete(engine.causes, key)
+	if time.Now().After(cause.expires) {
+		return nil
+	}
+	return cause.chain
+}
+
+func (engine *RuleEngine) execute(username string, rule *Rule, event *RuleEvent) {
+	chain := append(append([]string{}, event.chain...), rule.ID)
+	for _, action := range rule.Actions {
+		var err error
+		switch action.Type {
+		case ACTION_SET_VALUE:
+			engine.recordCause(username, action.HubUUID, action.DeviceUUID, action.Resource, chain)
+			conn := findHubConnection(engine.HubConnections, username, action.HubUUID)
+			err = setDeviceValueSync(conn, action.DeviceUUID, action.Resource, string(action.Value))
+		case ACTION_SCENE:
+			scene := engine.Scenes.getScene(username, action.SceneID)
+			if scene == nil {
+				err = errors.New("scene " + action.SceneID + " not found")
+				break
+			}
+			for _, sceneAction := range scene.Actions {
+				engine.recordCause(username, sceneAction.HubUUID, sceneAction.DeviceUUID, sceneAction.Resource, chain)
+			}
+			err = getActionsError(activateScene(engine.HubConnections, username, scene.Actions))
+		case ACTION_WEBHOOK:
+			err = callRuleWebhook(action.URL, rule, event)
+		}
+		if err != nil {
+			log.Println("Rule "+rule.Name+" action "+action.Type+" failed", err)
+		}
+	}
+}
+
+func callRuleWebhook(url string, rule *Rule, event *RuleEvent) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"rule":  rule.ID,
+		"name":  rule.Name,
+		"event": event,
+	})
+	if err != nil {
+		return err
+	}
+	client := newOutboundHTTPClient(RULE_WEBHOOK_TIMEOUT)
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("webhook responded with " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+func (engine *RuleEngine) OnValueUpdate(username string, hubUUID string, deviceUUID string, resource string, previous gjson.Result, current gjson.Result) {
+	chain := engine.takeCause(username, hubUUID, deviceUUID, resource)
+	engine.evaluate(username, &RuleEvent{
+		Type:       TRIGGER_VALUE,
+		HubUUID:    hubUUID,
+		DeviceUUID: deviceUUID,
+		Resource:   resource,
+		Value:      json.RawMessage(current.Raw),
+		Time:       time.Now(),
+		previous:   previous,
+		current:    current,
+		chain:      chain,
+	})
+	engine.evaluate(username, &RuleEvent{
+		Type:       TRIGGER_THRESHOLD,
+		HubUUID:    hubUUID,
+		DeviceUUID: deviceUUID,
+		Resource:   resource,
+		Value:      json.RawMessage(current.Raw),
+		Time:       time.Now(),
+		previous:   previous,
+		current:    current,
+		chain:      chain,
+	})
+}
+
+func (engine *RuleEngine) OnHubStateChange(username string, hubUUID string, online bool) {
+	eventType := TRIGGER_HUB_OFFLINE
+	if online {
+		eventType = TRIGGER_HUB_ONLINE
+	}
+	engine.evaluate(username, &RuleEvent{
+		Type:    eventType,
+		HubUUID: hubUUID,
+		Time:    time.Now(),
+	})
+}
+
+func (engine *RuleEngine) runTimeTriggers() {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+
+		engine.mutex.Lock()
+		var usernames []string
+		for username := range engine.rules {
+			usernames = append(usernames, username)
+		}
+		engine.mutex.Unlock()
+
+		for _, username := range usernames {
+			engine.evaluate(username, &RuleEvent{
+				Type: TRIGGER_TIME,
+				Time: next,
+			})
+		}
+	}
+}
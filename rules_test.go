@@ -0,0 +1,81 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestRuleLoopDetection(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	conn, connection := newTestHubConnection()
+	defer conn.Queue.Close()
+	hubs := list.New()
+	hubs.PushBack(conn)
+	engine := NewRuleEngine(hubs, NewSceneStore())
+
+	newValueRule := func(id string, trigger string, action string, value string) *Rule {
+		return &Rule{ID: id, Name: id, Enabled: true,
+			Triggers: []*RuleTrigger{{Type: TRIGGER_VALUE, HubUUID: "hub", DeviceUUID: "lamp", Resource: trigger, Property: "value"}},
+			Actions:  []*RuleAction{{Type: ACTION_SET_VALUE, HubUUID: "hub", DeviceUUID: "lamp", Resource: action, Value: json.RawMessage(value)}},
+		}
+	}
+	engine.addRule("user", newValueRule("first", "/switch", "/dimming", `{"dimmingSetting":10}`))
+	engine.addRule("user", newValueRule("second", "/dimming", "/switch", `{"value":false}`))
+
+	tests := []struct {
+		name     string
+		resource string
+		previous string
+		current  string
+		request  string
+	}{
+		{"user change fires first rule", "/switch", `{"value":false}`, `{"value":true}`, "/dimming"},
+		{"first rule fires second rule", "/dimming", `{"value":50}`, `{"value":10}`, "/switch"},
+		{"second rule can't fire first rule again", "/switch", `{"value":true}`, `{"value":false}`, ""},
+		{"later user change fires first rule", "/switch", `{"value":false}`, `{"value":true}`, "/dimming"},
+	}
+	for _, test := range tests {
+		engine.OnValueUpdate("user", "hub", "lamp", test.resource, gjson.Parse(test.previous), gjson.Parse(test.current))
+		if test.request == "" {
+			select {
+			case frame := <-connection.frames:
+				t.Errorf("%s: unexpected request %s", test.name, frame.Raw)
+			case <-time.After(100 * time.Millisecond):
+			}
+			continue
+		}
+		frame := connection.nextFrame(t)
+		if frame.Get("payload.resource").String() != test.request {
+			t.Errorf("%s: expected request for %s, got %s", test.name, test.request, frame.Raw)
+		}
+	}
+}
+
+func TestValidateRuleWebhook(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://93.184.215.14/hook", true},
+		{"ftp://93.184.215.14/hook", false},
+		{"http://127.0.0.1:8080/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://10.0.0.5/hook", false},
+		{"http://192.168.1.10/hook", false},
+		{"http://100.64.0.1/hook", false},
+	}
+	for _, test := range tests {
+		err := validateRule(&Rule{Name: "hook",
+			Triggers: []*RuleTrigger{{Type: TRIGGER_HUB_ONLINE, HubUUID: "hub"}},
+			Actions:  []*RuleAction{{Type: ACTION_WEBHOOK, URL: test.url}},
+		})
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.url, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	SCENES_STORAGE = "scenes"
+)
+
+var sceneMetadataProperties = map[string]bool{
+	"rt":    true,
+	"if":    true,
+	"n":     true,
+	"id":    true,
+	"range": true,
+}
+
+type SceneAction struct {
+	HubUUID    string          `json:"hubUuid"`
+	DeviceUUID string          `json:"uuid"`
+	Resource   string          `json:"resource"`
+	Value      json.RawMessage `json:"value"`
+}
+
+type Scene struct {
+	ID         string         `json:"id"`
+	Name       string         `json:"name"`
+	Actions    []*SceneAction `json:"actions"`
+	OffActions []*SceneAction `json:"offActions,omitempty"`
+}
+
+type SceneActionResult struct {
+	HubUUID    string `json:"hubUuid"`
+	DeviceUUID string `json:"uuid"`
+	Resource   string `json:"resource"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+type SceneStore struct {
+	mutex  sync.Mutex
+	scenes map[string][]*Scene
+}
+
+func NewSceneStore() *SceneStore {
+	store := &SceneStore{
+		scenes: make(map[string][]*Scene),
+	}
+	err := loadData(SCENES_STORAGE, &store.scenes)
+	if err != nil {
+		log.Println(err)
+	}
+	return store
+}
+
+func (store *SceneStore) getScenes(username string) []*Scene {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return append([]*Scene{}, store.scenes[username]...)
+}
+
+func (store *SceneStore) getScene(username string, id string) *Scene {
+	for _, scene := range store.getScenes(username) {
+		if scene.ID == id {
+			return scene
+		}
+	}
+	return nil
+}
+
+func (store *SceneStore) save() {
+	err := saveData(SCENES_STORAGE, store.scenes)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (store *SceneStore) addScene(username string, scene *Scene) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.scenes[username] = append(store.scenes[username], scene)
+	store.save()
+}
+
+func (store *SceneStore) deleteScene(username string, id string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	scenes := store.scenes[username]
+	for i, scene := range scenes {
+		if scene.ID == id {
+			store.scenes[username] = append(scenes[:i:i], scenes[i+1:]...)
+			store.save()
+			return true
+		}
+	}
+	return false
+}
+
+//captureSceneAction builds scene action from current value of resource
+func captureSceneAction(conn *HubConnection, deviceUUID string, resource string) (*SceneAction, error) {
+	if conn == nil {
+		return nil, errHubOffline
+	}
+	device := conn.getDevice(deviceUUID)
+	if device == nil || device.getVariable(resource) == nil {
+		return nil, errNoSuchDevice
+	}
+	value := device.getVariable(resource).VariableValue.Value
+
+	properties := make(map[string]json.RawMessage)
+	capabilities := device.getResourceCapabilities(resource)
+	for _, capability := range capabilities {
+		names := []string{capability.Capability.Property}
+		if capability.Capability.ValueType == VALUE_TYPE_HSV {
+			names = append(names, "saturation")
+		}
+		for _, name := range names {
+			if value.Get(name).Exists() {
+				properties[name] = json.RawMessage(value.Get(name).Raw)
+			}
+		}
+	}
+	if len(capabilities) == 0 {
+		value.ForEach(func(key, property gjson.Result) bool {
+			if !sceneMetadataProperties[key.String()] {
+				properties[key.String()] = json.RawMessage(property.Raw)
+			}
+			return true
+		})
+	}
+	if len(properties) == 0 {
+		return nil, errors.New("resource " + resource + " has no value to capture")
+	}
+	data, err := json.Marshal(properties)
+	if err != nil {
+		return nil, err
+	}
+	return &SceneAction{
+		HubUUID:    conn.Uuid,
+		DeviceUUID: deviceUUID,
+		Resource:   resource,
+		Value:      data,
+	}, nil
+}
+
+//activateScene writes all scene values, hubs are handled in parallel and return result of every write
+func activateScene(hubConnections *list.List, username string, actions []*SceneAction) []*SceneActionResult {
+	results := make([]*SceneActionResult, len(actions))
+	hubActions := make(map[string][]int)
+
+	for i, action := range actions {
+		results[i] = &SceneActionResult{
+			HubUUID:    action.HubUUID,
+			DeviceUUID: action.DeviceUUID,
+			Resource:   action.Resource,
+			Status:     "ok",
+		}
+		hubActions[action.HubUUID] = append(hubActions[action.HubUUID], i)
+	}
+
+	var wg sync.WaitGroup
+	for hubUUID, indexes := range hubActions {
+		wg.Add(1)
+		go func(conn *HubConnection, indexes []int) {
+			defer wg.Done()
+			var batch []*SceneAction
+			for _, i := range indexes {
+				batch = append(batch, actions[i])
+			}
+			for j, err := range setDeviceValuesSync(conn, batch) {
+				if err != nil {
+					i := indexes[j]
+					log.Println("Scene action failed "+actions[i].HubUUID+" "+actions[i].DeviceUUID+actions[i].Resource, err)
+					results[i].Status = "error"
+					results[i].Error = err.Error()
+				}
+			}
+		}(findHubConnection(hubConnections, username, hubUUID), indexes)
+	}
+	wg.Wait()
+	return results
+}
+
+//PartialFailureError reports that only some resources of scene or group were set
+type PartialFailureError struct {
+	Failed int
+	Total  int
+}
+
+func (e *PartialFailureError) Error() string {
+	return "failed to set " + strconv.Itoa(e.Failed) + " of " + strconv.Itoa(e.Total) + " resources"
+}
+
+//getActionsError returns nil when all resources were set, error of the first failure when none was
+//and PartialFailureError otherwise
+func getActionsError(results []*SceneActionResult) error {
+	failed := countFailedActions(results)
+	if failed == 0 {
+		return nil
+	}
+	if failed == len(results) {
+		for _, result := range results {
+			if result.Error == errHubOffline.Error() || result.Error == errHubTimeout.Error() {
+				return errHubOffline
+			}
+		}
+		return errors.New(results[0].Error)
+	}
+	return &PartialFailureError{Failed: failed, Total: len(results)}
+}
+
+//getActionsStatus summarizes results for clients as ok, partial or error
+func getActionsStatus(results []*SceneActionResult) string {
+	failed := countFailedActions(results)
+	if failed == len(results) {
+		return "error"
+	} else if failed > 0 {
+		return "partial"
+	}
+	return "ok"
+}
+
+func countFailedActions(results []*SceneActionResult) int {
+	failed := 0
+	for _, result := range results {
+		if result.Status != "ok" {
+			failed++
+		}
+	}
+	return failed
+}
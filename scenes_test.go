@@ -0,0 +1,126 @@
+package main
+
+import (
+	"container/list"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestCaptureSceneAction(t *testing.T) {
+	hub, _ := newTestHubConnection()
+	defer hub.Queue.Close()
+
+	tests := []struct {
+		name     string
+		conn     *HubConnection
+		device   string
+		resource string
+		value    string
+		err      error
+	}{
+		{"switch", hub, "lamp", "/switch", `{"value":true}`, nil},
+		{"dimming", hub, "lamp", "/dimming", `{"dimmingSetting":50}`, nil},
+		{"missing resource", hub, "lamp", "/missing", "", errNoSuchDevice},
+		{"missing device", hub, "missing", "/switch", "", errNoSuchDevice},
+		{"offline hub", nil, "lamp", "/switch", "", errHubOffline},
+	}
+	for _, test := range tests {
+		action, err := captureSceneAction(test.conn, test.device, test.resource)
+		if err != test.err {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if test.err == nil && (action.HubUUID != "hub" || string(action.Value) != test.value) {
+			t.Errorf("%s: unexpected action %s %s", test.name, action.HubUUID, action.Value)
+		}
+	}
+}
+
+func TestGetActionsStatus(t *testing.T) {
+	ok := &SceneActionResult{Status: "ok"}
+	failed := &SceneActionResult{Status: "error", Error: "out of range"}
+	offline := &SceneActionResult{Status: "error", Error: errHubOffline.Error()}
+
+	tests := []struct {
+		name    string
+		results []*SceneActionResult
+		status  string
+		err     string
+	}{
+		{"all set", []*SceneActionResult{ok, ok}, "ok", ""},
+		{"some failed", []*SceneActionResult{ok, failed}, "partial", "failed to set 1 of 2 resources"},
+		{"all failed", []*SceneActionResult{failed, failed}, "error", "out of range"},
+		{"hub offline", []*SceneActionResult{failed, offline}, "error", errHubOffline.Error()},
+	}
+	for _, test := range tests {
+		if status := getActionsStatus(test.results); status != test.status {
+			t.Errorf("%s: expected status %s, got %s", test.name, test.status, status)
+		}
+		err := getActionsError(test.results)
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+func TestSceneMessages(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	hub, hubConnection := newTestHubConnection()
+	defer hub.Queue.Close()
+	server := &ClientConnectionServer{HubConnections: list.New(), Scenes: NewSceneStore()}
+	server.HubConnections.PushBack(hub)
+	conn, connection := newTestWebClient("client", "user")
+	defer conn.Queue.Close()
+	other, otherConnection := newTestWebClient("other", "other")
+	defer other.Queue.Close()
+
+	tests := []struct {
+		name    string
+		message string
+		status  string
+	}{
+		{"missing name", `{"payload":{"actions":[{"hubUuid":"hub","uuid":"lamp","resource":"/switch","value":{"value":false}}]}}`, "error"},
+		{"no actions", `{"payload":{"name":"Empty"}}`, "error"},
+		{"invalid action", `{"payload":{"name":"Invalid","actions":[{"hubUuid":"hub","resource":"/switch","value":{"value":false}}]}}`, "error"},
+		{"capture of other hub", `{"payload":{"name":"Other","capture":[{"hubUuid":"missing","uuid":"lamp","resource":"/switch"}]}}`, "error"},
+		{"captured scene", `{"payload":{"name":"Evening","capture":[{"hubUuid":"hub","uuid":"lamp","resource":"/dimming"}]}}`, "ok"},
+	}
+	var id string
+	for _, test := range tests {
+		server.handleCreateScene(conn, 1, gjson.Parse(test.message))
+		frame := connection.nextFrame(t)
+		if frame.Get("payload.status").String() != test.status {
+			t.Errorf("%s: unexpected response %s", test.name, frame.Raw)
+		}
+		if test.status == "ok" {
+			id = frame.Get("payload.scene.id").String()
+		}
+	}
+
+	server.handleListScenes(other, 2)
+	if frame := otherConnection.nextFrame(t); len(frame.Get("payload.scenes").Array()) != 0 {
+		t.Errorf("scenes of other user were listed %s", frame.Raw)
+	}
+	server.handleListScenes(conn, 2)
+	if frame := connection.nextFrame(t); frame.Get("payload.scenes.#").Int() != 1 || frame.Get("payload.scenes.0.name").String() != "Evening" {
+		t.Errorf("unexpected scene list %s", frame.Raw)
+	}
+
+	server.handleActivateScene(conn, 3, id)
+	if frame := hubConnection.nextFrame(t); frame.Get("payload.value.dimmingSetting").Int() != 50 {
+		t.Errorf("unexpected hub request %s", frame.Raw)
+	}
+	if frame := connection.nextFrame(t); frame.Get("payload.status").String() != "ok" {
+		t.Errorf("unexpected activation response %s", frame.Raw)
+	}
+
+	server.handleDeleteScene(other, 4, id)
+	if frame := otherConnection.nextFrame(t); frame.Get("payload.status").String() != "error" {
+		t.Errorf("scene of other user was deleted %s", frame.Raw)
+	}
+	server.handleDeleteScene(conn, 4, id)
+	if frame := connection.nextFrame(t); frame.Get("payload.status").String() != "ok" || len(server.Scenes.getScenes("user")) != 0 {
+		t.Errorf("scene was not deleted %s", frame.Raw)
+	}
+}
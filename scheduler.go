@@ -0,0 +1,419 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	_ "time/tzdata"
+)
+
+const (
+	SCHEDULES_STORAGE        = "schedules"
+	SCHEDULE_HISTORY_STORAGE = "scheduleHistory"
+
+	SCHEDULE_CRON = "cron"
+	SCHEDULE_ONCE = "once"
+	SCHEDULE_SUN  = "sun"
+
+	MISSED_RUN_SKIP    = "skip"
+	MISSED_RUN_CATCHUP = "catchup"
+
+	EXECUTION_OK      = "ok"
+	EXECUTION_PARTIAL = "partial"
+	EXECUTION_ERROR   = "error"
+	EXECUTION_SKIPPED = "skipped"
+
+	SCHEDULER_TICK        = time.Second
+	SCHEDULE_HISTORY_SIZE = 200
+	SCHEDULE_CATCHUP_WAIT = 10 * time.Minute
+)
+
+type Schedule struct {
+	ID           string         `json:"id"`
+	Name         string         `json:"name"`
+	Enabled      bool           `json:"enabled"`
+	Type         string         `json:"type"`
+	Cron         string         `json:"cron,omitempty"`
+	At           time.Time      `json:"at,omitempty"`
+	SunEvent     string         `json:"sunEvent,omitempty"`
+	Offset       int            `json:"offset,omitempty"`
+	Latitude     *float64       `json:"latitude,omitempty"`
+	Longitude    *float64       `json:"longitude,omitempty"`
+	Timezone     string         `json:"timezone,omitempty"`
+	MissedPolicy string         `json:"missedPolicy,omitempty"`
+	Actions      []*SceneAction `json:"actions"`
+	LastRun      time.Time      `json:"lastRun,omitempty"`
+	NextRun      time.Time      `json:"nextRun,omitempty"`
+}
+
+type ScheduleExecution struct {
+	ScheduleID string               `json:"scheduleId"`
+	Name       string               `json:"name"`
+	Scheduled  time.Time            `json:"scheduled"`
+	Executed   time.Time            `json:"executed"`
+	CatchUp    bool                 `json:"catchUp,omitempty"`
+	Status     string               `json:"status"`
+	Results    []*SceneActionResult `json:"results,omitempty"`
+}
+
+//pendingCatchUp is missed run waiting until hubs of its actions connect after gateway start
+type pendingCatchUp struct {
+	username string
+	schedule Schedule
+	deadline time.Time
+}
+
+type Scheduler struct {
+	HubConnections *list.List
+
+	mutex     sync.Mutex
+	schedules map[string][]*Schedule
+	history   map[string][]*ScheduleExecution
+	catchUps  []*pendingCatchUp
+}
+
+func NewScheduler(hubConnections *list.List) *Scheduler {
+	scheduler := &Scheduler{
+		HubConnections: hubConnections,
+		schedules:      make(map[string][]*Schedule),
+		history:        make(map[string][]*ScheduleExecution),
+	}
+	err := loadData(SCHEDULES_STORAGE, &scheduler.schedules)
+	if err != nil {
+		log.Println(err)
+	}
+	err = loadData(SCHEDULE_HISTORY_STORAGE, &scheduler.history)
+	if err != nil {
+		log.Println(err)
+	}
+	scheduler.handleMissedRuns(time.Now())
+	go scheduler.run()
+	return scheduler
+}
+
+//getDefaultLocation returns coordinates used by sun schedules without own location
+func getDefaultLocation() (float64, float64, bool) {
+	latitude, err := strconv.ParseFloat(os.Getenv("LOCATION_LATITUDE"), 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	longitude, err := strconv.ParseFloat(os.Getenv("LOCATION_LONGITUDE"), 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return latitude, longitude, true
+}
+
+func (schedule *Schedule) location() (*time.Location, error) {
+	if schedule.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(schedule.Timezone)
+}
+
+func (schedule *Schedule) coordinates() (float64, float64, bool) {
+	if schedule.Latitude != nil && schedule.Longitude != nil {
+		return *schedule.Latitude, *schedule.Longitude, true
+	}
+	return getDefaultLocation()
+}
+
+//next returns first run of schedule after given time
+func (schedule *Schedule) next(after time.Time) (time.Time, bool) {
+	location, err := schedule.location()
+	if err != nil {
+		return time.Time{}, false
+	}
+	switch schedule.Type {
+	case SCHEDULE_CRON:
+		spec, err := parseCron(schedule.Cron)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return spec.Next(after, location)
+	case SCHEDULE_ONCE:
+		if schedule.At.After(after) {
+			return schedule.At, true
+		}
+	case SCHEDULE_SUN:
+		latitude, longitude, ok := schedule.coordinates()
+		if !ok {
+			return time.Time{}, false
+		}
+		return nextSunEvent(after, schedule.SunEvent, time.Duration(schedule.Offset)*time.Minute, latitude, longitude, location)
+	}
+	return time.Time{}, false
+}
+
+func validateSchedule(schedule *Schedule) error {
+	if schedule.Name == "" {
+		return errors.New("schedule name is missing")
+	}
+	if len(schedule.Actions) == 0 {
+		return errors.New("schedule has no actions")
+	}
+	for _, action := range schedule.Actions {
+		if action.HubUUID == "" || action.DeviceUUID == "" || action.Resource == "" || len(action.Value) == 0 {
+			return errors.New("invalid schedule action")
+		}
+	}
+	_, err := schedule.location()
+	if err != nil {
+		return err
+	}
+	switch schedule.Type {
+	case SCHEDULE_CRON:
+		_, err = parseCron(schedule.Cron)
+		if err != nil {
+			return err
+		}
+	case SCHEDULE_ONCE:
+		if schedule.At.IsZero() {
+			return errors.New("one-shot schedule requires at")
+		}
+	case SCHEDULE_SUN:
+		if schedule.SunEvent != SUN_EVENT_SUNRISE && schedule.SunEvent != SUN_EVENT_SUNSET {
+			return errors.New("sun schedule requires sunrise or sunset event")
+		}
+		if _, _, ok := schedule.coordinates(); !ok {
+			return errors.New("sun schedule requires location")
+		}
+	default:
+		return errors.New("unknown schedule type " + schedule.Type)
+	}
+	if schedule.MissedPolicy == "" {
+		schedule.MissedPolicy = MISSED_RUN_SKIP
+	}
+	if schedule.MissedPolicy != MISSED_RUN_SKIP && schedule.MissedPolicy != MISSED_RUN_CATCHUP {
+		return errors.New("unknown missed run policy " + schedule.MissedPolicy)
+	}
+	return nil
+}
+
+func (scheduler *Scheduler) save() {
+	err := saveData(SCHEDULES_STORAGE, scheduler.schedules)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//getSchedules returns copies of user schedules as run updates the stored ones
+func (scheduler *Scheduler) getSchedules(username string) []*Schedule {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	result := []*Schedule{}
+	for _, schedule := range scheduler.schedules[username] {
+		item := *schedule
+		result = append(result, &item)
+	}
+	return result
+}
+
+func (scheduler *Scheduler) addSchedule(username string, schedule *Schedule) error {
+	err := validateSchedule(schedule)
+	if err != nil {
+		return err
+	}
+	next, ok := schedule.next(time.Now())
+	if !ok && schedule.Type != SCHEDULE_ONCE {
+		return errors.New("schedule never runs")
+	}
+	if !ok {
+		return errors.New("one-shot schedule is in the past")
+	}
+	schedule.NextRun = next
+
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	scheduler.schedules[username] = append(scheduler.schedules[username], schedule)
+	scheduler.save()
+	return nil
+}
+
+func (scheduler *Scheduler) deleteSchedule(username string, id string) bool {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	schedules := scheduler.schedules[username]
+	for i, schedule := range schedules {
+		if schedule.ID == id {
+			scheduler.schedules[username] = append(schedules[:i:i], schedules[i+1:]...)
+			scheduler.save()
+			return true
+		}
+	}
+	return false
+}
+
+func (scheduler *Scheduler) setScheduleEnabled(username string, id string, enabled bool) bool {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	for _, schedule := range scheduler.schedules[username] {
+		if schedule.ID == id {
+			schedule.Enabled = enabled
+			if enabled {
+				schedule.NextRun, _ = schedule.next(time.Now())
+			}
+			scheduler.save()
+			return true
+		}
+	}
+	return false
+}
+
+func (scheduler *Scheduler) getHistory(username string, id string) []*ScheduleExecution {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	var result []*ScheduleExecution
+	for _, execution := range scheduler.history[username] {
+		if id == "" || execution.ScheduleID == id {
+			result = append(result, execution)
+		}
+	}
+	return result
+}
+
+func (scheduler *Scheduler) addHistory(username string, execution *ScheduleExecution) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	history := append(scheduler.history[username], execution)
+	if len(history) > SCHEDULE_HISTORY_SIZE {
+		history = history[len(history)-SCHEDULE_HISTORY_SIZE:]
+	}
+	scheduler.history[username] = history
+	err := saveData(SCHEDULE_HISTORY_STORAGE, scheduler.history)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//advance moves schedule to its next run, one-shot schedules are disabled after run
+func (schedule *Schedule) advance(now time.Time) {
+	next, ok := schedule.next(now)
+	schedule.NextRun = next
+	if !ok {
+		schedule.Enabled = false
+	}
+}
+
+//handleMissedRuns skips schedules which were due while gateway was down or queues
+//their catch up until hubs reconnect
+func (scheduler *Scheduler) handleMissedRuns(now time.Time) {
+	scheduler.mutex.Lock()
+	var missed []*pendingCatchUp
+	for username, schedules := range scheduler.schedules {
+		for _, schedule := range schedules {
+			if !schedule.Enabled || schedule.NextRun.IsZero() || schedule.NextRun.After(now) {
+				continue
+			}
+			missed = append(missed, &pendingCatchUp{username, *schedule, now.Add(SCHEDULE_CATCHUP_WAIT)})
+			schedule.advance(now)
+		}
+	}
+	scheduler.save()
+	for _, run := range missed {
+		if run.schedule.MissedPolicy == MISSED_RUN_CATCHUP {
+			log.Println("Missed schedule " + run.schedule.Name + " will catch up when its hubs connect")
+			scheduler.catchUps = append(scheduler.catchUps, run)
+		}
+	}
+	scheduler.mutex.Unlock()
+
+	for _, run := range missed {
+		if run.schedule.MissedPolicy != MISSED_RUN_CATCHUP {
+			log.Println("Skipping missed schedule " + run.schedule.Name)
+			scheduler.addHistory(run.username, &ScheduleExecution{
+				ScheduleID: run.schedule.ID,
+				Name:       run.schedule.Name,
+				Scheduled:  run.schedule.NextRun,
+				Executed:   now,
+				Status:     EXECUTION_SKIPPED,
+			})
+		}
+	}
+}
+
+func (scheduler *Scheduler) exists(username string, id string) bool {
+	for _, schedule := range scheduler.schedules[username] {
+		if schedule.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+//hubsConnected checks whether every hub used by schedule actions is online
+func (scheduler *Scheduler) hubsConnected(username string, schedule *Schedule) bool {
+	for _, action := range schedule.Actions {
+		if findHubConnection(scheduler.HubConnections, username, action.HubUUID) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+//runCatchUps executes pending catch ups once their hubs connected, after waiting too long
+//they run anyway so history records hubs which stayed offline
+func (scheduler *Scheduler) runCatchUps(now time.Time) {
+	var pending []*pendingCatchUp
+	for _, run := range scheduler.catchUps {
+		if !scheduler.exists(run.username, run.schedule.ID) {
+			continue
+		}
+		if !scheduler.hubsConnected(run.username, &run.schedule) && now.Before(run.deadline) {
+			pending = append(pending, run)
+			continue
+		}
+		log.Println("Catching up missed schedule " + run.schedule.Name)
+		go scheduler.execute(run.username, run.schedule, true)
+	}
+	scheduler.catchUps = pending
+}
+
+func (scheduler *Scheduler) execute(username string, schedule Schedule, catchUp bool) {
+	results := activateScene(scheduler.HubConnections, username, schedule.Actions)
+	status := EXECUTION_OK
+	failed := countFailedActions(results)
+	if failed == len(results) {
+		status = EXECUTION_ERROR
+	} else if failed > 0 {
+		status = EXECUTION_PARTIAL
+	}
+	log.Println("Schedule " + schedule.Name + " executed with status " + status)
+	scheduler.addHistory(username, &ScheduleExecution{
+		ScheduleID: schedule.ID,
+		Name:       schedule.Name,
+		Scheduled:  schedule.NextRun,
+		Executed:   time.Now(),
+		CatchUp:    catchUp,
+		Status:     status,
+		Results:    results,
+	})
+}
+
+func (scheduler *Scheduler) run() {
+	ticker := time.NewTicker(SCHEDULER_TICK)
+	for now := range ticker.C {
+		scheduler.mutex.Lock()
+		scheduler.runCatchUps(now)
+		changed := false
+		for username, schedules := range scheduler.schedules {
+			for _, schedule := range schedules {
+				if !schedule.Enabled || schedule.NextRun.IsZero() || schedule.NextRun.After(now) {
+					continue
+				}
+				go scheduler.execute(username, *schedule, false)
+				schedule.LastRun = now
+				schedule.advance(now)
+				changed = true
+			}
+		}
+		if changed {
+			scheduler.save()
+		}
+		scheduler.mutex.Unlock()
+	}
+}
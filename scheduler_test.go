@@ -0,0 +1,79 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSchedulerCatchUpWaitsForHubs(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	hubs := list.New()
+	scheduler := &Scheduler{
+		HubConnections: hubs,
+		schedules:      make(map[string][]*Schedule),
+		history:        make(map[string][]*ScheduleExecution),
+	}
+	now := time.Now()
+	missed := now.Add(-time.Hour)
+	scheduler.schedules["user"] = []*Schedule{
+		{ID: "catchup", Name: "catchup", Enabled: true, Type: SCHEDULE_ONCE, At: missed, NextRun: missed, MissedPolicy: MISSED_RUN_CATCHUP,
+			Actions: []*SceneAction{{HubUUID: "hub", DeviceUUID: "lamp", Resource: "/switch", Value: json.RawMessage(`{"value":true}`)}}},
+		{ID: "skip", Name: "skip", Enabled: true, Type: SCHEDULE_ONCE, At: missed, NextRun: missed, MissedPolicy: MISSED_RUN_SKIP,
+			Actions: []*SceneAction{{HubUUID: "hub", DeviceUUID: "lamp", Resource: "/switch", Value: json.RawMessage(`{"value":false}`)}}},
+	}
+
+	scheduler.handleMissedRuns(now)
+	if history := scheduler.getHistory("user", "skip"); len(history) != 1 || history[0].Status != EXECUTION_SKIPPED {
+		t.Fatalf("missed run was not skipped: %v", history)
+	}
+
+	scheduler.mutex.Lock()
+	scheduler.runCatchUps(now.Add(SCHEDULER_TICK))
+	pending := len(scheduler.catchUps)
+	scheduler.mutex.Unlock()
+	if pending != 1 {
+		t.Fatalf("catch up must wait for offline hub, %d pending", pending)
+	}
+
+	conn, connection := newTestHubConnection()
+	defer conn.Queue.Close()
+	hubs.PushBack(conn)
+	scheduler.mutex.Lock()
+	scheduler.runCatchUps(now.Add(2 * SCHEDULER_TICK))
+	pending = len(scheduler.catchUps)
+	scheduler.mutex.Unlock()
+	if pending != 0 {
+		t.Fatalf("catch up did not run after hub connected")
+	}
+	frame := connection.nextFrame(t)
+	if frame.Get("payload.resource").String() != "/switch" || !frame.Get("payload.value.value").Bool() {
+		t.Errorf("unexpected catch up request %s", frame.Raw)
+	}
+}
+
+func TestGetSchedulesReturnsCopies(t *testing.T) {
+	scheduler := &Scheduler{schedules: make(map[string][]*Schedule)}
+	next := time.Now().Add(time.Hour)
+	scheduler.schedules["user"] = []*Schedule{{ID: "daily", Name: "daily", Enabled: true, NextRun: next}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scheduler.mutex.Lock()
+		scheduler.schedules["user"][0].LastRun = time.Now()
+		scheduler.schedules["user"][0].NextRun = next.Add(time.Hour)
+		scheduler.mutex.Unlock()
+	}()
+	schedules := scheduler.getSchedules("user")
+	if len(schedules) != 1 || schedules[0].ID != "daily" {
+		t.Fatalf("unexpected schedules %v", schedules)
+	}
+	schedules[0].Enabled = false
+	schedules[0].NextRun = time.Time{}
+	<-done
+	if !scheduler.schedules["user"][0].Enabled {
+		t.Error("change of returned schedule must not modify stored schedule")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	CLIENT_SESSION_GRACE_PERIOD = 2 * time.Minute
+	CLIENT_SESSION_BUFFER_SIZE  = 500
+	CLIENT_SESSION_CHECK_PERIOD = 30 * time.Second
+)
+
+//BufferedEvent is an event frame kept for replay after session resume
+type BufferedEvent struct {
+	Sequence int64
+	Frame    []byte
+}
+
+func eventFrame(sequence int64, name string, payload string) []byte {
+	return []byte(`{ "mid":-1,"seq":` + strconv.FormatInt(sequence, 10) + `,"name":"` + name + `", "payload":` + payload + `}`)
+}
+
+//sendSequencedEvent numbers event, stores it in replay buffer of the session and queues it
+//unless client is detached, payload is built with sequence number of the event and events
+//with the same key may be coalesced by outbound queue
+func (conn *WebClientConnection) sendSequencedEvent(name string, key string, payload func(sequence int64) string) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.Sequence++
+	data := payload(conn.Sequence)
+	frame := eventFrame(conn.Sequence, name, data)
+	if conn.SessionToken != "" {
+		conn.buffer = append(conn.buffer, &BufferedEvent{Sequence: conn.Sequence, Frame: frame})
+		if len(conn.buffer) > CLIENT_SESSION_BUFFER_SIZE {
+			conn.buffer = conn.buffer[len(conn.buffer)-CLIENT_SESSION_BUFFER_SIZE:]
+		}
+	}
+	if conn.Detached.IsZero() {
+		log.Println("sendEvent" + data)
+		conn.Queue.Enqueue(key, frame)
+	}
+}
+
+func (conn *WebClientConnection) sendEvent(name string, payload string) {
+	conn.sendSequencedEvent(name, "", func(sequence int64) string {
+		return payload
+	})
+}
+
+//startSession assigns token which allows client to resume the session after reconnect
+func (conn *WebClientConnection) startSession() {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.SessionToken = generateRandomToken()
+}
+
+func (server *ClientConnectionServer) addWebClient(conn *WebClientConnection) {
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+	server.WebClientConnections.PushBack(conn)
+}
+
+func (server *ClientConnectionServer) removeWebClient(conn *WebClientConnection) {
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+	for e := server.WebClientConnections.Front(); e != nil; e = e.Next() {
+		if e.Value.(*WebClientConnection) == conn {
+			server.WebClientConnections.Remove(e)
+			return
+		}
+	}
+}
+
+//getWebClients returns snapshot of web client connections which can be iterated without the lock
+func (server *ClientConnectionServer) getWebClients() []*WebClientConnection {
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+	clients := make([]*WebClientConnection, 0, server.WebClientConnections.Len())
+	for e := server.WebClientConnections.Front(); e != nil; e = e.Next() {
+		clients = append(clients, e.Value.(*WebClientConnection))
+	}
+	return clients
+}
+
+//takeDetachedSession removes and returns detached connection of user with session token,
+//lookup and removal share the lock so session can be resumed only once
+func (server *ClientConnectionServer) takeDetachedSession(username string, token string) *WebClientConnection {
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+	for e := server.WebClientConnections.Front(); e != nil; e = e.Next() {
+		con := e.Value.(*WebClientConnection)
+		if con.isResumableBy(username, token) {
+			server.WebClientConnections.Remove(e)
+			return con
+		}
+	}
+	return nil
+}
+
+//resumeSession moves subscriptions and pending events of detached session to new connection,
+//returns false when session is gone, second result tells if no event after lastSequence was lost
+func (server *ClientConnectionServer) resumeSession(conn *WebClientConnection, username string, token string, lastSequence int64) (bool, bool) {
+	old := server.takeDetachedSession(username, token)
+	if old == nil {
+		return false, false
+	}
+
+	old.mutex.Lock()
+	defer old.mutex.Unlock()
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.SessionToken = old.SessionToken
+	conn.Subscriptions = old.Subscriptions
+	conn.Capabilities = old.Capabilities
+	conn.Sequence = old.Sequence
+	conn.buffer = old.buffer
+
+	complete := lastSequence >= conn.Sequence ||
+		(len(conn.buffer) > 0 && conn.buffer[0].Sequence <= lastSequence+1)
+	return true, complete
+}
+
+//completeResume sends authorize response followed by buffered events newer than lastSequence,
+//live events wait until replay is done
+func (conn *WebClientConnection) completeResume(mid int64, response string, lastSequence int64) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.Queue.Enqueue("", messageFrame(mid, "ResponseAuthorize", response))
+	for _, event := range conn.buffer {
+		if event.Sequence > lastSequence {
+			conn.Queue.Enqueue("", event.Frame)
+		}
+	}
+}
+
+//detach keeps disconnected session for grace period, sessions without token are dropped
+func (server *ClientConnectionServer) detach(conn *WebClientConnection) {
+	conn.mutex.Lock()
+	keep := conn.Username != "" && conn.SessionToken != ""
+	if keep {
+		conn.Detached = time.Now()
+	}
+	conn.mutex.Unlock()
+	if !keep {
+		server.removeWebClient(conn)
+	}
+}
+
+//isResumableBy checks if detached session in grace period belongs to user and token
+func (conn *WebClientConnection) isResumableBy(username string, token string) bool {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.SessionToken == token && conn.Username == username && !conn.Detached.IsZero() &&
+		time.Since(conn.Detached) < CLIENT_SESSION_GRACE_PERIOD
+}
+
+func (conn *WebClientConnection) isExpired() bool {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return !conn.Detached.IsZero() && time.Since(conn.Detached) >= CLIENT_SESSION_GRACE_PERIOD
+}
+
+func (server *ClientConnectionServer) expireSessions() {
+	ticker := time.NewTicker(CLIENT_SESSION_CHECK_PERIOD)
+	for range ticker.C {
+		server.removeExpiredSessions()
+	}
+}
+
+func (server *ClientConnectionServer) removeExpiredSessions() {
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+	var next *list.Element
+	for e := server.WebClientConnections.Front(); e != nil; e = next {
+		next = e.Next()
+		con := e.Value.(*WebClientConnection)
+		if con.isExpired() {
+			log.Println("Web client session of " + con.Username + " expired")
+			server.WebClientConnections.Remove(e)
+		}
+	}
+}
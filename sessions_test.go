@@ -0,0 +1,70 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionResumeAndExpiry(t *testing.T) {
+	server := &ClientConnectionServer{WebClientConnections: list.New()}
+	old, _ := newTestWebClient("old", "user")
+	defer old.Queue.Close()
+	old.startSession()
+	server.addWebClient(old)
+	server.detach(old)
+
+	var wg sync.WaitGroup
+	results := make(chan bool, 4)
+	for i := 0; i < 4; i++ {
+		conn, _ := newTestWebClient("new", "user")
+		defer conn.Queue.Close()
+		server.addWebClient(conn)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			resumed, _ := server.resumeSession(conn, "user", old.SessionToken, 0)
+			results <- resumed
+		}()
+		go func() {
+			defer wg.Done()
+			server.removeExpiredSessions()
+			server.getWebClients()
+		}()
+	}
+	wg.Wait()
+	close(results)
+	resumed := 0
+	for result := range results {
+		if result {
+			resumed++
+		}
+	}
+	if resumed != 1 {
+		t.Errorf("session resumed %d times", resumed)
+	}
+
+	tests := []struct {
+		name     string
+		detached time.Duration
+		kept     bool
+	}{
+		{"session in grace period", time.Second, true},
+		{"expired session", CLIENT_SESSION_GRACE_PERIOD + time.Second, false},
+	}
+	for _, test := range tests {
+		conn, _ := newTestWebClient(test.name, "user")
+		defer conn.Queue.Close()
+		conn.Detached = time.Now().Add(-test.detached)
+		server.addWebClient(conn)
+		server.removeExpiredSessions()
+		kept := false
+		for _, client := range server.getWebClients() {
+			kept = kept || client == conn
+		}
+		if kept != test.kept {
+			t.Errorf("%s: expected kept %v", test.name, test.kept)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var storageMutex sync.Mutex
+
+func getDataDir() string {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		dir = "data"
+	}
+	return dir
+}
+
+//loadData reads stored object, missing file leaves value untouched
+func loadData(name string, value interface{}) error {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+
+	data, err := ioutil.ReadFile(filepath.Join(getDataDir(), name+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+func saveData(name string, value interface{}) error {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := getDataDir()
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name+".json")
+	err = ioutil.WriteFile(path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
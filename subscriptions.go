@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+//WebClientSubscription selects resources client receives events for, empty fields match
+//everything so subscription without hub covers all devices of the user
+type WebClientSubscription struct {
+	Uuid         string `json:"uuid,omitempty"`
+	HubUuid      string `json:"hubUuid,omitempty"`
+	ResourceType string `json:"rt,omitempty"`
+	Href         string `json:"href,omitempty"`
+}
+
+func parseSubscription(message gjson.Result) (*WebClientSubscription, error) {
+	sub := &WebClientSubscription{
+		Uuid:         message.Get("payload.uuid").String(),
+		HubUuid:      message.Get("payload.hubUuid").String(),
+		ResourceType: message.Get("payload.rt").String(),
+		Href:         message.Get("payload.href").String(),
+	}
+	if sub.Uuid != "" && sub.HubUuid == "" {
+		return nil, errors.New("device subscription requires hubUuid")
+	}
+	if _, err := path.Match(sub.Href, ""); err != nil {
+		return nil, errors.New("invalid href pattern " + sub.Href)
+	}
+	return sub, nil
+}
+
+func hasResourceType(variable *IotVariable, resourceType string) bool {
+	for _, rt := range strings.FieldsFunc(variable.ResourceType, func(r rune) bool { return r == ' ' || r == ',' }) {
+		if rt == resourceType {
+			return true
+		}
+	}
+	return false
+}
+
+//matchesVariable checks if resource of device is covered by subscription
+func (sub *WebClientSubscription) matchesVariable(hubUUID string, device *IotDevice, variable *IotVariable) bool {
+	if sub.HubUuid != "" && sub.HubUuid != hubUUID {
+		return false
+	}
+	if sub.Uuid != "" && sub.Uuid != device.UUID {
+		return false
+	}
+	if sub.ResourceType != "" && !hasResourceType(variable, sub.ResourceType) {
+		return false
+	}
+	if sub.Href != "" {
+		matched, _ := path.Match(sub.Href, variable.Href)
+		return matched
+	}
+	return true
+}
+
+//matchesDevice checks if any resource of device is covered by subscription
+func (sub *WebClientSubscription) matchesDevice(hubUUID string, device *IotDevice) bool {
+	if len(device.Variables) == 0 {
+		return sub.matchesVariable(hubUUID, device, &IotVariable{}) && sub.ResourceType == "" && sub.Href == ""
+	}
+	for _, variable := range device.Variables {
+		if sub.matchesVariable(hubUUID, device, variable) {
+			return true
+		}
+	}
+	return false
+}
+
+//findSubscription looks up subscription while caller holds connection mutex
+func (conn *WebClientConnection) findSubscription(sub *WebClientSubscription) *WebClientSubscription {
+	for e := conn.Subscriptions.Front(); e != nil; e = e.Next() {
+		s := e.Value.(*WebClientSubscription)
+		if *s == *sub {
+			return s
+		}
+	}
+	return nil
+}
+
+//isSubscribed checks if any subscription of connection covers the resource, it runs on hub
+//goroutines while client changes subscriptions so the list is read under connection mutex
+func (conn *WebClientConnection) isSubscribed(hubUUID string, device *IotDevice, variable *IotVariable) bool {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	for e := conn.Subscriptions.Front(); e != nil; e = e.Next() {
+		if e.Value.(*WebClientSubscription).matchesVariable(hubUUID, device, variable) {
+			return true
+		}
+	}
+	return false
+}
+
+//addSubscription stores subscription of authorized client to one of its hubs and sends current
+//state of matching devices
+func (server *ClientConnectionServer) addSubscription(conn *WebClientConnection, sub *WebClientSubscription) error {
+	if conn.Username == "" {
+		return errNotAuthorized
+	}
+	if sub.HubUuid != "" && sub.HubUuid != GROUP_HUB_UUID && findHubConnection(server.HubConnections, conn.Username, sub.HubUuid) == nil {
+		return errors.New("hub not found")
+	}
+	if conn.storeSubscription(sub) {
+		server.sendSubscriptionState(conn, sub)
+	}
+	return nil
+}
+
+//storeSubscription adds subscription unless identical one exists, events are only delivered
+//for hubs of connection user so it can be stored before hub connects or client authorizes
+func (conn *WebClientConnection) storeSubscription(sub *WebClientSubscription) bool {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.findSubscription(sub) != nil {
+		return false
+	}
+	log.Println("Add subscribe " + sub.Uuid + " " + sub.HubUuid)
+	conn.Subscriptions.PushBack(sub)
+	return true
+}
+
+//sendSubscriptionState sends current state of devices of connection user matching subscription
+func (server *ClientConnectionServer) sendSubscriptionState(conn *WebClientConnection, sub *WebClientSubscription) {
+	if conn.Username == "" {
+		return
+	}
+	for _, hub := range getHubConnections(server.HubConnections) {
+		if hub.Username == "" || hub.Username != conn.Username {
+			continue
+		}
+		for _, device := range hub.getDevices() {
+			if sub.matchesDevice(hub.Uuid, device) {
+				server.sendDeviceUpdateEvent(conn, device.UUID, hub.Uuid)
+			}
+		}
+	}
+	for _, device := range createGroupDevices(server.HubConnections, conn.Username, server.Groups) {
+		if sub.matchesDevice(GROUP_HUB_UUID, device) {
+			server.sendGroupUpdateEvent(conn, device)
+		}
+	}
+}
+
+func (server *ClientConnectionServer) removeSubscription(conn *WebClientConnection, sub *WebClientSubscription) bool {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	for e := conn.Subscriptions.Front(); e != nil; e = e.Next() {
+		if *e.Value.(*WebClientSubscription) == *sub {
+			conn.Subscriptions.Remove(e)
+			return true
+		}
+	}
+	return false
+}
+
+func (server *ClientConnectionServer) handleSubscribe(conn *WebClientConnection, mid int64, message gjson.Result) {
+	sub, err := parseSubscription(message)
+	if err == nil {
+		err = server.addSubscription(conn, sub)
+	}
+	if err != nil {
+		conn.sendErrorResponse(mid, "ResponseSubscribe", err)
+		return
+	}
+	conn.sendResponse(mid, "ResponseSubscribe", `{"status":"ok"}`)
+}
+
+func (server *ClientConnectionServer) handleUnsubscribe(conn *WebClientConnection, mid int64, message gjson.Result) {
+	sub, err := parseSubscription(message)
+	if err == nil && !server.removeSubscription(conn, sub) {
+		err = errors.New("subscription not found")
+	}
+	if err != nil {
+		conn.sendErrorResponse(mid, "ResponseUnsubscribe", err)
+		return
+	}
+	conn.sendResponse(mid, "ResponseUnsubscribe", `{"status":"ok"}`)
+}
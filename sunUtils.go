@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	SUN_EVENT_SUNRISE = "sunrise"
+	SUN_EVENT_SUNSET  = "sunset"
+
+	JULIAN_UNIX_EPOCH = 2440587.5
+	JULIAN_2000       = 2451545.0
+)
+
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func toDegrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
+
+func julianToTime(julian float64) time.Time {
+	return time.Unix(0, int64((julian-JULIAN_UNIX_EPOCH)*86400*float64(time.Second))).UTC()
+}
+
+//sunTimes calculates sunrise and sunset for date using sunrise equation,
+//ok is false during polar day or night
+func sunTimes(date time.Time, latitude float64, longitude float64) (time.Time, time.Time, bool) {
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, time.UTC)
+	julian := float64(noon.Unix())/86400 + JULIAN_UNIX_EPOCH
+	n := math.Round(julian - JULIAN_2000 + 0.0008)
+
+	meanSolarTime := n - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanSolarTime, 360)
+	center := 1.9148*math.Sin(toRadians(anomaly)) + 0.02*math.Sin(toRadians(2*anomaly)) + 0.0003*math.Sin(toRadians(3*anomaly))
+	eclipticLongitude := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := JULIAN_2000 + meanSolarTime + 0.0053*math.Sin(toRadians(anomaly)) - 0.0069*math.Sin(toRadians(2*eclipticLongitude))
+
+	declination := math.Asin(math.Sin(toRadians(eclipticLongitude)) * math.Sin(toRadians(23.4397)))
+	cosHourAngle := (math.Sin(toRadians(-0.833)) - math.Sin(toRadians(latitude))*math.Sin(declination)) /
+		(math.Cos(toRadians(latitude)) * math.Cos(declination))
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := toDegrees(math.Acos(cosHourAngle))
+
+	return julianToTime(transit - hourAngle/360), julianToTime(transit + hourAngle/360), true
+}
+
+//nextSunEvent returns first sunrise or sunset shifted by offset after given time
+func nextSunEvent(after time.Time, event string, offset time.Duration, latitude float64, longitude float64, location *time.Location) (time.Time, bool) {
+	day := after.In(location)
+	for i := 0; i < 366; i++ {
+		date := time.Date(day.Year(), day.Month(), day.Day()+i, 12, 0, 0, 0, location)
+		sunrise, sunset, ok := sunTimes(date, latitude, longitude)
+		if !ok {
+			continue
+		}
+		t := sunrise
+		if event == SUN_EVENT_SUNSET {
+			t = sunset
+		}
+		t = t.Add(offset).In(location).Truncate(time.Minute)
+		if t.After(after) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	TEMPERATURE_UNIT_CELSIUS    = "C"
+	TEMPERATURE_UNIT_FAHRENHEIT = "F"
+	TEMPERATURE_UNIT_KELVIN     = "K"
+)
+
+func toCelsius(value float64, units string) float64 {
+	switch units {
+	case TEMPERATURE_UNIT_FAHRENHEIT:
+		return (value - 32) * 5 / 9
+	case TEMPERATURE_UNIT_KELVIN:
+		return value - 273.15
+	}
+	return value
+}
+
+func fromCelsius(value float64, units string) float64 {
+	switch units {
+	case TEMPERATURE_UNIT_FAHRENHEIT:
+		return value*9/5 + 32
+	case TEMPERATURE_UNIT_KELVIN:
+		return value + 273.15
+	}
+	return value
+}
+
+func roundTemperature(value float64) float64 {
+	return math.Round(value*10) / 10
+}
+
+func (c *ResourceCapability) temperatureUnits() string {
+	units := c.Value().Get("units").String()
+	if units == "" {
+		return TEMPERATURE_UNIT_CELSIUS
+	}
+	return units
+}
+
+//isSetpoint tells if temperature resource is a thermostat setpoint rather than a sensor
+func (c *ResourceCapability) isSetpoint() bool {
+	return c.Variable.hasInterface(INTERFACE_ACTUATOR)
+}
+
+//GetTemperature returns temperature in Celsius
+func (c *ResourceCapability) GetTemperature() float64 {
+	return roundTemperature(toCelsius(c.GetNumber(), c.temperatureUnits()))
+}
+
+//TemperatureRange returns allowed range in Celsius
+func (c *ResourceCapability) TemperatureRange() ValueRange {
+	value := c.Value()
+	if value.Get("range").Exists() {
+		r, ok := parseRange(value.Get("range"))
+		if ok {
+			units := c.temperatureUnits()
+			return ValueRange{
+				Min: roundTemperature(toCelsius(r.Min, units)),
+				Max: roundTemperature(toCelsius(r.Max, units)),
+			}
+		}
+	}
+	return c.Capability.DefaultRange
+}
+
+//SetTemperature writes temperature given in Celsius using resource units
+func (c *ResourceCapability) SetTemperature(conn *HubConnection, celsius float64) error {
+	r := c.TemperatureRange()
+	if !r.contains(roundTemperature(celsius)) {
+		return &ValueOutOfRangeError{Range: r}
+	}
+	value := roundTemperature(fromCelsius(celsius, c.temperatureUnits()))
+	err := c.set(conn, formatNumber(value))
+	if _, ok := err.(*ValueOutOfRangeError); ok {
+		return &ValueOutOfRangeError{Range: r}
+	}
+	return err
+}
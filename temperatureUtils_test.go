@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTemperatureConversion(t *testing.T) {
+	tests := []struct {
+		value   float64
+		units   string
+		celsius float64
+	}{
+		{21, TEMPERATURE_UNIT_CELSIUS, 21},
+		{70, TEMPERATURE_UNIT_FAHRENHEIT, 21.1},
+		{32, TEMPERATURE_UNIT_FAHRENHEIT, 0},
+		{-40, TEMPERATURE_UNIT_FAHRENHEIT, -40},
+		{294.15, TEMPERATURE_UNIT_KELVIN, 21},
+		{21, "", 21},
+	}
+	for _, test := range tests {
+		celsius := roundTemperature(toCelsius(test.value, test.units))
+		if celsius != test.celsius {
+			t.Errorf("%v%s: expected %vC, got %vC", test.value, test.units, test.celsius, celsius)
+		}
+		if back := fromCelsius(toCelsius(test.value, test.units), test.units); math.Abs(back-test.value) > 1e-9 {
+			t.Errorf("%v%s: round trip returned %v", test.value, test.units, back)
+		}
+	}
+}
+
+func TestTemperatureCapability(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		temperature float64
+		min         float64
+		max         float64
+	}{
+		{"celsius", `{"temperature":21.5,"units":"C","range":[5,30]}`, 21.5, 5, 30},
+		{"fahrenheit", `{"temperature":70,"units":"F","range":[50,86]}`, 21.1, 10, 30},
+		{"kelvin", `{"temperature":294.15,"units":"K","range":[278.15,303.15]}`, 21, 5, 30},
+		{"units missing", `{"temperature":21,"range":[5,30]}`, 21, 5, 30},
+	}
+	for _, test := range tests {
+		device := &IotDevice{UUID: "thermostat", Variables: []*IotVariable{
+			newTestVariable("/setpoint", "oic.r.temperature", INTERFACE_ACTUATOR, test.value),
+		}}
+		capability := device.getCapability(CAPABILITY_TEMPERATURE)
+		if capability == nil {
+			t.Fatalf("%s: temperature capability not found", test.name)
+		}
+		if !capability.isSetpoint() {
+			t.Errorf("%s: actuator temperature has to be setpoint", test.name)
+		}
+		if temperature := capability.GetTemperature(); temperature != test.temperature {
+			t.Errorf("%s: expected %vC, got %vC", test.name, test.temperature, temperature)
+		}
+		if r := capability.TemperatureRange(); r.Min != test.min || r.Max != test.max {
+			t.Errorf("%s: expected range %v-%v, got %+v", test.name, test.min, test.max, r)
+		}
+	}
+}
+
+func TestSetTemperature(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	tests := []struct {
+		name    string
+		value   string
+		celsius float64
+		written float64
+		valid   bool
+	}{
+		{"fahrenheit setpoint", `{"temperature":68,"units":"F"}`, 22, 71.6, true},
+		{"kelvin setpoint", `{"temperature":293.15,"units":"K"}`, 20, 293.2, true},
+		{"celsius setpoint", `{"temperature":20,"units":"C","range":[5,30]}`, 19.5, 19.5, true},
+		{"out of advertised range", `{"temperature":20,"units":"C","range":[5,30]}`, 35, 0, false},
+	}
+	for _, test := range tests {
+		conn, connection := newTestHubConnection()
+		device := &IotDevice{UUID: "thermostat", HubUUID: "hub", Variables: []*IotVariable{
+			newTestVariable("/setpoint", "oic.r.temperature", INTERFACE_ACTUATOR, test.value),
+		}}
+		conn.DeviceList.PushBack(device)
+		err := device.getCapability(CAPABILITY_TEMPERATURE).SetTemperature(conn, test.celsius)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+		if test.valid {
+			frame := connection.nextFrame(t)
+			if written := frame.Get("payload.value.temperature").Float(); written != test.written {
+				t.Errorf("%s: expected %v written, got %s", test.name, test.written, frame.Raw)
+			}
+		}
+		conn.Queue.Close()
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	VIRTUAL_DEVICES_STORAGE = "virtualDevices"
+
+	VIRTUAL_HUB_PREFIX = RESERVED_HUB_UUID_PREFIX
+	VIRTUAL_HUB_NAME   = "Gateway"
+
+	COMPUTED_FUNCTION_ANY = "any"
+	COMPUTED_FUNCTION_ALL = "all"
+)
+
+//ComputedValue makes resource of virtual device a sensor whose boolean property is computed
+//from the same property of source resources, like any window open
+type ComputedValue struct {
+	Function string         `json:"function"`
+	Property string         `json:"property,omitempty"`
+	Sources  []*GroupMember `json:"sources"`
+}
+
+//hubVariableData and hubDeviceData describe device the same way hubs do in EventDeviceListUpdate
+type hubVariableData struct {
+	Href         string          `json:"href"`
+	Name         string          `json:"n"`
+	Interface    string          `json:"if"`
+	ResourceType string          `json:"rt"`
+	Values       json.RawMessage `json:"values"`
+}
+
+type hubDeviceData struct {
+	ID        string             `json:"id"`
+	Name      string             `json:"name"`
+	Variables []*hubVariableData `json:"variables"`
+}
+
+//VirtualHub hosts devices implemented inside gateway, every user gets own hub connection
+//which handles requests in process so virtual devices behave exactly like hub devices,
+//in cluster every instance hosts own virtual hubs with own storage and publishes them like
+//hubs connected to it
+type VirtualHub struct {
+	Endpoint *HubConnectionEndpoint
+
+	mutex   sync.Mutex
+	devices map[string][]*IotDevice
+}
+
+func NewVirtualHub() *VirtualHub {
+	hub := &VirtualHub{
+		devices: make(map[string][]*IotDevice),
+	}
+	err := loadData(getVirtualDevicesStorage(), &hub.devices)
+	if err != nil {
+		log.Println(err)
+	}
+	return hub
+}
+
+func getVirtualDevicesStorage() string {
+	if instance := os.Getenv("CLUSTER_INSTANCE_ID"); instance != "" {
+		return VIRTUAL_DEVICES_STORAGE + "-" + instance
+	}
+	return VIRTUAL_DEVICES_STORAGE
+}
+
+//Start connects hubs of users who already have virtual devices
+func (hub *VirtualHub) Start(endpoint *HubConnectionEndpoint) {
+	hub.Endpoint = endpoint
+	hub.mutex.Lock()
+	var usernames []string
+	for username := range hub.devices {
+		usernames = append(usernames, username)
+	}
+	hub.mutex.Unlock()
+	for _, username := range usernames {
+		conn := hub.getConnection(username)
+		parseDeviceList(conn, hub.getDeviceListMessage(username))
+		endpoint.Cluster.PublishHubState(conn)
+	}
+}
+
+func (hub *VirtualHub) save() {
+	err := saveData(getVirtualDevicesStorage(), hub.devices)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//getVirtualHubUUID returns stable hub uuid of user, it has to be unique as some lookups
+//use hub uuid only, so virtual hubs of cluster instances differ by instance id
+func getVirtualHubUUID(username string) string {
+	name := username
+	if instance := os.Getenv("CLUSTER_INSTANCE_ID"); instance != "" {
+		name = instance + "\x00" + username
+	}
+	hash := sha256.Sum256([]byte(name))
+	return VIRTUAL_HUB_PREFIX + hex.EncodeToString(hash[:8])
+}
+
+func (hub *VirtualHub) getDevices(username string) []*IotDevice {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	return append([]*IotDevice{}, hub.devices[username]...)
+}
+
+func (hub *VirtualHub) addDevice(username string, device *IotDevice) error {
+	if device.Name == "" {
+		return errors.New("device name is missing")
+	}
+	if len(device.Variables) == 0 {
+		return errors.New("device has no resources")
+	}
+	hrefs := make(map[string]bool)
+	for _, variable := range device.Variables {
+		if !strings.HasPrefix(variable.Href, "/") || hrefs[variable.Href] {
+			return errors.New("invalid or duplicated resource href " + variable.Href)
+		}
+		if variable.ResourceType == "" {
+			return errors.New("resource " + variable.Href + " has no resource type")
+		}
+		if variable.Computed != nil {
+			err := validateComputedValue(variable.Computed)
+			if err != nil {
+				return errors.New("resource " + variable.Href + ": " + err.Error())
+			}
+			variable.Interface = INTERFACE_SENSOR
+			variable.VariableValue.Value = hub.computeValue(username, variable.Computed)
+		}
+		if !variable.VariableValue.Value.IsObject() {
+			return errors.New("value of resource " + variable.Href + " has to be an object")
+		}
+		if variable.Interface == "" {
+			variable.Interface = INTERFACE_ACTUATOR
+		}
+		hrefs[variable.Href] = true
+	}
+	device.UUID = generateMessageUUID()
+	device.HubUUID = getVirtualHubUUID(username)
+
+	hub.mutex.Lock()
+	hub.devices[username] = append(hub.devices[username], device)
+	hub.save()
+	hub.mutex.Unlock()
+	hub.publishDeviceList(username)
+	return nil
+}
+
+func (hub *VirtualHub) deleteDevice(username string, uuid string) bool {
+	hub.mutex.Lock()
+	devices := hub.devices[username]
+	found := false
+	for i, device := range devices {
+		if device.UUID == uuid {
+			hub.devices[username] = append(devices[:i:i], devices[i+1:]...)
+			hub.save()
+			found = true
+			break
+		}
+	}
+	hub.mutex.Unlock()
+	if found {
+		hub.publishDeviceList(username)
+	}
+	return found
+}
+
+//setValue merges properties of value into stored resource value and returns the result
+func (hub *VirtualHub) setValue(username string, uuid string, href string, value gjson.Result) (gjson.Result, error) {
+	if !value.IsObject() {
+		return gjson.Result{}, errors.New("value has to be an object")
+	}
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for _, device := range hub.devices[username] {
+		if device.UUID != uuid {
+			continue
+		}
+		variable := device.getVariable(href)
+		if variable == nil {
+			return gjson.Result{}, errors.New("unknown resource " + href)
+		}
+		if variable.Computed != nil {
+			return gjson.Result{}, errors.New("resource " + href + " is computed")
+		}
+		variable.VariableValue.Value = mergeValueDelta(variable.VariableValue.Value, value)
+		hub.save()
+		return variable.VariableValue.Value, nil
+	}
+	return gjson.Result{}, errNoSuchDevice
+}
+
+//getConnection returns hub connection of user, connecting it when missing
+func (hub *VirtualHub) getConnection(username string) *HubConnection {
+	hubUUID := getVirtualHubUUID(username)
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if conn := findHubConnection(hub.Endpoint.HubConnections, username, hubUUID); conn != nil && conn.Virtual {
+		return conn
+	}
+	conn := &HubConnection{
+		Username:        username,
+		Uuid:            hubUUID,
+		Name:            VIRTUAL_HUB_NAME,
+		Mid:             1,
+		Callbacks:       make(map[int64]RequestCallback),
+		ProtocolVersion: HUB_PROTOCOL_VERSION,
+		Capabilities:    map[string]bool{HUB_CAPABILITY_ACKNOWLEDGE: true},
+		Closed:          make(chan struct{}),
+		Virtual:         true,
+	}
+	conn.Forward = func(mid int64, name string, payload string) {
+		go hub.handleRequest(conn, mid, name, gjson.Parse(payload))
+	}
+	addHubConnection(hub.Endpoint.HubConnections, conn)
+	log.Println("Virtual hub " + hubUUID + " connected for " + username)
+	return conn
+}
+
+//getDeviceListMessage describes virtual devices of user as EventDeviceListUpdate of hub
+func (hub *VirtualHub) getDeviceListMessage(username string) string {
+	devices := []*hubDeviceData{}
+	for _, device := range hub.getDevices(username) {
+		data := &hubDeviceData{ID: device.UUID, Name: device.Name}
+		for _, variable := range device.Variables {
+			data.Variables = append(data.Variables, &hubVariableData{
+				Href:         variable.Href,
+				Name:         variable.Name,
+				Interface:    variable.Interface,
+				ResourceType: variable.ResourceType,
+				Values:       json.RawMessage(variable.VariableValue.Value.Raw),
+			})
+		}
+		devices = append(devices, data)
+	}
+	devicesData, _ := json.Marshal(devices)
+	return string(messageFrame(0, "EventDeviceListUpdate", `{"devices":`+string(devicesData)+`}`))
+}
+
+//publishDeviceList reports changed virtual devices of user to clients, Alexa and webhooks
+func (hub *VirtualHub) publishDeviceList(username string) {
+	hub.Endpoint.handleDeviceListUpdate(hub.getConnection(username), hub.getDeviceListMessage(username))
+}
+
+//handleRequest answers request sent to virtual hub, value changes are reported back to
+//gateway as EventValueUpdate so rules, history and clients see them like any other change
+func (hub *VirtualHub) handleRequest(conn *HubConnection, mid int64, name string, payload gjson.Result) {
+	response := `{"status":"ok"}`
+	switch name {
+	case "RequestSetValue":
+		uuid := payload.Get("uuid").String()
+		href := payload.Get("resource").String()
+		value, err := hub.setValue(conn.Username, uuid, href, payload.Get("value"))
+		if err != nil {
+			errorMessage, _ := json.Marshal(err.Error())
+			response = `{"status":"error","error":` + string(errorMessage) + `}`
+			break
+		}
+		uuidData, _ := json.Marshal(uuid)
+		hrefData, _ := json.Marshal(href)
+		hub.Endpoint.handleValueUpdate(conn, gjson.Parse(`{"payload":{"uuid":`+string(uuidData)+`,"resource":`+string(hrefData)+`,"value":`+value.Raw+`}}`))
+	case "RequestSubscribeDevice", "RequestUnsubscribeDevice":
+	default:
+		response = `{"status":"error","error":"` + name + ` is not supported by virtual hub"}`
+	}
+	callback := conn.popCallback(mid)
+	if callback != nil {
+		callback(string(messageFrame(mid, strings.Replace(name, "Request", "Response", 1), response)))
+	}
+}
+
+func validateComputedValue(computed *ComputedValue) error {
+	if computed.Function != COMPUTED_FUNCTION_ANY && computed.Function != COMPUTED_FUNCTION_ALL {
+		return errors.New("unknown computed function " + computed.Function)
+	}
+	if computed.Property == "" {
+		computed.Property = "value"
+	}
+	if len(computed.Sources) == 0 {
+		return errors.New("computed value has no sources")
+	}
+	for _, source := range computed.Sources {
+		if source.HubUUID == "" || source.DeviceUUID == "" || source.Resource == "" {
+			return errors.New("computed value source requires hubUuid, uuid and resource")
+		}
+	}
+	return nil
+}
+
+//computeValue evaluates function over sources which are online, all is false when none is
+func (hub *VirtualHub) computeValue(username string, computed *ComputedValue) gjson.Result {
+	anyTrue := false
+	allTrue := true
+	online := 0
+	for _, source := range computed.Sources {
+		conn := findHubConnection(hub.Endpoint.HubConnections, username, source.HubUUID)
+		if conn == nil {
+			continue
+		}
+		device := conn.getDevice(source.DeviceUUID)
+		if device == nil {
+			continue
+		}
+		variable := device.getVariable(source.Resource)
+		if variable == nil {
+			continue
+		}
+		online++
+		value := variable.VariableValue.Value.Get(computed.Property).Bool()
+		anyTrue = anyTrue || value
+		allTrue = allTrue && value
+	}
+	result := anyTrue
+	if computed.Function == COMPUTED_FUNCTION_ALL {
+		result = allTrue && online > 0
+	}
+	return gjson.Parse(`{"` + computed.Property + `":` + strconv.FormatBool(result) + `}`)
+}
+
+//OnValueUpdate recomputes computed resources of user which use changed resource as source
+//and reports those whose value changed
+func (hub *VirtualHub) OnValueUpdate(username string, hubUUID string, deviceUUID string, href string) {
+	if hub == nil || hub.Endpoint == nil {
+		return
+	}
+	type computedResource struct {
+		device   string
+		variable *IotVariable
+		computed *ComputedValue
+	}
+	var affected []*computedResource
+	hub.mutex.Lock()
+	for _, device := range hub.devices[username] {
+		for _, variable := range device.Variables {
+			if variable.Computed == nil {
+				continue
+			}
+			for _, source := range variable.Computed.Sources {
+				if source.HubUUID == hubUUID && source.DeviceUUID == deviceUUID && source.Resource == href {
+					affected = append(affected, &computedResource{device: device.UUID, variable: variable, computed: variable.Computed})
+					break
+				}
+			}
+		}
+	}
+	hub.mutex.Unlock()
+
+	for _, resource := range affected {
+		value := hub.computeValue(username, resource.computed)
+		hub.mutex.Lock()
+		changed := resource.variable.VariableValue.Value.Raw != value.Raw
+		if changed {
+			resource.variable.VariableValue.Value = value
+			hub.save()
+		}
+		hub.mutex.Unlock()
+		if changed {
+			uuidData, _ := json.Marshal(resource.device)
+			hrefData, _ := json.Marshal(resource.variable.Href)
+			hub.Endpoint.handleValueUpdate(hub.getConnection(username), gjson.Parse(`{"payload":{"uuid":`+string(uuidData)+
+				`,"resource":`+string(hrefData)+`,"value":`+value.Raw+`}}`))
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"container/list"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func newTestVirtualHub(t *testing.T) (*VirtualHub, *HubConnectionEndpoint, *HubConnection) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	hub, _ := newTestHubConnection()
+	t.Cleanup(hub.Queue.Close)
+	hubs := list.New()
+	hubs.PushBack(hub)
+	overlays := NewOverlayStore()
+	virtualHub := NewVirtualHub()
+	server := &ClientConnectionServer{
+		HubConnections:       hubs,
+		WebClientConnections: list.New(),
+		DeviceVersions:       NewDeviceVersions(),
+		Overlays:             overlays,
+		Groups:               NewGroupStore(overlays),
+		VirtualHub:           virtualHub,
+		AlexaEvents:          NewAlexaEventGateway(),
+	}
+	endpoint := &HubConnectionEndpoint{
+		HubConnections:         hubs,
+		ClientConnectionServer: server,
+		AlexaEvents:            server.AlexaEvents,
+		Rules:                  NewRuleEngine(hubs, NewSceneStore()),
+		History:                NewHistoryStore(),
+		Webhooks:               NewWebhookDispatcher(),
+	}
+	virtualHub.Start(endpoint)
+	return virtualHub, endpoint, hub
+}
+
+func TestComputedVirtualResources(t *testing.T) {
+	virtualHub, endpoint, hub := newTestVirtualHub(t)
+	sources := []*GroupMember{
+		{HubUUID: "hub", DeviceUUID: "lamp", Resource: "/switch"},
+		{HubUUID: "offline", DeviceUUID: "lamp", Resource: "/switch"},
+	}
+	device := &IotDevice{Name: "Lights", Variables: []*IotVariable{
+		{Href: "/any", ResourceType: "oic.r.sensor", Computed: &ComputedValue{Function: COMPUTED_FUNCTION_ANY, Sources: sources}},
+		{Href: "/all", ResourceType: "oic.r.sensor", Computed: &ComputedValue{Function: COMPUTED_FUNCTION_ALL, Sources: sources}},
+		{Href: "/vacation", ResourceType: "oic.r.switch.binary", VariableValue: VariableValue{Value: gjson.Parse(`{"value":false}`)}},
+	}}
+	err := virtualHub.addDevice("user", device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := virtualHub.getConnection("user")
+	if !conn.Virtual || conn.Remote {
+		t.Errorf("virtual hub connection must be marked virtual")
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		any   bool
+		all   bool
+	}{
+		{"source on", `{"value":true}`, true, true},
+		{"source off", `{"value":false}`, false, false},
+		{"source on again", `{"value":true}`, true, true},
+	}
+	for _, test := range tests {
+		endpoint.handleValueUpdate(hub, gjson.Parse(`{"payload":{"uuid":"lamp","resource":"/switch","value":`+test.value+`}}`))
+		published := conn.getDevice(device.UUID)
+		if published == nil {
+			t.Fatalf("%s: virtual device was not published", test.name)
+		}
+		if value := published.getVariable("/any").VariableValue.Value.Get("value").Bool(); value != test.any {
+			t.Errorf("%s: expected any %v, got %v", test.name, test.any, value)
+		}
+		if value := published.getVariable("/all").VariableValue.Value.Get("value").Bool(); value != test.all {
+			t.Errorf("%s: expected all %v, got %v", test.name, test.all, value)
+		}
+	}
+
+	if _, err := virtualHub.setValue("user", device.UUID, "/any", gjson.Parse(`{"value":false}`)); err == nil {
+		t.Errorf("computed resource must not be writable")
+	}
+	if _, err := virtualHub.setValue("user", device.UUID, "/vacation", gjson.Parse(`{"value":true}`)); err != nil {
+		t.Errorf("plain resource must be writable: %v", err)
+	}
+	invalid := &IotDevice{Name: "Invalid", Variables: []*IotVariable{
+		{Href: "/any", ResourceType: "oic.r.sensor", Computed: &ComputedValue{Function: "sum", Sources: sources}},
+	}}
+	if virtualHub.addDevice("user", invalid) == nil {
+		t.Errorf("unknown computed function must be rejected")
+	}
+}
+
+func TestVirtualHubUUIDPerInstance(t *testing.T) {
+	single := getVirtualHubUUID("user")
+	t.Setenv("CLUSTER_INSTANCE_ID", "first")
+	first := getVirtualHubUUID("user")
+	t.Setenv("CLUSTER_INSTANCE_ID", "second")
+	second := getVirtualHubUUID("user")
+	if single == first || first == second {
+		t.Errorf("virtual hub uuid must differ per instance: %s %s %s", single, first, second)
+	}
+	if getVirtualDevicesStorage() == VIRTUAL_DEVICES_STORAGE {
+		t.Errorf("virtual devices of cluster instance must use own storage")
+	}
+}
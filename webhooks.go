@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	WEBHOOKS_STORAGE     = "webhooks"
+	DEAD_LETTERS_STORAGE = "webhookDeadLetters"
+
+	WEBHOOK_EVENT_VALUE_CHANGE     = "valueChange"
+	WEBHOOK_EVENT_DEVICE_ADDED     = "deviceAdded"
+	WEBHOOK_EVENT_DEVICE_REMOVED   = "deviceRemoved"
+	WEBHOOK_EVENT_HUB_CONNECTED    = "hubConnected"
+	WEBHOOK_EVENT_HUB_DISCONNECTED = "hubDisconnected"
+
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_FAILED    = "failed"
+
+	WEBHOOK_MAX_ATTEMPTS       = 6
+	WEBHOOK_INITIAL_BACKOFF    = 2 * time.Second
+	WEBHOOK_MAX_BACKOFF        = 5 * time.Minute
+	WEBHOOK_TIMEOUT            = 10 * time.Second
+	WEBHOOK_MAX_CONCURRENT     = 16
+	WEBHOOK_QUEUE_SIZE         = 100
+	WEBHOOK_RECENT_DELIVERIES  = 20
+	WEBHOOK_DEAD_LETTERS_LIMIT = 100
+)
+
+var webhookEvents = map[string]bool{
+	WEBHOOK_EVENT_VALUE_CHANGE:     true,
+	WEBHOOK_EVENT_DEVICE_ADDED:     true,
+	WEBHOOK_EVENT_DEVICE_REMOVED:   true,
+	WEBHOOK_EVENT_HUB_CONNECTED:    true,
+	WEBHOOK_EVENT_HUB_DISCONNECTED: true,
+}
+
+type Webhook struct {
+	ID         string   `json:"id"`
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret,omitempty"`
+	Events     []string `json:"events"`
+	HubUUID    string   `json:"hubUuid,omitempty"`
+	DeviceUUID string   `json:"uuid,omitempty"`
+
+	LastStatus   string    `json:"lastStatus,omitempty"`
+	LastError    string    `json:"lastError,omitempty"`
+	LastDelivery time.Time `json:"lastDelivery,omitempty"`
+	Delivered    int       `json:"delivered"`
+	Failed       int       `json:"failed"`
+}
+
+type WebhookDelivery struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhookId"`
+	Event     string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError,omitempty"`
+	Created   time.Time       `json:"created"`
+	Updated   time.Time       `json:"updated"`
+}
+
+type WebhookEvent struct {
+	ID         string      `json:"id"`
+	Event      string      `json:"event"`
+	Time       time.Time   `json:"time"`
+	HubUUID    string      `json:"hubUuid,omitempty"`
+	DeviceUUID string      `json:"uuid,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+//webhookWorker delivers queued deliveries of one webhook in order
+type webhookWorker struct {
+	queue chan *WebhookDelivery
+	done  chan struct{}
+}
+
+type WebhookDispatcher struct {
+	mutex sync.Mutex
+	//saveMutex keeps snapshots written to storage in the order they were taken
+	saveMutex   sync.Mutex
+	webhooks    map[string][]*Webhook
+	deadLetters map[string][]*WebhookDelivery
+	recent      map[string][]*WebhookDelivery
+	workers     map[string]*webhookWorker
+	slots       chan struct{}
+}
+
+var webhookClient = newOutboundHTTPClient(WEBHOOK_TIMEOUT)
+
+func NewWebhookDispatcher() *WebhookDispatcher {
+	dispatcher := &WebhookDispatcher{
+		webhooks:    make(map[string][]*Webhook),
+		deadLetters: make(map[string][]*WebhookDelivery),
+		recent:      make(map[string][]*WebhookDelivery),
+		workers:     make(map[string]*webhookWorker),
+		slots:       make(chan struct{}, WEBHOOK_MAX_CONCURRENT),
+	}
+	err := loadData(WEBHOOKS_STORAGE, &dispatcher.webhooks)
+	if err != nil {
+		log.Println(err)
+	}
+	err = loadData(DEAD_LETTERS_STORAGE, &dispatcher.deadLetters)
+	if err != nil {
+		log.Println(err)
+	}
+	return dispatcher
+}
+
+func generateRandomToken() string {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		log.Println(err)
+	}
+	return hex.EncodeToString(secret)
+}
+
+//signWebhookPayload returns hex HMAC-SHA256 of timestamp and body joined with a dot
+func signWebhookPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//save writes webhooks or dead letters, snapshot is taken under the mutex and written outside of it
+//so slow disk does not block dispatching and deliveries
+func (dispatcher *WebhookDispatcher) save(name string) {
+	dispatcher.saveMutex.Lock()
+	defer dispatcher.saveMutex.Unlock()
+	dispatcher.mutex.Lock()
+	var value interface{} = dispatcher.webhooks
+	if name == DEAD_LETTERS_STORAGE {
+		value = dispatcher.deadLetters
+	}
+	data, err := json.Marshal(value)
+	dispatcher.mutex.Unlock()
+	if err == nil {
+		err = saveData(name, json.RawMessage(data))
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (dispatcher *WebhookDispatcher) addWebhook(username string, webhook *Webhook) error {
+	err := validateOutboundURL(webhook.URL)
+	if err != nil {
+		return errors.New("webhook " + err.Error())
+	}
+	if len(webhook.Events) == 0 {
+		return errors.New("webhook requires at least one event")
+	}
+	for _, event := range webhook.Events {
+		if !webhookEvents[event] {
+			return errors.New("unknown webhook event " + event)
+		}
+	}
+	if webhook.Secret == "" {
+		webhook.Secret = generateRandomToken()
+	}
+
+	dispatcher.mutex.Lock()
+	dispatcher.webhooks[username] = append(dispatcher.webhooks[username], webhook)
+	dispatcher.mutex.Unlock()
+	dispatcher.save(WEBHOOKS_STORAGE)
+	return nil
+}
+
+func (dispatcher *WebhookDispatcher) deleteWebhook(username string, id string) bool {
+	dispatcher.mutex.Lock()
+	found := false
+	webhooks := dispatcher.webhooks[username]
+	for i, webhook := range webhooks {
+		if webhook.ID == id {
+			dispatcher.webhooks[username] = append(webhooks[:i:i], webhooks[i+1:]...)
+			delete(dispatcher.recent, id)
+			if worker := dispatcher.workers[id]; worker != nil {
+				close(worker.done)
+				delete(dispatcher.workers, id)
+			}
+			found = true
+			break
+		}
+	}
+	dispatcher.mutex.Unlock()
+	if found {
+		dispatcher.save(WEBHOOKS_STORAGE)
+	}
+	return found
+}
+
+//getWebhooks returns copies of user webhooks with secrets removed
+func (dispatcher *WebhookDispatcher) getWebhooks(username string) []Webhook {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	var result []Webhook
+	for _, webhook := range dispatcher.webhooks[username] {
+		item := *webhook
+		item.Secret = ""
+		result = append(result, item)
+	}
+	return result
+}
+
+func (dispatcher *WebhookDispatcher) getWebhook(username string, id string) *Webhook {
+	for _, webhook := range dispatcher.webhooks[username] {
+		if webhook.ID == id {
+			return webhook
+		}
+	}
+	return nil
+}
+
+//getDeliveries returns recent deliveries and dead letters of webhook
+func (dispatcher *WebhookDispatcher) getDeliveries(username string, id string) ([]WebhookDelivery, []WebhookDelivery, bool) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	if dispatcher.getWebhook(username, id) == nil {
+		return nil, nil, false
+	}
+	var recent, deadLetters []WebhookDelivery
+	for _, delivery := range dispatcher.recent[id] {
+		recent = append(recent, *delivery)
+	}
+	for _, delivery := range dispatcher.deadLetters[username] {
+		if delivery.WebhookID == id {
+			deadLetters = append(deadLetters, *delivery)
+		}
+	}
+	return recent, deadLetters, true
+}
+
+func (webhook *Webhook) matches(event *WebhookEvent) bool {
+	if webhook.HubUUID != "" && webhook.HubUUID != event.HubUUID {
+		return false
+	}
+	if webhook.DeviceUUID != "" && webhook.DeviceUUID != event.DeviceUUID {
+		return false
+	}
+	for _, name := range webhook.Events {
+		if name == event.Event {
+			return true
+		}
+	}
+	return false
+}
+
+//Dispatch queues event for every matching webhook of the user
+func (dispatcher *WebhookDispatcher) Dispatch(username string, eventName string, hubUUID string, deviceUUID string, data interface{}) {
+	if username == "" {
+		return
+	}
+	event := &WebhookEvent{
+		ID:         generateMessageUUID(),
+		Event:      eventName,
+		Time:       time.Now().UTC(),
+		HubUUID:    hubUUID,
+		DeviceUUID: deviceUUID,
+		Data:       data,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	dispatcher.mutex.Lock()
+	deadLettered := false
+	for _, webhook := range dispatcher.webhooks[username] {
+		if !webhook.matches(event) {
+			continue
+		}
+		delivery := &WebhookDelivery{
+			ID:        generateMessageUUID(),
+			WebhookID: webhook.ID,
+			Event:     eventName,
+			Payload:   body,
+			Status:    DELIVERY_PENDING,
+			Created:   event.Time,
+			Updated:   event.Time,
+		}
+		recent := append(dispatcher.recent[webhook.ID], delivery)
+		if len(recent) > WEBHOOK_RECENT_DELIVERIES {
+			recent = recent[len(recent)-WEBHOOK_RECENT_DELIVERIES:]
+		}
+		dispatcher.recent[webhook.ID] = recent
+		if !dispatcher.enqueue(username, webhook, delivery) {
+			deadLettered = true
+		}
+	}
+	dispatcher.mutex.Unlock()
+	if deadLettered {
+		dispatcher.save(DEAD_LETTERS_STORAGE)
+	}
+}
+
+//enqueue passes delivery to worker of webhook, deliveries overflowing the queue go to dead letter log
+//and false is returned
+func (dispatcher *WebhookDispatcher) enqueue(username string, webhook *Webhook, delivery *WebhookDelivery) bool {
+	worker := dispatcher.workers[webhook.ID]
+	if worker == nil {
+		worker = &webhookWorker{
+			queue: make(chan *WebhookDelivery, WEBHOOK_QUEUE_SIZE),
+			done:  make(chan struct{}),
+		}
+		dispatcher.workers[webhook.ID] = worker
+		go dispatcher.runWorker(username, webhook.ID, worker)
+	}
+	select {
+	case worker.queue <- delivery:
+		return true
+	default:
+		delivery.Status = DELIVERY_FAILED
+		delivery.LastError = "webhook queue is full"
+		webhook.Failed++
+		webhook.LastStatus = DELIVERY_FAILED
+		webhook.LastError = delivery.LastError
+		webhook.LastDelivery = delivery.Updated
+		dispatcher.addDeadLetter(username, delivery)
+		log.Println("Webhook " + webhook.ID + " queue is full, delivery " + delivery.ID + " dropped")
+		return false
+	}
+}
+
+func (dispatcher *WebhookDispatcher) runWorker(username string, webhookID string, worker *webhookWorker) {
+	for {
+		select {
+		case delivery := <-worker.queue:
+			dispatcher.deliver(username, webhookID, delivery, worker.done)
+		case <-worker.done:
+			return
+		}
+	}
+}
+
+//addDeadLetter adds permanently failed delivery to dead letter log, caller holds the mutex
+//and saves dead letters after releasing it
+func (dispatcher *WebhookDispatcher) addDeadLetter(username string, delivery *WebhookDelivery) {
+	deadLetters := append(dispatcher.deadLetters[username], delivery)
+	if len(deadLetters) > WEBHOOK_DEAD_LETTERS_LIMIT {
+		deadLetters = deadLetters[len(deadLetters)-WEBHOOK_DEAD_LETTERS_LIMIT:]
+	}
+	dispatcher.deadLetters[username] = deadLetters
+}
+
+func postWebhook(url string, secret string, delivery *WebhookDelivery) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-type", "application/json")
+	req.Header.Add("X-Gateway-Event", delivery.Event)
+	req.Header.Add("X-Gateway-Delivery", delivery.ID)
+	req.Header.Add("X-Gateway-Timestamp", timestamp)
+	req.Header.Add("X-Gateway-Signature", "sha256="+signWebhookPayload(secret, timestamp, delivery.Payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("webhook responded with " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+//deliver posts delivery retrying with exponential backoff, failed deliveries go to dead letter log,
+//worker waits for it so later deliveries of the webhook are not sent before it
+func (dispatcher *WebhookDispatcher) deliver(username string, webhookID string, delivery *WebhookDelivery, done chan struct{}) {
+	backoff := WEBHOOK_INITIAL_BACKOFF
+	for {
+		dispatcher.mutex.Lock()
+		webhook := dispatcher.getWebhook(username, webhookID)
+		var url, secret string
+		if webhook != nil {
+			url, secret = webhook.URL, webhook.Secret
+		}
+		dispatcher.mutex.Unlock()
+
+		err := errors.New("webhook was deleted")
+		if webhook != nil {
+			dispatcher.slots <- struct{}{}
+			err = postWebhook(url, secret, delivery)
+			<-dispatcher.slots
+		}
+
+		dispatcher.mutex.Lock()
+		delivery.Attempts++
+		delivery.Updated = time.Now().UTC()
+		webhook = dispatcher.getWebhook(username, webhookID)
+		if err == nil {
+			delivery.Status = DELIVERY_DELIVERED
+			delivery.LastError = ""
+			if webhook != nil {
+				webhook.Delivered++
+				webhook.LastStatus = DELIVERY_DELIVERED
+				webhook.LastError = ""
+				webhook.LastDelivery = delivery.Updated
+			}
+			dispatcher.mutex.Unlock()
+			return
+		}
+		delivery.LastError = err.Error()
+		if webhook == nil || delivery.Attempts >= WEBHOOK_MAX_ATTEMPTS {
+			delivery.Status = DELIVERY_FAILED
+			if webhook != nil {
+				webhook.Failed++
+				webhook.LastStatus = DELIVERY_FAILED
+				webhook.LastError = delivery.LastError
+				webhook.LastDelivery = delivery.Updated
+			}
+			dispatcher.addDeadLetter(username, delivery)
+			dispatcher.mutex.Unlock()
+			dispatcher.save(DEAD_LETTERS_STORAGE)
+			log.Println("Webhook delivery "+delivery.ID+" failed permanently", err)
+			return
+		}
+		dispatcher.mutex.Unlock()
+
+		log.Println("Webhook delivery "+delivery.ID+" failed, retrying in "+backoff.String(), err)
+		select {
+		case <-time.After(backoff):
+		case <-done:
+			return
+		}
+		backoff *= 2
+		if backoff > WEBHOOK_MAX_BACKOFF {
+			backoff = WEBHOOK_MAX_BACKOFF
+		}
+	}
+}
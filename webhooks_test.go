@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestWebhookOrderedDelivery(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	t.Setenv("OUTBOUND_ALLOW_PRIVATE_NETWORKS", "true")
+	received := make(chan gjson.Result, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		//slow first delivery must not let later ones overtake it
+		if gjson.GetBytes(body, "data.index").Int() == 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		received <- gjson.ParseBytes(body)
+	}))
+	defer server.Close()
+
+	dispatcher := NewWebhookDispatcher()
+	err := dispatcher.addWebhook("user", &Webhook{ID: "hook", URL: server.URL, Events: []string{WEBHOOK_EVENT_VALUE_CHANGE}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		dispatcher.Dispatch("user", WEBHOOK_EVENT_VALUE_CHANGE, "hub", "lamp", map[string]int{"index": i})
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case event := <-received:
+			if event.Get("data.index").Int() != int64(i) {
+				t.Errorf("expected delivery %d, got %s", i, event.Raw)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("delivery %d was not received", i)
+		}
+	}
+	dispatcher.deleteWebhook("user", "hook")
+}
+
+func TestWebhookRejectsPrivateTargets(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	dispatcher := NewWebhookDispatcher()
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://93.184.215.14/hook", true},
+		{"http://localhost:8080/hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://172.16.0.1/hook", false},
+		{"http://[fd00::1]/hook", false},
+		{"file:///etc/passwd", false},
+	}
+	for _, test := range tests {
+		err := dispatcher.addWebhook("user", &Webhook{ID: test.url, URL: test.url, Events: []string{WEBHOOK_EVENT_HUB_CONNECTED}})
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.url, test.valid, err)
+		}
+	}
+}
+
+func TestWebhookDeadLettersSaved(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	t.Setenv("OUTBOUND_ALLOW_PRIVATE_NETWORKS", "true")
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	dispatcher := NewWebhookDispatcher()
+	err := dispatcher.addWebhook("user", &Webhook{ID: "hook", URL: server.URL, Events: []string{WEBHOOK_EVENT_VALUE_CHANGE}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dispatcher.deleteWebhook("user", "hook")
+	//worker is stuck on the first delivery so the rest overflows the queue
+	for i := 0; i < WEBHOOK_QUEUE_SIZE+3; i++ {
+		dispatcher.Dispatch("user", WEBHOOK_EVENT_VALUE_CHANGE, "hub", "lamp", map[string]int{"index": i})
+	}
+	_, deadLetters, _ := dispatcher.getDeliveries("user", "hook")
+	if len(deadLetters) < 2 {
+		t.Fatalf("expected overflowing deliveries in dead letters, got %d", len(deadLetters))
+	}
+
+	reloaded := NewWebhookDispatcher()
+	_, stored, ok := reloaded.getDeliveries("user", "hook")
+	if !ok || len(stored) != len(deadLetters) {
+		t.Errorf("expected %d stored dead letters, got %d", len(deadLetters), len(stored))
+	}
+}